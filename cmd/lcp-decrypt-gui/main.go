@@ -0,0 +1,353 @@
+// Command lcp-decrypt-gui is a graphical frontend for lcp-decrypt, for users
+// who'd rather not deal with the command line. It uses the native dialogs of
+// the system (Win32 on Windows, Cocoa on macOS, GTK through zenity on Linux)
+// to pick the books, ask for their passphrase and follow the decryption.
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ncruces/zenity"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+const title = "lcp-decrypt"
+
+func main() {
+	if err := run(); err != nil {
+		showError(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [options] [BOOK...]
+
+Decrypts books protected with Readium LCP DRM, using the passphrase given by
+the store or library. A file picker opens when no book is given.
+
+Options:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	outputDir := flag.String("outputDir", defaultOutputDir(), "directory where the decrypted books are written")
+
+	flag.Parse()
+
+	paths := flag.Args()
+
+	if len(paths) == 0 {
+		var err error
+
+		paths, err = zenity.SelectFileMultiple(
+			zenity.Title("Choose the books to decrypt"),
+			zenity.FileFilters{{Name: "LCP protected books", Patterns: []string{"*.epub", "*.lcpdf", "*.lcpau", "*.lcpa"}, CaseFold: true}},
+		)
+		if errors.Is(err, zenity.ErrCanceled) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("error choosing books: %w", err)
+		}
+	}
+
+	var outputs []string
+
+	for _, path := range paths {
+		output, err := decryptBook(path, *outputDir)
+		if errors.Is(err, zenity.ErrCanceled) {
+			continue
+		}
+
+		if err != nil {
+			showError(fmt.Errorf("%s: %w", filepath.Base(path), err))
+			continue
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	return showDone(outputs)
+}
+
+// defaultOutputDir returns the user's download directory if it exists, their
+// home directory otherwise.
+func defaultOutputDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+
+	downloads := filepath.Join(home, "Downloads")
+
+	if stat, err := os.Stat(downloads); err == nil && stat.IsDir() {
+		return downloads
+	}
+
+	return home
+}
+
+// book is a protected book opened in the GUI.
+type book struct {
+	path     string
+	name     string
+	provider string
+	hint     string
+	hintURL  string
+	// total is the number of files in the book.
+	total    int
+	licenses []*lcp.License
+}
+
+func openBook(path string) (*book, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening book: %w", err)
+	}
+
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error stating book: %w", err)
+	}
+
+	zr, err := zip.NewReader(fd, stat.Size())
+	if err != nil {
+		return nil, &lcp.Error{ID: lcp.MsgInvalidInput, Err: fmt.Errorf("this file is not an EPUB book or an LCP protected publication: %w", err)}
+	}
+
+	b := &book{
+		path:  path,
+		name:  filepath.Base(path),
+		total: len(zr.File),
+	}
+
+	if b.licenses, err = lcp.ReadLicenses(fd, stat.Size()); err != nil {
+		return nil, &lcp.Error{ID: lcp.MsgNoLicense, Err: fmt.Errorf("this book is not protected by LCP, or its license is missing: %w", err)}
+	}
+
+	license := b.licenses[0]
+
+	b.provider = license.Provider
+	b.hint = license.Encryption.UserKey.TextHint
+
+	if l, ok := license.Links.Link(lcp.LinkRelHint); ok {
+		b.hintURL = l.Href
+	}
+
+	return b, nil
+}
+
+// decryptBook asks for the passphrase of the book at path, and decrypts it to
+// outputDir with a progress bar. It returns the path of the decrypted book, or
+// zenity.ErrCanceled if the user gave up.
+func decryptBook(path, outputDir string) (string, error) {
+	b, err := openBook(path)
+	if err != nil {
+		return "", err
+	}
+
+	userKeyHex, opts, err := askPassphrase(b)
+	if err != nil {
+		return "", err
+	}
+
+	return decryptWithProgress(b, outputDir, userKeyHex, opts)
+}
+
+// askPassphrase asks for the passphrase of b until it matches one of its
+// licenses, and returns the matching Decrypt arguments.
+func askPassphrase(b *book) (string, []lcp.DecryptOption, error) {
+	text := "Passphrase of " + b.name
+	if b.provider != "" {
+		text += "\nfrom " + b.provider
+	}
+
+	if b.hint != "" {
+		text += "\n\nHint: " + b.hint
+	}
+
+	if b.hintURL != "" {
+		text += "\n(see " + b.hintURL + ")"
+	}
+
+	for {
+		passphrase, err := zenity.Entry(text, zenity.Title(title), zenity.HideText())
+		if err != nil {
+			return "", nil, err
+		}
+
+		userKey, userKeyHex, opts := credential(passphrase)
+
+		if matchesAnyLicense(b.licenses, userKey) {
+			return userKeyHex, opts, nil
+		}
+
+		showError(&lcp.Error{ID: lcp.MsgUserKeyMismatch, Err: errors.New("wrong passphrase")})
+	}
+}
+
+// credential returns the user key for a passphrase typed by the user, which
+// may also be a hex encoded user key, along with the matching Decrypt
+// arguments.
+func credential(passphrase string) ([]byte, string, []lcp.DecryptOption) {
+	if key, err := hex.DecodeString(passphrase); err == nil && len(key) == 32 {
+		return key, passphrase, nil
+	}
+
+	return lcp.UserKeyFromPassphrase(passphrase), "", []lcp.DecryptOption{lcp.WithPassphrase(passphrase)}
+}
+
+func matchesAnyLicense(licenses []*lcp.License, userKey []byte) bool {
+	for _, l := range licenses {
+		if l.CheckUserKey(userKey) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decryptWithProgress decrypts b to outputDir, showing a progress bar whose
+// cancel button stops the decryption.
+func decryptWithProgress(b *book, outputDir, userKeyHex string, opts []lcp.DecryptOption) (string, error) {
+	inFd, err := os.Open(b.path)
+	if err != nil {
+		return "", fmt.Errorf("error opening book: %w", err)
+	}
+
+	defer inFd.Close()
+
+	stat, err := inFd.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error stating book: %w", err)
+	}
+
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	outFd, err := createOutput(outputDir, b.name)
+	if err != nil {
+		return "", err
+	}
+
+	defer outFd.Close()
+
+	progress, err := zenity.Progress(zenity.Title(title), zenity.MaxValue(b.total))
+	if err != nil {
+		return "", fmt.Errorf("error opening progress dialog: %w", err)
+	}
+
+	defer progress.Close()
+
+	_ = progress.Text("Decrypting " + b.name + "...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-progress.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	done := 0
+
+	opts = append(opts, lcp.WithContext(ctx), lcp.WithOnFileEnd(func(lcp.FileResult) {
+		done = min(done+1, b.total)
+		_ = progress.Value(done)
+	}))
+
+	if err := lcp.Decrypt(outFd, inFd, stat.Size(), userKeyHex, opts...); err != nil {
+		outFd.Close()
+		os.Remove(outFd.Name())
+
+		if errors.Is(err, context.Canceled) {
+			return "", zenity.ErrCanceled
+		}
+
+		return "", err
+	}
+
+	if err := outFd.Close(); err != nil {
+		os.Remove(outFd.Name())
+		return "", fmt.Errorf("error writing decrypted book: %w", err)
+	}
+
+	_ = progress.Complete()
+
+	return outFd.Name(), nil
+}
+
+// createOutput creates the file for the decrypted version of the book called
+// name in dir, without overwriting existing files.
+func createOutput(dir, name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 0; ; i++ {
+		filename := filepath.Join(dir, stem+ext)
+		if i > 0 {
+			filename = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		}
+
+		fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error creating output file: %w", err)
+		}
+
+		return fd, nil
+	}
+}
+
+// showDone tells where the decrypted books are, offering to open their
+// folder.
+func showDone(outputs []string) error {
+	text := "Decrypted " + filepath.Base(outputs[0])
+	if len(outputs) > 1 {
+		text = fmt.Sprintf("Decrypted %d books", len(outputs))
+	}
+
+	text += " to " + filepath.Dir(outputs[0])
+
+	err := zenity.Info(text, zenity.Title(title), zenity.ExtraButton("Open folder"))
+	if !errors.Is(err, zenity.ErrExtraButton) {
+		return nil
+	}
+
+	if err := openFolder(filepath.Dir(outputs[0])); err != nil {
+		return fmt.Errorf("error opening folder: %w", err)
+	}
+
+	return nil
+}
+
+// showError shows err in the language of the user when it has a localizable
+// message.
+func showError(err error) {
+	_ = zenity.Error(lcp.Localize(err, lcp.UserLocale()), zenity.Title(title))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// openFolder shows dir in the file manager.
+func openFolder(dir string) error {
+	return start(dir)
+}
+
+// start opens target with the default application of the desktop.
+func start(target string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	case "darwin":
+		cmd = exec.Command("open", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go cmd.Wait() // reap the process
+
+	return nil
+}
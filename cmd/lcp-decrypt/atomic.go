@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is a file that only appears at its destination path once it has
+// been fully written. Until then, data is written to a temporary file in the
+// same directory, so that a crash never leaves a truncated file behind.
+type atomicFile struct {
+	*os.File
+	path string
+	// perm, if set, are the permissions of the committed file.
+	perm os.FileMode
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	fd, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{File: fd, path: path}, nil
+}
+
+// Commit flushes the temporary file to disk and moves it to its final path.
+func (f *atomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		f.Abort()
+		return fmt.Errorf("error flushing file: %w", err)
+	}
+
+	// CreateTemp creates files only readable by their owner, use the same
+	// permissions as os.Create would (or keep the ones of the file we're
+	// replacing).
+	var mode os.FileMode = 0o644
+	if f.perm != 0 {
+		mode = f.perm
+	} else if stat, err := os.Stat(f.path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Abort()
+		return fmt.Errorf("error setting file permissions: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		f.Abort()
+		return fmt.Errorf("error closing file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("error renaming file: %w", err)
+	}
+
+	return nil
+}
+
+// Abort discards the temporary file. It is safe to call Abort after Commit
+// or Abort.
+func (f *atomicFile) Abort() {
+	// Some platforms don't allow removing open files
+	_ = f.Close()
+	_ = os.Remove(f.Name()) // ignore error here
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+
+	_ "modernc.org/sqlite" // registers the sqlite driver
+)
+
+const auditSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at    TEXT NOT NULL,
+	finished_at   TEXT NOT NULL,
+	command       TEXT NOT NULL,
+	input         TEXT NOT NULL,
+	input_sha256  TEXT NOT NULL,
+	output        TEXT NOT NULL,
+	license_id    TEXT NOT NULL,
+	provider      TEXT NOT NULL,
+	rights        TEXT NOT NULL,
+	outcome       TEXT NOT NULL,
+	error         TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_input_sha256 ON runs (input_sha256);
+CREATE INDEX IF NOT EXISTS runs_license_id ON runs (license_id);
+`
+
+// Outcomes of a run in the audit log.
+const (
+	outcomeOK    = "ok"
+	outcomeError = "error"
+)
+
+func defaultAuditDBPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(configDir, "lcp-decrypt", "history.db")
+}
+
+// auditLog records the decryption runs in an SQLite database.
+type auditLog struct {
+	db *sql.DB
+}
+
+// addAuditFlags registers the flags enabling the audit log. The returned
+// function must be called once the flags are parsed, it returns nil if the
+// audit log is disabled.
+func addAuditFlags(flags *flag.FlagSet) func() (*auditLog, error) {
+	enabled := flags.Bool("audit", false, "record the run in the history database (see the history command)")
+	path := flags.String("auditDB", defaultAuditDBPath(), "path of the history database")
+
+	return func() (*auditLog, error) {
+		if !*enabled {
+			return nil, nil
+		}
+
+		return openAuditLog(*path)
+	}
+}
+
+// addSkipDecryptedFlag registers the flag skipping the books already
+// decrypted according to the audit log. The returned function must be called
+// once the flags are parsed, with the audit log.
+func addSkipDecryptedFlag(flags *flag.FlagSet) func(audit *auditLog) (bool, error) {
+	skip := flags.Bool("skipDecrypted", false, "skip the books that the history database (-audit) shows were already decrypted, if their output file still exists")
+
+	return func(audit *auditLog) (bool, error) {
+		if *skip && audit == nil {
+			return false, fmt.Errorf("-skipDecrypted requires -audit")
+		}
+
+		return *skip, nil
+	}
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no history database path")
+	}
+
+	// Histories tell what people read, keep them private
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("error creating history database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history database: %w", err)
+	}
+
+	if _, err := db.Exec(auditSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing history database %s: %w", path, err)
+	}
+
+	return &auditLog{db: db}, nil
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	return a.db.Close()
+}
+
+// auditRecord is a decryption run.
+type auditRecord struct {
+	ID          int64             `json:"id"`
+	StartedAt   time.Time         `json:"startedAt"`
+	FinishedAt  time.Time         `json:"finishedAt"`
+	Command     string            `json:"command"`
+	Input       string            `json:"input"`
+	InputSHA256 string            `json:"inputSha256"`
+	Output      string            `json:"output"`
+	LicenseID   string            `json:"licenseId"`
+	Provider    string            `json:"provider"`
+	Rights      lcp.LicenseRights `json:"rights"`
+	Outcome     string            `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// run calls decrypt, which decrypts inFilename, and records the run. r holds
+// the command, input and output names to record. license is the license of
+// the book, if nil it is read from inFilename. A nil auditLog only calls
+// decrypt.
+func (a *auditLog) run(r auditRecord, inFilename string, license *lcp.License, decrypt func() error) error {
+	if a == nil {
+		return decrypt()
+	}
+
+	r.StartedAt = time.Now()
+
+	if license == nil {
+		license, _ = loadLicense(inFilename) // the decryption reports the error
+	}
+
+	if license != nil {
+		r.LicenseID, r.Provider, r.Rights = license.ID, license.Provider, license.Rights
+	}
+
+	var err error
+
+	if r.InputSHA256, err = fileSHA256(inFilename); err != nil {
+		log.Printf("Error hashing %s for the history: %s", inFilename, err)
+	}
+
+	err = decrypt()
+
+	r.FinishedAt = time.Now()
+	r.Outcome = outcomeOK
+
+	if err != nil {
+		r.Outcome, r.Error = outcomeError, err.Error()
+	}
+
+	if err := a.insert(&r); err != nil {
+		log.Printf("Error recording the run in the history: %s", err)
+	}
+
+	return err
+}
+
+// alreadyDecrypted returns the previous successful run for the book in
+// filename (same file, or same license), if its output still exists.
+func (a *auditLog) alreadyDecrypted(filename string) (auditRecord, bool, error) {
+	hash, err := fileSHA256(filename)
+	if err != nil {
+		return auditRecord{}, false, fmt.Errorf("error hashing %s: %w", filename, err)
+	}
+
+	licenseID := ""
+	if license, err := loadLicense(filename); err == nil {
+		licenseID = license.ID
+	}
+
+	records, err := a.query(
+		`SELECT id, started_at, finished_at, command, input, input_sha256, output, license_id, provider, rights, outcome, error FROM runs
+		WHERE outcome = ? AND (input_sha256 = ? OR (license_id != '' AND license_id = ?))
+		ORDER BY id DESC`,
+		outcomeOK, hash, licenseID,
+	)
+	if err != nil {
+		return auditRecord{}, false, err
+	}
+
+	for _, r := range records {
+		if _, err := os.Stat(r.Output); err == nil {
+			return r, true, nil
+		}
+	}
+
+	return auditRecord{}, false, nil
+}
+
+func (a *auditLog) insert(r *auditRecord) error {
+	rights, err := json.Marshal(r.Rights)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.db.Exec(
+		`INSERT INTO runs (started_at, finished_at, command, input, input_sha256, output, license_id, provider, rights, outcome, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.StartedAt.UTC().Format(time.RFC3339Nano), r.FinishedAt.UTC().Format(time.RFC3339Nano),
+		r.Command, r.Input, r.InputSHA256, r.Output, r.LicenseID, r.Provider, string(rights), r.Outcome, r.Error,
+	)
+
+	return err
+}
+
+func fileSHA256(filename string) (string, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+
+	defer fd.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func absPath(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+
+	return filename
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// batchJob is one row of a batch manifest.
+type batchJob struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// Key is either a hex encoded user key, or a passphrase.
+	Key         string `json:"key"`
+	LicenseFile string `json:"licenseFile,omitempty"`
+}
+
+// batchResult is the outcome of a batchJob.
+type batchResult struct {
+	Job      batchJob
+	Warnings []string
+	Err      error
+	// SkippedOutput is the output of the previous run, for the books that
+	// were skipped because they were already decrypted.
+	SkippedOutput string
+}
+
+func runBatch(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s batch [options] manifest.(csv|json)
+       %[1]s batch [options] -outputDir DIR folder|archive.zip
+
+Decrypts all the books listed in a manifest file. This is useful when books
+come from several providers, each requiring a different key.
+
+CSV manifests have one book per line, with the columns
+
+  input,output,key,licenseFile
+
+A first line with those column names is ignored. JSON manifests contain an
+array of objects with the same keys:
+
+  [{"input": "...", "output": "...", "key": "...", "licenseFile": "..."}]
+
+key is either a hex encoded user key or a passphrase. If it is empty, the key
+stored for the provider of the book is used (see "%[1]s keys -h").
+licenseFile is optional and only needed for books that don't embed their
+license. Relative paths are
+resolved relative to the directory of the manifest.
+
+Instead of a manifest, batch also accepts a folder or a zip archive holding
+several books and their .lcpl licenses, as exported by some library apps.
+Each book is paired with the license that has the same name, or else the one
+whose publication link points to it, and decrypted to the same path in the
+-outputDir directory, with -key. The journal of archives can't be used to
+resume a batch, as they are extracted again on each run.
+
+The progress of the batch is recorded in a journal (manifest.csv.journal by
+default). If the batch is interrupted, run it again with -resume to skip the
+books that were completed.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	duplicates := flags.String("duplicates", lcp.DuplicateLastWins.String(), "what to do with duplicate entries in the input files: last (keep the last one), first (keep the first one) or error")
+	scanUnlisted := flags.Bool("scanUnlisted", false, "warn about files that look encrypted but are not listed in encryption.xml")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	allowedProviders := flags.String("allowedProviders", "", "comma separated list of the providers whose licenses can be processed (by default, all providers are allowed)")
+	openAudit := addAuditFlags(flags)
+	loadSkipDecrypted := addSkipDecryptedFlag(flags)
+	openJournal := addJournalFlags(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+	addMaxMemoryFlag(flags)
+	addLimitsFlags(flags, lcp.Limits{})
+	addTransformsFlag(flags)
+	addOutputPasswordFlag(flags)
+	newHTMLReport := addHTMLReportFlag(flags, "batch")
+	openEvents := addEventsFlag(flags)
+	outputDir := flags.String("outputDir", "", "directory where the books of a folder or archive are decrypted")
+	collectionKey := flags.String("key", "", "hex encoded user key or passphrase of the books of a folder or archive (by default, the key stored for the provider of each book is used)")
+
+	_ = flags.Parse(args) // exits on error
+
+	duplicatePolicy, err := lcp.ParseDuplicatePolicy(*duplicates)
+	if err != nil {
+		return err
+	}
+
+	manifestFilename := flags.Arg(0)
+	if manifestFilename == "" {
+		return fmt.Errorf("no manifest file specified")
+	}
+
+	var (
+		jobs    []batchJob
+		results []batchResult
+	)
+
+	if isCollection(manifestFilename) {
+		if *outputDir == "" {
+			return errors.New("-outputDir is mandatory for folders and archives")
+		}
+
+		var cleanup func()
+
+		jobs, results, cleanup, err = readCollection(manifestFilename, *outputDir, *collectionKey)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+
+		log.Printf("Found %d book(s) in %s", len(jobs), manifestFilename)
+	} else if jobs, err = readBatchManifest(manifestFilename); err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	// The licenses of a collection that have no book count as failed jobs
+	total := len(jobs) + len(results)
+
+	events, err := openEvents()
+	if err != nil {
+		return err
+	}
+
+	journal, err := openJournal(manifestFilename)
+	if err != nil {
+		return err
+	}
+
+	defer journal.Close()
+
+	audit, err := openAudit()
+	if err != nil {
+		return err
+	}
+
+	defer audit.Close()
+
+	skipDecrypted, err := loadSkipDecrypted(audit)
+	if err != nil {
+		return err
+	}
+
+	keyDB := &keyDB{}
+
+	if *keyDBPath != "" {
+		if keyDB, err = loadKeyDB(*keyDBPath); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	htmlReport := newHTMLReport()
+
+	for i, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if journal.completed(job) {
+			log.Printf("[%d/%d] Skipping %s, completed by a previous run", i+1, len(jobs), job.Input)
+			results = append(results, batchResult{Job: job, SkippedOutput: job.Output})
+
+			reportBook, _ := htmlReport.addBook(job.Input, job.Output)
+			reportBook.skip()
+
+			events.emit("done", map[string]any{"input": job.Input, "output": job.Output, "ok": true, "skipped": true})
+
+			continue
+		}
+
+		if skipDecrypted {
+			previous, ok, err := audit.alreadyDecrypted(job.Input)
+			if err != nil {
+				results = append(results, batchResult{Job: job, Err: err})
+				continue
+			}
+
+			if ok {
+				log.Printf("[%d/%d] Skipping %s, already decrypted to %s", i+1, len(jobs), job.Input, previous.Output)
+				results = append(results, batchResult{Job: job, SkippedOutput: previous.Output})
+
+				reportBook, _ := htmlReport.addBook(job.Input, previous.Output)
+				reportBook.skip()
+
+				events.emit("done", map[string]any{"input": job.Input, "output": previous.Output, "ok": true, "skipped": true})
+
+				continue
+			}
+		}
+
+		log.Printf("[%d/%d] Decrypting %s...", i+1, len(jobs), job.Input)
+
+		var report lcp.Report
+
+		opts := []lcp.DecryptOption{
+			lcp.WithLogger(func(msg string) { log.Printf("[%d/%d] %s", i+1, len(jobs), msg) }),
+			lcp.WithContext(ctx),
+			lcp.WithDuplicatePolicy(duplicatePolicy),
+			lcp.WithReport(&report),
+		}
+
+		opts = append(opts, memoryOptions()...)
+		opts = append(opts, limitsOptions()...)
+		opts = append(opts, transformOptions...)
+
+		if *scanUnlisted {
+			opts = append(opts, lcp.WithUnlistedEncryptionScan())
+		}
+
+		if providers := splitList(*allowedProviders); len(providers) > 0 {
+			opts = append(opts, lcp.WithAllowedProviders(providers))
+		}
+
+		reportBook, reportOpts := htmlReport.addBook(job.Input, job.Output)
+		opts = append(opts, reportOpts...)
+		opts = append(opts, events.start(job.Input, job.Output)...)
+
+		record := auditRecord{Command: "batch", Input: absPath(job.Input), Output: absPath(job.Output)}
+
+		if err := journal.start(job); err != nil {
+			return err
+		}
+
+		err := audit.run(record, job.Input, nil, func() error { return runBatchJob(job, keyDB, opts) })
+		if err == nil {
+			if err := journal.finish(job); err != nil {
+				return err
+			}
+		}
+
+		results = append(results, batchResult{Job: job, Warnings: report.Warnings, Err: err})
+		events.finish(job.Input, job.Output, report, err)
+
+		if htmlReport != nil {
+			licenseFile := job.LicenseFile
+			if licenseFile == "" {
+				licenseFile = job.Input
+			}
+
+			license, _ := loadLicense(licenseFile)
+			reportBook.finish(license, report, err)
+		}
+	}
+
+	if err := htmlReport.write(); err != nil {
+		return err
+	}
+
+	// Keep the standard output for the events
+	summary := io.Writer(os.Stdout)
+	if events != nil {
+		summary = os.Stderr
+	}
+
+	return printBatchReport(summary, results, total)
+}
+
+func runBatchJob(job batchJob, keyDB *keyDB, opts []lcp.DecryptOption) error {
+	cred := parseCredential(job.Key)
+
+	if job.Key == "" {
+		licenseFile := job.LicenseFile
+		if licenseFile == "" {
+			licenseFile = job.Input
+		}
+
+		license, err := loadLicense(licenseFile)
+		if err != nil {
+			return err
+		}
+
+		e, ok := keyDB.lookup(license)
+		if !ok {
+			return fmt.Errorf("no key specified, and no stored key matches provider %s", license.Provider)
+		}
+
+		cred = e.credential
+	}
+
+	userKeyHex, credOpts := cred.decryptArgs()
+	opts = append(opts, credOpts...)
+
+	if job.LicenseFile != "" {
+		licenseFd, err := os.Open(job.LicenseFile)
+		if err != nil {
+			return fmt.Errorf("error opening license file: %w", err)
+		}
+
+		defer licenseFd.Close()
+
+		opts = append(opts, lcp.WithExternalLicense(licenseFd))
+	}
+
+	return decryptFile(job.Input, job.Output, formatEPUB, userKeyHex, opts...)
+}
+
+// isUserKey returns true if key looks like a hex encoded user key rather than
+// a passphrase.
+func isUserKey(key string) bool {
+	decoded, err := hex.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+func printBatchReport(w io.Writer, results []batchResult, total int) error {
+	failed, alreadyDecrypted := 0, 0
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Summary:")
+
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+			fmt.Fprintf(w, "  FAILED  %s: %s\n", r.Job.Input, r.Err)
+		case r.SkippedOutput != "":
+			alreadyDecrypted++
+			fmt.Fprintf(w, "  SKIPPED %s (already decrypted to %s)\n", r.Job.Input, r.SkippedOutput)
+		case len(r.Warnings) > 0:
+			fmt.Fprintf(w, "  OK      %s -> %s (%d warning(s))\n", r.Job.Input, r.Job.Output, len(r.Warnings))
+		default:
+			fmt.Fprintf(w, "  OK      %s -> %s\n", r.Job.Input, r.Job.Output)
+		}
+
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(w, "          warning: %s\n", warning)
+		}
+	}
+
+	if skipped := total - len(results); skipped > 0 {
+		fmt.Fprintf(w, "  %d book(s) skipped because the batch was interrupted\n", skipped)
+		failed += skipped
+	}
+
+	fmt.Fprintf(w, "%d/%d book(s) decrypted\n", total-failed-alreadyDecrypted, total)
+
+	if alreadyDecrypted > 0 {
+		fmt.Fprintf(w, "%d book(s) skipped because they were already decrypted\n", alreadyDecrypted)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d book(s) could not be decrypted", failed)
+	}
+
+	return nil
+}
+
+func readBatchManifest(filename string) ([]batchJob, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	var jobs []batchJob
+
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		if err := json.NewDecoder(fd).Decode(&jobs); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %w", err)
+		}
+	} else {
+		jobs, err = readBatchCSV(fd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	baseDir := filepath.Dir(filename)
+
+	resolve := func(p string) string {
+		// On Windows, \dir\book.epub and C:book.epub are not absolute,
+		// but not relative to the manifest either.
+		if p == "" || filepath.IsAbs(p) || filepath.VolumeName(p) != "" || os.IsPathSeparator(p[0]) {
+			return p
+		}
+
+		return filepath.Join(baseDir, p)
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+
+		if job.Input == "" || job.Output == "" {
+			return nil, fmt.Errorf("book #%d: input and output are mandatory", i+1)
+		}
+
+		job.Input = resolve(job.Input)
+		job.Output = resolve(job.Output)
+		job.LicenseFile = resolve(job.LicenseFile)
+	}
+
+	return jobs, nil
+}
+
+func readBatchCSV(r io.Reader) ([]batchJob, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // licenseFile is optional
+	reader.TrimLeadingSpace = true
+
+	var jobs []batchJob
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error decoding CSV: %w", err)
+		}
+
+		if line == 1 && strings.EqualFold(record[0], "input") {
+			continue // header
+		}
+
+		if len(record) < 2 || len(record) > 4 {
+			return nil, fmt.Errorf("line %d: expected between 2 and 4 columns, got %d", line, len(record))
+		}
+
+		job := batchJob{Input: record[0], Output: record[1]}
+
+		if len(record) > 2 {
+			job.Key = record[2]
+		}
+
+		if len(record) > 3 {
+			job.LicenseFile = record[3]
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpCache stores the documents fetched for a license (licenses, hints,
+// status documents) on disk, so that repeated runs don't fetch them again and
+// keep working while the server is unreachable.
+type httpCache struct {
+	dir string
+}
+
+// cache is the cache used by cachedGet, nil when caching is disabled.
+var cache *httpCache
+
+func defaultCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(cacheDir, "lcp-decrypt")
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	Expires      time.Time `json:"expires"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Body         []byte    `json:"body"`
+}
+
+var safeLicenseIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// path returns the path of the cache entry for url. Entries are grouped in a
+// directory per license.
+func (c *httpCache) path(licenseID, url string) string {
+	if !safeLicenseIDRegexp.MatchString(licenseID) {
+		h := sha256.Sum256([]byte(licenseID))
+		licenseID = hex.EncodeToString(h[:16])
+	}
+
+	h := sha256.Sum256([]byte(url))
+
+	return filepath.Join(c.dir, licenseID, hex.EncodeToString(h[:16])+".json")
+}
+
+func (c *httpCache) load(licenseID, url string) (*cacheEntry, error) {
+	data, err := os.ReadFile(c.path(licenseID, url))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entry cacheEntry
+
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (c *httpCache) save(licenseID string, entry *cacheEntry) error {
+	path := c.path(licenseID, entry.URL)
+
+	// Licenses hold personal information
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	out, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+
+	defer out.Abort()
+
+	out.perm = 0o600
+
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+
+	return out.Commit()
+}
+
+// cachedGet is like httpGet, for documents related to the license with the
+// given ID. Responses are cached as allowed by their cache headers, and the
+// cached copy is returned when the server can't be reached.
+func cachedGet(ctx context.Context, client *http.Client, licenseID, url string) ([]byte, error) {
+	if cache == nil || licenseID == "" {
+		return httpGet(ctx, client, url, nil)
+	}
+
+	entry, err := cache.load(licenseID, url)
+	if err != nil {
+		log.Printf("Error reading cache entry for %s: %s", url, err)
+	}
+
+	if entry != nil && time.Now().Before(entry.Expires) {
+		return entry.Body, nil
+	}
+
+	res, body, err := revalidate(ctx, client, url, entry)
+	if err != nil {
+		if entry != nil {
+			log.Printf("Using the cached copy of %s (%s)", url, err)
+			return entry.Body, nil
+		}
+
+		return nil, err
+	}
+
+	cacheControl := parseCacheControl(res.Header.Get("Cache-Control"))
+
+	if res.StatusCode == http.StatusNotModified {
+		body = entry.Body
+	} else {
+		entry = &cacheEntry{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			Body:         body,
+		}
+	}
+
+	if _, noStore := cacheControl["no-store"]; noStore {
+		return body, nil
+	}
+
+	entry.Expires = expiry(res.Header, cacheControl, time.Now())
+
+	if err := cache.save(licenseID, entry); err != nil {
+		log.Printf("Error caching %s: %s", url, err)
+	}
+
+	return body, nil
+}
+
+// revalidate fetches url, making the request conditional if a cached entry
+// exists. Error statuses are reported as errors, so that the cached copy gets
+// used.
+func revalidate(ctx context.Context, client *http.Client, url string, entry *cacheEntry) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && entry != nil:
+		return res, nil, nil
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return nil, nil, fmt.Errorf("unexpected status code %d for %s", res.StatusCode, url)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	return res, body, nil
+}
+
+// parseCacheControl returns the directives of a Cache-Control header, mapped
+// to their (possibly empty) value.
+func parseCacheControl(header string) map[string]string {
+	res := map[string]string{}
+
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			res[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return res
+}
+
+// expiry returns until when a response can be used without revalidating it.
+// Responses without freshness information are revalidated every time, the
+// cached copy is then only used when the server is unreachable.
+func expiry(header http.Header, cacheControl map[string]string, now time.Time) time.Time {
+	if _, noCache := cacheControl["no-cache"]; noCache {
+		return now
+	}
+
+	if maxAge, ok := cacheControl["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second)
+		}
+
+		return now
+	}
+
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires
+	}
+
+	return now
+}
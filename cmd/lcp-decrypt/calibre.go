@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// calibreFlag is the value of the -addToCalibre flag. It can be passed alone
+// to use calibre's default library, or with a value to pick a library:
+// -addToCalibre=/path/to/library.
+type calibreFlag struct {
+	enabled bool
+	library string
+}
+
+func (f *calibreFlag) String() string {
+	if f == nil || !f.enabled {
+		return ""
+	}
+
+	if f.library == "" {
+		return "true"
+	}
+
+	return f.library
+}
+
+func (f *calibreFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.enabled, f.library = true, ""
+	case "false":
+		f.enabled, f.library = false, ""
+	default:
+		f.enabled, f.library = true, value
+	}
+
+	return nil
+}
+
+// IsBoolFlag lets the flag be passed without a value.
+func (f *calibreFlag) IsBoolFlag() bool { return true }
+
+// addToCalibre imports filename in a calibre library using calibredb, which
+// extracts the book's metadata. library is the path of the library, or empty
+// to use the default one.
+func addToCalibre(filename, library string) error {
+	args := []string{"add"}
+	if library != "" {
+		args = append(args, "--with-library", externalPath(library))
+	}
+
+	args = append(args, externalPath(filename))
+
+	cmd := exec.Command("calibredb", args...)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("error adding %s to calibre: %w", filename, err)
+	}
+
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		log.Println(msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif" // decoders for the cover images
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// calibrePathLimit is the maximum length of the author and title components
+// of the paths in a calibre library, as calibre itself truncates them.
+const calibrePathLimit = 100
+
+// calibreBookDirRe matches the directories holding the books in a calibre
+// library, named after the title and the calibre ID of the book.
+var calibreBookDirRe = regexp.MustCompile(`\((\d+)\)$`)
+
+// calibreBook is a book being added to a calibre library folder, without
+// going through calibredb.
+type calibreBook struct {
+	ID       int
+	Dir      string
+	Filename string
+	pkg      *epub.Package
+}
+
+// newCalibreBook prepares adding the book stored in inFilename to the calibre
+// library folder at library. The directory of the book is laid out as calibre
+// does: Author/Title (id)/Title - Author.epub, id being the first ID not used
+// in the library. The directory is created, and must be removed with remove
+// if the book can't be added.
+func newCalibreBook(library, inFilename string, format outputFormat) (*calibreBook, error) {
+	r, err := zip.OpenReader(inFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+
+	defer r.Close()
+
+	pkg, err := epub.ReadPackage(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading package document: %w", err)
+	}
+
+	id, err := nextCalibreID(library)
+	if err != nil {
+		return nil, err
+	}
+
+	title := calibrePathComponent(pkg.Title())
+	author := "Unknown"
+	if authors := calibreAuthors(pkg); len(authors) > 0 {
+		author = calibrePathComponent(authors[0].Name)
+	}
+
+	if title == "" {
+		title = "Unknown"
+	}
+
+	dir := filepath.Join(library, author, fmt.Sprintf("%s (%d)", title, id))
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating book directory: %w", err)
+	}
+
+	return &calibreBook{
+		ID:       id,
+		Dir:      dir,
+		Filename: format.filename(filepath.Join(dir, title+" - "+author+".epub")),
+		pkg:      pkg,
+	}, nil
+}
+
+// nextCalibreID returns the first book ID not used by the books of library.
+func nextCalibreID(library string) (int, error) {
+	dirs, err := filepath.Glob(filepath.Join(library, "*", "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	maxID := 0
+
+	for _, dir := range dirs {
+		m := calibreBookDirRe.FindStringSubmatch(filepath.Base(dir))
+		if m == nil {
+			continue
+		}
+
+		if id, err := strconv.Atoi(m[1]); err == nil {
+			maxID = max(maxID, id)
+		}
+	}
+
+	return maxID + 1, nil
+}
+
+// calibrePathComponent makes s usable as a file name, replacing the characters
+// calibre replaces.
+func calibrePathComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`\/:*?"<>|`, r) {
+			return '_'
+		}
+
+		return r
+	}, strings.TrimSpace(s))
+
+	if runes := []rune(s); len(runes) > calibrePathLimit {
+		s = string(runes[:calibrePathLimit])
+	}
+
+	return strings.TrimRight(s, ". ")
+}
+
+// calibreAuthors returns the creators of the book that are authors.
+func calibreAuthors(pkg *epub.Package) []epub.Creator {
+	var authors []epub.Creator
+
+	for _, c := range pkg.Metadata.Creators {
+		if (c.Role == "" || c.Role == "aut") && strings.TrimSpace(c.Name) != "" {
+			c.Name = strings.TrimSpace(c.Name)
+			authors = append(authors, c)
+		}
+	}
+
+	return authors
+}
+
+// remove deletes the directory of the book, and the directory of its author
+// if it is left empty.
+func (b *calibreBook) remove() {
+	os.RemoveAll(b.Dir)
+	os.Remove(filepath.Dir(b.Dir)) // fails if other books remain
+}
+
+// finish writes the metadata.opf file and the cover of the book next to the
+// decrypted book, like calibre does.
+func (b *calibreBook) finish() error {
+	hasCover, err := b.writeCover()
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(filepath.Join(b.Dir, "metadata.opf"), func(w io.Writer) error {
+		return b.writeMetadata(w, hasCover)
+	})
+}
+
+// writeCover extracts the cover of the decrypted book to cover.jpg, converting
+// it to JPEG if needed. It returns false if the book has no usable cover.
+func (b *calibreBook) writeCover() (bool, error) {
+	r, err := zip.OpenReader(b.Filename)
+	if err != nil {
+		return false, fmt.Errorf("error opening decrypted book: %w", err)
+	}
+
+	defer r.Close()
+
+	item, ok := b.pkg.Cover()
+	if !ok {
+		return false, nil
+	}
+
+	data, err := fs.ReadFile(r, b.pkg.ItemPath(item))
+	if err != nil {
+		return false, nil // dangling cover reference
+	}
+
+	if item.MediaType != "image/jpeg" {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return false, nil // SVG covers and the like
+		}
+
+		var buf bytes.Buffer
+
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return false, fmt.Errorf("error converting cover to JPEG: %w", err)
+		}
+
+		data = buf.Bytes()
+	}
+
+	err = writeAtomic(filepath.Join(b.Dir, "cover.jpg"), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+
+	return err == nil, err
+}
+
+type calibreOPF struct {
+	XMLName          xml.Name         `xml:"http://www.idpf.org/2007/opf package"`
+	UniqueIdentifier string           `xml:"unique-identifier,attr"`
+	Version          string           `xml:"version,attr"`
+	Metadata         calibreOPFMeta   `xml:"metadata"`
+	Guide            *calibreOPFGuide `xml:"guide,omitempty"`
+}
+
+type calibreOPFMeta struct {
+	DC          string              `xml:"xmlns:dc,attr"`
+	OPF         string              `xml:"xmlns:opf,attr"`
+	Identifiers []calibreOPFElement `xml:"dc:identifier"`
+	Title       string              `xml:"dc:title"`
+	Creators    []calibreOPFElement `xml:"dc:creator"`
+	Date        string              `xml:"dc:date,omitempty"`
+	Description string              `xml:"dc:description,omitempty"`
+	Publisher   string              `xml:"dc:publisher,omitempty"`
+	Languages   []string            `xml:"dc:language"`
+	Subjects    []string            `xml:"dc:subject"`
+	Rights      string              `xml:"dc:rights,omitempty"`
+	Meta        []calibreOPFMetaTag `xml:"meta"`
+}
+
+type calibreOPFElement struct {
+	ID     string `xml:"id,attr,omitempty"`
+	Scheme string `xml:"opf:scheme,attr,omitempty"`
+	FileAs string `xml:"opf:file-as,attr,omitempty"`
+	Role   string `xml:"opf:role,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+type calibreOPFMetaTag struct {
+	Name    string `xml:"name,attr"`
+	Content string `xml:"content,attr"`
+}
+
+type calibreOPFGuide struct {
+	References []calibreOPFReference `xml:"reference"`
+}
+
+type calibreOPFReference struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+// writeMetadata writes the metadata.opf file of the book, in the format used
+// by calibre to back up the metadata of its books.
+func (b *calibreBook) writeMetadata(w io.Writer, hasCover bool) error {
+	uuid, err := newUUID()
+	if err != nil {
+		return err
+	}
+
+	m := b.pkg.Metadata
+
+	opf := calibreOPF{
+		UniqueIdentifier: "uuid_id",
+		Version:          "2.0",
+		Metadata: calibreOPFMeta{
+			DC:  "http://purl.org/dc/elements/1.1/",
+			OPF: "http://www.idpf.org/2007/opf",
+			Identifiers: []calibreOPFElement{
+				{ID: "calibre_id", Scheme: "calibre", Value: strconv.Itoa(b.ID)},
+				{ID: "uuid_id", Scheme: "uuid", Value: uuid},
+			},
+			Title:       b.pkg.Title(),
+			Date:        strings.TrimSpace(m.Date),
+			Description: strings.TrimSpace(m.Description),
+			Publisher:   strings.TrimSpace(m.Publisher),
+			Languages:   m.Languages,
+			Subjects:    m.Subjects,
+			Rights:      strings.TrimSpace(m.Rights),
+			Meta: []calibreOPFMetaTag{
+				{Name: "calibre:timestamp", Content: time.Now().UTC().Format(time.RFC3339)},
+			},
+		},
+	}
+
+	for _, id := range m.Identifiers {
+		if value := strings.TrimSpace(id.Value); value != "" {
+			opf.Metadata.Identifiers = append(opf.Metadata.Identifiers, calibreOPFElement{Scheme: id.Scheme, Value: value})
+		}
+	}
+
+	for _, c := range calibreAuthors(b.pkg) {
+		opf.Metadata.Creators = append(opf.Metadata.Creators, calibreOPFElement{FileAs: c.FileAs, Role: "aut", Value: c.Name})
+	}
+
+	if hasCover {
+		opf.Guide = &calibreOPFGuide{References: []calibreOPFReference{{Type: "cover", Title: "Cover", Href: "cover.jpg"}}}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "    ")
+
+	if err := encoder.Encode(opf); err != nil {
+		return fmt.Errorf("error writing metadata.opf: %w", err)
+	}
+
+	_, err = io.WriteString(w, "\n")
+
+	return err
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("error generating UUID: %w", err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// isCollection returns true if filename is a folder or an archive holding
+// several books and their licenses, rather than a batch manifest.
+func isCollection(filename string) bool {
+	if stat, err := os.Stat(filename); err == nil && stat.IsDir() {
+		return true
+	}
+
+	return strings.EqualFold(filepath.Ext(filename), ".zip")
+}
+
+// isCollectionBook returns true if name looks like a protected publication.
+// Archives are not, as collections are exported as archives.
+func isCollectionBook(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext != ".zip" && slices.Contains(daemonInputExtensions, ext)
+}
+
+// readCollection returns the jobs decrypting the books of a collection (a
+// folder, or a zip archive that is extracted to a temporary directory) to
+// outputDir, with key. Each book is paired with its license, if it doesn't
+// embed it. The licenses for which no book was found are returned as failed
+// results. cleanup removes the temporary files, and must be called once the
+// jobs are done.
+func readCollection(filename, outputDir, key string) (jobs []batchJob, orphans []batchResult, cleanup func(), err error) {
+	cleanup = func() {}
+	root := filename
+
+	if stat, err := os.Stat(filename); err != nil {
+		return nil, nil, cleanup, err
+	} else if !stat.IsDir() {
+		if root, err = os.MkdirTemp("", "lcp-decrypt-collection-*"); err != nil {
+			return nil, nil, cleanup, fmt.Errorf("error creating temporary directory: %w", err)
+		}
+
+		cleanup = func() { os.RemoveAll(root) }
+
+		if err := extractCollection(root, filename); err != nil {
+			cleanup()
+			return nil, nil, func() {}, fmt.Errorf("error extracting %s: %w", filename, err)
+		}
+	}
+
+	var books, licenses []string
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case d.IsDir():
+			return nil
+		case strings.EqualFold(filepath.Ext(p), ".lcpl"):
+			licenses = append(licenses, p)
+		case isCollectionBook(p):
+			books = append(books, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		return nil, nil, func() {}, fmt.Errorf("error listing books: %w", err)
+	}
+
+	paired := pairLicenses(books, licenses)
+
+	for _, book := range books {
+		rel, err := filepath.Rel(root, book)
+		if err != nil {
+			rel = filepath.Base(book)
+		}
+
+		output := filepath.Join(outputDir, rel)
+
+		if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+			cleanup()
+			return nil, nil, func() {}, fmt.Errorf("error creating output directory: %w", err)
+		}
+
+		jobs = append(jobs, batchJob{Input: book, Output: output, Key: key, LicenseFile: paired[book]})
+	}
+
+	for _, license := range licenses {
+		if !slices.ContainsFunc(jobs, func(j batchJob) bool { return j.LicenseFile == license }) {
+			orphans = append(orphans, batchResult{
+				Job: batchJob{Input: license},
+				Err: fmt.Errorf("no publication found for this license"),
+			})
+		}
+	}
+
+	return jobs, orphans, cleanup, nil
+}
+
+// pairLicenses returns the license of each book of books that has one in
+// licenses. A license goes with the book that has the same name (book.epub
+// and book.lcpl, in the same folder), or else the one named like the file of
+// its publication link, or else the one embedding a license with the same ID.
+func pairLicenses(books, licenses []string) map[string]string {
+	res := map[string]string{}
+	stem := func(p string) string { return strings.TrimSuffix(p, filepath.Ext(p)) }
+
+	for _, license := range licenses {
+		book := ""
+
+		if i := slices.IndexFunc(books, func(b string) bool { return stem(b) == stem(license) }); i >= 0 {
+			book = books[i]
+		} else if l, err := loadLicense(license); err != nil {
+			log.Printf("Ignoring license %s: %s", license, err)
+			continue
+		} else {
+			book = findLicensedBook(books, l.ID, publicationName(l.Links))
+		}
+
+		if book == "" {
+			continue
+		}
+
+		if previous, ok := res[book]; ok {
+			log.Printf("Several licenses found for %s, using %s rather than %s", book, previous, license)
+			continue
+		}
+
+		res[book] = license
+	}
+
+	return res
+}
+
+// findLicensedBook returns the book of books named name, or else the one
+// embedding the license licenseID, or an empty string.
+func findLicensedBook(books []string, licenseID, name string) string {
+	if name != "" {
+		if i := slices.IndexFunc(books, func(b string) bool { return filepath.Base(b) == name }); i >= 0 {
+			return books[i]
+		}
+	}
+
+	for _, book := range books {
+		embedded, err := loadLicenses(book)
+		if err != nil {
+			continue
+		}
+
+		if slices.ContainsFunc(embedded, func(l *lcp.License) bool { return l.ID == licenseID }) {
+			return book
+		}
+	}
+
+	return ""
+}
+
+// publicationName returns the file name of the publication link of a license,
+// or an empty string.
+func publicationName(links lcp.Links) string {
+	link, ok := links.Link(lcp.LinkRelPublication)
+	if !ok {
+		return ""
+	}
+
+	u, err := url.Parse(link.Href)
+	if err != nil || u.Path == "" {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
+
+// extractCollection extracts the books and licenses of the zip archive at
+// filename to dir.
+func extractCollection(dir, filename string) error {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !(isCollectionBook(f.Name) || strings.EqualFold(path.Ext(f.Name), ".lcpl")) {
+			continue
+		}
+
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			log.Printf("Ignoring %s, which has an unsafe name", f.Name)
+			continue
+		}
+
+		if err := extractCollectionFile(f, filepath.Join(dir, filepath.FromSlash(f.Name))); err != nil {
+			return fmt.Errorf("error extracting %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func extractCollectionFile(f *zip.File, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	fd, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fd, src); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+)
+
+// Kinds of differences between two books.
+const (
+	diffOnlyInA    = "only-in-a"
+	diffOnlyInB    = "only-in-b"
+	diffSize       = "size"
+	diffContent    = "content"
+	diffUnreadable = "unreadable"
+)
+
+// entryDiff is a difference between an entry of two books.
+type entryDiff struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// A and B describe the entry in each book, when relevant.
+	A string `json:"a,omitempty"`
+	B string `json:"b,omitempty"`
+}
+
+func (d entryDiff) String() string {
+	switch d.Kind {
+	case diffOnlyInA:
+		return "only in A: " + d.Path
+	case diffOnlyInB:
+		return "only in B: " + d.Path
+	case diffSize:
+		return fmt.Sprintf("size differs: %s (A: %s, B: %s)", d.Path, d.A, d.B)
+	case diffUnreadable:
+		return fmt.Sprintf("unreadable: %s (A: %s, B: %s)", d.Path, d.A, d.B)
+	default:
+		return "content differs: " + d.Path
+	}
+}
+
+func runCompare(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s compare [options] decrypted.epub reference.epub
+
+Compares the entries of two books (A and B), for example a book decrypted by
+this program and a known-good copy exported by a reading app, and lists the
+entries found in only one of them, and the ones whose size or contents
+(SHA-256) differ. The compression of the entries is not compared.
+
+Exits with a non-zero status if the books differ.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	ignore := flags.String("ignore", "", "comma separated list of patterns (as in path.Match) of entries not to compare, for example META-INF/license.lcpl")
+	asJSON := flags.Bool("json", false, "print the differences as JSON")
+
+	_ = flags.Parse(args) // exits on error
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("expected two files to compare")
+	}
+
+	patterns := splitList(*ignore)
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+
+	a, err := zip.OpenReader(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", flags.Arg(0), err)
+	}
+
+	defer a.Close()
+
+	b, err := zip.OpenReader(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", flags.Arg(1), err)
+	}
+
+	defer b.Close()
+
+	diffs := compareZips(&a.Reader, &b.Reader, func(name string) bool {
+		return slices.ContainsFunc(patterns, func(p string) bool {
+			ok, _ := path.Match(p, name)
+			return ok
+		})
+	})
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(map[string]any{"identical": len(diffs) == 0, "differences": diffs}); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("%d difference(s) between %s and %s", len(diffs), flags.Arg(0), flags.Arg(1))
+	}
+
+	if !*asJSON {
+		fmt.Println("The books are identical")
+	}
+
+	return nil
+}
+
+// compareZips returns the differences between the entries of a and b, sorted
+// by path. Entries for which ignored returns true are not compared.
+func compareZips(a, b *zip.Reader, ignored func(name string) bool) []entryDiff {
+	entries := func(r *zip.Reader) map[string]*zip.File {
+		res := map[string]*zip.File{}
+
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() && !ignored(f.Name) {
+				res[f.Name] = f
+			}
+		}
+
+		return res
+	}
+
+	aFiles, bFiles := entries(a), entries(b)
+
+	var diffs []entryDiff
+
+	for name, fa := range aFiles {
+		fb, ok := bFiles[name]
+		if !ok {
+			diffs = append(diffs, entryDiff{Path: name, Kind: diffOnlyInA})
+			continue
+		}
+
+		if fa.UncompressedSize64 != fb.UncompressedSize64 {
+			diffs = append(diffs, entryDiff{
+				Path: name,
+				Kind: diffSize,
+				A:    fmt.Sprintf("%d bytes", fa.UncompressedSize64),
+				B:    fmt.Sprintf("%d bytes", fb.UncompressedSize64),
+			})
+
+			continue
+		}
+
+		// Sizes match, the CRCs are not trusted as a broken tool could
+		// have written them for the wrong data.
+		sumA, errA := zipEntrySHA256(fa)
+		sumB, errB := zipEntrySHA256(fb)
+
+		switch {
+		case errA != nil || errB != nil:
+			diffs = append(diffs, entryDiff{Path: name, Kind: diffUnreadable, A: errString(errA, "ok"), B: errString(errB, "ok")})
+		case sumA != sumB:
+			diffs = append(diffs, entryDiff{Path: name, Kind: diffContent, A: sumA, B: sumB})
+		}
+	}
+
+	for name := range bFiles {
+		if _, ok := aFiles[name]; !ok {
+			diffs = append(diffs, entryDiff{Path: name, Kind: diffOnlyInB})
+		}
+	}
+
+	slices.SortFunc(diffs, func(x, y entryDiff) int { return cmp.Compare(x.Path, y.Path) })
+
+	return diffs
+}
+
+// zipEntrySHA256 returns the hex encoded SHA-256 of the contents of f.
+func zipEntrySHA256(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+
+	defer r.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// errString returns the message of err, or ok if err is nil.
+func errString(err error, ok string) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return ok
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// Environment variables holding the credential of the books, for scripts and
+// containers. They are only used when no key flag is passed, and take
+// precedence over the key database and the prompt.
+const (
+	userKeyEnv    = "LCP_USER_KEY"
+	passphraseEnv = "LCP_PASSPHRASE"
+)
+
+// envCredential returns the credential set in the environment, which is empty
+// if there is none.
+func envCredential() (credential, error) {
+	cred := credential{UserKey: os.Getenv(userKeyEnv), Passphrase: os.Getenv(passphraseEnv)}
+
+	if cred.UserKey != "" && cred.Passphrase != "" {
+		return credential{}, fmt.Errorf("$%s and $%s cannot be used together", userKeyEnv, passphraseEnv)
+	}
+
+	return cred, nil
+}
+
+// findCredential returns the credential to use for a book protected by one
+// of licenses, looking up the key database by the provider of the license,
+// and prompting the user if no stored key matches. When the book embeds
+// several licenses, licenseID picks one, otherwise they are all tried.
+func findCredential(ctx context.Context, licenses []*lcp.License, keyDBPath, licenseID string) (credential, error) {
+	if licenseID != "" {
+		licenses = slices.DeleteFunc(licenses, func(l *lcp.License) bool { return l.ID != licenseID })
+
+		if len(licenses) == 0 {
+			return credential{}, fmt.Errorf("no license with ID %s", licenseID)
+		}
+	}
+
+	if keyDBPath != "" {
+		db, err := loadKeyDB(keyDBPath)
+		if err != nil {
+			return credential{}, err
+		}
+
+		for _, license := range licenses {
+			if e, ok := db.lookup(license); ok {
+				log.Printf("Using the key stored for %s", e)
+				return e.credential, nil
+			}
+		}
+	}
+
+	license := licenses[0]
+
+	if !isTerminal(os.Stdin) {
+		return credential{}, fmt.Errorf("user key not specified, and no stored key matches provider %s", license.Provider)
+	}
+
+	cred, err := promptCredential(ctx, license)
+	if err != nil {
+		return credential{}, err
+	}
+
+	if keyDBPath != "" {
+		offerToSaveCredential(keyDBPath, license.Provider, cred)
+	}
+
+	return cred, nil
+}
+
+// passphraseVariants are the normalizations of the passphrases tried when
+// they don't match as typed (-passphraseVariants flag).
+var passphraseVariants []lcp.PassphraseVariant
+
+func addPassphraseVariantsFlag(flags *flag.FlagSet) {
+	flags.Func("passphraseVariants", "comma separated normalizations of the passphrase to try when it does not match as typed, for the applications hashing a normalized passphrase: trimmed, nfc, nfkc, case-folded, nfkc-case-folded, or all", func(s string) error {
+		var err error
+		passphraseVariants, err = lcp.ParsePassphraseVariants(s)
+
+		return err
+	})
+}
+
+// passphraseOptions returns the options deriving user keys from passphrases,
+// according to the -passphraseVariants and -profileSecrets flags.
+func passphraseOptions() []lcp.DecryptOption {
+	return append([]lcp.DecryptOption{lcp.WithPassphraseVariants(passphraseVariants...)}, profileTransforms...)
+}
+
+// checkCredential returns an error if cred is not the right credential for
+// license.
+func checkCredential(license *lcp.License, cred credential) error {
+	_, err := cred.licenseUserKey(license)
+	return err
+}
+
+// maxPassphraseAttempts is the number of times the passphrase is asked for
+// before giving up.
+const maxPassphraseAttempts = 3
+
+// promptCredential shows the passphrase hints of license to the user, and asks
+// for the passphrase (without echoing it) until it matches the license.
+func promptCredential(ctx context.Context, license *lcp.License) (credential, error) {
+	fmt.Fprintf(os.Stderr, "No stored key matches provider %s.\n", license.Provider)
+
+	if hint := license.Encryption.UserKey.TextHint; hint != "" {
+		fmt.Fprintf(os.Stderr, "Passphrase hint: %s\n", hint)
+	}
+
+	for _, l := range license.Links.All(lcp.LinkRelHint) {
+		if text, err := fetchHint(ctx, license.ID, l.Href); err == nil && text != "" {
+			fmt.Fprintf(os.Stderr, "More information (from %s):\n%s\n", l.Href, text)
+		} else {
+			fmt.Fprintf(os.Stderr, "More information: %s\n", l.Href)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		input, err := promptSecret("Enter your passphrase (or user key): ")
+		if err != nil {
+			return credential{}, err
+		}
+
+		if input == "" {
+			return credential{}, fmt.Errorf("no passphrase specified")
+		}
+
+		cred := parseCredential(input)
+
+		err = checkCredential(license, cred)
+		if err == nil {
+			return cred, nil
+		}
+
+		if attempt == maxPassphraseAttempts {
+			return credential{}, fmt.Errorf("invalid passphrase: %w", err)
+		}
+
+		fmt.Fprintln(os.Stderr, "The passphrase does not match the license of the book, try again.")
+	}
+}
+
+// offerToSaveCredential asks the user whether cred should be saved in the key
+// database. Errors are only logged, since they don't prevent decrypting.
+func offerToSaveCredential(keyDBPath, provider string, cred credential) {
+	answer, err := prompt(fmt.Sprintf("Save this key for provider %s? [y/N] ", provider))
+	if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+		return
+	}
+
+	db, err := loadKeyDB(keyDBPath)
+	if err == nil {
+		err = db.add(keyDBEntry{Provider: provider, credential: cred})
+	}
+
+	if err == nil {
+		err = db.save(keyDBPath)
+	}
+
+	if err != nil {
+		log.Printf("Error saving key: %s", err)
+	}
+}
+
+// maxHintLength is the maximum length of the hint page text shown to the
+// user.
+const maxHintLength = 500
+
+// fetchHint downloads the hint page of a license and returns its text
+// content.
+func fetchHint(ctx context.Context, licenseID, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	body, err := cachedGet(ctx, newHTTPClient(), licenseID, url)
+	if err != nil {
+		return "", err
+	}
+
+	return truncateText(htmlToText(string(body)), maxHintLength), nil
+}
+
+// truncateText cuts text to at most maxLength bytes, without splitting a
+// character, and marks the cut with an ellipsis.
+func truncateText(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+
+	n := maxLength
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+
+	return text[:n] + "..."
+}
+
+var (
+	htmlInvisibleRegexp = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	htmlTagRegexp       = regexp.MustCompile(`(?s)<[^>]*>`)
+	whitespaceRegexp    = regexp.MustCompile(`\s+`)
+)
+
+// htmlToText roughly extracts the text from an HTML document. It is only
+// meant to show short hint pages in a terminal.
+func htmlToText(html string) string {
+	text := htmlInvisibleRegexp.ReplaceAllString(html, " ")
+	text = htmlTagRegexp.ReplaceAllString(text, " ")
+	text = strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'").Replace(text)
+
+	return strings.TrimSpace(whitespaceRegexp.ReplaceAllString(text, " "))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateText(t *testing.T) {
+	for _, tc := range []struct {
+		text      string
+		maxLength int
+		want      string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer text", 8, "a longer..."},
+		// "é" is two bytes, cutting after its first one would split it
+		{"café au lait", 4, "caf..."},
+		{"café au lait", 5, "café..."},
+		{"日本語", 4, "日..."},
+	} {
+		got := truncateText(tc.text, tc.maxLength)
+		if got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.text, tc.maxLength, got, tc.want)
+		}
+
+		if !utf8.ValidString(got) {
+			t.Errorf("truncateText(%q, %d) = %q is not valid UTF-8", tc.text, tc.maxLength, got)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// daemonInputExtensions are the extensions of the inbox files processed by
+// the daemon.
+var daemonInputExtensions = []string{".epub", ".lcpdf", ".lcpau", ".lcpa", ".audiobook", ".zip"}
+
+// daemon decrypts the books dropped in its inbox to its outbox.
+type daemon struct {
+	inbox, outbox   string
+	format          outputFormat
+	keyDBPath       string
+	maxAttempts     int
+	retryDelay      time.Duration
+	removeProcessed bool
+	state           *daemonState
+	audit           *auditLog
+	skipDecrypted   bool
+	webhook         *webhook
+
+	started  time.Time
+	lastScan atomic.Int64 // Unix time in nanoseconds
+	// seen records the size and modification time of the files at the
+	// previous scan, files are only processed once they stop changing.
+	seen map[string]fs.FileInfo
+}
+
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s daemon [options] -inbox DIR -outbox DIR
+
+Runs until interrupted, decrypting the books dropped in the inbox directory to
+the outbox directory, using the keys stored for their provider (see "%[1]s
+keys -h"). Books that fail to decrypt (for example because no key is stored
+yet for their provider) are retried later.
+
+What happened to each book is recorded in a state database, which -status
+serves as JSON for monitoring.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	inbox := flags.String("inbox", "", "directory watched for protected books")
+	outbox := flags.String("outbox", "", "directory where the decrypted books are written")
+	statePath := flags.String("state", "", "path of the state database (default INBOX/.lcp-decrypt-state.json)")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	formatName := flags.String("format", string(formatEPUB), "format of the output files: epub, kepub, webpub, webpub-dir, m4b or audio-dir")
+	interval := flags.Duration("interval", 10*time.Second, "delay between two scans of the inbox")
+	maxAttempts := flags.Int("maxAttempts", 5, "number of attempts before giving up on a book, until it changes")
+	retryDelay := flags.Duration("retryDelay", time.Minute, "delay before retrying a book that failed to decrypt, doubled after each failure")
+	removeProcessed := flags.Bool("removeProcessed", false, "remove the books from the inbox once decrypted")
+	openAudit := addAuditFlags(flags)
+	loadSkipDecrypted := addSkipDecryptedFlag(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+	addMaxMemoryFlag(flags)
+	addLimitsFlags(flags, lcp.Limits{})
+	addTransformsFlag(flags)
+	addOutputPasswordFlag(flags)
+	loadWebhook := addWebhookFlags(flags)
+	loadTLSFlags := addTLSFlags(flags)
+	statusAddr := flags.String("status", "", "address to serve the status on (for example localhost:8080), disabled by default")
+
+	_ = flags.Parse(args) // exits on error
+
+	if *inbox == "" || *outbox == "" {
+		return errors.New("-inbox and -outbox are mandatory")
+	}
+
+	if err := loadTLSFlags(); err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	if *statePath == "" {
+		*statePath = filepath.Join(*inbox, ".lcp-decrypt-state.json")
+	}
+
+	if err := os.MkdirAll(*outbox, 0o755); err != nil {
+		return fmt.Errorf("error creating outbox: %w", err)
+	}
+
+	state, err := loadDaemonState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAudit()
+	if err != nil {
+		return err
+	}
+
+	defer audit.Close()
+
+	skipDecrypted, err := loadSkipDecrypted(audit)
+	if err != nil {
+		return err
+	}
+
+	d := &daemon{
+		inbox:           *inbox,
+		outbox:          *outbox,
+		format:          format,
+		keyDBPath:       *keyDBPath,
+		maxAttempts:     max(*maxAttempts, 1),
+		retryDelay:      *retryDelay,
+		removeProcessed: *removeProcessed,
+		state:           state,
+		audit:           audit,
+		skipDecrypted:   skipDecrypted,
+		webhook:         loadWebhook(),
+		started:         time.Now(),
+		seen:            map[string]fs.FileInfo{},
+	}
+
+	defer d.webhook.wait()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *statusAddr != "" {
+		if err := d.serveStatus(ctx, *statusAddr); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Watching %s, decrypted books go to %s", d.inbox, d.outbox)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.scan(ctx); err != nil {
+			log.Printf("Error scanning inbox: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan processes the books of the inbox that are due.
+func (d *daemon) scan(ctx context.Context) error {
+	entries, err := os.ReadDir(d.inbox)
+	if err != nil {
+		return err
+	}
+
+	d.lastScan.Store(time.Now().UnixNano())
+	seen := make(map[string]fs.FileInfo, len(entries))
+
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if !e.Type().IsRegular() || !isDaemonInput(e.Name()) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue // removed in the meantime
+		}
+
+		seen[e.Name()] = info
+
+		if previous, ok := d.seen[e.Name()]; !ok || previous.Size() != info.Size() || !previous.ModTime().Equal(info.ModTime()) {
+			continue // possibly still being copied, wait for the next scan
+		}
+
+		d.processIfDue(ctx, info)
+	}
+
+	d.seen = seen
+
+	return nil
+}
+
+func isDaemonInput(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, e := range daemonInputExtensions {
+		if ext == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *daemon) processIfDue(ctx context.Context, info fs.FileInfo) {
+	f, ok := d.state.get(info.Name())
+
+	if !ok || f.changed(info) {
+		f = fileState{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), Status: statusPending}
+	}
+
+	if f.Status != statusPending || time.Now().Before(f.NextAttempt) {
+		return
+	}
+
+	if d.skipDecrypted {
+		previous, ok, err := d.audit.alreadyDecrypted(filepath.Join(d.inbox, f.Name))
+		if err != nil {
+			log.Printf("Error looking up %s in the history: %s", f.Name, err)
+		} else if ok {
+			log.Printf("Skipping %s, already decrypted to %s", f.Name, previous.Output)
+
+			f.Status, f.Output = statusDone, previous.Output
+
+			if err := d.state.put(f); err != nil {
+				log.Printf("Error: %s", err)
+			}
+
+			return
+		}
+	}
+
+	f.Attempts++
+	f.LastAttempt = time.Now()
+
+	log.Printf("Decrypting %s (attempt %d/%d)...", f.Name, f.Attempts, d.maxAttempts)
+
+	output, err := d.process(ctx, f.Name)
+
+	switch {
+	case ctx.Err() != nil:
+		return // interrupted, the attempt does not count
+	case err == nil:
+		f.Status, f.Output, f.LastError, f.NextAttempt = statusDone, output, "", time.Time{}
+		log.Printf("Decrypted %s to %s", f.Name, output)
+
+		d.notify(webhookEvent{Event: webhookDone, Output: output}, f.Name)
+
+		if d.removeProcessed {
+			if err := os.Remove(filepath.Join(d.inbox, f.Name)); err != nil {
+				log.Printf("Error removing %s from inbox: %s", f.Name, err)
+			}
+		}
+	case f.Attempts >= d.maxAttempts:
+		f.Status, f.LastError, f.NextAttempt = statusFailed, err.Error(), time.Time{}
+		log.Printf("Error decrypting %s, giving up: %s", f.Name, err)
+
+		d.notify(webhookEvent{Event: webhookFailed, Error: err.Error()}, f.Name)
+	default:
+		f.LastError = err.Error()
+		f.NextAttempt = time.Now().Add(d.retryDelay << (f.Attempts - 1))
+		log.Printf("Error decrypting %s, retrying at %s: %s", f.Name, f.NextAttempt.Format(time.TimeOnly), err)
+	}
+
+	if err := d.state.put(f); err != nil {
+		log.Printf("Error: %s", err)
+	}
+}
+
+// process decrypts the inbox file called name, and returns the path of the
+// decrypted file.
+func (d *daemon) process(ctx context.Context, name string) (string, error) {
+	inFilename := filepath.Join(d.inbox, name)
+
+	cred, err := d.storedCredential(inFilename)
+	if err != nil {
+		return "", err
+	}
+
+	outFilename := d.outputFilename(name)
+
+	userKey, opts := cred.decryptArgs()
+	opts = append(opts,
+		lcp.WithLogger(func(msg string) { log.Printf("[%s] %s", name, msg) }),
+		lcp.WithContext(ctx),
+	)
+	opts = append(opts, memoryOptions()...)
+	opts = append(opts, limitsOptions()...)
+	opts = append(opts, transformOptions...)
+
+	record := auditRecord{Command: "daemon", Input: absPath(inFilename), Output: absPath(d.format.filename(outFilename))}
+
+	err = d.audit.run(record, inFilename, nil, func() error {
+		return decryptFile(inFilename, outFilename, d.format, userKey, opts...)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return d.format.filename(outFilename), nil
+}
+
+// notify sends event about the inbox file called name to the webhook.
+func (d *daemon) notify(event webhookEvent, name string) {
+	inFilename := filepath.Join(d.inbox, name)
+
+	event.Command = "daemon"
+	event.Input = absPath(inFilename)
+	if event.Output != "" {
+		event.Output = absPath(event.Output)
+	}
+
+	d.webhook.notify(event, inFilename, "")
+}
+
+// storedCredential returns the credential stored in the key database for the
+// provider of the book in filename. The database is read again for each
+// book, so that the keys added while the daemon runs are used.
+func (d *daemon) storedCredential(filename string) (credential, error) {
+	licenses, err := loadLicenses(filename)
+	if err != nil {
+		return credential{}, err
+	}
+
+	db := &keyDB{}
+
+	if d.keyDBPath != "" {
+		if db, err = loadKeyDB(d.keyDBPath); err != nil {
+			return credential{}, err
+		}
+	}
+
+	for _, license := range licenses {
+		if e, ok := db.lookup(license); ok {
+			return e.credential, nil
+		}
+	}
+
+	return credential{}, fmt.Errorf("no key stored for provider %s", licenses[0].Provider)
+}
+
+// outputFilename returns the path of the decrypted version of the inbox file
+// called name, without clobbering the existing files of the outbox.
+func (d *daemon) outputFilename(name string) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 0; ; i++ {
+		filename := filepath.Join(d.outbox, stem+ext)
+		if i > 0 {
+			filename = filepath.Join(d.outbox, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		}
+
+		if _, err := os.Stat(d.format.filename(filename)); errors.Is(err, fs.ErrNotExist) {
+			return filename
+		}
+	}
+}
+
+// daemonStatus is the document served by the status endpoint.
+type daemonStatus struct {
+	Started  time.Time          `json:"started"`
+	LastScan time.Time          `json:"lastScan"`
+	Counts   map[fileStatus]int `json:"counts"`
+	Files    []fileState        `json:"files"`
+}
+
+func (d *daemon) serveStatus(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := daemonStatus{
+			Started:  d.started,
+			LastScan: time.Unix(0, d.lastScan.Load()),
+			Counts:   map[fileStatus]int{},
+			Files:    d.state.list(),
+		}
+
+		for _, f := range status.Files {
+			status.Counts[f.Status]++
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving status: %s", err)
+		}
+	}()
+
+	log.Printf("Serving status on http://%s/status", listener.Addr())
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStatus is the processing status of a file of the daemon's inbox.
+type fileStatus string
+
+const (
+	// statusPending files are waiting to be processed, possibly for a retry.
+	statusPending fileStatus = "pending"
+	// statusDone files were decrypted to the outbox.
+	statusDone fileStatus = "done"
+	// statusFailed files failed too many times, and are only retried if
+	// they change.
+	statusFailed fileStatus = "failed"
+)
+
+// fileState is what the daemon knows about a file of its inbox. A file that
+// changes (size or modification time) is processed again.
+type fileState struct {
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	ModTime     time.Time  `json:"modTime"`
+	Status      fileStatus `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastAttempt time.Time  `json:"lastAttempt"`
+	NextAttempt time.Time  `json:"nextAttempt"`
+	LastError   string     `json:"lastError,omitempty"`
+	Output      string     `json:"output,omitempty"`
+}
+
+// changed returns true if the file was modified since it was recorded.
+func (s *fileState) changed(info fs.FileInfo) bool {
+	return s.Size != info.Size() || !s.ModTime.Equal(info.ModTime())
+}
+
+// daemonState is the state database of the daemon, stored as a JSON file.
+type daemonState struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]*fileState
+}
+
+func loadDaemonState(path string) (*daemonState, error) {
+	state := &daemonState{path: path, files: map[string]*fileState{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading state database: %w", err)
+	}
+
+	var files []*fileState
+
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("error decoding state database %s: %w", path, err)
+	}
+
+	for _, f := range files {
+		state.files[f.Name] = f
+	}
+
+	return state, nil
+}
+
+// get returns a copy of the state of the file called name.
+func (s *daemonState) get(name string) (fileState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return fileState{}, false
+	}
+
+	return *f, true
+}
+
+// put records the state of a file, and saves the database.
+func (s *daemonState) put(f fileState) error {
+	s.mu.Lock()
+	s.files[f.Name] = &f
+	s.mu.Unlock()
+
+	return s.save()
+}
+
+// list returns a copy of the states of all the files, sorted by name.
+func (s *daemonState) list() []fileState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]fileState, 0, len(s.files))
+
+	for _, f := range s.files {
+		res = append(res, *f)
+	}
+
+	slices.SortFunc(res, func(a, b fileState) int { return strings.Compare(a.Name, b.Name) })
+
+	return res
+}
+
+func (s *daemonState) save() error {
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	out, err := createAtomic(s.path)
+	if err != nil {
+		return fmt.Errorf("error saving state database: %w", err)
+	}
+
+	defer out.Abort()
+
+	if _, err := out.Write(data); err != nil {
+		return fmt.Errorf("error saving state database: %w", err)
+	}
+
+	if err := out.Commit(); err != nil {
+		return fmt.Errorf("error saving state database: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+func runDoctor(args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s doctor [-userKey KEY] book.epub
+
+Checks a book for the problems that prevent decrypting it or make readers
+choke on it, and prints what was found, most serious first: zip integrity,
+mimetype, license presence and validity, key check, encryption algorithm and
+size of each encrypted file, files missing from the archive. With a user key
+or passphrase (or one stored for the provider of the book, see "%[1]s keys
+-h"), the book is also decrypted, without writing the result anywhere.
+
+Please attach the output of this command to bug reports (with -redactPII to
+mask the license IDs and user details).
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	key := flags.String("userKey", "", "hex encoded LCP user key, or passphrase")
+	licenseFilename := flags.String("licenseFile", "", "license of the book, for books distributed separately from their license")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	asJSON := flags.Bool("json", false, "print the findings as JSON")
+	addRedactPIIFlag(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	inFilename := flags.Arg(0)
+	if inFilename == "" {
+		return fmt.Errorf("no input file specified")
+	}
+
+	inFd, err := os.Open(inFilename)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+
+	defer inFd.Close()
+
+	inStat, err := inFd.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating input file: %w", err)
+	}
+
+	var opts []lcp.DecryptOption
+
+	licenseFile := inFilename
+
+	if *licenseFilename != "" {
+		data, err := os.ReadFile(*licenseFilename)
+		if err != nil {
+			return fmt.Errorf("error reading license file: %w", err)
+		}
+
+		opts = append(opts, lcp.WithExternalLicense(bytes.NewReader(data)))
+		licenseFile = *licenseFilename
+	}
+
+	if redactPII {
+		opts = append(opts, lcp.WithRedactPII())
+	}
+
+	cred := parseCredential(*key)
+
+	if *key == "" && *keyDBPath != "" {
+		// The license might be what's broken, it's checked below anyway
+		if license, err := loadLicense(licenseFile); err == nil {
+			if keyDB, err := loadKeyDB(*keyDBPath); err == nil {
+				if e, ok := keyDB.lookup(license); ok {
+					cred = e.credential
+				} else if i := slices.IndexFunc(keyDB.Keys, func(e keyDBEntry) bool { return e.Provider == license.Provider }); i >= 0 {
+					cred = keyDB.Keys[i].credential // diagnosed as not matching
+				}
+			}
+		}
+	}
+
+	userKeyHex, credOpts := cred.decryptArgs()
+	opts = append(opts, credOpts...)
+
+	findings := lcp.Diagnose(inFd, inStat.Size(), userKeyHex, opts...)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(map[string]any{
+			"platform": runtime.GOOS + "/" + runtime.GOARCH,
+			"go":       runtime.Version(),
+			"findings": findings,
+		})
+	}
+
+	fmt.Printf("lcp-decrypt doctor on %s/%s (%s)\n\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+
+	errors, warnings := 0, 0
+
+	for _, f := range findings {
+		switch f.Severity {
+		case lcp.SeverityError:
+			errors++
+		case lcp.SeverityWarning:
+			warnings++
+		}
+
+		fmt.Printf("%-8s %s\n", strings.ToUpper(f.Severity.String()), f)
+	}
+
+	fmt.Printf("\n%d error(s), %d warning(s)\n", errors, warnings)
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isURL returns true if the input file name is an HTTP(S) URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// downloadPath returns the file the publication at url is downloaded to.
+// The name only depends on url, so that an interrupted download is resumed
+// by the next run.
+func downloadPath(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(os.TempDir(), "lcp-decrypt-"+hex.EncodeToString(h[:16])+".download")
+}
+
+// downloadInput downloads the publication at url and returns the path of the
+// downloaded file. The download resumes from the data left by a previous
+// interrupted run when the server supports it. The caller should remove the
+// file once it is done with it.
+func downloadInput(ctx context.Context, url string) (string, error) {
+	filename := downloadPath(url)
+	partFilename := filename + ".part"
+
+	if _, err := os.Stat(filename); err == nil {
+		log.Printf("Using the publication downloaded by a previous run (%s)", filename)
+		return filename, nil
+	}
+
+	fd, err := os.OpenFile(partFilename, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("error creating download file: %w", err)
+	}
+
+	defer fd.Close()
+
+	offset, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("error seeking in download file: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	client := newDownloadClient(url)
+	client.Timeout = 0 // publications can take a while to download, ctx is enough
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error downloading publication: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+		log.Printf("Resuming download of %s at %s", url, formatBytes(offset))
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		// The server ignored the range, start over
+		if offset, err = fd.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("error seeking in download file: %w", err)
+		}
+
+		if err := fd.Truncate(0); err != nil {
+			return "", fmt.Errorf("error truncating download file: %w", err)
+		}
+
+		log.Printf("Downloading %s...", url)
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The file changed since the previous run, start over
+		if err := os.Remove(partFilename); err != nil {
+			return "", fmt.Errorf("error removing stale download file: %w", err)
+		}
+
+		return "", fmt.Errorf("the publication at %s changed since the previous download attempt, please try again", url)
+	default:
+		return "", fmt.Errorf("unexpected status code %d for %s", res.StatusCode, url)
+	}
+
+	total := int64(-1)
+	if res.ContentLength >= 0 {
+		total = offset + res.ContentLength
+	}
+
+	progress := &progressWriter{done: offset, total: total, enabled: isTerminal(os.Stderr)}
+
+	_, err = io.Copy(io.MultiWriter(fd, progress), res.Body)
+	progress.finish()
+
+	if err != nil {
+		return "", fmt.Errorf("error downloading publication (run the same command again to resume): %w", err)
+	}
+
+	if err := fd.Close(); err != nil {
+		return "", fmt.Errorf("error writing download file: %w", err)
+	}
+
+	if err := os.Rename(partFilename, filename); err != nil {
+		return "", fmt.Errorf("error renaming download file: %w", err)
+	}
+
+	return filename, nil
+}
+
+// download writes the publication at url to w.
+func download(ctx context.Context, client *http.Client, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error downloading publication: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d while downloading publication", res.StatusCode)
+	}
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("error downloading publication: %w", err)
+	}
+
+	return nil
+}
+
+// removeDownload removes a file returned by downloadInput.
+func removeDownload(filename string) {
+	if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Error removing downloaded file %s: %s", filename, err)
+	}
+}
+
+// progressWriter prints the progress of a download on stderr.
+type progressWriter struct {
+	done, total int64
+	enabled     bool
+	lastPrint   time.Time
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.done += int64(len(data))
+
+	if p.enabled && time.Since(p.lastPrint) > 200*time.Millisecond {
+		p.print()
+		p.lastPrint = time.Now()
+	}
+
+	return len(data), nil
+}
+
+func (p *progressWriter) print() {
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%3d%% (%s/%s)", p.done*100/p.total, formatBytes(p.done), formatBytes(p.total))
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s", formatBytes(p.done))
+	}
+}
+
+func (p *progressWriter) finish() {
+	if p.enabled {
+		p.print()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// formatBytes formats a size in a human readable way.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
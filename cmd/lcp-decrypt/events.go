@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// eventStream writes the progress of the decryptions as machine readable
+// events, one JSON object per line (NDJSON), for the programs driving
+// lcp-decrypt as a subprocess. Each object has an "event" field (start,
+// file-start, file-done, warning or done) and a "time" field.
+type eventStream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// addEventsFlag registers the flag enabling the event stream on the standard
+// output. The returned function must be called once the flags are parsed,
+// and returns nil if no events were requested.
+func addEventsFlag(flags *flag.FlagSet) func() (*eventStream, error) {
+	format := flags.String("events", "", "print progress events on the standard output, in the given format (only ndjson is supported: one JSON object per line), for programs driving this one")
+
+	return func() (*eventStream, error) {
+		switch *format {
+		case "":
+			return nil, nil
+		case "ndjson":
+			return &eventStream{w: os.Stdout}, nil
+		default:
+			return nil, fmt.Errorf("invalid events format %q (valid values: ndjson)", *format)
+		}
+	}
+}
+
+// emit writes an event, with fields merged in the JSON object.
+func (s *eventStream) emit(event string, fields map[string]any) {
+	if s == nil {
+		return
+	}
+
+	obj := map[string]any{"event": event, "time": time.Now().UTC()}
+	for k, v := range fields {
+		obj[k] = v
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, _ = s.w.Write(append(data, '\n'))
+}
+
+// start emits the start event of the decryption of input into output, and
+// returns the options emitting the events of its files and its warnings.
+func (s *eventStream) start(input, output string) []lcp.DecryptOption {
+	if s == nil {
+		return nil
+	}
+
+	s.emit("start", map[string]any{"input": input, "output": output})
+
+	return []lcp.DecryptOption{
+		lcp.WithOnFileStart(func(entry lcp.FileEntry, action lcp.FileAction) {
+			s.emit("file-start", map[string]any{"input": input, "path": entry.Path, "action": action})
+		}),
+		lcp.WithOnFileEnd(func(result lcp.FileResult) {
+			fields := map[string]any{
+				"input":      input,
+				"path":       result.Entry.Path,
+				"action":     result.Action,
+				"durationMs": result.Duration.Milliseconds(),
+			}
+
+			if result.Err != nil {
+				fields["error"] = result.Err.Error()
+			}
+
+			s.emit("file-done", fields)
+		}),
+		lcp.WithOnWarning(func(w lcp.Warning) {
+			fields := map[string]any{"input": input, "kind": w.Kind, "message": w.Message}
+			if w.Path != "" {
+				fields["path"] = w.Path
+			}
+
+			s.emit("warning", fields)
+		}),
+	}
+}
+
+// finish emits the done event of the decryption of input. report is the one
+// filled by Decrypt.
+func (s *eventStream) finish(input, output string, report lcp.Report, err error) {
+	if s == nil {
+		return
+	}
+
+	fields := map[string]any{
+		"input":    input,
+		"output":   output,
+		"ok":       err == nil && report.Err == nil,
+		"warnings": len(report.Warnings),
+	}
+
+	switch {
+	case err != nil:
+		fields["error"] = err.Error()
+	case report.Err != nil:
+		fields["error"] = report.Err.Error()
+	}
+
+	s.emit("done", fields)
+}
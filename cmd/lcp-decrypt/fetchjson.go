@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+	"github.com/abustany/lcp-decrypt/pkg/stores"
+)
+
+func runFetchJSON(args []string) error {
+	flags := flag.NewFlagSet("fetch-json", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %s fetch-json response.json -o book.epub
+
+Downloads and decrypts a book described by a store response, for example
+
+{"signed_link": "https://...", "key": "0123...cdef"}
+
+where signed_link points to the protected file and key is its hex encoded
+content key. Such responses come from providers that don't ship LCP licenses.
+Standard LCP licenses linking to their publication are supported as well, the
+user key is then looked up like when decrypting a file.
+
+Supported stores:
+
+%s
+Options:
+`, os.Args[0], describeStores())
+		flags.PrintDefaults()
+	}
+
+	outFilename := flags.String("o", "", "path of the output file")
+	formatName := flags.String("format", string(formatEPUB), "format of the output file: epub, kepub, webpub, webpub-dir, m4b or audio-dir")
+	storeName := flags.String("store", "", "name of the store the response comes from (by default, it is detected)")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	loadDownloadFlags := addDownloadFlags(flags)
+	loadTLSFlags := addTLSFlags(flags)
+	openAudit := addAuditFlags(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+	addMaxMemoryFlag(flags)
+	addLimitsFlags(flags, lcp.Limits{})
+	addTransformsFlag(flags)
+	addOutputPasswordFlag(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	inFilename := flags.Arg(0)
+	if inFilename == "" {
+		return fmt.Errorf("no input file specified")
+	}
+
+	// Allow options after the input file
+	_ = flags.Parse(flags.Args()[1:])
+
+	if *outFilename == "" {
+		return fmt.Errorf("no output file specified")
+	}
+
+	format, err := parseOutputFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	if err := loadDownloadFlags(); err != nil {
+		return err
+	}
+
+	if err := loadTLSFlags(); err != nil {
+		return err
+	}
+
+	audit, err := openAudit()
+	if err != nil {
+		return err
+	}
+
+	defer audit.Close()
+
+	data, err := os.ReadFile(inFilename)
+	if err != nil {
+		return fmt.Errorf("error reading input file: %w", err)
+	}
+
+	var fulfillment *stores.Fulfillment
+
+	if *storeName != "" {
+		adapter, ok := stores.Lookup(*storeName)
+		if !ok || adapter.ParseFulfillment == nil {
+			return fmt.Errorf("unknown store %s", *storeName)
+		}
+
+		fulfillment, err = adapter.ParseFulfillment(data)
+	} else {
+		var adapter *stores.Adapter
+
+		if adapter, fulfillment, err = stores.DetectFulfillment(data); err == nil {
+			log.Printf("Detected a %s response", adapter.Name)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", inFilename, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts := []lcp.DecryptOption{
+		lcp.WithLogger(func(msg string) { log.Println(msg) }),
+		lcp.WithContext(ctx),
+	}
+	opts = append(opts, memoryOptions()...)
+	opts = append(opts, limitsOptions()...)
+	opts = append(opts, transformOptions...)
+
+	var userKey string
+	var license *lcp.License
+
+	if fulfillment.ContentKey != nil {
+		opts = append(opts, lcp.WithContentKey(fulfillment.ContentKey))
+	} else {
+		if license, err = lcp.ParseLicense(bytes.NewReader(fulfillment.License)); err != nil {
+			return fmt.Errorf("error reading license: %w", err)
+		}
+
+		cred, err := findCredential(ctx, []*lcp.License{license}, *keyDBPath, "")
+		if err != nil {
+			return err
+		}
+
+		var credOpts []lcp.DecryptOption
+
+		userKey, credOpts = cred.decryptArgs()
+		opts = append(opts, credOpts...)
+		opts = append(opts, lcp.WithExternalLicense(bytes.NewReader(fulfillment.License)))
+	}
+
+	tmpFd, err := os.CreateTemp("", "lcp-decrypt-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	defer os.Remove(tmpFd.Name())
+	defer tmpFd.Close()
+
+	log.Println("Downloading protected file...")
+
+	client := newDownloadClient(fulfillment.URL)
+	client.Timeout = 0 // publications can take a while to download, ctx is enough
+
+	if err := download(ctx, client, fulfillment.URL, tmpFd); err != nil {
+		return err
+	}
+
+	if err := tmpFd.Close(); err != nil {
+		return fmt.Errorf("error writing temporary file: %w", err)
+	}
+
+	record := auditRecord{Command: "fetch-json", Input: fulfillment.URL, Output: absPath(format.filename(*outFilename))}
+
+	return audit.run(record, tmpFd.Name(), license, func() error {
+		return decryptFile(tmpFd.Name(), *outFilename, format, userKey, opts...)
+	})
+}
+
+// describeStores lists the registered store adapters for the usage message.
+func describeStores() string {
+	var sb strings.Builder
+
+	for _, a := range stores.All() {
+		if a.ParseFulfillment != nil {
+			fmt.Fprintf(&sb, "  %-12s %s\n", a.Name, a.Description)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/audiobook"
+	"github.com/abustany/lcp-decrypt/pkg/kepub"
+	"github.com/abustany/lcp-decrypt/pkg/webpub"
+)
+
+// outputFormat is the format of the file written after decrypting a book.
+type outputFormat string
+
+const (
+	formatEPUB      outputFormat = "epub"
+	formatKepub     outputFormat = "kepub"
+	formatWebPub    outputFormat = "webpub"
+	formatWebPubDir outputFormat = "webpub-dir"
+	formatM4B       outputFormat = "m4b"
+	formatAudioDir  outputFormat = "audio-dir"
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(s); f {
+	case formatEPUB, formatKepub, formatWebPub, formatWebPubDir, formatM4B, formatAudioDir:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid output format %q (valid values: epub, kepub, webpub, webpub-dir, m4b, audio-dir)", s)
+	}
+}
+
+// filename returns the name of the output file for the given format.
+func (f outputFormat) filename(name string) string {
+	switch f {
+	case formatKepub:
+		if !strings.HasSuffix(strings.ToLower(name), ".kepub.epub") {
+			return strings.TrimSuffix(name, ".epub") + ".kepub.epub"
+		}
+	case formatWebPub:
+		return strings.TrimSuffix(name, ".epub") + ".webpub"
+	case formatWebPubDir:
+		if trimmed := strings.TrimSuffix(name, ".epub"); trimmed != "" {
+			return trimmed
+		}
+	case formatM4B:
+		if !strings.EqualFold(filepath.Ext(name), ".m4b") {
+			return strings.TrimSuffix(name, filepath.Ext(name)) + ".m4b"
+		}
+	case formatAudioDir:
+		if trimmed := strings.TrimSuffix(name, filepath.Ext(name)); trimmed != "" {
+			return trimmed
+		}
+	}
+
+	return name
+}
+
+// mediaType returns the media type of the files produced by the format.
+func (f outputFormat) mediaType() string {
+	switch f {
+	case formatKepub, formatEPUB:
+		return "application/epub+zip"
+	case formatWebPub:
+		return "application/webpub+zip"
+	case formatM4B:
+		return "audio/mp4"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// isDirectory returns whether the format produces a directory rather than a
+// single file.
+func (f outputFormat) isDirectory() bool {
+	return f == formatWebPubDir || f == formatAudioDir
+}
+
+// isAudio returns whether the format repackages audiobooks, rather than
+// converting EPUB books.
+func (f outputFormat) isAudio() bool {
+	return f == formatM4B || f == formatAudioDir
+}
+
+// convert converts the decrypted EPUB file (or audiobook) in into out. It is
+// only called for formats other than epub that produce a single file.
+func (f outputFormat) convert(out io.Writer, in io.ReaderAt, inSize int64) error {
+	switch f {
+	case formatKepub:
+		return kepub.Convert(out, in, inSize)
+	case formatWebPub:
+		return webpub.Package(out, in, inSize)
+	case formatM4B:
+		return audiobook.ConvertM4B(out, in, inSize)
+	default:
+		return fmt.Errorf("no conversion available to %s", f)
+	}
+}
+
+// extract converts the decrypted EPUB file (or audiobook) in into the
+// directory at dir. The directory only appears once the conversion succeeds.
+func (f outputFormat) extract(dir string, in io.ReaderAt, inSize int64) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	if f == formatAudioDir {
+		err = audiobook.Extract(tmpDir, in, inSize)
+	} else {
+		err = webpub.Extract(tmpDir, in, inSize)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpDir, 0o755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDir, dir)
+}
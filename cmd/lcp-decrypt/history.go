@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s history [options] [book.epub | TEXT]
+
+Lists the decryption runs recorded in the history database, most recent
+first. Runs are only recorded when passing -audit to the other commands.
+
+If a book file is given, only the runs for that book (same file, or same
+license) are listed. Otherwise, TEXT filters the runs by path, license ID or
+provider.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	path := flags.String("auditDB", defaultAuditDBPath(), "path of the history database")
+	jsonOutput := flags.Bool("json", false, "print the runs as JSON")
+	limit := flags.Int("limit", 50, "maximum number of runs to list, 0 for no limit")
+	addRedactPIIFlag(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	if _, err := os.Stat(*path); err != nil {
+		return fmt.Errorf("no history database at %s, pass -audit when decrypting books to record them", *path)
+	}
+
+	a, err := openAuditLog(*path)
+	if err != nil {
+		return err
+	}
+
+	defer a.Close()
+
+	query := `SELECT id, started_at, finished_at, command, input, input_sha256, output, license_id, provider, rights, outcome, error FROM runs`
+	var queryArgs []any
+
+	if arg := flags.Arg(0); arg != "" {
+		if stat, err := os.Stat(arg); err == nil && stat.Mode().IsRegular() {
+			hash, err := fileSHA256(arg)
+			if err != nil {
+				return fmt.Errorf("error hashing %s: %w", arg, err)
+			}
+
+			licenseID := ""
+			if license, err := loadLicense(arg); err == nil {
+				licenseID = license.ID
+			}
+
+			query += ` WHERE input_sha256 = ? OR (license_id != '' AND license_id = ?)`
+			queryArgs = append(queryArgs, hash, licenseID)
+		} else {
+			pattern := "%" + arg + "%"
+			query += ` WHERE input LIKE ? OR output LIKE ? OR license_id LIKE ? OR provider LIKE ?`
+			queryArgs = append(queryArgs, pattern, pattern, pattern, pattern)
+		}
+	}
+
+	query += ` ORDER BY id DESC`
+
+	if *limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, *limit)
+	}
+
+	records, err := a.query(query, queryArgs...)
+	if err != nil {
+		return err
+	}
+
+	for i := range records {
+		records[i].LicenseID = redact(records[i].LicenseID)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(records)
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No matching run")
+		return nil
+	}
+
+	for _, r := range records {
+		printAuditRecord(r)
+	}
+
+	return nil
+}
+
+func (a *auditLog) query(query string, args ...any) ([]auditRecord, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying history database: %w", err)
+	}
+
+	defer rows.Close()
+
+	records := []auditRecord{}
+
+	for rows.Next() {
+		var r auditRecord
+		var startedAt, finishedAt, rights string
+
+		if err := rows.Scan(&r.ID, &startedAt, &finishedAt, &r.Command, &r.Input, &r.InputSHA256, &r.Output, &r.LicenseID, &r.Provider, &rights, &r.Outcome, &r.Error); err != nil {
+			return nil, fmt.Errorf("error reading history database: %w", err)
+		}
+
+		r.StartedAt, _ = time.Parse(time.RFC3339Nano, startedAt)
+		r.FinishedAt, _ = time.Parse(time.RFC3339Nano, finishedAt)
+		_ = json.Unmarshal([]byte(rights), &r.Rights)
+
+		records = append(records, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history database: %w", err)
+	}
+
+	return records, nil
+}
+
+func printAuditRecord(r auditRecord) {
+	fmt.Printf("%s  %-5s  %s\n", formatTime(r.StartedAt), strings.ToUpper(r.Outcome), r.Input)
+
+	if r.Output != "" {
+		fmt.Printf("    output:   %s\n", r.Output)
+	}
+
+	if r.LicenseID != "" {
+		fmt.Printf("    license:  %s (%s)\n", r.LicenseID, r.Provider)
+	}
+
+	if r.Rights.End != nil {
+		fmt.Printf("    loan end: %s\n", formatTime(*r.Rights.End))
+	}
+
+	if r.Error != "" {
+		fmt.Printf("    error:    %s\n", r.Error)
+	}
+}
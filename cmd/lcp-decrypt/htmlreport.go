@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/zip"
+	_ "embed"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+//go:embed htmlreport.html
+var htmlReportTemplateSource string
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"formatTime":      formatTime,
+	"formatAllowance": formatAllowance,
+	"redact":          redact,
+}).Parse(htmlReportTemplateSource))
+
+// htmlReport collects the outcome of the decryptions of a run, and renders it
+// as a self-contained HTML page.
+type htmlReport struct {
+	filename  string
+	Command   string
+	StartedAt time.Time
+	Books     []*bookReport
+}
+
+// bookReport is the part of the HTML report about a single book.
+type bookReport struct {
+	Input  string
+	Output string
+
+	Title      string
+	Authors    []string
+	Identifier string
+	Language   string
+	Publisher  string
+
+	License   *lcp.License
+	Container lcp.ContainerInfo
+	Files     []fileReport
+	Report    lcp.Report
+	Err       error
+	Skipped   bool
+}
+
+// fileReport is a row of the per file table of the HTML report.
+type fileReport struct {
+	Path     string
+	Action   lcp.FileAction
+	Err      error
+	Duration time.Duration
+	Digest   string
+}
+
+// addHTMLReportFlag registers the flag writing an HTML report of the run. The
+// returned function must be called once the flags are parsed, and returns nil
+// if no report was requested.
+func addHTMLReportFlag(flags *flag.FlagSet, command string) func() *htmlReport {
+	filename := flags.String("htmlReport", "", "write a self-contained HTML report of the run (book metadata, license, files and their checksums) to this file")
+
+	return func() *htmlReport {
+		if *filename == "" {
+			return nil
+		}
+
+		return &htmlReport{filename: *filename, Command: command, StartedAt: time.Now()}
+	}
+}
+
+// addBook adds a book to the report, and returns the options collecting the
+// details of its decryption.
+func (r *htmlReport) addBook(input, output string) (*bookReport, []lcp.DecryptOption) {
+	if r == nil {
+		return nil, nil
+	}
+
+	b := &bookReport{Input: input, Output: output}
+	r.Books = append(r.Books, b)
+
+	return b, []lcp.DecryptOption{
+		lcp.WithOnFileEnd(func(result lcp.FileResult) {
+			b.Files = append(b.Files, fileReport{
+				Path:     result.Entry.Path,
+				Action:   result.Action,
+				Err:      result.Err,
+				Duration: result.Duration,
+			})
+		}),
+	}
+}
+
+// finish records the outcome of the decryption of the book. license may be
+// nil if it could not be read, report is the one filled by Decrypt.
+func (b *bookReport) finish(license *lcp.License, report lcp.Report, err error) {
+	if b == nil {
+		return
+	}
+
+	b.License, b.Report, b.Err, b.Container = license, report, err, report.Container
+
+	for i := range b.Files {
+		b.Files[i].Digest = report.Digests[b.Files[i].Path]
+	}
+
+	sort.Slice(b.Files, func(i, j int) bool { return b.Files[i].Path < b.Files[j].Path })
+
+	b.readMetadata()
+}
+
+// skip records that the book was not decrypted again, as the output of a
+// previous run still exists.
+func (b *bookReport) skip() {
+	if b == nil {
+		return
+	}
+
+	b.Skipped = true
+	b.readMetadata()
+}
+
+// readMetadata reads the metadata of the book from its package document,
+// which is never encrypted. Books that are not EPUB publications have none.
+func (b *bookReport) readMetadata() {
+	r, err := zip.OpenReader(b.Input)
+	if err != nil {
+		return
+	}
+
+	defer r.Close()
+
+	pkg, err := epub.ReadPackage(r)
+	if err != nil {
+		return
+	}
+
+	b.Title = pkg.Title()
+	b.Identifier = pkg.Identifier()
+	b.Publisher = strings.TrimSpace(pkg.Metadata.Publisher)
+
+	if len(pkg.Metadata.Languages) > 0 {
+		b.Language = strings.TrimSpace(pkg.Metadata.Languages[0])
+	}
+
+	for _, c := range pkg.Metadata.Creators {
+		if name := strings.TrimSpace(c.Name); name != "" {
+			b.Authors = append(b.Authors, name)
+		}
+	}
+}
+
+// Failed returns the number of files that could not be processed.
+func (b *bookReport) Failed() int {
+	n := 0
+
+	for _, f := range b.Files {
+		if f.Err != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// write renders the report to its file.
+func (r *htmlReport) write() error {
+	if r == nil {
+		return nil
+	}
+
+	return writeAtomic(r.filename, func(w io.Writer) error {
+		if err := htmlReportTemplate.Execute(w, r); err != nil {
+			return fmt.Errorf("error writing HTML report: %w", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// headerFlag collects the HTTP headers passed as repeated "Name: value"
+// command line flags.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var lines []string
+
+	for name, values := range h {
+		for _, v := range values {
+			lines = append(lines, name+": "+v)
+		}
+	}
+
+	return strings.Join(lines, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", s)
+	}
+
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+
+	return nil
+}
+
+// errOffline is returned by all network operations once goOffline has been
+// called.
+var errOffline = errors.New("network access is disabled by -offline")
+
+// offlineTransport fails all requests.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%w, not fetching %s", errOffline, req.URL.Redacted())
+}
+
+var offline bool
+
+// goOffline makes all the network operations fail, including the ones using
+// the default HTTP client.
+func goOffline() {
+	offline = true
+	http.DefaultTransport = offlineTransport{}
+}
+
+// newHTTPClient returns the client used for all network operations.
+func newHTTPClient() *http.Client {
+	client := &http.Client{
+		Timeout: 2 * time.Minute,
+	}
+
+	if offline {
+		client.Transport = offlineTransport{}
+	} else if transport := newTLSTransport(); transport != nil {
+		client.Transport = transport
+	}
+
+	return client
+}
+
+// downloadHeader and cookieJar are sent along with the requests downloading
+// books and licenses (-header and -cookieJar flags).
+var (
+	downloadHeader = headerFlag{}
+	cookieJar      http.CookieJar
+)
+
+// addDownloadFlags registers the flags configuring the requests downloading
+// books and licenses. The returned function must be called once the flags are
+// parsed.
+func addDownloadFlags(flags *flag.FlagSet) func() error {
+	flags.Var(downloadHeader, "header", "HTTP header to send when downloading the book or its license, as \"Name: value\" (can be repeated)")
+	cookieJarFilename := flags.String("cookieJar", "", "cookie file in the Netscape format (as written by curl or the cookies.txt browser extensions) holding the cookies to send when downloading the book or its license")
+
+	return func() error {
+		if *cookieJarFilename == "" {
+			return nil
+		}
+
+		var err error
+		cookieJar, err = loadCookieJar(*cookieJarFilename)
+
+		return err
+	}
+}
+
+// newDownloadClient returns the client used to download the book or license
+// at url. The -header headers are only sent to the host of url, so that they
+// don't leak to the hosts the server redirects to.
+func newDownloadClient(rawURL string) *http.Client {
+	client := newHTTPClient()
+	client.Jar = cookieJar
+
+	if len(downloadHeader) == 0 {
+		return client
+	}
+
+	if u, err := url.Parse(rawURL); err == nil {
+		client.Transport = &headerTransport{host: u.Host, header: http.Header(downloadHeader), base: client.Transport}
+	}
+
+	return client
+}
+
+// headerTransport adds header to the requests sent to host.
+type headerTransport struct {
+	host   string
+	header http.Header
+	base   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if req.URL.Host != t.host {
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+
+	return base.RoundTrip(req)
+}
+
+// httpGet fetches url and returns the response body, failing on non 2xx
+// status codes.
+func httpGet(ctx context.Context, client *http.Client, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d for %s", res.StatusCode, url)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	return body, nil
+}
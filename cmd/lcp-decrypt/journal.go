@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Journal entry states.
+const (
+	journalStarted = "started"
+	journalDone    = "done"
+)
+
+// journalEntry is one line of a batch journal.
+type journalEntry struct {
+	State  string    `json:"state"`
+	Input  string    `json:"input"`
+	Output string    `json:"output"`
+	Time   time.Time `json:"time"`
+	// Size and SHA256 describe the output, once it is written.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// batchJournal records the progress of a batch, one JSON object per line, so
+// that an interrupted batch can be resumed. Every entry is flushed to disk
+// before the batch moves on.
+type batchJournal struct {
+	fd *os.File
+	// done holds the completed books of the previous runs, by input.
+	done map[string]journalEntry
+	// started holds the books a previous run started but did not complete.
+	started map[string]journalEntry
+}
+
+// addJournalFlags registers the flags of the batch journal. The returned
+// function must be called once the flags are parsed, with the path of the
+// manifest.
+func addJournalFlags(flags *flag.FlagSet) func(manifestFilename string) (*batchJournal, error) {
+	path := flags.String("journal", "", "path of the journal recording the progress of the batch (by default, the manifest path followed by .journal)")
+	resume := flags.Bool("resume", false, "resume an interrupted batch: skip the books the journal shows were completed, if their output is unchanged, and decrypt the others again")
+
+	return func(manifestFilename string) (*batchJournal, error) {
+		journalPath := *path
+		if journalPath == "" {
+			journalPath = manifestFilename + ".journal"
+		}
+
+		return openBatchJournal(journalPath, *resume)
+	}
+}
+
+// openBatchJournal opens the journal at path. Unless resume is set, the
+// entries of the previous runs are discarded.
+func openBatchJournal(path string, resume bool) (*batchJournal, error) {
+	j := &batchJournal{done: map[string]journalEntry{}, started: map[string]journalEntry{}}
+
+	if resume {
+		if err := j.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	fd, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %w", err)
+	}
+
+	j.fd = fd
+
+	return j, nil
+}
+
+func (j *batchJournal) load(path string) error {
+	fd, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("error opening journal: %w", err)
+	}
+
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for scanner.Scan() {
+		var entry journalEntry
+
+		// The last line can be truncated if the previous run crashed while
+		// writing it.
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		switch entry.State {
+		case journalStarted:
+			j.started[entry.Input] = entry
+			delete(j.done, entry.Input)
+		case journalDone:
+			j.done[entry.Input] = entry
+			delete(j.started, entry.Input)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading journal: %w", err)
+	}
+
+	return nil
+}
+
+func (j *batchJournal) Close() error {
+	return j.fd.Close()
+}
+
+func (j *batchJournal) append(entry journalEntry) error {
+	entry.Time = time.Now().UTC()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.fd.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+
+	if err := j.fd.Sync(); err != nil {
+		return fmt.Errorf("error flushing journal: %w", err)
+	}
+
+	return nil
+}
+
+// completed returns whether a previous run completed job, and its output is
+// still the one that run wrote. Books that were started but not completed
+// have the temporary files of their output removed.
+func (j *batchJournal) completed(job batchJob) bool {
+	if entry, ok := j.started[job.Input]; ok {
+		removeTempOutputs(entry.Output)
+		return false
+	}
+
+	entry, ok := j.done[job.Input]
+	if !ok || entry.Output != job.Output {
+		return false
+	}
+
+	stat, err := os.Stat(job.Output)
+	if err != nil || stat.Size() != entry.Size {
+		log.Printf("%s is missing or was modified since it was written, decrypting it again", job.Output)
+		return false
+	}
+
+	if sum, err := fileSHA256(job.Output); err != nil || sum != entry.SHA256 {
+		log.Printf("%s was modified since it was written, decrypting it again", job.Output)
+		return false
+	}
+
+	return true
+}
+
+// start records that job is being decrypted.
+func (j *batchJournal) start(job batchJob) error {
+	return j.append(journalEntry{State: journalStarted, Input: job.Input, Output: job.Output})
+}
+
+// finish records that the output of job was fully written.
+func (j *batchJournal) finish(job batchJob) error {
+	stat, err := os.Stat(job.Output)
+	if err != nil {
+		return err
+	}
+
+	sum, err := fileSHA256(job.Output)
+	if err != nil {
+		return err
+	}
+
+	return j.append(journalEntry{State: journalDone, Input: job.Input, Output: job.Output, Size: stat.Size(), SHA256: sum})
+}
+
+// removeTempOutputs removes the temporary files left by an interrupted
+// atomic write of output.
+func removeTempOutputs(output string) {
+	matches, _ := filepath.Glob(globEscape(output) + ".tmp-*")
+
+	for _, m := range matches {
+		if err := os.Remove(m); err == nil {
+			log.Printf("Removed %s, left by an interrupted run", m)
+		}
+	}
+}
+
+// globEscape escapes the special characters of filepath.Match in s.
+func globEscape(s string) string {
+	var escaped []rune
+
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[':
+			escaped = append(escaped, '[', r, ']')
+		case '\\':
+			if filepath.Separator != '\\' {
+				escaped = append(escaped, '\\')
+			}
+
+			escaped = append(escaped, r)
+		default:
+			escaped = append(escaped, r)
+		}
+	}
+
+	return string(escaped)
+}
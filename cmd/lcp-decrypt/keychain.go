@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/abustany/lcp-decrypt/pkg/keyring"
+)
+
+// keychainService is the service the keys are stored under in the keychain.
+const keychainService = "lcp-decrypt"
+
+// useKeychain is true when the keys saved in the key database are stored in
+// the keychain of the system rather than in the database file (-useKeychain
+// flag).
+var useKeychain bool
+
+func addUseKeychainFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&useKeychain, "useKeychain", false, "store the saved keys in the keychain of the system (macOS Keychain, Windows Credential Manager, or Secret Service through secret-tool) rather than in plain text in the key database, which then only references them")
+}
+
+// resolve returns the entry with its credential, read from the keychain if
+// it is stored there.
+func (e keyDBEntry) resolve() (keyDBEntry, error) {
+	if e.Keychain == "" {
+		return e, nil
+	}
+
+	backend, err := keyring.Default()
+	if err != nil {
+		return keyDBEntry{}, err
+	}
+
+	secret, err := backend.Get(keychainService, e.Keychain)
+	if err != nil {
+		return keyDBEntry{}, fmt.Errorf("error reading the key stored for %s from the %s: %w", e, backend.Name(), err)
+	}
+
+	if err := json.Unmarshal([]byte(secret), &e.credential); err != nil {
+		return keyDBEntry{}, fmt.Errorf("error decoding the key stored for %s: %w", e, err)
+	}
+
+	return e, nil
+}
+
+// toKeychain moves the credential of the entry to the keychain, under a new
+// random account name.
+func (e keyDBEntry) toKeychain() (keyDBEntry, error) {
+	backend, err := keyring.Default()
+	if err != nil {
+		return keyDBEntry{}, err
+	}
+
+	secret, err := json.Marshal(e.credential)
+	if err != nil {
+		return keyDBEntry{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return keyDBEntry{}, err
+	}
+
+	e.Keychain = hex.EncodeToString(id)
+
+	if err := backend.Set(keychainService, e.Keychain, string(secret)); err != nil {
+		return keyDBEntry{}, fmt.Errorf("error storing the key in the %s: %w", backend.Name(), err)
+	}
+
+	e.credential = credential{}
+
+	return e, nil
+}
+
+// deleteFromKeychain removes the credential of the entry from the keychain,
+// if it is stored there.
+func (e keyDBEntry) deleteFromKeychain() error {
+	if e.Keychain == "" {
+		return nil
+	}
+
+	backend, err := keyring.Default()
+	if err != nil {
+		return err
+	}
+
+	if err := backend.Delete(keychainService, e.Keychain); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("error removing the key stored for %s from the %s: %w", e, backend.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// keyCommandRequest is the document passed on the standard input of the
+// -keyCommand program.
+type keyCommandRequest struct {
+	// File is the path of the book being decrypted.
+	File    string       `json:"file"`
+	License *lcp.License `json:"license"`
+}
+
+// runKeyCommand runs the external program command to get the credential for
+// the book stored in filename. The program receives a keyCommandRequest as
+// JSON on its standard input, and prints the hex encoded user key or the
+// passphrase on the first line of its standard output. Its standard error is
+// passed through, so that it can interact with the user.
+//
+// When the book embeds several licenses, the program is called for each of
+// them until it returns a matching credential.
+func runKeyCommand(ctx context.Context, command, filename string, licenses []*lcp.License) (credential, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return credential{}, errors.New("empty key command")
+	}
+
+	for _, license := range licenses {
+		request, err := json.Marshal(keyCommandRequest{File: filename, License: license})
+		if err != nil {
+			return credential{}, fmt.Errorf("error encoding key command request: %w", err)
+		}
+
+		var stdout bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(request)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return credential{}, fmt.Errorf("error running key command: %w", err)
+		}
+
+		line, _, _ := strings.Cut(stdout.String(), "\n")
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			log.Printf("The key command returned no key for license %s", redact(license.ID))
+			continue
+		}
+
+		cred := parseCredential(line)
+
+		if err := checkCredential(license, cred); err != nil {
+			log.Printf("The key returned by the key command does not match license %s", redact(license.ID))
+			continue
+		}
+
+		return cred, nil
+	}
+
+	return credential{}, errors.New("the key command did not return any key matching the license")
+}
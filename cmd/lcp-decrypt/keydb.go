@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// credential is what unlocks the licenses of a provider: either a hex encoded
+// user key, or a passphrase.
+type credential struct {
+	UserKey    string `json:"userKey,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// parseCredential interprets a string typed by the user as a user key if it
+// looks like one, as a passphrase otherwise.
+func parseCredential(s string) credential {
+	if isUserKey(s) {
+		return credential{UserKey: s}
+	}
+
+	return credential{Passphrase: s}
+}
+
+// decryptArgs returns the userKeyHex argument and the options to pass to
+// lcp.Decrypt.
+func (c credential) decryptArgs() (string, []lcp.DecryptOption) {
+	if c.Passphrase != "" {
+		return "", append([]lcp.DecryptOption{lcp.WithPassphrase(c.Passphrase)}, passphraseOptions()...)
+	}
+
+	return c.UserKey, nil
+}
+
+// licenseUserKey returns the user key derived from the credential, and an
+// error if it does not unlock license.
+func (c credential) licenseUserKey(license *lcp.License) ([]byte, error) {
+	if c.Passphrase != "" {
+		userKey, _, err := license.PassphraseUserKey(c.Passphrase, passphraseOptions()...)
+		return userKey, err
+	}
+
+	userKey, err := hex.DecodeString(c.UserKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding user key: %w", err)
+	}
+
+	return userKey, license.CheckUserKey(userKey)
+}
+
+// keyDBEntry is a stored credential. Provider is the provider of the licenses
+// it unlocks, empty if it is tried for all the providers, and Label tells the
+// keys of a provider apart (library card, account...). Keychain is the
+// account name of the credential in the keychain of the system, if it is
+// stored there rather than in the database.
+type keyDBEntry struct {
+	Provider string `json:"provider"`
+	Label    string `json:"label,omitempty"`
+	Keychain string `json:"keychain,omitempty"`
+	credential
+}
+
+func (e keyDBEntry) String() string {
+	s := "any provider"
+	if e.Provider != "" {
+		s = "provider " + e.Provider
+	}
+
+	if e.Label != "" {
+		s += " (" + e.Label + ")"
+	}
+
+	return s
+}
+
+// keyDB stores the credentials of the user, several of them possibly for the
+// same provider (the provider URL found in the licenses).
+type keyDB struct {
+	Keys []keyDBEntry `json:"keys"`
+}
+
+// defaultKeyDBPath returns the path of keys.json in the configuration
+// directory of the user, or of its encrypted version if there is one.
+func defaultKeyDBPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	path := filepath.Join(configDir, "lcp-decrypt", "keys.json")
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		for _, ext := range []string{".gpg", ".age"} {
+			if _, err := os.Stat(path + ext); err == nil {
+				return path + ext
+			}
+		}
+	}
+
+	return path
+}
+
+// loadKeyDB reads the key database at path. A missing file yields an empty
+// database.
+func loadKeyDB(path string) (*keyDB, error) {
+	var db keyDB
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &db, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if keyDBCipher(path) != "" {
+		if data, err = decryptKeyDB(path); err != nil {
+			return nil, fmt.Errorf("error decrypting key database %s: %w", path, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, fmt.Errorf("error decoding key database %s: %w", path, err)
+	}
+
+	return &db, nil
+}
+
+func (db *keyDB) save(path string) error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if keyDBCipher(path) != "" {
+		if data, err = encryptKeyDB(path, data); err != nil {
+			return fmt.Errorf("error encrypting key database %s: %w", path, err)
+		}
+	}
+
+	// Keys are secrets, keep them private
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	out, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+
+	defer out.Abort()
+
+	out.perm = 0o600
+
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+
+	return out.Commit()
+}
+
+// lookup returns the stored key unlocking license, trying the keys of its
+// provider first, then the others.
+func (db *keyDB) lookup(license *lcp.License) (keyDBEntry, bool) {
+	for _, ofProvider := range []bool{true, false} {
+		for _, e := range db.Keys {
+			if (e.Provider == license.Provider) != ofProvider {
+				continue
+			}
+
+			e, err := e.resolve()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			if checkCredential(license, e.credential) == nil {
+				return e, true
+			}
+		}
+	}
+
+	return keyDBEntry{}, false
+}
+
+// add stores a key, in the keychain with -useKeychain. It replaces the key of
+// the provider with the same label, or the same key already stored for the
+// provider.
+func (db *keyDB) add(e keyDBEntry) error {
+	i := slices.IndexFunc(db.Keys, func(other keyDBEntry) bool {
+		if other.Provider != e.Provider {
+			return false
+		}
+
+		if e.Label != "" && other.Label == e.Label {
+			return true
+		}
+
+		other, err := other.resolve()
+
+		return err == nil && other.credential == e.credential
+	})
+
+	if useKeychain {
+		var err error
+		if e, err = e.toKeychain(); err != nil {
+			return err
+		}
+	}
+
+	if i < 0 {
+		db.Keys = append(db.Keys, e)
+		return nil
+	}
+
+	replaced := db.Keys[i]
+	db.Keys[i] = e
+
+	return replaced.deleteFromKeychain()
+}
+
+// remove removes the keys of provider labeled label, an empty string
+// matching all the providers or labels, along with their keychain items. It
+// returns the number of keys removed.
+func (db *keyDB) remove(provider, label string) (int, error) {
+	matches := func(e keyDBEntry) bool {
+		return (provider == "" || e.Provider == provider) && (label == "" || e.Label == label)
+	}
+
+	for _, e := range db.Keys {
+		if matches(e) {
+			if err := e.deleteFromKeychain(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n := len(db.Keys)
+	db.Keys = slices.DeleteFunc(db.Keys, matches)
+
+	return n - len(db.Keys), nil
+}
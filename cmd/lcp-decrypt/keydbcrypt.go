@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Key databases whose name ends with .gpg or .age are encrypted, for the
+// systems without a keychain: they are decrypted with gpg or age when loaded,
+// and encrypted again when saved, so that the keys are never written in clear
+// on the disk.
+const (
+	// keyDBRecipientsEnv is the environment variable holding the comma
+	// separated recipients the key database is encrypted to. Without it, gpg
+	// encrypts to the default key of the user and age asks for a passphrase.
+	keyDBRecipientsEnv = "LCP_DECRYPT_KEYDB_RECIPIENTS"
+	// keyDBIdentityEnv is the environment variable holding the path of the age
+	// identity file decrypting the key database. Without it, age asks for the
+	// passphrase.
+	keyDBIdentityEnv = "LCP_DECRYPT_AGE_IDENTITY"
+)
+
+// keyDBCipher returns the program encrypting the key database at path, an
+// empty string if it is not encrypted.
+func keyDBCipher(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpg":
+		return "gpg"
+	case ".age":
+		return "age"
+	default:
+		return ""
+	}
+}
+
+// decryptKeyDB returns the contents of the encrypted key database at path.
+// The programs prompt for the passphrase on the terminal if needed.
+func decryptKeyDB(path string) ([]byte, error) {
+	var args []string
+
+	switch keyDBCipher(path) {
+	case "gpg":
+		args = []string{"gpg", "--quiet", "--decrypt", path}
+	case "age":
+		args = []string{"age", "--decrypt"}
+
+		if identity := os.Getenv(keyDBIdentityEnv); identity != "" {
+			args = append(args, "--identity", identity)
+		}
+
+		args = append(args, path)
+	}
+
+	return runKeyDBCipher(args, nil)
+}
+
+// encryptKeyDB returns data encrypted for the key database at path.
+func encryptKeyDB(path string, data []byte) ([]byte, error) {
+	recipients := splitList(os.Getenv(keyDBRecipientsEnv))
+
+	var args []string
+
+	switch keyDBCipher(path) {
+	case "gpg":
+		args = []string{"gpg", "--quiet", "--encrypt"}
+
+		if len(recipients) == 0 {
+			args = append(args, "--default-recipient-self")
+		}
+
+		for _, r := range recipients {
+			args = append(args, "--recipient", r)
+		}
+	case "age":
+		args = []string{"age", "--encrypt"}
+
+		if len(recipients) == 0 {
+			args = append(args, "--passphrase")
+		}
+
+		for _, r := range recipients {
+			args = append(args, "--recipient", r)
+		}
+	}
+
+	return runKeyDBCipher(args, data)
+}
+
+// runKeyDBCipher runs the gpg or age command line args, with stdin on its
+// standard input, and returns its output. Its standard error is passed
+// through, so that it can interact with the user.
+func runKeyDBCipher(args []string, stdin []byte) ([]byte, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error running %s: %w", args[0], err)
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+	"github.com/abustany/lcp-decrypt/pkg/stores"
+)
+
+// readKeyJSON reads the store response passed in -keyJSON, from the standard
+// input if filename is "-".
+func readKeyJSON(filename string) ([]byte, error) {
+	if filename == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key JSON from the standard input: %w", err)
+		}
+
+		return data, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key JSON: %w", err)
+	}
+
+	return data, nil
+}
+
+// keyFromJSON extracts the key of the book from data, the response of a store
+// API. The responses shipping the content key of the book (as the ones of
+// fetch-json) give the content key, the others the user key matching one of
+// the licenses of the book.
+func keyFromJSON(data []byte, bookLicenses func() ([]*lcp.License, error)) (userKey string, contentKey []byte, err error) {
+	if _, fulfillment, err := stores.DetectFulfillment(data); err == nil && fulfillment.ContentKey != nil {
+		return "", fulfillment.ContentKey, nil
+	}
+
+	licenses, err := bookLicenses()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var keys []string
+
+	if adapter, ok := stores.ForProvider(licenses[0].Provider); ok && adapter.ParseUserKeys != nil {
+		keys, err = adapter.ParseUserKeys(data)
+	} else {
+		keys, err = stores.FindUserKeys(data)
+	}
+
+	if err != nil {
+		return "", nil, fmt.Errorf("error extracting user key from key JSON: %w", err)
+	}
+
+	if userKey, err = matchingUserKey(keys, licenses, "-keyJSON"); err != nil {
+		return "", nil, err
+	}
+
+	return userKey, nil, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func runKeys(args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s keys list [-keyDB FILE]
+       %[1]s keys add [-keyDB FILE] [-useKeychain] [-provider URL | -book book.epub] [-label LABEL] (-userKey KEY | -passphrase PASSPHRASE)
+       %[1]s keys remove [-keyDB FILE] [-label LABEL] [PROVIDER_URL]
+
+Manages the stored keys. When decrypting a book without passing -userKey,
+each stored key is checked against its license, starting with the keys of the
+provider of the license, and the first one matching is used. Several keys can
+be stored for a provider (one per library card or account), told apart by
+their label, and keys added without a provider are tried for all the books.
+
+With -useKeychain, the key is stored in the keychain of the system rather
+than in plain text in the key database.
+
+Key databases named *.gpg or *.age are encrypted with gpg or age, to the
+recipients listed in $%[2]s
+(comma separated), and decrypted with the identity file in
+$%[3]s for age (see the README).
+
+Options:
+`, os.Args[0], keyDBRecipientsEnv, keyDBIdentityEnv)
+		flags.PrintDefaults()
+	}
+
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the key database")
+	provider := flags.String("provider", "", "provider URL, as found in the licenses (add; by default, the key is tried for all the providers)")
+	book := flags.String("book", "", "book or license file to read the provider URL from (add)")
+	userKey := flags.String("userKey", "", "hex encoded LCP user key (add)")
+	passphrase := flags.String("passphrase", "", "LCP passphrase (add)")
+	addUseKeychainFlag(flags)
+	label := flags.String("label", "", "label telling the keys of a provider apart, for example the name of the account (add, remove)")
+
+	// The flags before the command are parsed too, so that "keys -h" prints
+	// the usage and exits successfully like the other commands
+	_ = flags.Parse(args) // exits on error
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no keys command specified")
+	}
+
+	command := flags.Arg(0)
+
+	_ = flags.Parse(flags.Args()[1:]) // exits on error
+
+	if *keyDBPath == "" {
+		return fmt.Errorf("no key database path specified")
+	}
+
+	db, err := loadKeyDB(*keyDBPath)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "list":
+		for _, e := range db.Keys {
+			kind := "user key"
+			if e.Keychain != "" {
+				kind = "in keychain"
+			} else if e.Passphrase != "" {
+				kind = "passphrase"
+			}
+
+			fmt.Printf("%s: %s\n", e, kind)
+		}
+
+		return nil
+	case "add":
+		if *book != "" {
+			license, err := loadLicense(*book)
+			if err != nil {
+				return err
+			}
+
+			*provider = license.Provider
+		}
+
+		if (*userKey == "") == (*passphrase == "") {
+			return fmt.Errorf("exactly one of -userKey or -passphrase is required")
+		}
+
+		if *userKey != "" && !isUserKey(*userKey) {
+			return fmt.Errorf("invalid user key, it should be 64 hexadecimal characters")
+		}
+
+		if err := db.add(keyDBEntry{Provider: *provider, Label: *label, credential: credential{UserKey: *userKey, Passphrase: *passphrase}}); err != nil {
+			return err
+		}
+
+		return db.save(*keyDBPath)
+	case "remove":
+		if flags.Arg(0) == "" && *label == "" {
+			return fmt.Errorf("no provider or label specified")
+		}
+
+		n, err := db.remove(flags.Arg(0), *label)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return fmt.Errorf("no key stored for %s", keyDBEntry{Provider: flags.Arg(0), Label: *label})
+		}
+
+		return db.save(*keyDBPath)
+	default:
+		flags.Usage()
+		return fmt.Errorf("invalid keys command %q", command)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+	"github.com/abustany/lcp-decrypt/pkg/stores"
+)
+
+// fetchUserKey retrieves the user key from a store endpoint, by default
+// returning a JSON document like
+//
+//	[{"user_key": "0123..."}]
+//
+// Stores with a different format are handled by their adapter. If the store
+// returns several keys, the one matching license is returned.
+func fetchUserKey(ctx context.Context, url string, header http.Header, license *lcp.License) (string, error) {
+	body, err := httpGet(ctx, newHTTPClient(), url, header)
+	if err != nil {
+		return "", fmt.Errorf("error fetching user key: %w", err)
+	}
+
+	adapter, ok := stores.ForProvider(license.Provider)
+	if !ok {
+		adapter = &stores.Adapter{}
+	}
+
+	keys, err := adapter.UserKeys(body)
+	if err != nil {
+		return "", fmt.Errorf("error extracting user key from response: %w", err)
+	}
+
+	return matchingUserKey(keys, []*lcp.License{license}, "the key endpoint")
+}
+
+// matchingUserKey returns the key of keys matching one of licenses, keys
+// being the user keys returned by source. A single key is returned as is, to
+// report the mismatch when decrypting.
+func matchingUserKey(keys []string, licenses []*lcp.License, source string) (string, error) {
+	if len(keys) == 1 {
+		return keys[0], nil
+	}
+
+	log.Printf("Found %d keys in the response of %s, looking for the one matching the license", len(keys), source)
+
+	for _, k := range keys {
+		userKey, err := hex.DecodeString(k)
+		if err == nil && slices.ContainsFunc(licenses, func(l *lcp.License) bool { return l.CheckUserKey(userKey) == nil }) {
+			return k, nil
+		}
+	}
+
+	return "", fmt.Errorf("none of the %d keys returned by %s matches the license", len(keys), source)
+}
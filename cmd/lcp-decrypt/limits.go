@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// limits are the limits set with -maxEntries, -maxEntrySize, -maxTotalSize
+// and -maxCompressionRatio.
+var limits lcp.Limits
+
+// addLimitsFlags registers the flags protecting the host from zip bombs,
+// defaults being the limits applying when they are not set.
+func addLimitsFlags(flags *flag.FlagSet, defaults lcp.Limits) {
+	limits = defaults
+
+	flags.IntVar(&limits.MaxEntries, "maxEntries", defaults.MaxEntries, "maximum number of files in a book (0 for no limit)")
+	flags.Var((*sizeFlag)(&limits.MaxEntrySize), "maxEntrySize", "maximum size of a file of a book once decrypted and decompressed, for example 500M (0 for no limit)")
+	flags.Var((*sizeFlag)(&limits.MaxTotalSize), "maxTotalSize", "maximum size of a book once decrypted and decompressed, for example 2G (0 for no limit)")
+	flags.Int64Var(&limits.MaxCompressionRatio, "maxCompressionRatio", defaults.MaxCompressionRatio, "maximum compression ratio of the files of a book, for the ones larger than 1M (0 for no limit)")
+}
+
+// limitsOptions returns the decryption options applying the limits.
+func limitsOptions() []lcp.DecryptOption {
+	if limits == (lcp.Limits{}) {
+		return nil
+	}
+
+	return []lcp.DecryptOption{lcp.WithLimits(limits)}
+}
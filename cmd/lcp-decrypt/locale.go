@@ -0,0 +1,19 @@
+package main
+
+import "github.com/abustany/lcp-decrypt/pkg/lcp"
+
+// errorMessage returns the message printed for err: the error itself, in
+// English, preceded by its translation when the user has another language.
+func errorMessage(err error) string {
+	locale := lcp.UserLocale()
+
+	if lcp.MatchLanguage(locale) == "en" {
+		return err.Error()
+	}
+
+	if msg := lcp.Localize(err, locale); msg != err.Error() {
+		return msg + "\n(" + err.Error() + ")"
+	}
+
+	return err.Error()
+}
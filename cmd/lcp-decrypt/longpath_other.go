@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+// externalPath returns the form of path to pass to other programs, which only
+// differs on Windows.
+func externalPath(path string) string {
+	return path
+}
+
+// pathErrorHint returns a hint for the errors caused by paths the system
+// can't handle, which only happen on Windows.
+func pathErrorHint(err error) string {
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxPath is the length from which Windows programs that are not aware of
+// long paths fail to open files (MAX_PATH, minus the room some APIs keep for
+// a file name).
+const maxPath = 248
+
+// errorFilenameExcedRange is ERROR_FILENAME_EXCED_RANGE, returned when a
+// component of a path is longer than the file system allows.
+const errorFilenameExcedRange = syscall.Errno(206)
+
+// externalPath returns the form of path to pass to other programs. The os
+// package takes care of long paths, but other programs get them as is: long
+// paths are converted to their extended-length form (\\?\C:\... or
+// \\?\UNC\server\share\...), which they can open even when long paths are
+// not enabled on the system.
+func externalPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil || len(abs) < maxPath {
+		return path
+	}
+
+	// Extended-length paths are not normalized by Windows, filepath.Abs
+	// already cleaned them.
+	if unc, ok := strings.CutPrefix(abs, `\\`); ok {
+		return `\\?\UNC\` + unc
+	}
+
+	return `\\?\` + abs
+}
+
+// pathErrorHint returns a hint for the errors caused by paths Windows can't
+// handle, or an empty string.
+func pathErrorHint(err error) string {
+	if errors.Is(err, errorFilenameExcedRange) {
+		return "a file or directory name is longer than the 255 characters Windows allows, try a shorter output file name"
+	}
+
+	return ""
+}
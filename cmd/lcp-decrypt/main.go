@@ -1,23 +1,68 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/abustany/lcp-decrypt/pkg/lcp"
 )
 
 func main() {
 	if err := run(); err != nil {
-		log.Fatalf("error: %s", err)
+		msg := errorMessage(err)
+		if hint := pathErrorHint(err); hint != "" {
+			msg += "\n" + hint
+		}
+
+		log.Fatalf("error: %s", msg)
 	}
 }
 
+// commands maps the subcommand names to their implementation. Running the
+// program without a subcommand decrypts a file.
+var commands = map[string]func(args []string) error{
+	"batch":        runBatch,
+	"compare":      runCompare,
+	"daemon":       runDaemon,
+	"doctor":       runDoctor,
+	"fetch-json":   runFetchJSON,
+	"history":      runHistory,
+	"keys":         runKeys,
+	"privacy-scan": runPrivacyScan,
+	"read":         runRead,
+	"rights":       runRights,
+	"selftest":     runSelfTest,
+	"serve":        runServe,
+}
+
 func run() error {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			return command(os.Args[2:])
+		}
+	}
+
+	return runDecrypt()
+}
+
+func runDecrypt() error {
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s -userKey USER_KEY_HEX in.epub out.epub
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %[1]s -userKey USER_KEY_HEX in.epub out.epub
+
+The input can also be the HTTP(S) URL of the book, which is then downloaded
+first. Interrupted downloads are resumed by the next run.
 
 Decrypts the files of an EPUB book protected with Readium LCP (CARE) DRM. This
 program requires the "user key" to operate, in other words it does not "crack"
@@ -32,15 +77,173 @@ and the response should look like
 
 [{"user_key": "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}]
 
-The 0123... string is the value you should pass in -userKey.
+The 0123... string is the value you should pass in -userKey. Alternatively,
+pass the URL of the request in -keyURL (and any required authentication
+headers in -keyHeader) to have the key fetched automatically.
+
+If you know the passphrase of the book instead (the one your reading
+application asks for), pass it in -passphrase: the user key is derived from
+it, as long as the license uses the basic encryption profile.
+
+Without any key flag, the user key or passphrase is read from the
+LCP_USER_KEY or LCP_PASSPHRASE environment variable if one is set, which keeps
+it out of the command line of scripts and containers.
+
+To retrieve keys in some other way, pass a program in -keyCommand. It gets
+{"file": "in.epub", "license": {...}} as JSON on its standard input, and must
+print the user key or the passphrase on its standard output.
+
+If your store API gives you the content key of the book rather than a user
+key, pass it in -contentKey instead: the license is then not needed at all.
+
+To avoid copying keys out of the responses of store APIs, save the response
+to a file and pass it in -keyJSON (or pass -keyJSON - and pipe it to the
+standard input): the user key or content key is extracted from it.
+
+Other commands:
+
+  %[1]s batch manifest.csv
+      Decrypts all the books listed in a manifest file, each with its own
+      key or passphrase. Run "%[1]s batch -h" for details.
+
+  %[1]s compare decrypted.epub reference.epub
+      Lists the entries that differ between two books, for example to check
+      a decrypted book against a known-good copy.
+
+  %[1]s daemon -inbox DIR -outbox DIR
+      Runs until interrupted, decrypting the books dropped in a directory
+      with the keys stored for their provider. Run "%[1]s daemon -h" for
+      details.
+
+  %[1]s doctor [-userKey KEY] book.epub
+      Checks a book for the problems that prevent decrypting it, and prints
+      what was found. Run it before reporting a bug.
+
+  %[1]s fetch-json response.json -o book.epub
+      Downloads and decrypts a book from a store response, like an LCP
+      license linking to the book, or a signed_link to the protected file
+      along with its content key for providers that don't ship LCP licenses.
+      Run "%[1]s fetch-json -h" for the list of supported stores.
+
+  %[1]s history [book.epub]
+      Lists the books decrypted with -audit, and when. Run "%[1]s history
+      -h" for details.
+
+  %[1]s keys (list|add|remove)
+      Manages the keys stored for each provider, used when no -userKey is
+      passed. Run "%[1]s keys -h" for details.
+
+  %[1]s privacy-scan [-license book.lcpl] decrypted.epub
+      Lists the personal data a decrypted book still carries (user details
+      of its license, watermarks...). Run "%[1]s privacy-scan -h" for
+      details.
+
+  %[1]s read book.epub
+      Serves a book for reading in your web browser, decrypting its
+      resources on the fly instead of writing a decrypted copy. Run "%[1]s
+      read -h" for details.
+
+  %[1]s rights [-json] book.epub
+      Prints the rights granted by the license of a book (loan period,
+      print and copy allowances...)
+
+  %[1]s selftest
+      Checks that decryption gives the expected results on this machine.
+
+  %[1]s serve [-listen ADDR]
+      Serves an HTTP API decrypting the books posted to it, for web
+      frontends. Run "%[1]s serve -h" for details.
+
+Options:
 `, os.Args[0])
 		flag.PrintDefaults()
 	}
 
-	userKeyHex := flag.String("userKey", "", "hex encoded LCP user key")
+	userKeyHex := flag.String("userKey", "", "hex encoded LCP user key (if not set, use $"+userKeyEnv+" or $"+passphraseEnv+", or else the key stored for the book's provider, or prompt for it)")
+	passphrase := flag.String("passphrase", "", "LCP passphrase of the book, from which the user key is derived (basic encryption profile), instead of -userKey")
+	keyDBPath := flag.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	addUseKeychainFlag(flag.CommandLine)
+	keyURL := flag.String("keyURL", "", "URL of a store endpoint returning the user key as JSON ({\"user_key\": \"...\"})")
+	keyJSON := flag.String("keyJSON", "", "JSON response of a store API holding the user key or content key of the book (as [{\"user_key\": \"...\"}] or {\"result\": {\"key\": \"...\"}}), - to read it from the standard input")
+	keyCommand := flag.String("keyCommand", "", "program printing the user key or passphrase of the book, called with the license as JSON on its standard input (arguments are separated by spaces)")
+	keyHeader := headerFlag{}
+	flag.Var(keyHeader, "keyHeader", "HTTP header to send with the -keyURL request, as \"Name: value\" (can be repeated)")
+	contentKeyHex := flag.String("contentKey", "", "hex encoded content key of the book, for keys obtained from a store API rather than a license (the license is then ignored)")
+	licenseURL := flag.String("licenseURL", "", "URL of the license of the book, for stores serving it from a link rather than embedding it in the book")
+	licenseID := flag.String("licenseId", "", "ID of the license to use, for books embedding several licenses (by default, the first license matching the key is used)")
+	allowedProviders := flag.String("allowedProviders", "", "comma separated list of the providers whose licenses can be processed (by default, all providers are allowed)")
+	duplicates := flag.String("duplicates", lcp.DuplicateLastWins.String(), "what to do with duplicate entries in the input file: last (keep the last one), first (keep the first one) or error")
+	scanUnlisted := flag.Bool("scanUnlisted", false, "warn about files that look encrypted but are not listed in encryption.xml")
+	concurrency := flag.Int("concurrency", 1, "number of files to decrypt in parallel")
+	digestsFilename := flag.String("digests", "", "write the SHA-256 digests of the decrypted resources to this file, in the format of sha256sum")
+	preview := flag.Int("preview", 0, "only decrypt the first N chapters (documents of the reading order) of EPUB books, to quickly check the key and the rendering of a large book")
+	stats := flag.Bool("stats", false, "print the time spent in each phase of the decryption (license, key, and the reading, decryption, decompression, compression and writing of the files), the throughput and the peak memory use to the standard error")
+	keepGoing := flag.Bool("keepGoing", false, "skip the files that fail to decrypt instead of aborting, and report all the errors at the end")
+	calibre := &calibreFlag{}
+	flag.Var(calibre, "addToCalibre", "import the decrypted book in calibre using calibredb; pass -addToCalibre=PATH to use the library at PATH instead of the default one")
+	calibreLayout := flag.Bool("calibreLayout", false, "treat the output path as a calibre library folder, and write the book to Author/Title (id)/ in it along with a metadata.opf file and the cover, without running calibredb")
+	cacheDir := flag.String("cacheDir", defaultCacheDir(), "directory where the documents fetched for licenses (hints...) are cached, empty to disable caching")
+	offlineMode := flag.Bool("offline", false, "never access the network: hint pages are not fetched, and -keyURL fails")
+	loadDownloadFlags := addDownloadFlags(flag.CommandLine)
+	loadTLSFlags := addTLSFlags(flag.CommandLine)
+	openAudit := addAuditFlags(flag.CommandLine)
+	newHTMLReport := addHTMLReportFlag(flag.CommandLine, "decrypt")
+	openEvents := addEventsFlag(flag.CommandLine)
+	newLicenseValidator := addVerifyLicenseFlags(flag.CommandLine)
+	addRedactPIIFlag(flag.CommandLine)
+	addPassphraseVariantsFlag(flag.CommandLine)
+	addProfileSecretsFlag(flag.CommandLine)
+	addMaxMemoryFlag(flag.CommandLine)
+	addLimitsFlags(flag.CommandLine, lcp.Limits{})
+	addTransformsFlag(flag.CommandLine)
+	addOutputPasswordFlag(flag.CommandLine)
+	formatName := flag.String("format", string(formatEPUB), "format of the output file: epub, kepub for Kobo e-readers (renamed to .kepub.epub), webpub for a packaged Readium Web Publication (renamed to .webpub), or webpub-dir for a directory holding the Web Publication manifest and resources; for audiobooks, m4b for a single file with chapters (requires ffmpeg) or audio-dir for a directory holding a file per chapter")
 
 	flag.Parse()
 
+	if *offlineMode {
+		goOffline()
+	}
+
+	if err := loadDownloadFlags(); err != nil {
+		return err
+	}
+
+	if err := loadTLSFlags(); err != nil {
+		return err
+	}
+
+	events, err := openEvents()
+	if err != nil {
+		return err
+	}
+
+	validator, err := newLicenseValidator()
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAudit()
+	if err != nil {
+		return err
+	}
+
+	defer audit.Close()
+
+	if *cacheDir != "" {
+		cache = &httpCache{dir: *cacheDir}
+	}
+
+	duplicatePolicy, err := lcp.ParseDuplicatePolicy(*duplicates)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
 	inFilename := flag.Arg(0)
 	if inFilename == "" {
 		return fmt.Errorf("no input file specified")
@@ -51,6 +254,299 @@ The 0123... string is the value you should pass in -userKey.
 		return fmt.Errorf("no output file specified")
 	}
 
+	// Stop on Ctrl-C/SIGTERM, so that we get a chance to remove the temporary
+	// output file.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var downloadedFilename string
+
+	if isURL(inFilename) {
+		if downloadedFilename, err = downloadInput(ctx, inFilename); err != nil {
+			return err
+		}
+
+		inFilename = downloadedFilename
+	}
+
+	var externalLicense []byte
+
+	if *licenseURL != "" {
+		if *contentKeyHex != "" {
+			return fmt.Errorf("-contentKey and -licenseURL cannot be used together")
+		}
+
+		if externalLicense, err = fetchLicense(ctx, *licenseURL); err != nil {
+			return err
+		}
+	}
+
+	bookLicenses := func() ([]*lcp.License, error) {
+		if externalLicense != nil {
+			license, err := lcp.ParseLicense(bytes.NewReader(externalLicense))
+			if err != nil {
+				return nil, fmt.Errorf("error reading license: %w", err)
+			}
+
+			return []*lcp.License{license}, nil
+		}
+
+		return loadLicenses(inFilename)
+	}
+
+	if validator != nil {
+		if *contentKeyHex != "" {
+			return fmt.Errorf("-verifyLicense requires a license, it cannot be used along with -contentKey")
+		}
+
+		licenses, err := bookLicenses()
+		if err != nil {
+			return err
+		}
+
+		for _, l := range licenses {
+			if *licenseID != "" && l.ID != *licenseID {
+				continue
+			}
+
+			if err := validator.verify(ctx, l); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *userKeyHex != "" && *passphrase != "" {
+		return fmt.Errorf("-userKey and -passphrase cannot be used together")
+	}
+
+	cred := credential{UserKey: *userKeyHex, Passphrase: *passphrase}
+
+	// The key flags take precedence over the environment
+	if cred == (credential{}) && *contentKeyHex == "" && *keyJSON == "" && *keyURL == "" && *keyCommand == "" {
+		if cred, err = envCredential(); err != nil {
+			return err
+		}
+	}
+
+	var contentKey []byte
+
+	switch {
+	case *contentKeyHex != "":
+		if cred != (credential{}) || *keyJSON != "" {
+			return fmt.Errorf("-contentKey cannot be used with -userKey, -passphrase or -keyJSON")
+		}
+
+		if contentKey, err = hex.DecodeString(*contentKeyHex); err != nil {
+			return fmt.Errorf("error decoding content key: %w", err)
+		}
+	case cred != (credential{}):
+		if *keyJSON != "" {
+			return fmt.Errorf("-keyJSON cannot be used with -userKey or -passphrase")
+		}
+	case *keyJSON != "":
+		data, err := readKeyJSON(*keyJSON)
+		if err != nil {
+			return err
+		}
+
+		if cred.UserKey, contentKey, err = keyFromJSON(data, bookLicenses); err != nil {
+			return err
+		}
+	case *keyURL != "":
+		licenses, err := bookLicenses()
+		if err != nil {
+			return err
+		}
+
+		if cred.UserKey, err = fetchUserKey(ctx, *keyURL, http.Header(keyHeader), licenses[0]); err != nil {
+			return err
+		}
+	case *keyCommand != "":
+		licenses, err := bookLicenses()
+		if err != nil {
+			return err
+		}
+
+		if *licenseID != "" {
+			licenses = slices.DeleteFunc(licenses, func(l *lcp.License) bool { return l.ID != *licenseID })
+
+			if len(licenses) == 0 {
+				return fmt.Errorf("no license with ID %s", redact(*licenseID))
+			}
+		}
+
+		if cred, err = runKeyCommand(ctx, *keyCommand, inFilename, licenses); err != nil {
+			return err
+		}
+	default:
+		licenses, err := bookLicenses()
+		if err != nil {
+			return err
+		}
+
+		if cred, err = findCredential(ctx, licenses, *keyDBPath, *licenseID); err != nil {
+			return err
+		}
+	}
+
+	userKey, credOpts := cred.decryptArgs()
+
+	decryptOpts := []lcp.DecryptOption{
+		lcp.WithLogger(func(msg string) { log.Println(msg) }),
+		lcp.WithDuplicatePolicy(duplicatePolicy),
+	}
+	decryptOpts = append(decryptOpts, credOpts...)
+
+	if contentKey != nil {
+		decryptOpts = append(decryptOpts, lcp.WithContentKey(contentKey))
+	}
+
+	if externalLicense != nil {
+		decryptOpts = append(decryptOpts, lcp.WithExternalLicense(bytes.NewReader(externalLicense)))
+	}
+
+	if *licenseID != "" {
+		decryptOpts = append(decryptOpts, lcp.WithLicenseID(*licenseID))
+	}
+
+	if providers := splitList(*allowedProviders); len(providers) > 0 {
+		decryptOpts = append(decryptOpts, lcp.WithAllowedProviders(providers))
+	}
+
+	if *scanUnlisted {
+		decryptOpts = append(decryptOpts, lcp.WithUnlistedEncryptionScan())
+	}
+
+	var report lcp.Report
+	decryptOpts = append(decryptOpts, lcp.WithReport(&report))
+
+	if *keepGoing {
+		decryptOpts = append(decryptOpts, lcp.WithContinueOnError())
+	}
+
+	if *concurrency > 1 {
+		decryptOpts = append(decryptOpts, lcp.WithConcurrency(*concurrency))
+	}
+
+	if redactPII {
+		decryptOpts = append(decryptOpts, lcp.WithRedactPII())
+	}
+
+	if *preview > 0 {
+		decryptOpts = append(decryptOpts, lcp.WithPreview(*preview))
+	}
+
+	decryptOpts = append(decryptOpts, memoryOptions()...)
+	decryptOpts = append(decryptOpts, limitsOptions()...)
+	decryptOpts = append(decryptOpts, transformOptions...)
+	decryptOpts = append(decryptOpts, lcp.WithContext(ctx))
+
+	var auditLicense *lcp.License
+	if externalLicense != nil {
+		auditLicense, _ = lcp.ParseLicense(bytes.NewReader(externalLicense))
+	}
+
+	var calibreBook *calibreBook
+
+	if outputPassword != "" && (*calibreLayout || calibre.enabled) {
+		return fmt.Errorf("-outputPassword cannot be used along with calibre, which can't read protected files")
+	}
+
+	if *calibreLayout {
+		if calibre.enabled {
+			return fmt.Errorf("-calibreLayout and -addToCalibre cannot be used together")
+		}
+
+		if format != formatEPUB && format != formatKepub {
+			return fmt.Errorf("-calibreLayout only supports the epub and kepub formats")
+		}
+
+		if calibreBook, err = newCalibreBook(outFilename, inFilename, format); err != nil {
+			return err
+		}
+
+		outFilename = calibreBook.Filename
+	}
+
+	record := auditRecord{Command: "decrypt", Input: flag.Arg(0), Output: absPath(format.filename(outFilename))}
+	if downloadedFilename == "" {
+		record.Input = absPath(inFilename)
+	}
+
+	htmlReport := newHTMLReport()
+	reportBook, reportOpts := htmlReport.addBook(record.Input, record.Output)
+	decryptOpts = append(decryptOpts, reportOpts...)
+	decryptOpts = append(decryptOpts, events.start(record.Input, record.Output)...)
+
+	var memory *peakMemory
+	if *stats {
+		memory = startPeakMemory()
+	}
+
+	err = audit.run(record, inFilename, auditLicense, func() error {
+		return decryptFile(inFilename, outFilename, format, userKey, decryptOpts...)
+	})
+
+	if memory != nil {
+		printStats(os.Stderr, report.Timings, memory.stop())
+	}
+
+	events.finish(record.Input, record.Output, report, err)
+
+	if htmlReport != nil {
+		license := auditLicense
+		if license == nil {
+			license, _ = loadLicense(inFilename)
+		}
+
+		reportBook.finish(license, report, err)
+
+		if err := htmlReport.write(); err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		if calibreBook != nil {
+			calibreBook.remove()
+		}
+
+		return err
+	}
+
+	if calibreBook != nil {
+		if err := calibreBook.finish(); err != nil {
+			return err
+		}
+	}
+
+	if downloadedFilename != "" {
+		// Only now, so that retrying after a failure does not download the
+		// publication again
+		removeDownload(downloadedFilename)
+	}
+
+	if *digestsFilename != "" {
+		if err := writeDigests(*digestsFilename, report.Digests); err != nil {
+			return err
+		}
+	}
+
+	if report.Err != nil {
+		return fmt.Errorf("some files could not be decrypted and were left out of the output file:\n%w", report.Err)
+	}
+
+	if calibre.enabled {
+		return addToCalibre(format.filename(outFilename), calibre.library)
+	}
+
+	return nil
+}
+
+// decryptFile decrypts the publication stored in inFilename into
+// outFilename, converting it to format. The output file is only created if the
+// decryption succeeds. Its name may be adjusted to match the format.
+func decryptFile(inFilename, outFilename string, format outputFormat, userKeyHex string, opts ...lcp.DecryptOption) error {
 	inFd, err := os.Open(inFilename)
 	if err != nil {
 		return fmt.Errorf("error opening input file: %w", err)
@@ -63,21 +559,155 @@ The 0123... string is the value you should pass in -userKey.
 		return fmt.Errorf("error stating input file: %w", err)
 	}
 
-	outFd, err := os.Create(outFilename)
+	if err := checkOutputPassword(format); err != nil {
+		return err
+	}
+
+	if format == formatEPUB {
+		return writeAtomic(outFilename, protectOutput(func(w io.Writer) error {
+			if err := lcp.Decrypt(w, inFd, inStat.Size(), userKeyHex, opts...); err != nil {
+				return fmt.Errorf("error decrypting file: %w", err)
+			}
+
+			return nil
+		}))
+	}
+
+	if err := checkConvertible(inFd, inStat.Size(), format); err != nil {
+		return err
+	}
+
+	// Decrypt to a temporary file first, the converters need random access to
+	// the decrypted EPUB.
+	tmpFd, err := os.CreateTemp("", "lcp-decrypt-*.epub")
 	if err != nil {
-		return fmt.Errorf("error creating output file: %w", err)
+		return fmt.Errorf("error creating temporary file: %w", err)
 	}
 
-	defer outFd.Close()
+	defer os.Remove(tmpFd.Name())
+	defer tmpFd.Close()
 
-	if err := lcp.Decrypt(outFd, inFd, inStat.Size(), *userKeyHex, lcp.WithLogger(func(msg string) { log.Println(msg) })); err != nil {
-		_ = os.Remove(outFilename) // ignore error here
+	if err := lcp.Decrypt(tmpFd, inFd, inStat.Size(), userKeyHex, opts...); err != nil {
 		return fmt.Errorf("error decrypting file: %w", err)
 	}
 
-	if err := outFd.Sync(); err != nil {
-		return fmt.Errorf("error flushing output file: %w", err)
+	tmpStat, err := tmpFd.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating decrypted file: %w", err)
+	}
+
+	outFilename = format.filename(outFilename)
+
+	if format.isDirectory() {
+		err = format.extract(outFilename, tmpFd, tmpStat.Size())
+	} else {
+		err = writeAtomic(outFilename, protectOutput(func(w io.Writer) error {
+			return format.convert(w, tmpFd, tmpStat.Size())
+		}))
+	}
+
+	if err != nil {
+		return fmt.Errorf("error converting file to %s: %w", format, err)
+	}
+
+	log.Printf("Wrote %s", outFilename)
+
+	return nil
+}
+
+// checkConvertible returns an error if the input file is not the kind of
+// publication the converters of format handle: audiobooks for the audio
+// formats, EPUB files for the others.
+func checkConvertible(in io.ReaderAt, size int64, format outputFormat) error {
+	zipReader, err := zip.NewReader(in, size)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+
+	container, err := lcp.DetectContainer(zipReader)
+	if err != nil {
+		return nil // Decrypt reports the issue
+	}
+
+	if format.isAudio() {
+		if container.Type != lcp.ContainerAudiobook {
+			return fmt.Errorf("only audiobooks can be converted to %s, the input file holds: %s", format, container.Type)
+		}
+
+		return nil
+	}
+
+	if !container.Type.IsEPUB() {
+		return fmt.Errorf("only EPUB publications can be converted to %s, the input file holds: %s", format, container.Type)
 	}
 
 	return nil
 }
+
+// writeAtomic creates the file at filename with the data written by write.
+// The file is only created if write succeeds.
+func writeAtomic(filename string, write func(w io.Writer) error) error {
+	outFd, err := createAtomic(filename)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+
+	defer outFd.Abort()
+
+	if err := write(outFd); err != nil {
+		return err
+	}
+
+	if err := outFd.Commit(); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	return nil
+}
+
+// fetchLicense downloads the license at url.
+func fetchLicense(ctx context.Context, url string) ([]byte, error) {
+	log.Printf("Fetching license from %s...", url)
+
+	data, err := httpGet(ctx, newDownloadClient(url), url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching license: %w", err)
+	}
+
+	return data, nil
+}
+
+// writeDigests writes the digests of the decrypted resources to filename, in
+// the format of sha256sum, sorted by path.
+func writeDigests(filename string, digests map[string]string) error {
+	return writeAtomic(filename, func(w io.Writer) error {
+		names := make([]string, 0, len(digests))
+		for name := range digests {
+			names = append(names, name)
+		}
+
+		slices.Sort(names)
+
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s  %s\n", digests[name], name); err != nil {
+				return fmt.Errorf("error writing digests: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// splitList splits a comma separated command line value, ignoring empty
+// items.
+func splitList(s string) []string {
+	var res []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
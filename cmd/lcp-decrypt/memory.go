@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"runtime/debug"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// maxMemory is the memory cap set with -maxMemory, 0 if there is none.
+var maxMemory int64
+
+func addMaxMemoryFlag(flags *flag.FlagSet) {
+	flags.Func("maxMemory", "approximate memory cap (for example 256M), for small hosts: fewer files are decrypted in parallel, and the files that don't fit are decrypted through temporary files", func(value string) error {
+		var size sizeFlag
+		if err := size.Set(value); err != nil {
+			return err
+		}
+
+		maxMemory = int64(size)
+
+		// Also make the garbage collector work harder as the cap gets close
+		if maxMemory > 0 {
+			debug.SetMemoryLimit(maxMemory)
+		}
+
+		return nil
+	})
+}
+
+// memoryOptions returns the decryption options applying -maxMemory.
+func memoryOptions() []lcp.DecryptOption {
+	if maxMemory <= 0 {
+		return nil
+	}
+
+	return []lcp.DecryptOption{lcp.WithMaxMemory(maxMemory)}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/abustany/lcp-decrypt/pkg/zipaes"
+)
+
+// outputPasswordEnv is the environment variable holding the password of the
+// output files, if -outputPassword is not set.
+const outputPasswordEnv = "LCP_DECRYPT_OUTPUT_PASSWORD"
+
+// outputPassword is the password protecting the output files, empty if they
+// are not protected.
+var outputPassword string
+
+func addOutputPasswordFlag(flags *flag.FlagSet) {
+	flags.StringVar(&outputPassword, "outputPassword", os.Getenv(outputPasswordEnv), "password protecting the output file with ZIP AES-256 encryption, for storing it on shared drives (default $"+outputPasswordEnv+"; readers can't open the protected file until it is extracted)")
+}
+
+// checkOutputPassword returns an error if the files of format can't be
+// password protected.
+func checkOutputPassword(format outputFormat) error {
+	if outputPassword != "" && (format.isDirectory() || format == formatM4B) {
+		return fmt.Errorf("-outputPassword can only be used with formats producing zip files (epub, kepub or webpub)")
+	}
+
+	return nil
+}
+
+// protectOutput wraps write, the function writing an output file, so that the
+// zip file it writes gets encrypted with the output password if one is set.
+func protectOutput(write func(w io.Writer) error) func(w io.Writer) error {
+	if outputPassword == "" {
+		return write
+	}
+
+	return func(w io.Writer) error {
+		tmpFd, err := os.CreateTemp("", "lcp-decrypt-*.zip")
+		if err != nil {
+			return fmt.Errorf("error creating temporary file: %w", err)
+		}
+
+		defer os.Remove(tmpFd.Name())
+		defer tmpFd.Close()
+
+		if err := write(tmpFd); err != nil {
+			return err
+		}
+
+		tmpStat, err := tmpFd.Stat()
+		if err != nil {
+			return fmt.Errorf("error stating decrypted file: %w", err)
+		}
+
+		if err := zipaes.Encrypt(w, tmpFd, tmpStat.Size(), outputPassword); err != nil {
+			return fmt.Errorf("error protecting output file: %w", err)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// redactPII makes the commands mask the personal information (license IDs,
+// user details) in their output.
+var redactPII bool
+
+func addRedactPIIFlag(flags *flag.FlagSet) {
+	flags.BoolVar(&redactPII, "redactPII", false, "mask the license IDs and the user details (ID, email, name) in the output, for shared or logged environments")
+}
+
+// redact masks value if -redactPII is set.
+func redact(value string) string {
+	if !redactPII {
+		return value
+	}
+
+	return lcp.Redact(value)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Kinds of personal data found by privacy-scan.
+const (
+	privacyLicenseValue  = "license-value"
+	privacyCustomValue   = "custom-value"
+	privacyEmail         = "email"
+	privacyMetadata      = "watermark-metadata"
+	privacyText          = "watermark-text"
+	privacyInvisibleText = "invisible-characters"
+)
+
+// privacyContextSize is the number of bytes shown around the findings.
+const privacyContextSize = 40
+
+// privacyFinding is a place where a decrypted book carries personal data.
+type privacyFinding struct {
+	Path string `json:"path"`
+	// Line is the line of the finding in text files, Offset its position in
+	// bytes in the file.
+	Line    int    `json:"line,omitempty"`
+	Offset  int    `json:"offset"`
+	Kind    string `json:"kind"`
+	Match   string `json:"match"`
+	Context string `json:"context,omitempty"`
+}
+
+func (f privacyFinding) String() string {
+	where := fmt.Sprintf("%s:%d", f.Path, f.Line)
+	if f.Line == 0 {
+		where = fmt.Sprintf("%s@%d", f.Path, f.Offset)
+	}
+
+	s := fmt.Sprintf("%s: %s %q", where, f.Kind, f.Match)
+	if f.Context != "" {
+		s += " in ..." + f.Context + "..."
+	}
+
+	return s
+}
+
+// privacyPatterns are the patterns of the watermarks stores are known to
+// add, looked for in the text files.
+var privacyPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{privacyEmail, regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{privacyMetadata, regexp.MustCompile(`(?i)<meta\s[^>]*(name|property)\s*=\s*["'][^"']*(watermark|buyer|customer|purchaser|transaction|order[-_ ]?id|user[-_ ]?id)[^"']*["'][^>]*>`)},
+	{privacyMetadata, regexp.MustCompile(`(?i)\b(id|class)\s*=\s*["'][^"']*watermark[^"']*["']`)},
+	{privacyMetadata, regexp.MustCompile(`(?is)<!--[^>]{0,200}?(watermark|purchased|licensed to|customer|order id)[^>]{0,200}?-->`)},
+	{privacyText, regexp.MustCompile(`(?i)\b(purchased by|licensed to|sold to|this (e-?book|copy) (belongs to|is licensed to|was purchased by)|gekauft von|lizenziert für|acheté par|appartient à)\b`)},
+	{privacyInvisibleText, regexp.MustCompile(`[\x{200B}\x{200C}\x{200D}\x{2060}]{4,}`)},
+}
+
+// privacyTextExtensions are the extensions of the files the patterns are
+// looked for in. The personal values are looked for in all the files, as
+// images can carry them in their metadata.
+var privacyTextExtensions = []string{".xhtml", ".html", ".htm", ".opf", ".ncx", ".xml", ".smil", ".css", ".js", ".json", ".txt"}
+
+func runPrivacyScan(args []string) error {
+	flags := flag.NewFlagSet("privacy-scan", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s privacy-scan [options] decrypted.epub
+
+Looks for the personal data a decrypted book still carries, and prints where
+it appears: the user details of its license (ID, email, name, also base64
+encoded), the values passed in -values, email addresses, and the watermarks
+stores are known to add ("purchased by..." notices, metadata, invisible
+characters...).
+
+Pass the license of the book in -license (the .lcpl file, or the protected
+book embedding it): without it, only the values of -values and the known
+watermarks are looked for.
+
+Exits with a non-zero status if personal data was found.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	licenseFilename := flags.String("license", "", "license of the book (.lcpl file, or the protected book), whose user details are looked for")
+	values := flags.String("values", "", "comma separated list of other personal values to look for (name, customer number...)")
+	asJSON := flags.Bool("json", false, "print the findings as JSON")
+	addRedactPIIFlag(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected the decrypted book to scan")
+	}
+
+	var personal []personalValue
+
+	if *licenseFilename != "" {
+		licenses, err := loadLicenses(*licenseFilename)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range licenses {
+			for _, v := range []string{l.ID, l.User.ID, l.User.Email, l.User.Name} {
+				personal = append(personal, personalValue{value: v, kind: privacyLicenseValue})
+			}
+		}
+	}
+
+	for _, v := range splitList(*values) {
+		personal = append(personal, personalValue{value: v, kind: privacyCustomValue})
+	}
+
+	r, err := zip.OpenReader(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", flags.Arg(0), err)
+	}
+
+	defer r.Close()
+
+	var findings []privacyFinding
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		fileFindings, err := scanPrivacy(f, personal)
+		if err != nil {
+			return fmt.Errorf("error scanning %s: %w", f.Name, err)
+		}
+
+		findings = append(findings, fileFindings...)
+	}
+
+	if redactPII {
+		for i := range findings {
+			if findings[i].Kind != privacyMetadata && findings[i].Kind != privacyInvisibleText {
+				findings[i].Match = redact(findings[i].Match)
+				findings[i].Context = ""
+			}
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(map[string]any{"clean": len(findings) == 0, "findings": findings}); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+	}
+
+	if len(findings) > 0 {
+		return fmt.Errorf("%d place(s) carrying personal data found in %s", len(findings), flags.Arg(0))
+	}
+
+	if !*asJSON {
+		fmt.Println("No personal data found")
+	}
+
+	return nil
+}
+
+// personalValue is a value privacy-scan looks for.
+type personalValue struct {
+	value string
+	kind  string
+}
+
+// scanPrivacy returns the places where the entry f carries personal data.
+func scanPrivacy(f *zip.File, personal []personalValue) ([]privacyFinding, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	isText := false
+	for _, ext := range privacyTextExtensions {
+		isText = isText || strings.EqualFold(path.Ext(f.Name), ext)
+	}
+
+	var findings []privacyFinding
+
+	add := func(kind string, start, end int) {
+		finding := privacyFinding{Path: f.Name, Offset: start, Kind: kind, Match: string(data[start:end])}
+
+		if isText {
+			finding.Line = bytes.Count(data[:start], []byte("\n")) + 1
+			finding.Context = privacyContext(data, start, end)
+		}
+
+		findings = append(findings, finding)
+	}
+
+	// Lowering the case of some characters changes their size, the offsets
+	// would then not match: fall back to case sensitive matching.
+	lower := bytes.ToLower(data)
+	caseFolded := len(lower) == len(data)
+
+	find := func(kind string, haystack []byte, needle string) {
+		for offset := 0; ; {
+			i := bytes.Index(haystack[offset:], []byte(needle))
+			if i < 0 {
+				return
+			}
+
+			start, end := offset+i, offset+i+len(needle)
+			offset = end
+
+			// Values contained in others (the name in the email...) are
+			// only reported once
+			if !slices.ContainsFunc(findings, func(f privacyFinding) bool {
+				return start < f.Offset+len(f.Match) && f.Offset < end
+			}) {
+				add(kind, start, end)
+			}
+		}
+	}
+
+	for _, p := range personal {
+		if len(p.value) < 3 {
+			continue // too short to mean anything
+		}
+
+		if caseFolded {
+			find(p.kind, lower, strings.ToLower(p.value))
+		} else {
+			find(p.kind, data, p.value)
+		}
+
+		find(p.kind, data, base64.StdEncoding.EncodeToString([]byte(p.value)))
+	}
+
+	if !isText {
+		return findings, nil
+	}
+
+	// The personal values already found (emails...) are not reported again
+	found := map[int]bool{}
+	for _, finding := range findings {
+		found[finding.Offset] = true
+	}
+
+	for _, p := range privacyPatterns {
+		for _, loc := range p.re.FindAllIndex(data, -1) {
+			if !found[loc[0]] {
+				add(p.kind, loc[0], loc[1])
+			}
+		}
+	}
+
+	slices.SortStableFunc(findings, func(a, b privacyFinding) int { return cmp.Compare(a.Offset, b.Offset) })
+
+	return findings, nil
+}
+
+// privacyContext returns the text around data[start:end], on a single line.
+func privacyContext(data []byte, start, end int) string {
+	from, to := max(start-privacyContextSize, 0), min(end+privacyContextSize, len(data))
+
+	return strings.Join(strings.Fields(strings.ToValidUTF8(string(data[from:to]), "")), " ")
+}
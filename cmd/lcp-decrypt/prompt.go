@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// stdin is shared by all prompts, so that input buffered while reading one
+// answer is not lost for the next one.
+var stdin = bufio.NewReader(os.Stdin)
+
+// isTerminal returns true if f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// prompt prints msg on stderr and returns the line typed by the user.
+func prompt(msg string) (string, error) {
+	fmt.Fprint(os.Stderr, msg)
+
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("error reading from standard input: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// promptSecret prints msg on stderr and returns the line typed by the user,
+// without echoing it when reading from a terminal.
+func promptSecret(msg string) (string, error) {
+	if !isTerminal(os.Stdin) {
+		return prompt(msg)
+	}
+
+	fmt.Fprint(os.Stderr, msg)
+
+	line, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr) // the newline typed by the user was not echoed either
+
+	if err != nil {
+		return "", fmt.Errorf("error reading from standard input: %w", err)
+	}
+
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
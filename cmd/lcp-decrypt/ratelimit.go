@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of requests per key (API token, client
+// address...), allowing bursts of up to perMinute requests.
+type rateLimiter struct {
+	perMinute int
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: map[string]*rateBucket{}}
+}
+
+// allow records a request for key, and returns whether it is allowed. If it
+// isn't, it also returns how long to wait before the next request is.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil || l.perMinute <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(l.perMinute) / float64(time.Minute)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+
+		b = &rateBucket{tokens: float64(l.perMinute), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(float64(l.perMinute), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+
+	b.tokens--
+
+	return true, 0
+}
+
+// prune forgets the keys whose bucket is full again, so that the map does not
+// grow with every client ever seen.
+func (l *rateLimiter) prune(now time.Time) {
+	if len(l.buckets) < 1024 {
+		return
+	}
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= time.Minute {
+			delete(l.buckets, key)
+		}
+	}
+}
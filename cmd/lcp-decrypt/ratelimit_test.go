@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(60)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A burst of perMinute requests is allowed
+	for i := 0; i < 60; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst rejected", i)
+		}
+	}
+
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request over the limit allowed")
+	}
+
+	if wait < time.Second-time.Millisecond || wait > time.Second {
+		t.Errorf("got wait %s, want 1s", wait)
+	}
+
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("request for another key rejected")
+	}
+
+	// One request per second comes back
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); ok {
+		t.Error("request allowed before the bucket refilled")
+	}
+
+	if ok, _ := l.allow("a", now.Add(time.Second+time.Millisecond)); !ok {
+		t.Error("request rejected after the bucket refilled")
+	}
+
+	// The bucket does not fill beyond perMinute
+	later := now.Add(time.Hour)
+	allowed := 0
+
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("a", later); ok {
+			allowed++
+		}
+	}
+
+	if allowed != 60 {
+		t.Errorf("got %d requests allowed after an hour, want 60", allowed)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var nilLimiter *rateLimiter
+
+	for _, l := range []*rateLimiter{nilLimiter, newRateLimiter(0)} {
+		for i := 0; i < 1000; i++ {
+			if ok, _ := l.allow("a", time.Now()); !ok {
+				t.Fatalf("request %d rejected by an unlimited limiter", i)
+			}
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(10)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 1024; i++ {
+		l.allow(time.Duration(i).String(), now)
+	}
+
+	l.allow("new", now.Add(time.Minute))
+
+	if len(l.buckets) != 1 {
+		t.Errorf("got %d buckets after pruning, want 1", len(l.buckets))
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+	"github.com/abustany/lcp-decrypt/pkg/webpub"
+)
+
+//go:embed read.html
+var readerPage []byte
+
+func runRead(args []string) error {
+	flags := flag.NewFlagSet("read", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s read [options] book.epub
+
+Opens a book protected with Readium LCP for reading, without writing a
+decrypted copy anywhere: a local web server decrypts its resources as your
+browser requests them, and serves a minimal reader page. Open the printed
+address in your browser, and stop the server with Ctrl-C when you are done.
+
+The key is looked up as when decrypting a book (see "%[1]s -h").
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	addr := flags.String("listen", "localhost:0", "address to listen on, which must be local to the machine (by default, a free port is picked)")
+	userKeyHex := flags.String("userKey", "", "hex encoded LCP user key (if not set, use $"+userKeyEnv+" or $"+passphraseEnv+", or else the key stored for the book's provider, or prompt for it)")
+	passphrase := flags.String("passphrase", "", "LCP passphrase of the book, from which the user key is derived (basic encryption profile), instead of -userKey")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	addUseKeychainFlag(flags)
+	licenseID := flags.String("licenseId", "", "ID of the license to use, for books embedding several licenses")
+	addRedactPIIFlag(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+	loadTLSFlags := addTLSFlags(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	inFilename := flags.Arg(0)
+	if inFilename == "" {
+		return fmt.Errorf("no input file specified")
+	}
+
+	if err := loadTLSFlags(); err != nil {
+		return err
+	}
+
+	// The decrypted book is served to anyone who can connect
+	if !isLoopbackAddr(*addr) {
+		return fmt.Errorf("refusing to serve the decrypted book on %s, only local addresses are allowed", *addr)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *userKeyHex != "" && *passphrase != "" {
+		return fmt.Errorf("-userKey and -passphrase cannot be used together")
+	}
+
+	cred := credential{UserKey: *userKeyHex, Passphrase: *passphrase}
+
+	if cred == (credential{}) {
+		var err error
+		if cred, err = envCredential(); err != nil {
+			return err
+		}
+	}
+
+	if cred == (credential{}) {
+		licenses, err := loadLicenses(inFilename)
+		if err != nil {
+			return err
+		}
+
+		if cred, err = findCredential(ctx, licenses, *keyDBPath, *licenseID); err != nil {
+			return err
+		}
+	}
+
+	userKey, opts := cred.decryptArgs()
+
+	if *licenseID != "" {
+		opts = append(opts, lcp.WithLicenseID(*licenseID))
+	}
+
+	if redactPII {
+		opts = append(opts, lcp.WithRedactPII())
+	}
+
+	fd, err := os.Open(inFilename)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating input file: %w", err)
+	}
+
+	fsys, err := lcp.OpenFS(fd, stat.Size(), userKey, opts...)
+	if err != nil {
+		return fmt.Errorf("error opening book: %w", err)
+	}
+
+	manifest, err := readingManifest(fsys)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", *addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           readHandler(fsys, manifest),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Printf("Reading %s at http://%s/ (press Ctrl-C to stop)", cmp.Or(manifest.Metadata.Title, inFilename), listener.Addr())
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// readingManifest returns the Web Publication manifest describing the
+// reading order of the decrypted publication: the one of Readium packages,
+// or one built from the package document of EPUB books.
+func readingManifest(fsys fs.FS) (*webpub.Manifest, error) {
+	data, err := fs.ReadFile(fsys, webpub.ManifestPath)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		m, err := webpub.FromEPUB(fsys)
+		if err != nil {
+			return nil, fmt.Errorf("error reading book: %w", err)
+		}
+
+		return m, nil
+	case err != nil:
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var m webpub.Manifest
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+
+	return &m, nil
+}
+
+// readHandler serves the reader page on /, and the decrypted publication
+// under /pub/, its manifest being /pub/manifest.json.
+func readHandler(fsys fs.FS, manifest *webpub.Manifest) http.Handler {
+	// Servers don't agree on the media type of .xhtml files, and browsers
+	// only render them with the right one.
+	mediaTypes := map[string]string{}
+
+	for _, links := range [][]webpub.Link{manifest.ReadingOrder, manifest.Resources} {
+		for _, link := range links {
+			href, _, _ := strings.Cut(link.Href, "#")
+
+			if p, err := url.PathUnescape(href); err == nil && link.Type != "" {
+				mediaTypes[p] = link.Type
+			}
+		}
+	}
+
+	files := http.FileServerFS(fsys)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(readerPage)
+	})
+
+	mux.HandleFunc("GET /pub/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", webpub.ManifestMediaType)
+		_ = json.NewEncoder(w).Encode(manifest)
+	})
+
+	mux.Handle("GET /pub/", http.StripPrefix("/pub", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t, ok := mediaTypes[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+			w.Header().Set("Content-Type", t)
+		}
+
+		files.ServeHTTP(w, r)
+	})))
+
+	return mux
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+func runRights(args []string) error {
+	flags := flag.NewFlagSet("rights", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s rights [-json] [-strict] book.epub
+
+Prints the rights granted by the license of a book protected with Readium LCP:
+loan period, number of pages that can be printed, number of characters that
+can be copied, and any provider specific rights. The license can also be
+passed as a standalone .lcpl file.
+
+The user the license was issued to is printed as well. Providers may encrypt
+these details, they are then decrypted with the key stored for the provider
+(see "%[1]s keys -h") or the one passed in -userKey.
+
+The deviations of the license from the specification (missing fields, values
+of the wrong type...) are printed as warnings, or make the command fail with
+-strict.
+
+Options:
+`, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	asJSON := flags.Bool("json", false, "print the rights as JSON")
+	strict := flags.Bool("strict", false, "fail if the license deviates from the specification, instead of printing warnings")
+	userKeyHex := flags.String("userKey", "", "hex encoded LCP user key, to decrypt the user details")
+	keyDBPath := flags.String("keyDB", defaultKeyDBPath(), "path of the database of keys stored for each provider")
+	addRedactPIIFlag(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	inFilename := flags.Arg(0)
+	if inFilename == "" {
+		return fmt.Errorf("no input file specified")
+	}
+
+	parseOpts := []lcp.LicenseParseOption{lcp.WithParseWarnings(func(msg string) {
+		log.Print("Warning: license: " + msg)
+	})}
+
+	if *strict {
+		parseOpts = []lcp.LicenseParseOption{lcp.WithStrictParsing()}
+	}
+
+	license, err := loadLicense(inFilename, parseOpts...)
+	if err != nil {
+		return err
+	}
+
+	user, err := licenseUser(license, *userKeyHex, *keyDBPath)
+	if err != nil {
+		return err
+	}
+
+	user.ID, user.Email, user.Name = redact(user.ID), redact(user.Email), redact(user.Name)
+
+	if *asJSON {
+		return printRightsJSON(license, user)
+	}
+
+	printRights(license, user, time.Now())
+
+	return nil
+}
+
+// loadLicense reads a license from a standalone .lcpl file, or from a
+// protected publication.
+func loadLicense(filename string, opts ...lcp.LicenseParseOption) (*lcp.License, error) {
+	licenses, err := loadLicenses(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return licenses[0], nil
+}
+
+// loadLicenses reads the licenses from a standalone .lcpl file, or all the
+// licenses embedded in a protected publication.
+func loadLicenses(filename string, opts ...lcp.LicenseParseOption) ([]*lcp.License, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+
+	defer fd.Close()
+
+	if strings.EqualFold(filepath.Ext(filename), ".lcpl") {
+		license, err := lcp.ParseLicense(fd, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error reading license: %w", err)
+		}
+
+		return []*lcp.License{license}, nil
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error stating input file: %w", err)
+	}
+
+	licenses, err := lcp.ReadLicenses(fd, stat.Size(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading license: %w", err)
+	}
+
+	return licenses, nil
+}
+
+// licenseUser returns the user details of license, decrypted if they are
+// encrypted and a key is available.
+func licenseUser(license *lcp.License, userKeyHex, keyDBPath string) (lcp.LicenseUser, error) {
+	if len(license.User.Encrypted) == 0 {
+		return license.User, nil
+	}
+
+	cred := credential{UserKey: userKeyHex}
+
+	if userKeyHex == "" {
+		db := &keyDB{}
+
+		if keyDBPath != "" {
+			var err error
+
+			if db, err = loadKeyDB(keyDBPath); err != nil {
+				return lcp.LicenseUser{}, err
+			}
+		}
+
+		e, ok := db.lookup(license)
+		if !ok {
+			return license.User, nil // left encrypted
+		}
+
+		cred = e.credential
+	}
+
+	userKey, err := cred.licenseUserKey(license)
+	if err != nil {
+		if userKeyHex != "" {
+			return lcp.LicenseUser{}, fmt.Errorf("invalid user key: %w", err)
+		}
+
+		return license.User, nil // the stored key is for another account
+	}
+
+	return license.User.Decrypt(userKey)
+}
+
+func printRightsJSON(license *lcp.License, user lcp.LicenseUser) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(struct {
+		ID       string            `json:"id"`
+		Provider string            `json:"provider"`
+		User     lcp.LicenseUser   `json:"user"`
+		Rights   lcp.LicenseRights `json:"rights"`
+	}{
+		ID:       redact(license.ID),
+		Provider: license.Provider,
+		User:     user,
+		Rights:   license.Rights,
+	})
+}
+
+func printRights(license *lcp.License, user lcp.LicenseUser, now time.Time) {
+	rights := license.Rights
+
+	fmt.Printf("License:    %s\n", redact(license.ID))
+	fmt.Printf("Provider:   %s\n", license.Provider)
+
+	for _, field := range []struct{ label, name, value string }{
+		{"User ID:   ", "id", user.ID},
+		{"User email:", "email", user.Email},
+		{"User name: ", "name", user.Name},
+	} {
+		switch {
+		case field.value == "":
+		case user.IsEncrypted(field.name):
+			fmt.Printf("%s (encrypted, no key available)\n", field.label)
+		default:
+			fmt.Printf("%s %s\n", field.label, field.value)
+		}
+	}
+
+	switch {
+	case rights.Start == nil && rights.End == nil:
+		fmt.Println("Loan:       unlimited")
+	default:
+		if rights.Start != nil {
+			fmt.Printf("Loan start: %s\n", formatTime(*rights.Start))
+		}
+
+		if rights.End != nil {
+			fmt.Printf("Loan end:   %s (%s)\n", formatTime(*rights.End), describeDeadline(*rights.End, now))
+		}
+	}
+
+	fmt.Printf("Print:      %s\n", formatAllowance(rights.Print, "page"))
+	fmt.Printf("Copy:       %s\n", formatAllowance(rights.Copy, "character"))
+
+	if len(rights.Extensions) > 0 {
+		keys := make([]string, 0, len(rights.Extensions))
+		for k := range rights.Extensions {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		fmt.Println("Other rights:")
+
+		for _, k := range keys {
+			fmt.Printf("  %s: %s\n", k, rights.Extensions[k])
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04 MST")
+}
+
+func describeDeadline(t, now time.Time) string {
+	if !t.After(now) {
+		return "expired"
+	}
+
+	remaining := t.Sub(now)
+
+	if remaining < 24*time.Hour {
+		return fmt.Sprintf("expires in %d hour(s)", int(remaining.Hours()))
+	}
+
+	return fmt.Sprintf("expires in %d day(s)", int(remaining.Hours()/24))
+}
+
+func formatAllowance(n *int64, unit string) string {
+	if n == nil {
+		return "unlimited"
+	}
+
+	return fmt.Sprintf("%d %s(s)", *n, unit)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// profileSecrets is the file passed in -profileSecrets. For each production
+// encryption profile, it holds the secret the user key derivation relies on,
+// and the program implementing that derivation. Only the parties legitimately
+// holding these secrets (for example publishers testing the output of their
+// own license server) can provide them.
+type profileSecrets struct {
+	Profiles []profileSecret `json:"profiles"`
+}
+
+type profileSecret struct {
+	// Profile is the URI of the profile (for example
+	// http://readium.org/lcp/profile-1.0).
+	Profile string `json:"profile"`
+	// Secret is the hex encoded secret of the profile, passed to Command in
+	// the LCP_PROFILE_SECRET environment variable.
+	Secret string `json:"secret"`
+	// Command receives the hex encoded SHA-256 hash of the passphrase on its
+	// standard input, and must print the hex encoded user key on its
+	// standard output (arguments are separated by spaces).
+	Command string `json:"command"`
+}
+
+// profileTransforms are the options deriving the user keys of the production
+// profiles listed in -profileSecrets.
+var profileTransforms []lcp.DecryptOption
+
+func addProfileSecretsFlag(flags *flag.FlagSet) {
+	flags.Func("profileSecrets", "JSON file holding the secrets of production encryption profiles and the programs deriving user keys with them, to use passphrases with licenses of these profiles", func(filename string) error {
+		secrets, err := loadProfileSecrets(filename)
+		if err != nil {
+			return err
+		}
+
+		profileTransforms = nil
+
+		for _, s := range secrets.Profiles {
+			profileTransforms = append(profileTransforms, lcp.WithProfileTransform(s.Profile, s.transform))
+		}
+
+		return nil
+	})
+}
+
+func loadProfileSecrets(filename string) (*profileSecrets, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening profile secrets: %w", err)
+	}
+
+	defer fd.Close()
+
+	if stat, err := fd.Stat(); err == nil && runtime.GOOS != "windows" && stat.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: %s holds secrets but can be read by other users", filename)
+	}
+
+	var secrets profileSecrets
+
+	if err := json.NewDecoder(fd).Decode(&secrets); err != nil {
+		return nil, fmt.Errorf("error decoding profile secrets %s: %w", filename, err)
+	}
+
+	for _, s := range secrets.Profiles {
+		switch {
+		case s.Profile == "":
+			return nil, fmt.Errorf("profile secrets %s: missing profile URI", filename)
+		case len(strings.Fields(s.Command)) == 0:
+			return nil, fmt.Errorf("profile secrets %s: missing command for profile %s", filename, s.Profile)
+		}
+
+		if _, err := hex.DecodeString(s.Secret); err != nil {
+			return nil, fmt.Errorf("profile secrets %s: invalid secret for profile %s: %w", filename, s.Profile, err)
+		}
+	}
+
+	return &secrets, nil
+}
+
+// transform derives a user key from the hash of a passphrase by running the
+// command of the profile.
+func (s profileSecret) transform(passphraseHash []byte) ([]byte, error) {
+	args := strings.Fields(s.Command)
+
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(hex.EncodeToString(passphraseHash) + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "LCP_PROFILE="+s.Profile, "LCP_PROFILE_SECRET="+s.Secret)
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error running the command of profile %s: %w", s.Profile, err)
+	}
+
+	line, _, _ := strings.Cut(stdout.String(), "\n")
+
+	userKey, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the user key returned by the command of profile %s: %w", s.Profile, err)
+	}
+
+	if len(userKey) != 32 {
+		return nil, errors.New("the command of profile " + s.Profile + " did not return a 32 bytes user key")
+	}
+
+	return userKey, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+func runSelfTest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s selftest
+
+Checks that the cryptographic code paths used to decrypt books (AES, key
+unwrapping, padding, decompression...) give the expected results on this
+machine. If a book fails to decrypt on an unusual platform (NAS, single-board
+computer...), run this before suspecting the key.
+`, os.Args[0])
+	}
+
+	_ = flags.Parse(args) // exits on error
+
+	failed := 0
+
+	for _, r := range lcp.SelfTest() {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", r.Name, r.Err)
+		} else {
+			fmt.Printf("ok    %s\n", r.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed on %s/%s, decryption can't be trusted on this platform", failed, runtime.GOOS, runtime.GOARCH)
+	}
+
+	return nil
+}
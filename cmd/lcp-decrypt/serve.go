@@ -0,0 +1,519 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// serveMaxMemory is the size of the uploads kept in memory, bigger files are
+// spooled to disk.
+const serveMaxMemory = 32 << 20
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage: %[1]s serve [options]
+
+Serves an HTTP API decrypting books, for web frontends and other programs
+that can't run this one. Books are decrypted by posting a multipart/form-data
+request to /decrypt, with the fields
+
+  book        the protected file (required)
+  license     the .lcpl license, for books that don't embed it
+  key         hex encoded user key, or passphrase
+  userKey     hex encoded user key
+  passphrase  passphrase
+  contentKey  hex encoded content key (the license is then ignored)
+  licenseId   ID of the license to use, for books embedding several licenses
+  format      format of the output: epub (default), kepub or webpub, or m4b
+              for audiobooks
+
+The response holds the decrypted book, or a JSON object with an "error" field
+if it could not be decrypted.
+
+If no key is posted, the keys stored with "%[1]s keys add" are used when
+-keyDB is set. Only do this if all the clients of the server may decrypt the
+books of the stored accounts.
+
+Requests must present one of the API tokens listed in -tokens (one per line,
+optionally followed by its rate class) or in the %[2]s environment
+variable (comma separated TOKEN or TOKEN:CLASS items), as an
+"Authorization: Bearer TOKEN" header. Rate classes are defined with
+-rateClass NAME=N, N being the number of requests per minute allowed for each
+token of the class. Tokens that don't name a class are in the "default" one,
+which is unlimited unless defined. Without tokens, the server only listens on
+the local machine.
+
+Options:
+`, os.Args[0], serveTokensEnv)
+		flags.PrintDefaults()
+	}
+
+	addr := flags.String("listen", "localhost:8080", "address to listen on")
+	tokensFilename := flags.String("tokens", "", "file listing the API tokens accepted by the server, one per line, optionally followed by their rate class")
+	rateClasses := rateClassFlag{}
+	flags.Var(rateClasses, "rateClass", "rate class of API tokens, as NAME=N to allow N requests per minute (can be repeated)")
+	keyDBPath := flags.String("keyDB", "", "path of the database of keys stored for each provider, used for the requests posting no key (disabled by default)")
+	allowedProviders := flags.String("allowedProviders", "", "comma separated list of the providers whose licenses can be processed (by default, all providers are allowed)")
+	maxUploadSize := sizeFlag(2 << 30)
+	flags.Var(&maxUploadSize, "maxUploadSize", "maximum size of a request, for example 500M or 2G (0 for no limit)")
+	maxJobs := flags.Int("maxJobs", runtime.NumCPU(), "maximum number of books decrypted at the same time, the other requests wait (0 for no limit)")
+	clientRate := flags.Int("clientRate", 0, "maximum number of requests per minute from a single client address (0 for no limit)")
+	tempQuota := sizeFlag(0)
+	flags.Var(&tempQuota, "tempQuota", "maximum temporary disk space used by the requests being handled, each one reserving 3 times its size; requests exceeding it are rejected (0 for no limit)")
+	addRedactPIIFlag(flags)
+	addPassphraseVariantsFlag(flags)
+	addProfileSecretsFlag(flags)
+	addMaxMemoryFlag(flags)
+	addLimitsFlags(flags, lcp.ServiceLimits)
+	loadWebhook := addWebhookFlags(flags)
+	loadTLSFlags := addTLSFlags(flags)
+
+	_ = flags.Parse(args) // exits on error
+
+	if err := loadTLSFlags(); err != nil {
+		return err
+	}
+
+	tokens, err := loadServeTokens(*tokensFilename)
+	if err != nil {
+		return err
+	}
+
+	auth, err := newServeAuth(tokens, rateClasses)
+	if err != nil {
+		return err
+	}
+
+	if !auth.enabled() && !isLoopbackAddr(*addr) {
+		return fmt.Errorf("refusing to serve on %s without API tokens, pass -tokens or set %s", *addr, serveTokensEnv)
+	}
+
+	s := &decryptServer{
+		keyDBPath:        *keyDBPath,
+		allowedProviders: splitList(*allowedProviders),
+		limits:           newServeLimits(int64(maxUploadSize), int64(tempQuota), *maxJobs, *clientRate),
+		webhook:          loadWebhook(),
+	}
+
+	defer s.webhook.wait()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", *addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           auth.middleware(s.handler()),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Printf("Serving on http://%s/decrypt", listener.Addr())
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// decryptServer is the HTTP API of the serve command.
+type decryptServer struct {
+	keyDBPath        string
+	allowedProviders []string
+	limits           *serveLimits
+	webhook          *webhook
+}
+
+func (s *decryptServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /decrypt", s.handleDecrypt)
+	mux.HandleFunc("GET /capabilities", s.handleCapabilities)
+
+	return mux
+}
+
+// decryptRequest is a decryption request posted to the server, once its
+// files are saved to disk.
+type decryptRequest struct {
+	name        string
+	book        string
+	licenseFile string
+	cred        credential
+	contentKey  []byte
+	licenseID   string
+	format      outputFormat
+}
+
+// outputName returns the file name of the decrypted book sent in the
+// response.
+func (req *decryptRequest) outputName() string {
+	return req.format.filename(strings.TrimSuffix(req.name, filepath.Ext(req.name)) + ".epub")
+}
+
+// requestError is an error caused by the request, rather than by the server.
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+func badRequest(format string, args ...any) error {
+	return &requestError{status: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+func (s *decryptServer) handleDecrypt(w http.ResponseWriter, r *http.Request) {
+	err := s.serveDecrypt(w, r)
+	if err != nil {
+		log.Printf("Error handling request from %s: %s", r.RemoteAddr, err)
+		httpError(w, err)
+	}
+}
+
+func (s *decryptServer) serveDecrypt(w http.ResponseWriter, r *http.Request) error {
+	release, err := s.limits.admit(w, r)
+	if err != nil {
+		return err
+	}
+
+	defer release()
+
+	dir, err := os.MkdirTemp("", "lcp-decrypt-serve-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	req, err := s.readRequest(r, dir)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return s.limits.tooLarge()
+		}
+
+		return err
+	}
+
+	done, err := s.limits.acquireJob(r.Context())
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
+	err = s.decrypt(r.Context(), w, req, dir)
+
+	event := webhookEvent{Event: webhookDone, Command: "serve", Input: req.name, Output: req.outputName()}
+	if err != nil {
+		event = webhookEvent{Event: webhookFailed, Command: "serve", Input: req.name, Error: err.Error()}
+	}
+
+	// Read the metadata now, dir is removed once the request is handled
+	s.webhook.notify(event, req.book, req.licenseFile)
+
+	return err
+}
+
+// readRequest parses the multipart form of r, saving the uploaded files in
+// dir.
+func (s *decryptServer) readRequest(r *http.Request, dir string) (*decryptRequest, error) {
+	if err := r.ParseMultipartForm(serveMaxMemory); err != nil {
+		return nil, badRequest("error reading multipart form: %w", err)
+	}
+
+	defer r.MultipartForm.RemoveAll()
+
+	req := &decryptRequest{
+		book:      filepath.Join(dir, "book"),
+		licenseID: r.FormValue("licenseId"),
+	}
+
+	name, err := saveFormFile(r.MultipartForm, "book", req.book)
+	switch {
+	case errors.Is(err, http.ErrMissingFile):
+		return nil, badRequest("no book posted")
+	case err != nil:
+		return nil, err
+	}
+
+	req.name = filepath.Base(name)
+
+	_, err = saveFormFile(r.MultipartForm, "license", filepath.Join(dir, "license.lcpl"))
+	switch {
+	case err == nil:
+		req.licenseFile = filepath.Join(dir, "license.lcpl")
+	case !errors.Is(err, http.ErrMissingFile):
+		return nil, err
+	}
+
+	if req.format, err = parseOutputFormat(cmp.Or(r.FormValue("format"), string(formatEPUB))); err != nil {
+		return nil, badRequest("%w", err)
+	}
+
+	if req.format.isDirectory() {
+		return nil, badRequest("the %s format can't be served", req.format)
+	}
+
+	key, userKey, passphrase, contentKey := r.FormValue("key"), r.FormValue("userKey"), r.FormValue("passphrase"), r.FormValue("contentKey")
+
+	set := 0
+	for _, v := range []string{key, userKey, passphrase, contentKey} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return nil, badRequest("only one of key, userKey, passphrase and contentKey can be posted")
+	}
+
+	switch {
+	case key != "":
+		req.cred = parseCredential(key)
+	case userKey != "":
+		if !isUserKey(userKey) {
+			return nil, badRequest("userKey is not a hex encoded 32 bytes key")
+		}
+
+		req.cred = credential{UserKey: userKey}
+	case passphrase != "":
+		req.cred = credential{Passphrase: passphrase}
+	case contentKey != "":
+		if req.licenseFile != "" {
+			return nil, badRequest("contentKey and license cannot be posted together")
+		}
+
+		if req.contentKey, err = hex.DecodeString(contentKey); err != nil {
+			return nil, badRequest("error decoding content key: %w", err)
+		}
+	}
+
+	return req, nil
+}
+
+// saveFormFile saves the file posted in the field called name to filename,
+// and returns its original name.
+func saveFormFile(form *multipart.Form, name, filename string) (string, error) {
+	files := form.File[name]
+	if len(files) == 0 {
+		return "", http.ErrMissingFile
+	}
+
+	src, err := files[0].Open()
+	if err != nil {
+		return "", fmt.Errorf("error reading posted %s: %w", name, err)
+	}
+
+	defer src.Close()
+
+	fd, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	defer fd.Close()
+
+	if _, err := io.Copy(fd, src); err != nil {
+		return "", fmt.Errorf("error saving posted %s: %w", name, err)
+	}
+
+	return files[0].Filename, fd.Close()
+}
+
+// credential returns the credential to use for req, checking it against the
+// licenses of the book.
+func (s *decryptServer) credential(req *decryptRequest) (credential, error) {
+	licenseFile := req.licenseFile
+	if licenseFile == "" {
+		licenseFile = req.book
+	}
+
+	licenses, err := loadLicenses(licenseFile)
+	if err != nil {
+		return credential{}, badRequest("%w", err)
+	}
+
+	if req.licenseID != "" {
+		licenses = slices.DeleteFunc(licenses, func(l *lcp.License) bool { return l.ID != req.licenseID })
+
+		if len(licenses) == 0 {
+			return credential{}, badRequest("no license with ID %s", redact(req.licenseID))
+		}
+	}
+
+	if req.cred != (credential{}) {
+		for _, l := range licenses {
+			if checkCredential(l, req.cred) == nil {
+				return req.cred, nil
+			}
+		}
+
+		return credential{}, &requestError{status: http.StatusForbidden, err: errors.New("the key does not match the license of the book")}
+	}
+
+	if s.keyDBPath != "" {
+		db, err := loadKeyDB(s.keyDBPath)
+		if err != nil {
+			return credential{}, err
+		}
+
+		for _, l := range licenses {
+			if e, ok := db.lookup(l); ok {
+				return e.credential, nil
+			}
+		}
+	}
+
+	return credential{}, &requestError{status: http.StatusForbidden, err: fmt.Errorf("no key posted, and no stored key matches provider %s", licenses[0].Provider)}
+}
+
+// decrypt decrypts the book of req, and writes it to w.
+func (s *decryptServer) decrypt(ctx context.Context, w http.ResponseWriter, req *decryptRequest, dir string) error {
+	opts := append([]lcp.DecryptOption{lcp.WithContext(ctx)}, memoryOptions()...)
+	opts = append(opts, limitsOptions()...)
+
+	if req.contentKey != nil {
+		opts = append(opts, lcp.WithContentKey(req.contentKey))
+	} else {
+		cred, err := s.credential(req)
+		if err != nil {
+			return err
+		}
+
+		req.cred = cred
+	}
+
+	userKey, credOpts := req.cred.decryptArgs()
+	opts = append(opts, credOpts...)
+
+	if req.licenseFile != "" {
+		licenseFd, err := os.Open(req.licenseFile)
+		if err != nil {
+			return fmt.Errorf("error opening license file: %w", err)
+		}
+
+		defer licenseFd.Close()
+
+		opts = append(opts, lcp.WithExternalLicense(licenseFd))
+	}
+
+	if req.licenseID != "" {
+		opts = append(opts, lcp.WithLicenseID(req.licenseID))
+	}
+
+	if len(s.allowedProviders) > 0 {
+		opts = append(opts, lcp.WithAllowedProviders(s.allowedProviders))
+	}
+
+	if redactPII {
+		opts = append(opts, lcp.WithRedactPII())
+	}
+
+	outFilename := filepath.Join(dir, "out.epub")
+
+	if err := decryptFile(req.book, outFilename, req.format, userKey, opts...); err != nil {
+		if errors.Is(err, lcp.ErrProviderNotAllowed) {
+			return &requestError{status: http.StatusForbidden, err: err}
+		}
+
+		if errors.Is(err, lcp.ErrLimitExceeded) {
+			return &requestError{status: http.StatusRequestEntityTooLarge, err: err}
+		}
+
+		return &requestError{status: http.StatusUnprocessableEntity, err: err}
+	}
+
+	fd, err := os.Open(req.format.filename(outFilename))
+	if err != nil {
+		return fmt.Errorf("error opening decrypted book: %w", err)
+	}
+
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error stating decrypted book: %w", err)
+	}
+
+	w.Header().Set("Content-Type", req.format.mediaType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": req.outputName()}))
+
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+
+	if _, err := io.Copy(w, fd); err != nil {
+		log.Printf("Error sending decrypted %s: %s", req.name, err)
+		return nil // too late to report the error
+	}
+
+	log.Printf("Decrypted %s", req.name)
+
+	return nil
+}
+
+// handleCapabilities describes what the server supports, so that frontends
+// can adapt their forms to it.
+func (s *decryptServer) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	var formats []outputFormat
+
+	for _, f := range []outputFormat{formatEPUB, formatKepub, formatWebPub, formatWebPubDir, formatM4B, formatAudioDir} {
+		// Directories can't be sent in a response
+		if !f.isDirectory() {
+			formats = append(formats, f)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"lcp":     lcp.Capabilities(),
+		"formats": formats,
+	})
+}
+
+// httpError writes err as a JSON document, with the status of the request
+// error it wraps, if any.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		status = reqErr.status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveTokensEnv is the environment variable holding API tokens for the serve
+// command, as a comma separated list of TOKEN or TOKEN:CLASS items.
+const serveTokensEnv = "LCP_DECRYPT_SERVE_TOKENS"
+
+// defaultRateClass is the rate class of the tokens that don't name one.
+const defaultRateClass = "default"
+
+// serveToken is an API token accepted by the serve command.
+type serveToken struct {
+	token string
+	// class is the rate class of the token, which sets how many requests it
+	// can make per minute.
+	class string
+}
+
+// rateClassFlag collects the rate classes passed as repeated NAME=N flags, N
+// being the number of requests per minute.
+type rateClassFlag map[string]int
+
+func (f rateClassFlag) String() string {
+	items := make([]string, 0, len(f))
+	for name, n := range f {
+		items = append(items, name+"="+strconv.Itoa(n))
+	}
+
+	sort.Strings(items)
+
+	return strings.Join(items, ",")
+}
+
+func (f rateClassFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid rate class %q, expected NAME=REQUESTS_PER_MINUTE", s)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid number of requests per minute in rate class %q", s)
+	}
+
+	f[strings.TrimSpace(name)] = n
+
+	return nil
+}
+
+// parseServeToken parses a TOKEN or TOKEN CLASS item, the fields being
+// separated by sep.
+func parseServeToken(s string, sep func(rune) bool) (serveToken, error) {
+	fields := strings.FieldsFunc(s, sep)
+
+	switch len(fields) {
+	case 1:
+		return serveToken{token: fields[0], class: defaultRateClass}, nil
+	case 2:
+		return serveToken{token: fields[0], class: fields[1]}, nil
+	default:
+		return serveToken{}, errors.New("expected a token, optionally followed by its rate class")
+	}
+}
+
+// loadServeTokens reads the API tokens from filename, which holds one token
+// per line optionally followed by its rate class, and from the serveTokensEnv
+// environment variable.
+func loadServeTokens(filename string) ([]serveToken, error) {
+	var tokens []serveToken
+
+	for _, item := range strings.Split(os.Getenv(serveTokensEnv), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		t, err := parseServeToken(item, func(r rune) bool { return r == ':' })
+		if err != nil {
+			return nil, fmt.Errorf("invalid token in %s: %w", serveTokensEnv, err)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	if filename == "" {
+		return tokens, nil
+	}
+
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening tokens file: %w", err)
+	}
+
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		t, err := parseServeToken(text, func(r rune) bool { return r == ' ' || r == '\t' })
+		if err != nil {
+			return nil, fmt.Errorf("invalid token on line %d of %s: %w", line, filename, err)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading tokens file: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// serveAuth checks the API tokens of the requests made to the serve command,
+// and limits their rate according to their class.
+type serveAuth struct {
+	tokens   []serveToken
+	limiters map[string]*rateLimiter
+}
+
+// newServeAuth returns the authentication of the requests made with tokens,
+// whose rate classes are defined in classes. The default class is unlimited
+// unless classes defines it.
+func newServeAuth(tokens []serveToken, classes rateClassFlag) (*serveAuth, error) {
+	a := &serveAuth{tokens: tokens, limiters: map[string]*rateLimiter{}}
+
+	for name, perMinute := range classes {
+		a.limiters[name] = newRateLimiter(perMinute)
+	}
+
+	for _, t := range tokens {
+		if _, ok := classes[t.class]; !ok && t.class != defaultRateClass {
+			return nil, fmt.Errorf("unknown rate class %s, define it with -rateClass %s=N", t.class, t.class)
+		}
+	}
+
+	return a, nil
+}
+
+// enabled returns whether requests must present a token.
+func (a *serveAuth) enabled() bool {
+	return len(a.tokens) > 0
+}
+
+// lookup returns the index of token in the accepted tokens, or -1. All tokens
+// are compared in constant time.
+func (a *serveAuth) lookup(token string) int {
+	found := -1
+
+	for i, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.token), []byte(token)) == 1 && found < 0 {
+			found = i
+		}
+	}
+
+	return found
+}
+
+// middleware rejects the requests that don't present a valid bearer token, or
+// exceed the rate of their token class.
+func (a *serveAuth) middleware(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		i := -1
+		if ok {
+			i = a.lookup(strings.TrimSpace(token))
+		}
+
+		if i < 0 {
+			log.Printf("Rejected unauthenticated request from %s", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lcp-decrypt"`)
+			httpError(w, &requestError{status: http.StatusUnauthorized, err: errors.New("missing or invalid API token")})
+
+			return
+		}
+
+		t := a.tokens[i]
+
+		if ok, wait := a.limiters[t.class].allow(strconv.Itoa(i), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, &requestError{status: http.StatusTooManyRequests, err: fmt.Errorf("too many requests for rate class %s", t.class)})
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackAddr returns whether addr, a host:port listen address, only
+// accepts connections from the local machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
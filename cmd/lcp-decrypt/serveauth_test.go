@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// okHandler answers 200 to the requests that get through the middleware.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// doRequest sends a request through handler with authorization as its
+// Authorization header, if not empty.
+func doRequest(handler http.Handler, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/decrypt", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestServeAuthTokens(t *testing.T) {
+	auth, err := newServeAuth([]serveToken{
+		{token: "first-token", class: defaultRateClass},
+		{token: "second-token", class: defaultRateClass},
+	}, rateClassFlag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := auth.middleware(okHandler)
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong-token", http.StatusUnauthorized},
+		{"prefix of a token", "Bearer first", http.StatusUnauthorized},
+		{"not a bearer token", "Basic first-token", http.StatusUnauthorized},
+		{"empty bearer token", "Bearer ", http.StatusUnauthorized},
+		{"valid", "Bearer first-token", http.StatusOK},
+		{"other valid token", "Bearer second-token", http.StatusOK},
+		{"surrounding spaces", "Bearer  first-token ", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := doRequest(handler, tc.authorization)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, want %d (%s)", w.Code, tc.status, w.Body)
+			}
+
+			if challenge := w.Header().Get("WWW-Authenticate"); (tc.status == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("unexpected WWW-Authenticate header %q", challenge)
+			}
+		})
+	}
+}
+
+func TestServeAuthDisabled(t *testing.T) {
+	auth, err := newServeAuth(nil, rateClassFlag{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := doRequest(auth.middleware(okHandler), ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d without tokens configured, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServeAuthRateLimit(t *testing.T) {
+	auth, err := newServeAuth([]serveToken{
+		{token: "limited", class: "small"},
+		{token: "other-limited", class: "small"},
+		{token: "unlimited", class: defaultRateClass},
+	}, rateClassFlag{"small": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := auth.middleware(okHandler)
+
+	for i := 0; i < 2; i++ {
+		if w := doRequest(handler, "Bearer limited"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	w := doRequest(handler, "Bearer limited")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d over the limit, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// 2 requests per minute, the next one is allowed in 30 seconds
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("got Retry-After %q, want 30", retryAfter)
+	}
+
+	// Each token has its own bucket, even in the same class
+	if w := doRequest(handler, "Bearer other-limited"); w.Code != http.StatusOK {
+		t.Errorf("got status %d for another token of the class, want %d", w.Code, http.StatusOK)
+	}
+
+	for i := 0; i < 10; i++ {
+		if w := doRequest(handler, "Bearer unlimited"); w.Code != http.StatusOK {
+			t.Fatalf("request %d of the default class: got status %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	// Rejected requests are not counted against the limit of a token
+	if w := doRequest(handler, "Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a wrong token, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNewServeAuthUnknownClass(t *testing.T) {
+	if _, err := newServeAuth([]serveToken{{token: "t", class: "missing"}}, rateClassFlag{"small": 2}); err == nil {
+		t.Error("expected an error for an unknown rate class")
+	}
+}
+
+func TestLoadServeTokens(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens")
+
+	if err := os.WriteFile(filename, []byte("# API tokens\nfile-token\n\n  classed-token\tsmall  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(serveTokensEnv, "env-token, env-classed:large,")
+
+	tokens, err := loadServeTokens(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []serveToken{
+		{token: "env-token", class: defaultRateClass},
+		{token: "env-classed", class: "large"},
+		{token: "file-token", class: defaultRateClass},
+		{token: "classed-token", class: "small"},
+	}
+
+	if !slices.Equal(tokens, want) {
+		t.Errorf("got tokens %+v, want %+v", tokens, want)
+	}
+
+	t.Setenv(serveTokensEnv, "a:b:c")
+
+	if _, err := loadServeTokens(""); err == nil {
+		t.Error("expected an error for an invalid token")
+	}
+}
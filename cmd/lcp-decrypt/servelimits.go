@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sizeFlag is a size in bytes passed on the command line, either as a number
+// of bytes or with a K, M or G suffix (powers of 1024).
+type sizeFlag int64
+
+func (f *sizeFlag) String() string {
+	if f == nil {
+		return "0"
+	}
+
+	n := int64(*f)
+
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n > 0 && n%unit.size == 0 {
+			return strconv.FormatInt(n/unit.size, 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(n, 10)
+}
+
+func (f *sizeFlag) Set(value string) error {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+
+	multiplier := int64(1)
+
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, expected a number of bytes optionally followed by K, M or G", value)
+	}
+
+	*f = sizeFlag(n * multiplier)
+
+	return nil
+}
+
+// tempSpaceFactor is the number of copies of an upload that can be on disk
+// while handling a request: the spooled multipart form, the saved book and
+// the decrypted book.
+const tempSpaceFactor = 3
+
+// serveLimits protects the host of the serve command from oversized or too
+// many requests. Zero values disable the corresponding limit.
+type serveLimits struct {
+	maxUploadSize int64
+	tempQuota     int64
+	clients       *rateLimiter
+	jobs          chan struct{}
+
+	mu       sync.Mutex
+	tempUsed int64
+}
+
+func newServeLimits(maxUploadSize, tempQuota int64, maxJobs, clientRate int) *serveLimits {
+	l := &serveLimits{
+		maxUploadSize: maxUploadSize,
+		tempQuota:     tempQuota,
+	}
+
+	if clientRate > 0 {
+		l.clients = newRateLimiter(clientRate)
+	}
+
+	if maxJobs > 0 {
+		l.jobs = make(chan struct{}, maxJobs)
+	}
+
+	return l
+}
+
+// admit checks the limits that apply before reading a request. It returns the
+// function releasing the temporary space reserved for the request, which
+// must be called once it is handled.
+func (l *serveLimits) admit(w http.ResponseWriter, r *http.Request) (func(), error) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	if ok, wait := l.clients.allow(client, time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return nil, &requestError{status: http.StatusTooManyRequests, err: errors.New("too many requests from this client")}
+	}
+
+	size := r.ContentLength
+
+	if l.maxUploadSize > 0 {
+		if size > l.maxUploadSize {
+			return nil, l.tooLarge()
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, l.maxUploadSize)
+
+		if size < 0 {
+			size = l.maxUploadSize
+		}
+	}
+
+	if l.tempQuota <= 0 {
+		return func() {}, nil
+	}
+
+	if size < 0 {
+		return nil, &requestError{status: http.StatusLengthRequired, err: errors.New("the request must have a Content-Length")}
+	}
+
+	reserved := tempSpaceFactor * size
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tempUsed+reserved > l.tempQuota {
+		return nil, &requestError{status: http.StatusInsufficientStorage, err: errors.New("not enough temporary space to handle the request, try again later")}
+	}
+
+	l.tempUsed += reserved
+
+	return func() {
+		l.mu.Lock()
+		l.tempUsed -= reserved
+		l.mu.Unlock()
+	}, nil
+}
+
+func (l *serveLimits) tooLarge() error {
+	return &requestError{status: http.StatusRequestEntityTooLarge, err: fmt.Errorf("the request is larger than the maximum upload size (%s)", formatBytes(l.maxUploadSize))}
+}
+
+// acquireJob waits until less than the maximum number of jobs are running,
+// and returns the function to call once the job is done.
+func (l *serveLimits) acquireJob(ctx context.Context) (func(), error) {
+	if l.jobs == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.jobs <- struct{}{}:
+		return func() { <-l.jobs }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
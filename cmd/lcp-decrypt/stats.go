@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// memorySampleInterval is how often peakMemory samples the memory use.
+const memorySampleInterval = 10 * time.Millisecond
+
+// peakMemory records the peak of the memory obtained by the Go runtime from
+// the OS, which is close to the resident memory of the process.
+type peakMemory struct {
+	done chan struct{}
+	peak chan uint64
+}
+
+func startPeakMemory() *peakMemory {
+	m := &peakMemory{done: make(chan struct{}), peak: make(chan uint64)}
+
+	go func() {
+		sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+
+		var peak uint64
+
+		for {
+			metrics.Read(sample)
+			peak = max(peak, sample[0].Value.Uint64())
+
+			select {
+			case <-m.done:
+				m.peak <- peak
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return m
+}
+
+// stop stops sampling and returns the peak memory use, in bytes.
+func (m *peakMemory) stop() uint64 {
+	close(m.done)
+	return <-m.peak
+}
+
+// printStats prints the timings of a decryption and its peak memory use.
+func printStats(w io.Writer, t lcp.Timings, peakMemory uint64) {
+	phases := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"license parse", t.License},
+		{"key unwrap", t.KeyUnwrap},
+		{"read", t.Read},
+		{"decrypt", t.Decrypt},
+		{"inflate", t.Inflate},
+		{"compress", t.Compress},
+		{"write", t.Write},
+		{"total", t.Total},
+	}
+
+	for _, p := range phases {
+		fmt.Fprintf(w, "%-14s %10s\n", p.name+":", p.duration.Round(time.Microsecond))
+	}
+
+	var throughput float64
+	if seconds := t.Total.Seconds(); seconds > 0 {
+		throughput = float64(t.EncryptedBytes) / seconds / (1 << 20)
+	}
+
+	fmt.Fprintf(w, "%-14s %d bytes encrypted, %d bytes decrypted\n", "data:", t.EncryptedBytes, t.DecryptedBytes)
+	fmt.Fprintf(w, "%-14s %.1f MiB/s\n", "throughput:", throughput)
+	fmt.Fprintf(w, "%-14s %.1f MiB\n", "peak memory:", float64(peakMemory)/(1<<20))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// tlsConfig is the TLS configuration of all the network operations, set with
+// the -clientCert, -clientKey and -caBundle flags. It is nil when they are
+// not set.
+var tlsConfig *tls.Config
+
+// addTLSFlags registers the flags configuring TLS, for the license and status
+// servers requiring a client certificate (mutual TLS) or using a private
+// certificate authority. The returned function must be called once the flags
+// are parsed.
+func addTLSFlags(flags *flag.FlagSet) func() error {
+	certFilename := flags.String("clientCert", "", "PEM file holding the client certificate to present to the servers requiring one (mutual TLS), used with -clientKey")
+	keyFilename := flags.String("clientKey", "", "PEM file holding the private key of the -clientCert certificate (by default, the key is read from the -clientCert file)")
+	caFilename := flags.String("caBundle", "", "PEM file holding additional certificate authorities to trust, for servers using a private one")
+
+	return func() error {
+		if *certFilename == "" && *keyFilename == "" && *caFilename == "" {
+			return nil
+		}
+
+		config, err := loadTLSConfig(*certFilename, *keyFilename, *caFilename)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig = config
+
+		return nil
+	}
+}
+
+func loadTLSConfig(certFilename, keyFilename, caFilename string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if keyFilename != "" && certFilename == "" {
+		return nil, errors.New("-clientKey requires -clientCert")
+	}
+
+	if certFilename != "" {
+		if keyFilename == "" {
+			keyFilename = certFilename
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFilename != "" {
+		data, err := os.ReadFile(caFilename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+
+		// Trust the private authorities along with the system ones
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", caFilename)
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// newTLSTransport returns a transport using tlsConfig, or nil if there is none
+// (meaning the default transport).
+func newTLSTransport() http.RoundTripper {
+	if tlsConfig == nil {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig.Clone()
+
+	return transport
+}
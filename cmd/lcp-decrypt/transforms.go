@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// transformRule is a rule of the file passed in -transforms, rewriting the
+// decrypted files matching Files with one of the actions.
+type transformRule struct {
+	// Files is the pattern of the paths of the files to rewrite, as in
+	// path.Match. Patterns without a slash are matched against the file
+	// names only.
+	Files string `json:"files"`
+	// AppendFile and PrependFile are local files whose contents are added
+	// at the end or at the start of the files (for example custom CSS).
+	// Relative paths are resolved relative to the directory of the rules
+	// file.
+	AppendFile  string `json:"appendFile,omitempty"`
+	PrependFile string `json:"prependFile,omitempty"`
+	// Replace replaces all the occurrences of a string with With, and Regexp
+	// those of a regular expression (With can then refer to its groups, as
+	// $1).
+	Replace string  `json:"replace,omitempty"`
+	Regexp  string  `json:"regexp,omitempty"`
+	With    *string `json:"with,omitempty"`
+}
+
+// transformOptions are the options registering the transformers of the
+// -transforms rules.
+var transformOptions []lcp.DecryptOption
+
+func addTransformsFlag(flags *flag.FlagSet) {
+	flags.Func("transforms", "JSON file holding rules rewriting the decrypted files before they are written, for common fix-ups (custom CSS, broken references...), see the README for the format", func(filename string) error {
+		rules, err := loadTransformRules(filename)
+		if err != nil {
+			return err
+		}
+
+		transformOptions = nil
+
+		for _, r := range rules {
+			fn, err := r.transformer(filepath.Dir(filename))
+			if err != nil {
+				return fmt.Errorf("transform rules %s: files %s: %w", filename, r.Files, err)
+			}
+
+			transformOptions = append(transformOptions, lcp.WithTransformer(r.Files, fn))
+		}
+
+		return nil
+	})
+}
+
+func loadTransformRules(filename string) ([]transformRule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading transform rules: %w", err)
+	}
+
+	var rules []transformRule
+
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error decoding transform rules %s: %w", filename, err)
+	}
+
+	for i, r := range rules {
+		if r.Files == "" {
+			return nil, fmt.Errorf("transform rules %s: rule #%d: missing files pattern", filename, i+1)
+		}
+
+		if _, err := path.Match(r.Files, ""); err != nil {
+			return nil, fmt.Errorf("transform rules %s: rule #%d: invalid files pattern: %w", filename, i+1, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// transformer returns the function applying the action of the rule, baseDir
+// being the directory relative paths are resolved from.
+func (r transformRule) transformer(baseDir string) (lcp.TransformerFunc, error) {
+	actions := 0
+	for _, s := range []string{r.AppendFile, r.PrependFile, r.Replace, r.Regexp} {
+		if s != "" {
+			actions++
+		}
+	}
+
+	if actions != 1 {
+		return nil, fmt.Errorf("expected exactly one of appendFile, prependFile, replace or regexp")
+	}
+
+	if (r.Replace != "" || r.Regexp != "") && r.With == nil {
+		return nil, fmt.Errorf("missing with")
+	}
+
+	readFile := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(baseDir, name)
+		}
+
+		return os.ReadFile(name)
+	}
+
+	switch {
+	case r.AppendFile != "":
+		extra, err := readFile(r.AppendFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(_ string, data []byte) ([]byte, error) {
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				data = append(data, '\n')
+			}
+
+			return append(data, extra...), nil
+		}, nil
+	case r.PrependFile != "":
+		extra, err := readFile(r.PrependFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(_ string, data []byte) ([]byte, error) {
+			return append(extra[:len(extra):len(extra)], data...), nil
+		}, nil
+	case r.Replace != "":
+		old, replacement := []byte(r.Replace), []byte(*r.With)
+
+		return func(_ string, data []byte) ([]byte, error) {
+			return bytes.ReplaceAll(data, old, replacement), nil
+		}, nil
+	default:
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return nil, err
+		}
+
+		replacement := []byte(*r.With)
+
+		return func(_ string, data []byte) ([]byte, error) {
+			return re.ReplaceAll(data, replacement), nil
+		}, nil
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// trustStore records the licenses whose signature and status were verified,
+// so that later offline runs (for example on an air-gapped archival machine)
+// can treat them as validated.
+type trustStore struct {
+	Licenses []trustedLicense `json:"licenses"`
+}
+
+type trustedLicense struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	// CertificateSHA256 is the fingerprint of the provider certificate the
+	// license was signed with.
+	CertificateSHA256 string            `json:"certificateSha256"`
+	Status            lcp.LicenseStatus `json:"status"`
+	Validated         time.Time         `json:"validated"`
+}
+
+func defaultTrustStorePath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(configDir, "lcp-decrypt", "trust.json")
+}
+
+// loadTrustStore reads the trust store at path. A missing file yields an
+// empty store.
+func loadTrustStore(path string) (*trustStore, error) {
+	var store trustStore
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("error decoding trust store %s: %w", path, err)
+	}
+
+	return &store, nil
+}
+
+func (s *trustStore) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// License IDs are personal information
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	out, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+
+	defer out.Abort()
+
+	out.perm = 0o600
+
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+
+	return out.Commit()
+}
+
+// lookup returns the record of the license with the given ID, if it was
+// validated with the certificate whose fingerprint is given.
+func (s *trustStore) lookup(id, fingerprint string) (trustedLicense, bool) {
+	for _, l := range s.Licenses {
+		if l.ID == id && l.CertificateSHA256 == fingerprint {
+			return l, true
+		}
+	}
+
+	return trustedLicense{}, false
+}
+
+// record stores l, replacing any previous record of the same license.
+func (s *trustStore) record(l trustedLicense) {
+	s.Licenses = slices.DeleteFunc(s.Licenses, func(other trustedLicense) bool { return other.ID == l.ID })
+	s.Licenses = append(s.Licenses, l)
+}
+
+// licenseValidator checks the signature and the status of licenses before
+// decrypting their book (-verifyLicense flag).
+type licenseValidator struct {
+	storePath string
+	roots     *x509.CertPool
+}
+
+// addVerifyLicenseFlags registers the flags enabling the validation of the
+// licenses. The returned function must be called once the flags are parsed,
+// and returns nil if no validation was requested.
+func addVerifyLicenseFlags(flags *flag.FlagSet) func() (*licenseValidator, error) {
+	verify := flags.Bool("verifyLicense", false, "check the signature and the status of the license before decrypting, and record the licenses found valid in the trust store; with -offline, the licenses of the trust store are considered valid without fetching their status")
+	storePath := flags.String("trustStore", defaultTrustStorePath(), "path of the trust store, recording the licenses validated with -verifyLicense")
+	rootCAFilename := flags.String("rootCA", "", "PEM file holding the root certificates that must have issued the provider certificates (for example the EDRLab one), used by -verifyLicense; by default, only the signature itself is checked")
+
+	return func() (*licenseValidator, error) {
+		if !*verify {
+			return nil, nil
+		}
+
+		if *storePath == "" {
+			return nil, fmt.Errorf("-verifyLicense requires a -trustStore path")
+		}
+
+		v := &licenseValidator{storePath: *storePath}
+
+		if *rootCAFilename != "" {
+			data, err := os.ReadFile(*rootCAFilename)
+			if err != nil {
+				return nil, fmt.Errorf("error reading root certificates: %w", err)
+			}
+
+			v.roots = x509.NewCertPool()
+
+			if !v.roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %s", *rootCAFilename)
+			}
+		}
+
+		return v, nil
+	}
+}
+
+// verify checks the signature and the status of license. When offline, the
+// status is not fetched for the licenses found in the trust store.
+func (v *licenseValidator) verify(ctx context.Context, license *lcp.License) error {
+	if v == nil {
+		return nil
+	}
+
+	id := redact(license.ID)
+
+	if err := license.VerifySignature(v.roots); err != nil {
+		return fmt.Errorf("error verifying license %s: %w", id, err)
+	}
+
+	fingerprint, err := license.CertificateFingerprint()
+	if err != nil {
+		return err
+	}
+
+	store, err := loadTrustStore(v.storePath)
+	if err != nil {
+		return err
+	}
+
+	if offline {
+		if trusted, ok := store.lookup(license.ID, fingerprint); ok {
+			log.Printf("License %s was validated on %s", id, trusted.Validated.Local().Format(time.DateOnly))
+			return nil
+		}
+	}
+
+	status, err := fetchLicenseStatus(ctx, license)
+	if err != nil {
+		return fmt.Errorf("error checking the status of license %s: %w", id, err)
+	}
+
+	if !status.Status.IsUsable() {
+		if status.Message != "" {
+			return fmt.Errorf("license %s is %s: %s", id, status.Status, status.Message)
+		}
+
+		return fmt.Errorf("license %s is %s", id, status.Status)
+	}
+
+	log.Printf("License %s is valid (%s), recording it in the trust store", id, status.Status)
+
+	store.record(trustedLicense{
+		ID:                license.ID,
+		Provider:          license.Provider,
+		CertificateSHA256: fingerprint,
+		Status:            status.Status,
+		Validated:         time.Now().UTC(),
+	})
+
+	if err := store.save(v.storePath); err != nil {
+		return fmt.Errorf("error saving trust store: %w", err)
+	}
+
+	return nil
+}
+
+// fetchLicenseStatus fetches the status document of license. Cached copies
+// are not used, they can't prove that the license is still valid.
+func fetchLicenseStatus(ctx context.Context, license *lcp.License) (*lcp.StatusDocument, error) {
+	link, ok := license.Links.Link(lcp.LinkRelStatus)
+	if !ok {
+		return nil, fmt.Errorf("the license has no status link")
+	}
+
+	body, err := httpGet(ctx, newHTTPClient(), link.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := lcp.ParseStatusDocument(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if status.ID != license.ID {
+		return nil, fmt.Errorf("the status document is for another license")
+	}
+
+	return status, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// webhookTimeout bounds the time spent notifying the webhook of a job.
+const webhookTimeout = 30 * time.Second
+
+// Webhook events.
+const (
+	webhookDone   = "done"
+	webhookFailed = "failed"
+)
+
+// webhookEvent is the JSON payload posted to the webhook when a job
+// completes or fails.
+type webhookEvent struct {
+	Event   string    `json:"event"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	Input   string    `json:"input"`
+	// Output is where the decrypted book was written (the file name sent
+	// in the response for serve).
+	Output string       `json:"output,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Book   *webhookBook `json:"book,omitempty"`
+}
+
+// webhookBook is the metadata of the book of a webhookEvent, as far as it
+// could be read.
+type webhookBook struct {
+	Title      string   `json:"title,omitempty"`
+	Authors    []string `json:"authors,omitempty"`
+	Identifier string   `json:"identifier,omitempty"`
+	Provider   string   `json:"provider,omitempty"`
+}
+
+// webhook posts webhookEvents to a URL. Events are sent in the background, so
+// that a slow endpoint doesn't hold the jobs back.
+type webhook struct {
+	url    string
+	header http.Header
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// addWebhookFlags registers the flags configuring the webhook notified of the
+// jobs. The returned function must be called once the flags are parsed, and
+// returns nil if no webhook is configured.
+func addWebhookFlags(flags *flag.FlagSet) func() *webhook {
+	url := flags.String("webhook", "", "URL to POST a JSON notification to when a book is decrypted or fails to")
+	header := headerFlag{}
+	flags.Var(header, "webhookHeader", "HTTP header to send to the webhook, as \"Name: value\" (can be repeated)")
+
+	return func() *webhook {
+		if *url == "" {
+			return nil
+		}
+
+		return &webhook{url: *url, header: http.Header(header), client: newHTTPClient()}
+	}
+}
+
+// notify sends event in the background, reading the metadata of the book
+// from bookFilename and its license from licenseFilename (bookFilename if
+// empty).
+func (h *webhook) notify(event webhookEvent, bookFilename, licenseFilename string) {
+	if h == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.Book = readWebhookBook(bookFilename, licenseFilename)
+
+	h.wg.Add(1)
+
+	go func() {
+		defer h.wg.Done()
+
+		if err := h.post(event); err != nil {
+			log.Printf("Error notifying webhook of %s: %s", event.Input, err)
+		}
+	}()
+}
+
+func (h *webhook) post(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	for name, values := range h.header {
+		req.Header[name] = values
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// wait waits for the notifications being sent.
+func (h *webhook) wait() {
+	if h != nil {
+		h.wg.Wait()
+	}
+}
+
+// readWebhookBook reads the metadata of a book for a webhook notification,
+// returning nil if there is none.
+func readWebhookBook(bookFilename, licenseFilename string) *webhookBook {
+	var book webhookBook
+
+	if licenseFilename == "" {
+		licenseFilename = bookFilename
+	}
+
+	if license, err := loadLicense(licenseFilename); err == nil {
+		book.Provider = license.Provider
+	}
+
+	// The package document is never encrypted
+	if r, err := zip.OpenReader(bookFilename); err == nil {
+		defer r.Close()
+
+		if pkg, err := epub.ReadPackage(r); err == nil {
+			book.Title = pkg.Title()
+			book.Identifier = pkg.Identifier()
+
+			for _, c := range pkg.Metadata.Creators {
+				if name := strings.TrimSpace(c.Name); name != "" {
+					book.Authors = append(book.Authors, name)
+				}
+			}
+		}
+	}
+
+	if book.Title == "" && len(book.Authors) == 0 && book.Identifier == "" && book.Provider == "" {
+		return nil
+	}
+
+	return &book
+}
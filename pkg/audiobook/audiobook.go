@@ -0,0 +1,294 @@
+// Package audiobook repackages decrypted Readium audiobooks for regular audio
+// players, which don't know about Readium packages: as a single M4B file with
+// chapters, or as a folder holding one file per chapter.
+//
+// Audio streams are copied as they are, never re-encoded.
+package audiobook
+
+import (
+	"archive/zip"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+const manifestPath = "manifest.json"
+
+// Book describes an audiobook from its Readium manifest.
+type Book struct {
+	Title   string
+	Authors []string
+	// Tracks are the audio files of the reading order.
+	Tracks []Track
+	// Chapters are the entries of the table of contents, or one entry per
+	// track if the manifest has none.
+	Chapters []Chapter
+}
+
+// Track is an audio file of an audiobook.
+type Track struct {
+	// Path is the path of the file in the package.
+	Path  string
+	Type  string
+	Title string
+	// Duration is in seconds, 0 if the manifest does not tell it.
+	Duration float64
+}
+
+// Chapter is an entry of the table of contents of an audiobook.
+type Chapter struct {
+	Title string
+	// Track is the index of the track the chapter starts in.
+	Track int
+	// Offset is the position of the start of the chapter in its track, in
+	// seconds.
+	Offset float64
+}
+
+type manifest struct {
+	Metadata struct {
+		Title  json.RawMessage `json:"title"`
+		Author json.RawMessage `json:"author"`
+	} `json:"metadata"`
+	ReadingOrder []link `json:"readingOrder"`
+	TOC          []link `json:"toc"`
+}
+
+type link struct {
+	Href     string  `json:"href"`
+	Type     string  `json:"type"`
+	Title    string  `json:"title"`
+	Duration float64 `json:"duration"`
+	Children []link  `json:"children"`
+}
+
+// Read reads the manifest of the decrypted audiobook stored in fsys.
+func Read(fsys fs.FS) (*Book, error) {
+	data, err := fs.ReadFile(fsys, manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var m manifest
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+
+	b := &Book{
+		Title:   localizedString(m.Metadata.Title),
+		Authors: contributorNames(m.Metadata.Author),
+	}
+
+	trackIndex := map[string]int{}
+
+	for _, l := range m.ReadingOrder {
+		if !strings.HasPrefix(l.Type, "audio/") {
+			return nil, fmt.Errorf("%s is not an audio file (%s), only audiobooks can be repackaged", l.Href, l.Type)
+		}
+
+		p := epub.ResolveHref(manifestPath, l.Href)
+		trackIndex[p] = len(b.Tracks)
+		b.Tracks = append(b.Tracks, Track{Path: p, Type: l.Type, Title: l.Title, Duration: l.Duration})
+	}
+
+	if len(b.Tracks) == 0 {
+		return nil, fmt.Errorf("the manifest has no reading order")
+	}
+
+	var addChapters func(links []link)
+	addChapters = func(links []link) {
+		for _, l := range links {
+			if track, ok := trackIndex[epub.ResolveHref(manifestPath, l.Href)]; ok {
+				b.Chapters = append(b.Chapters, Chapter{Title: l.Title, Track: track, Offset: timeFragment(l.Href)})
+			}
+
+			addChapters(l.Children)
+		}
+	}
+	addChapters(m.TOC)
+
+	if len(b.Chapters) == 0 {
+		for i, t := range b.Tracks {
+			b.Chapters = append(b.Chapters, Chapter{Title: t.Title, Track: i})
+		}
+	}
+
+	for i := range b.Tracks {
+		if b.Tracks[i].Title == "" {
+			b.Tracks[i].Title = b.trackTitle(i)
+		}
+	}
+
+	return b, nil
+}
+
+// trackTitle names a track after the first chapter starting at its
+// beginning, or after its file.
+func (b *Book) trackTitle(track int) string {
+	for _, c := range b.Chapters {
+		if c.Track == track && c.Offset == 0 && c.Title != "" {
+			return c.Title
+		}
+	}
+
+	name := path.Base(b.Tracks[track].Path)
+
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// timeFragment returns the start time in seconds of a media fragment like
+// "#t=120" or "#t=120,180", or 0.
+func timeFragment(href string) float64 {
+	_, fragment, _ := strings.Cut(href, "#")
+
+	value, ok := strings.CutPrefix(fragment, "t=")
+	if !ok {
+		return 0
+	}
+
+	start, _, _ := strings.Cut(value, ",")
+
+	t, err := strconv.ParseFloat(strings.TrimPrefix(start, "npt:"), 64)
+	if err != nil || t < 0 {
+		return 0
+	}
+
+	return t
+}
+
+// localizedString decodes a manifest string, which can also be a map of
+// translations.
+func localizedString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	var translations map[string]string
+	if json.Unmarshal(raw, &translations) != nil {
+		return ""
+	}
+
+	if s, ok := translations["en"]; ok {
+		return s
+	}
+
+	for _, s := range translations {
+		return s
+	}
+
+	return ""
+}
+
+// contributorNames decodes a manifest contributor, which can be a name, an
+// object with a name, or an array of either.
+func contributorNames(raw json.RawMessage) []string {
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		items = []json.RawMessage{raw}
+	}
+
+	var names []string
+
+	for _, item := range items {
+		name := localizedString(item)
+
+		if name == "" {
+			var c struct {
+				Name json.RawMessage `json:"name"`
+			}
+
+			if json.Unmarshal(item, &c) == nil {
+				name = localizedString(c.Name)
+			}
+		}
+
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Extract writes the tracks of the decrypted audiobook in in to the directory
+// dir, which must exist, naming them after their number and title
+// ("01 - Chapter 1.mp3"). inSize should be the total size of the input data.
+func Extract(dir string, in io.ReaderAt, inSize int64) error {
+	inFile, b, err := open(in, inSize)
+	if err != nil {
+		return err
+	}
+
+	width := max(2, len(strconv.Itoa(len(b.Tracks))))
+
+	for i, t := range b.Tracks {
+		name := fmt.Sprintf("%0*d - %s%s", width, i+1, cmp.Or(sanitizeFilename(t.Title), "Track"), path.Ext(t.Path))
+
+		if err := extractFile(inFile, t.Path, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("error extracting file %s: %w", t.Path, err)
+		}
+	}
+
+	return nil
+}
+
+func open(in io.ReaderAt, inSize int64) (*zip.Reader, *Book, error) {
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening input file: %w", err)
+	}
+
+	b, err := Read(inFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return inFile, b, nil
+}
+
+func extractFile(fsys fs.FS, name, dst string) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dstFd, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	defer dstFd.Close()
+
+	if _, err := io.Copy(dstFd, src); err != nil {
+		return err
+	}
+
+	return dstFd.Close()
+}
+
+// sanitizeFilename replaces the characters that are not allowed in file
+// names on common systems.
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+
+		return r
+	}, s)
+
+	return strings.TrimRight(strings.TrimSpace(s), ".")
+}
@@ -0,0 +1,171 @@
+package audiobook
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConvertM4B reads the decrypted audiobook in in, and writes to out an M4B
+// file joining its tracks, with a chapter for each entry of its table of
+// contents. inSize should be the total size of the input data.
+//
+// The audio streams are remuxed, not re-encoded, using the ffmpeg program
+// (and ffprobe for the tracks whose duration the manifest does not tell).
+// The tracks must all use the same codec, which is the case of the
+// audiobooks sold in stores.
+func ConvertM4B(out io.Writer, in io.ReaderAt, inSize int64) error {
+	inFile, b, err := open(in, inSize)
+	if err != nil {
+		return err
+	}
+
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("converting audiobooks to M4B requires ffmpeg: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "lcp-decrypt-m4b-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var list strings.Builder
+
+	for i, t := range b.Tracks {
+		name := fmt.Sprintf("%04d%s", i, path.Ext(t.Path))
+
+		if err := extractFile(inFile, t.Path, filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("error extracting file %s: %w", t.Path, err)
+		}
+
+		if t.Duration <= 0 {
+			if b.Tracks[i].Duration, err = probeDuration(filepath.Join(dir, name)); err != nil {
+				return fmt.Errorf("error reading the duration of %s: %w", t.Path, err)
+			}
+		}
+
+		fmt.Fprintf(&list, "file '%s'\n", name)
+	}
+
+	listFilename := filepath.Join(dir, "tracks.txt")
+	if err := os.WriteFile(listFilename, []byte(list.String()), 0o600); err != nil {
+		return fmt.Errorf("error writing track list: %w", err)
+	}
+
+	metadataFilename := filepath.Join(dir, "metadata.txt")
+	if err := os.WriteFile(metadataFilename, b.ffmetadata(), 0o600); err != nil {
+		return fmt.Errorf("error writing chapters: %w", err)
+	}
+
+	outFilename := filepath.Join(dir, "out.m4b")
+
+	cmd := exec.Command("ffmpeg", "-nostdin", "-v", "error",
+		"-f", "concat", "-safe", "0", "-i", listFilename,
+		"-i", metadataFilename,
+		"-map", "0:a", "-map_metadata", "1", "-map_chapters", "1",
+		"-c", "copy", "-movflags", "+faststart", "-f", "mp4", outFilename)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	fd, err := os.Open(outFilename)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	if _, err := io.Copy(out, fd); err != nil {
+		return fmt.Errorf("error copying M4B file: %w", err)
+	}
+
+	return nil
+}
+
+// ffmetadata returns the global metadata and the chapters of the book in the
+// FFMETADATA format of ffmpeg. The durations of all tracks must be known.
+func (b *Book) ffmetadata() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(";FFMETADATA1\n")
+
+	if b.Title != "" {
+		fmt.Fprintf(&buf, "title=%s\nalbum=%s\n", ffmetadataEscape(b.Title), ffmetadataEscape(b.Title))
+	}
+
+	if len(b.Authors) > 0 {
+		fmt.Fprintf(&buf, "artist=%s\n", ffmetadataEscape(strings.Join(b.Authors, ", ")))
+	}
+
+	buf.WriteString("genre=Audiobook\n")
+
+	trackStarts := make([]float64, len(b.Tracks)+1)
+	for i, t := range b.Tracks {
+		trackStarts[i+1] = trackStarts[i] + t.Duration
+	}
+
+	total := trackStarts[len(b.Tracks)]
+
+	for i, c := range b.Chapters {
+		start := min(trackStarts[c.Track]+c.Offset, total)
+
+		end := total
+		if i+1 < len(b.Chapters) {
+			next := b.Chapters[i+1]
+			end = min(trackStarts[next.Track]+next.Offset, total)
+		}
+
+		if end <= start {
+			continue // out of order, or past the end
+		}
+
+		title := c.Title
+		if title == "" {
+			title = b.Tracks[c.Track].Title
+		}
+
+		fmt.Fprintf(&buf, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n", int64(start*1000), int64(end*1000), ffmetadataEscape(title))
+	}
+
+	return buf.Bytes()
+}
+
+// ffmetadataEscape escapes the characters with a special meaning in the
+// FFMETADATA format.
+func ffmetadataEscape(s string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		switch r {
+		case '=', ';', '#', '\\', '\n':
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// probeDuration returns the duration in seconds of an audio file, using
+// ffprobe.
+func probeDuration(filename string) (float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", filename).Output()
+	if err != nil {
+		return 0, fmt.Errorf("error running ffprobe: %w", err)
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
@@ -0,0 +1,262 @@
+// Package epub reads the structure of EPUB publications: the container file
+// pointing to the package document, and the package document itself (metadata,
+// manifest and spine).
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ContainerPath is the path of the container file in an EPUB file.
+const ContainerPath = "META-INF/container.xml"
+
+// PackageMediaType is the media type of EPUB package documents.
+const PackageMediaType = "application/oebps-package+xml"
+
+type container struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// Package is an EPUB package document (the .opf file).
+type Package struct {
+	// Path is the path of the package document in the EPUB file.
+	Path string `xml:"-"`
+
+	Version          string   `xml:"version,attr"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         Metadata `xml:"metadata"`
+	Manifest         []Item   `xml:"manifest>item"`
+	Spine            Spine    `xml:"spine"`
+}
+
+// Metadata holds the Dublin Core metadata and the meta elements of a package
+// document.
+type Metadata struct {
+	Identifiers  []Identifier `xml:"identifier"`
+	Titles       []string     `xml:"title"`
+	Creators     []Creator    `xml:"creator"`
+	Contributors []Creator    `xml:"contributor"`
+	Languages    []string     `xml:"language"`
+	Publisher    string       `xml:"publisher"`
+	Date         string       `xml:"date"`
+	Description  string       `xml:"description"`
+	Subjects     []string     `xml:"subject"`
+	Rights       string       `xml:"rights"`
+	Meta         []Meta       `xml:"meta"`
+}
+
+// Identifier is a dc:identifier element.
+type Identifier struct {
+	ID     string `xml:"id,attr"`
+	Scheme string `xml:"scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// Creator is a dc:creator or dc:contributor element.
+type Creator struct {
+	ID     string `xml:"id,attr"`
+	Role   string `xml:"role,attr"`
+	FileAs string `xml:"file-as,attr"`
+	Name   string `xml:",chardata"`
+}
+
+// Meta is a meta element, either in the EPUB 3 form (property/refines and a
+// text value) or in the EPUB 2 form (name/content attributes).
+type Meta struct {
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Item is a resource listed in the manifest of a package document.
+type Item struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+// HasProperty returns whether the item has the given property (for example
+// "nav" or "cover-image").
+func (i Item) HasProperty(property string) bool {
+	return slices.Contains(strings.Fields(i.Properties), property)
+}
+
+// Spine is the default reading order of a publication.
+type Spine struct {
+	Toc      string    `xml:"toc,attr"`
+	ItemRefs []ItemRef `xml:"itemref"`
+}
+
+// ItemRef is a reference to a manifest item in the spine.
+type ItemRef struct {
+	IDRef  string `xml:"idref,attr"`
+	Linear string `xml:"linear,attr"`
+}
+
+// ReadPackage reads the package document of the EPUB publication stored in
+// fsys, usually a *zip.Reader.
+func ReadPackage(fsys fs.FS) (*Package, error) {
+	data, err := fs.ReadFile(fsys, ContainerPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading container file: %w", err)
+	}
+
+	var c container
+
+	if err := xml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error decoding container file: %w", err)
+	}
+
+	packagePath := ""
+
+	for _, r := range c.Rootfiles {
+		if r.MediaType == PackageMediaType || r.MediaType == "" {
+			packagePath = r.FullPath
+			break
+		}
+	}
+
+	if packagePath == "" {
+		return nil, errors.New("container file does not reference any package document")
+	}
+
+	if data, err = fs.ReadFile(fsys, packagePath); err != nil {
+		return nil, fmt.Errorf("error reading package document: %w", err)
+	}
+
+	var p Package
+
+	if err := xml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("error decoding package document %s: %w", packagePath, err)
+	}
+
+	p.Path = packagePath
+
+	return &p, nil
+}
+
+// Item returns the manifest item with the given ID.
+func (p *Package) Item(id string) (Item, bool) {
+	for _, item := range p.Manifest {
+		if item.ID == id {
+			return item, true
+		}
+	}
+
+	return Item{}, false
+}
+
+// ItemPath returns the path of a manifest item in the EPUB file. Item hrefs
+// are relative to the package document.
+func (p *Package) ItemPath(item Item) string {
+	return p.ResolveHref(item.Href)
+}
+
+// ResolveHref returns the path in the EPUB file of href, relative to the
+// package document. Any fragment is dropped.
+func (p *Package) ResolveHref(href string) string {
+	return ResolveHref(p.Path, href)
+}
+
+// ResolveHref returns the path in the EPUB file of href, relative to the
+// document at base. Any fragment is dropped.
+func ResolveHref(base, href string) string {
+	href, _, _ = strings.Cut(href, "#")
+
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+
+	return strings.TrimPrefix(path.Join(path.Dir(base), href), "/")
+}
+
+// ReadingOrder returns the manifest items listed in the spine, in order.
+func (p *Package) ReadingOrder() []Item {
+	items := make([]Item, 0, len(p.Spine.ItemRefs))
+
+	for _, ref := range p.Spine.ItemRefs {
+		if item, ok := p.Item(ref.IDRef); ok {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Title returns the main title of the publication.
+func (p *Package) Title() string {
+	if len(p.Metadata.Titles) == 0 {
+		return ""
+	}
+
+	return strings.TrimSpace(p.Metadata.Titles[0])
+}
+
+// Identifier returns the unique identifier of the publication.
+func (p *Package) Identifier() string {
+	for _, id := range p.Metadata.Identifiers {
+		if id.ID == p.UniqueIdentifier {
+			return strings.TrimSpace(id.Value)
+		}
+	}
+
+	if len(p.Metadata.Identifiers) > 0 {
+		return strings.TrimSpace(p.Metadata.Identifiers[0].Value)
+	}
+
+	return ""
+}
+
+// Property returns the value of the first EPUB 3 meta element with the given
+// property that does not refine another element.
+func (p *Package) Property(property string) string {
+	for _, m := range p.Metadata.Meta {
+		if m.Property == property && m.Refines == "" {
+			return strings.TrimSpace(m.Value)
+		}
+	}
+
+	return ""
+}
+
+// Cover returns the manifest item of the cover image, if any.
+func (p *Package) Cover() (Item, bool) {
+	for _, item := range p.Manifest {
+		if item.HasProperty("cover-image") {
+			return item, true
+		}
+	}
+
+	// EPUB 2 style <meta name="cover" content="item-id"/>
+	for _, m := range p.Metadata.Meta {
+		if m.Name == "cover" {
+			return p.Item(m.Content)
+		}
+	}
+
+	return Item{}, false
+}
+
+// Nav returns the manifest item of the EPUB 3 navigation document, if any.
+func (p *Package) Nav() (Item, bool) {
+	for _, item := range p.Manifest {
+		if item.HasProperty("nav") {
+			return item, true
+		}
+	}
+
+	return Item{}, false
+}
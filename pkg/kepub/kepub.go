@@ -0,0 +1,260 @@
+// Package kepub converts EPUB files to kepub, the flavour of EPUB used by Kobo
+// e-readers. Kobo readers only enable their full set of features (reading
+// statistics, accurate progress...) on kepub files.
+//
+// The conversion wraps each sentence of the content documents in a span with
+// the "koboSpan" class, and the body of each document in the "book-columns"
+// and "book-inner" divs.
+package kepub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Convert reads an EPUB file from in and writes its kepub version to out.
+// inSize should be the total size of the input data.
+func Convert(out io.Writer, in io.ReaderAt, inSize int64) error {
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+
+	outZip := zip.NewWriter(out)
+
+	if err := outZip.SetComment(inFile.Comment); err != nil {
+		return fmt.Errorf("error setting output file comment: %w", err)
+	}
+
+	for _, f := range inFile.File {
+		if isContentDocument(f.Name) {
+			err = convertEntry(outZip, f)
+		} else {
+			err = copyEntry(outZip, f)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error converting file %s: %w", f.Name, err)
+		}
+	}
+
+	if err := outZip.Close(); err != nil {
+		return fmt.Errorf("error finalizing output zip file: %w", err)
+	}
+
+	return nil
+}
+
+func isContentDocument(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".xhtml", ".html", ".htm":
+		return true
+	default:
+		return false
+	}
+}
+
+func copyEntry(outZip *zip.Writer, f *zip.File) error {
+	header := f.FileHeader
+
+	dst, err := outZip.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("error appending file: %w", err)
+	}
+
+	src, err := f.OpenRaw()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("error copying data: %w", err)
+	}
+
+	return nil
+}
+
+func convertEntry(outZip *zip.Writer, f *zip.File) error {
+	src, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+
+	defer src.Close()
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+
+	dst, err := outZip.CreateHeader(&zip.FileHeader{
+		Name:         f.Name,
+		Method:       zip.Deflate,
+		Modified:     f.Modified,
+		ModifiedTime: f.ModifiedTime,
+		ModifiedDate: f.ModifiedDate,
+	})
+	if err != nil {
+		return fmt.Errorf("error appending file: %w", err)
+	}
+
+	if _, err := dst.Write(AddSpans(data)); err != nil {
+		return fmt.Errorf("error writing data: %w", err)
+	}
+
+	return nil
+}
+
+// paragraphElements are the elements starting a new paragraph in the span
+// numbering.
+var paragraphElements = map[string]bool{
+	"p": true, "div": true, "li": true, "blockquote": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"td": true, "th": true, "dt": true, "dd": true, "caption": true,
+	"figcaption": true, "section": true, "aside": true,
+}
+
+// ignoredElements are the elements whose text must not be wrapped in spans.
+var ignoredElements = map[string]bool{
+	"script": true, "style": true, "svg": true, "math": true, "title": true,
+	"textarea": true,
+}
+
+var (
+	tagNameRegexp  = regexp.MustCompile(`^</?\s*([a-zA-Z][a-zA-Z0-9:-]*)`)
+	sentenceRegexp = regexp.MustCompile(`[^.!?…]*[.!?…]+['"’”)\]]*\s*|[^.!?…]+$`)
+)
+
+// AddSpans wraps the sentences of an (X)HTML document in Kobo spans. The
+// markup is processed as text, so that the document is otherwise left
+// untouched.
+func AddSpans(doc []byte) []byte {
+	var (
+		res       bytes.Buffer
+		inBody    bool
+		ignored   int // depth of nested ignored elements
+		paragraph int
+		sentence  int
+		wrapped   bool // whether the body was wrapped in the Kobo divs
+	)
+
+	res.Grow(len(doc) * 2)
+
+	for len(doc) > 0 {
+		if doc[0] != '<' {
+			end := bytes.IndexByte(doc, '<')
+			if end == -1 {
+				end = len(doc)
+			}
+
+			text := doc[:end]
+			doc = doc[end:]
+
+			if !inBody || ignored > 0 || len(bytes.TrimSpace(text)) == 0 {
+				res.Write(text)
+				continue
+			}
+
+			if paragraph == 0 {
+				paragraph = 1
+			}
+
+			for _, s := range sentenceRegexp.FindAll(text, -1) {
+				trimmed := bytes.TrimRight(s, " \t\r\n")
+				if len(bytes.TrimSpace(trimmed)) == 0 {
+					res.Write(s)
+					continue
+				}
+
+				sentence++
+				fmt.Fprintf(&res, `<span class="koboSpan" id="kobo.%d.%d">%s</span>%s`, paragraph, sentence, trimmed, s[len(trimmed):])
+			}
+
+			continue
+		}
+
+		end := markupEnd(doc)
+		markup := doc[:end]
+		doc = doc[end:]
+
+		match := tagNameRegexp.FindSubmatch(markup)
+		if match == nil {
+			// Comment, processing instruction, doctype...
+			res.Write(markup)
+			continue
+		}
+
+		name := strings.ToLower(string(match[1]))
+		if i := strings.IndexByte(name, ':'); i != -1 {
+			name = name[i+1:]
+		}
+
+		closing := markup[1] == '/'
+		selfClosing := bytes.HasSuffix(markup, []byte("/>"))
+
+		if name == "body" && closing && wrapped {
+			res.WriteString(`</div></div>`)
+			wrapped = false
+		}
+
+		res.Write(markup)
+
+		switch {
+		case name == "body":
+			inBody = !closing
+
+			if inBody && !bytes.Contains(doc, []byte(`id="book-columns"`)) {
+				res.WriteString(`<div id="book-columns"><div id="book-inner">`)
+				wrapped = true
+			}
+		case ignoredElements[name] && !selfClosing:
+			if closing {
+				ignored = max(0, ignored-1)
+			} else {
+				ignored++
+			}
+		case paragraphElements[name] && !closing:
+			paragraph++
+			sentence = 0
+		}
+	}
+
+	return res.Bytes()
+}
+
+// markupEnd returns the length of the markup (tag, comment...) doc starts
+// with.
+func markupEnd(doc []byte) int {
+	for _, delims := range [][2]string{{"<!--", "-->"}, {"<![CDATA[", "]]>"}, {"<?", "?>"}} {
+		if bytes.HasPrefix(doc, []byte(delims[0])) {
+			if i := bytes.Index(doc, []byte(delims[1])); i != -1 {
+				return i + len(delims[1])
+			}
+
+			return len(doc)
+		}
+	}
+
+	// Look for the end of the tag, skipping quoted attribute values
+	var quote byte
+
+	for i := 1; i < len(doc); i++ {
+		switch c := doc[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+
+	return len(doc)
+}
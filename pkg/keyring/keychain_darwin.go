@@ -0,0 +1,84 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	Register(keychain{})
+}
+
+// errSecItemNotFound is the exit status of the security command when the item
+// does not exist.
+const errSecItemNotFound = 44
+
+// keychain stores the secrets in the macOS Keychain, with the security
+// command.
+type keychain struct{}
+
+func (keychain) Name() string {
+	return "macOS Keychain"
+}
+
+func (keychain) Available() bool {
+	_, err := exec.LookPath("security")
+	return err == nil
+}
+
+func (keychain) Get(service, account string) (string, error) {
+	out, err := runSecurity(nil, "find-generic-password", "-s", service, "-a", account, "-w")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (keychain) Set(service, account, secret string) error {
+	for _, s := range []string{service, account} {
+		if strings.ContainsAny(s, "\"\\\n") {
+			return fmt.Errorf("invalid keychain item name %q", s)
+		}
+	}
+
+	// The secret goes through the standard input of an interactive session
+	// rather than the command line, where other users could see it.
+	command := fmt.Sprintf("add-generic-password -U -s \"%s\" -a \"%s\" -X %s\n", service, account, hex.EncodeToString([]byte(secret)))
+	_, err := runSecurity(strings.NewReader(command), "-i")
+
+	return err
+}
+
+func (keychain) Delete(service, account string) error {
+	_, err := runSecurity(nil, "delete-generic-password", "-s", service, "-a", account)
+	return err
+}
+
+func runSecurity(stdin *strings.Reader, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("security", args...)
+	cmd.Stderr = &stderr
+
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == errSecItemNotFound {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error running security: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
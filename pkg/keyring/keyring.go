@@ -0,0 +1,58 @@
+// Package keyring stores secrets in the credential store of the operating
+// system: the Keychain on macOS, the Credential Manager on Windows, and the
+// Secret Service (GNOME Keyring, KWallet...) through libsecret on the other
+// systems. Other stores can be plugged in by registering a Backend.
+package keyring
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+// ErrNotFound is returned when a secret is not in the store.
+var ErrNotFound = errors.New("secret not found in the keyring")
+
+// Backend is a credential store, holding secrets identified by a service and
+// an account name.
+type Backend interface {
+	// Name identifies the store, for example in messages.
+	Name() string
+	// Available returns true if the store can be used on this machine.
+	Available() bool
+	// Get returns the secret of account, or ErrNotFound.
+	Get(service, account string) (string, error)
+	// Set stores the secret of account, replacing the existing one.
+	Set(service, account, secret string) error
+	// Delete removes the secret of account, or returns ErrNotFound.
+	Delete(service, account string) error
+}
+
+var (
+	mu       sync.RWMutex
+	backends []Backend
+)
+
+// Register makes a backend available. The backends registered last are tried
+// first, so that they take precedence over the built-in ones.
+func Register(b Backend) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	backends = append([]Backend{b}, backends...)
+}
+
+// Default returns the first available backend, or an error if there is none.
+func Default() (Backend, error) {
+	mu.RLock()
+	candidates := slices.Clone(backends)
+	mu.RUnlock()
+
+	for _, b := range candidates {
+		if b.Available() {
+			return b, nil
+		}
+	}
+
+	return nil, errors.New("no keyring is available on this system")
+}
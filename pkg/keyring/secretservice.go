@@ -0,0 +1,81 @@
+//go:build linux || freebsd || netbsd || openbsd || dragonfly
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	Register(secretService{})
+}
+
+// secretService stores the secrets in the Secret Service of the desktop
+// (GNOME Keyring, KWallet...), with the secret-tool command of libsecret.
+type secretService struct{}
+
+func (secretService) Name() string {
+	return "Secret Service"
+}
+
+func (secretService) Available() bool {
+	_, err := exec.LookPath("secret-tool")
+	return err == nil
+}
+
+func (secretService) Get(service, account string) (string, error) {
+	out, err := runSecretTool(nil, "lookup", "service", service, "account", account)
+	if err != nil {
+		return "", err
+	}
+
+	// secret-tool fails without any message when there is no such secret
+	if len(out) == 0 {
+		return "", ErrNotFound
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (secretService) Set(service, account, secret string) error {
+	label := fmt.Sprintf("%s (%s)", service, account)
+	_, err := runSecretTool(strings.NewReader(secret), "store", "--label", label, "service", service, "account", account)
+
+	return err
+}
+
+func (s secretService) Delete(service, account string) error {
+	// clear succeeds even if there is no such secret
+	if _, err := s.Get(service, account); err != nil {
+		return err
+	}
+
+	_, err := runSecretTool(nil, "clear", "service", service, "account", account)
+
+	return err
+}
+
+func runSecretTool(stdin *strings.Reader, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stderr = &stderr
+
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() == 0 && len(out) == 0 {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error running secret-tool: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
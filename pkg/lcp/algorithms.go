@@ -0,0 +1,131 @@
+package lcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// DecipherFunc decrypts the contents of a resource encrypted with an
+// algorithm (the EncryptionMethod of encryption.xml, or the encryption
+// algorithm of a Readium manifest). data is the encrypted contents, and can
+// be modified in place; key is the content key of the publication (the key
+// derived from its unique identifier for the font obfuscations). The
+// anomalies that don't prevent decryption (for example a malformed padding)
+// can be reported with warn, msg being appended to "file PATH ".
+type DecipherFunc func(data, key []byte, warn func(msg string)) ([]byte, error)
+
+type registeredAlgorithm struct {
+	decipher DecipherFunc
+	// streamable tells whether the algorithm is a built in one that can be
+	// decrypted one chunk at a time (see WithMaxMemory).
+	streamable bool
+}
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = map[EncryptionAlgorithm]registeredAlgorithm{}
+)
+
+func init() {
+	registerAlgorithm(EncryptionAlgorithmAES256CBC, decipherAES256CBCResource, true)
+	registerAlgorithm(EncryptionAlgorithmAES256GCM, decipherAES256GCMResource, false)
+	registerAlgorithm(EncryptionAlgorithmFontObfuscation, decipherFontObfuscationResource, true)
+	registerAlgorithm(EncryptionAlgorithmAdobeFontObfuscation, decipherAdobeFontObfuscationResource, true)
+}
+
+// RegisterAlgorithm makes Decrypt use fn to decrypt the resources encrypted
+// with the algorithm identified by uri, for example a vendor specific one.
+// Registering a built in algorithm again replaces its implementation.
+// RegisterAlgorithm is meant to be called from init functions.
+func RegisterAlgorithm(uri string, fn DecipherFunc) {
+	registerAlgorithm(EncryptionAlgorithm(uri), fn, false)
+}
+
+func registerAlgorithm(alg EncryptionAlgorithm, fn DecipherFunc, streamable bool) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	algorithms[alg] = registeredAlgorithm{decipher: fn, streamable: streamable}
+}
+
+func lookupAlgorithm(alg EncryptionAlgorithm) (registeredAlgorithm, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	a, ok := algorithms[alg]
+
+	return a, ok
+}
+
+// registeredAlgorithms returns the registered algorithms, sorted.
+func registeredAlgorithms() []EncryptionAlgorithm {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	res := make([]EncryptionAlgorithm, 0, len(algorithms))
+
+	for alg := range algorithms {
+		res = append(res, alg)
+	}
+
+	slices.Sort(res)
+
+	return res
+}
+
+// checkAlgorithm returns an error if no implementation of alg is registered.
+func checkAlgorithm(path string, alg EncryptionAlgorithm) error {
+	if _, ok := lookupAlgorithm(alg); !ok {
+		return newError(MsgUnsupportedAlgorithm, fmt.Errorf("unsupported encryption algorithm for file %s: %s", path, alg), path, alg)
+	}
+
+	return nil
+}
+
+func decipherAES256CBCResource(data, key []byte, warn func(msg string)) ([]byte, error) {
+	res, validPadding, err := decipherAES256CBCPadding(data, key)
+	if err == nil && !validPadding {
+		warn("has a malformed padding, it might be corrupted")
+	}
+
+	return res, err
+}
+
+// decipherAES256GCMResource decrypts AES-256-GCM data, prefixed with its
+// nonce and followed by the authentication tag (XML Encryption 1.1).
+func decipherAES256GCMResource(data, key []byte, warn func(msg string)) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("data is too short (%d bytes)", len(data))
+	}
+
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	// Decrypt in place, data can be large
+	res, err := gcm.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating data: %w", err)
+	}
+
+	return res, nil
+}
+
+func decipherFontObfuscationResource(data, key []byte, warn func(msg string)) ([]byte, error) {
+	return deobfuscateFont(data, key, fontObfuscations[EncryptionAlgorithmFontObfuscation].length), nil
+}
+
+func decipherAdobeFontObfuscationResource(data, key []byte, warn func(msg string)) ([]byte, error) {
+	return deobfuscateFont(data, key, fontObfuscations[EncryptionAlgorithmAdobeFontObfuscation].length), nil
+}
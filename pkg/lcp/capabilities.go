@@ -0,0 +1,80 @@
+package lcp
+
+// Optional features reported by Capabilities.
+const (
+	// FeatureFastInflate means that resources are decompressed with the
+	// faster deflate implementation of the klauspost build tag.
+	FeatureFastInflate = "fast-inflate"
+	// FeatureResourcesIterator means that Resources is available (it
+	// requires Go 1.23).
+	FeatureResourcesIterator = "resources-iterator"
+	// FeatureSignatureVerification means that License.VerifySignature is
+	// available.
+	FeatureSignatureVerification = "signature-verification"
+	// FeaturePassphraseVariants means that WithPassphraseVariants is
+	// available.
+	FeaturePassphraseVariants = "passphrase-variants"
+	// FeatureProfileTransforms means that WithProfileTransform is
+	// available, to use passphrases with production profiles.
+	FeatureProfileTransforms = "profile-transforms"
+	// FeaturePreview means that WithPreview is available.
+	FeaturePreview = "preview"
+	// FeatureConcurrency means that WithConcurrency is available.
+	FeatureConcurrency = "concurrency"
+	// FeatureMaxMemory means that WithMaxMemory is available.
+	FeatureMaxMemory = "max-memory"
+)
+
+// CapabilitiesInfo describes what this build of the package supports, so that
+// frontends can adapt to it rather than discover the missing features through
+// errors.
+type CapabilitiesInfo struct {
+	// EncryptionAlgorithms are the algorithms resources can be encrypted
+	// with, including the ones added with RegisterAlgorithm.
+	EncryptionAlgorithms []EncryptionAlgorithm `json:"encryptionAlgorithms"`
+	// SignatureAlgorithms are the algorithms license signatures can be
+	// verified with.
+	SignatureAlgorithms []string `json:"signatureAlgorithms"`
+	// PassphraseProfiles are the encryption profiles whose user key can be
+	// derived from a passphrase without WithProfileTransform. User keys
+	// work whatever the profile.
+	PassphraseProfiles []string `json:"passphraseProfiles"`
+	// ContainerTypes are the kinds of publications that can be decrypted.
+	ContainerTypes []ContainerType `json:"containerTypes"`
+	// PassphraseVariants are the names of the built in passphrase variants.
+	PassphraseVariants []string `json:"passphraseVariants"`
+	// Features lists the optional features available (Feature constants).
+	Features []string `json:"features"`
+}
+
+// Capabilities returns what this build of the package supports.
+func Capabilities() CapabilitiesInfo {
+	c := CapabilitiesInfo{
+		EncryptionAlgorithms: registeredAlgorithms(),
+		SignatureAlgorithms:  []string{SignatureAlgorithmRSASHA256, SignatureAlgorithmECDSASHA256},
+		PassphraseProfiles:   []string{ProfileBasic},
+		ContainerTypes:       containerTypes(),
+		Features: []string{
+			FeatureSignatureVerification,
+			FeaturePassphraseVariants,
+			FeatureProfileTransforms,
+			FeaturePreview,
+			FeatureConcurrency,
+			FeatureMaxMemory,
+		},
+	}
+
+	for _, v := range PassphraseVariants {
+		c.PassphraseVariants = append(c.PassphraseVariants, v.Name)
+	}
+
+	if fastInflate {
+		c.Features = append(c.Features, FeatureFastInflate)
+	}
+
+	if hasResourcesIterator {
+		c.Features = append(c.Features, FeatureResourcesIterator)
+	}
+
+	return c
+}
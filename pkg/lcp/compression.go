@@ -0,0 +1,40 @@
+package lcp
+
+import (
+	"archive/zip"
+	"path"
+	"strings"
+)
+
+// compressedExtensions lists the extensions of file formats which are already
+// compressed, and for which deflating only wastes time.
+var compressedExtensions = map[string]struct{}{
+	".jpg": {}, ".jpeg": {}, ".png": {}, ".gif": {}, ".webp": {}, ".avif": {},
+	".woff": {}, ".woff2": {},
+	".mp3": {}, ".mp4": {}, ".m4a": {}, ".m4b": {}, ".m4v": {}, ".aac": {},
+	".ogg": {}, ".opus": {}, ".webm": {},
+	".zip": {},
+}
+
+// compressionMethod returns the zip compression method to use for a file
+// named name with the given contents.
+func compressionMethod(name string, data []byte) uint16 {
+	ext := strings.ToLower(path.Ext(name))
+
+	if _, ok := compressedExtensions[ext]; ok {
+		return zip.Store
+	}
+
+	if _, ok := textExtensions[ext]; ok {
+		return zip.Deflate
+	}
+
+	// Unknown extension, look at the data itself
+	for ext := range compressedExtensions {
+		if _, ok := magicsByExtension[ext]; ok && hasKnownMagic(ext, data) {
+			return zip.Store
+		}
+	}
+
+	return zip.Deflate
+}
@@ -0,0 +1,326 @@
+package lcp
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WithConcurrency makes Decrypt process up to n entries at the same time.
+//
+// When out also implements io.WriterAt (for example *os.File), the entries are
+// written in parallel too, starting at offset 0 of out. Otherwise they are
+// written one after the other, in their original order.
+//
+// The logger and the OnFileStart/OnFileEnd callbacks are never called
+// concurrently.
+func WithConcurrency(n int) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Concurrency = n
+	}
+}
+
+// newEntryWriter returns the writer for the output file out.
+func (d *decrypter) newEntryWriter(out io.Writer) entryWriter {
+	if outAt, ok := out.(io.WriterAt); ok && d.opts.Concurrency > 1 {
+		return &parallelWriter{out: outAt}
+	}
+
+	return &serialWriter{zw: zip.NewWriter(out)}
+}
+
+// fileJob is the processing of an entry of the input file.
+type fileJob struct {
+	index    int
+	file     *zip.File
+	entry    FileEntry
+	action   FileAction
+	start    time.Time
+	prepared *preparedFile
+	err      error
+}
+
+// prepare decrypts an entry of the input file. It can run concurrently for
+// several entries.
+func (d *decrypter) prepare(index int, f *zip.File) *fileJob {
+	job := &fileJob{index: index, file: f}
+	job.entry, job.action = d.fileAction(f)
+
+	d.fileStart(job.entry, job.action)
+
+	job.start = time.Now()
+	job.prepared, job.err = d.prepareFile(f, job.entry, job.action)
+
+	if job.prepared != nil {
+		job.prepared.index = index
+
+		if err := d.countOutput(int64(job.prepared.header.UncompressedSize64)); err != nil {
+			job.prepared.release()
+			job.prepared, job.err = nil, err
+		}
+	}
+
+	return job
+}
+
+// finish writes a prepared entry, and returns the error that happened while
+// preparing or writing it.
+func (d *decrypter) finish(job *fileJob, w entryWriter) error {
+	err := job.err
+
+	if err == nil && job.prepared != nil {
+		start := time.Now()
+		err = w.writeEntry(job.prepared)
+		d.timings.since(phaseWrite, start)
+		job.prepared.release()
+	}
+
+	d.fileEnd(FileResult{
+		Entry:    job.entry,
+		Action:   job.action,
+		Err:      err,
+		Duration: time.Since(job.start),
+	})
+
+	return err
+}
+
+// indexedError is an error affecting a single entry.
+type indexedError struct {
+	index int
+	err   error
+}
+
+// triage records err if the entry can be skipped, and returns it otherwise.
+func (d *decrypter) triage(job *fileJob, err error) error {
+	var skippable *skippableError
+
+	if err == nil || !d.opts.ContinueOnError || !errors.As(err, &skippable) || errors.Is(err, ErrLimitExceeded) {
+		return err
+	}
+
+	d.mu.Lock()
+	d.fileErrors = append(d.fileErrors, indexedError{job.index, skippable.Err})
+	d.mu.Unlock()
+
+	d.log("Error: " + skippable.Err.Error() + ", skipping file")
+	d.notifyWarning(Warning{Kind: WarningSkippedEntry, Path: job.entry.Path, Message: d.redactError(skippable.Err).Error()})
+
+	return nil
+}
+
+// processFiles decrypts the entries of the input file and writes them to w.
+// Entries are numbered from 1, the mimetype entry comes first.
+func (d *decrypter) processFiles(files []*zip.File, w entryWriter) error {
+	ctx := d.opts.Context
+
+	if d.opts.Concurrency <= 1 {
+		for i, f := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			job := d.prepare(i+1, f)
+			if err := d.triage(job, d.finish(job, w)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		fatal     error
+		fatalOnce sync.Once
+		wg        sync.WaitGroup
+	)
+
+	setFatal := func(err error) {
+		fatalOnce.Do(func() {
+			fatal = err
+			cancel()
+		})
+	}
+
+	jobs := make(chan int)
+
+	// With WithMaxMemory, jobs only start once the memory they need is
+	// available. They acquire it in order, so that the writer never waits
+	// for an entry that can't start.
+	var budget *memoryBudget
+	if d.opts.MaxMemory > 0 {
+		budget = newMemoryBudget(d.opts.MaxMemory)
+	}
+
+	releaseMemory := func(i int) {
+		if budget != nil {
+			budget.release(d.jobMemory(files[i]))
+		}
+	}
+
+	// dispatch feeds the workers, waiting for a slot in window (if not nil)
+	// and for the memory the job needs before each job.
+	dispatch := func(window chan struct{}) {
+		defer close(jobs)
+
+		for i := range files {
+			if window != nil {
+				select {
+				case window <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if budget != nil {
+				if err := budget.acquire(ctx, d.jobMemory(files[i])); err != nil {
+					return
+				}
+			}
+
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	if _, parallel := w.(*parallelWriter); parallel {
+		for range d.opts.Concurrency {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for i := range jobs {
+					job := d.prepare(i+1, files[i])
+					if err := d.triage(job, d.finish(job, w)); err != nil {
+						setFatal(err)
+					}
+
+					releaseMemory(i)
+				}
+			}()
+		}
+
+		dispatch(nil)
+	} else {
+		// Entries get written in order, the window limits how far ahead of the
+		// writer the workers can go (and hence how much decrypted data is held
+		// in memory).
+		results := make([]chan *fileJob, len(files))
+		for i := range results {
+			results[i] = make(chan *fileJob, 1)
+		}
+
+		window := make(chan struct{}, 2*d.opts.Concurrency)
+
+		for range d.opts.Concurrency {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for i := range jobs {
+					results[i] <- d.prepare(i+1, files[i])
+				}
+			}()
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			dispatch(window)
+		}()
+
+	WriteLoop:
+		for i := range files {
+			select {
+			case job := <-results[i]:
+				if err := d.triage(job, d.finish(job, w)); err != nil {
+					setFatal(err)
+					break WriteLoop
+				}
+
+				releaseMemory(i)
+				<-window
+			case <-ctx.Done():
+				break WriteLoop
+			}
+		}
+
+		cancel()
+
+		wg.Wait()
+
+		// Remove the temporary files of the entries prepared but not written
+		for i := range results {
+			select {
+			case job := <-results[i]:
+				if job.prepared != nil {
+					job.prepared.release()
+				}
+			default:
+			}
+		}
+	}
+
+	wg.Wait()
+
+	if fatal != nil {
+		return fatal
+	}
+
+	return d.opts.Context.Err()
+}
+
+// sortedFileErrors returns the errors of the skipped entries, in the order of
+// the entries.
+func (d *decrypter) sortedFileErrors() []error {
+	slices.SortFunc(d.fileErrors, func(a, b indexedError) int { return a.index - b.index })
+
+	res := make([]error, len(d.fileErrors))
+
+	for i, e := range d.fileErrors {
+		res[i] = e.err
+	}
+
+	return res
+}
+
+func (d *decrypter) fileStart(entry FileEntry, action FileAction) {
+	if d.opts.OnFileStart == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.opts.OnFileStart(entry, action)
+}
+
+func (d *decrypter) fileEnd(result FileResult) {
+	if d.opts.OnFileEnd == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.opts.OnFileEnd(result)
+}
+
+// interruptedError reports a decryption stopped because its context was done.
+func interruptedError(err error) error {
+	return newError(MsgInterrupted, fmt.Errorf("decryption interrupted: %w", err))
+}
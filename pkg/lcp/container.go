@@ -0,0 +1,438 @@
+package lcp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// ContainerType is the kind of publication held by an LCP container.
+type ContainerType string
+
+const (
+	ContainerEPUB2 ContainerType = "epub2"
+	ContainerEPUB3 ContainerType = "epub3"
+	// ContainerPDF is a Readium package holding PDF documents (.lcpdf).
+	ContainerPDF ContainerType = "pdf"
+	// ContainerAudiobook is a Readium package holding audio files (.lcpau).
+	ContainerAudiobook ContainerType = "audiobook"
+	// ContainerDivina is a Readium package holding comic pages.
+	ContainerDivina ContainerType = "divina"
+	// ContainerReadium is any other Readium package.
+	ContainerReadium ContainerType = "readium"
+	// ContainerUnknown is a zip file with neither an EPUB package document
+	// nor a Readium manifest.
+	ContainerUnknown ContainerType = "unknown"
+)
+
+// IsEPUB returns whether the container is an EPUB file.
+func (t ContainerType) IsEPUB() bool {
+	return t == ContainerEPUB2 || t == ContainerEPUB3
+}
+
+// IsReadium returns whether the container is a Readium package.
+func (t ContainerType) IsReadium() bool {
+	switch t {
+	case ContainerPDF, ContainerAudiobook, ContainerDivina, ContainerReadium:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t ContainerType) String() string {
+	switch t {
+	case ContainerEPUB2:
+		return "EPUB 2 publication"
+	case ContainerEPUB3:
+		return "EPUB 3 publication"
+	case ContainerPDF:
+		return "PDF package"
+	case ContainerAudiobook:
+		return "audiobook"
+	case ContainerDivina:
+		return "Divina package"
+	case ContainerReadium:
+		return "Readium package"
+	case ContainerUnknown:
+		return "unknown container"
+	default:
+		return string(t) + " container"
+	}
+}
+
+// ContainerInfo describes an LCP container.
+type ContainerInfo struct {
+	Type ContainerType
+	// Version is the version of the EPUB package document (for example
+	// "3.0"), empty for other containers.
+	Version string
+	// Mimetype is the contents of the mimetype file, empty if the container
+	// has none.
+	Mimetype string
+	// PackagePath is the path of the EPUB package document, empty for other
+	// containers.
+	PackagePath string
+
+	// container is the implementation that detected the container.
+	container Container
+}
+
+// Container implements the support of a kind of LCP container: it recognizes
+// it, finds its encrypted resources and tells how the decrypted publication
+// is packaged. EPUB files and Readium packages (PDF, audiobooks, Divina...)
+// are built in, other kinds can be added with RegisterContainer.
+type Container interface {
+	// Types returns the container types Detect can return.
+	Types() []ContainerType
+	// Detect returns the description of the container at root, and false if
+	// it is not of this kind. When the container is of this kind but broken,
+	// it returns true along with the error.
+	Detect(root fs.FS) (ContainerInfo, bool, error)
+	// LicenseLocators returns the locators finding the licenses embedded in
+	// this kind of container, tried after the built in ones.
+	LicenseLocators() []LicenseLocator
+	// Encryption returns the encrypted resources of the container. It also
+	// returns the new contents of the unencrypted files that change in the
+	// output file (for example the ones describing the encryption), by path.
+	Encryption(root fs.FS, info ContainerInfo) ([]FileEntry, map[string][]byte, error)
+	// Packaging returns the conventions of the output file.
+	Packaging(info ContainerInfo) Packaging
+}
+
+// Packaging are the conventions of a container type that the output file
+// follows.
+type Packaging struct {
+	// RequireMimetype adds a mimetype file when the input file has none.
+	RequireMimetype bool
+	// RepairMimetype writes the mimetype file first and uncompressed, and
+	// fixes its contents. Otherwise, it is copied as is.
+	RepairMimetype bool
+	// Mimetype is the only valid contents of the mimetype file, which
+	// replaces invalid ones when repairing it. Empty means any.
+	Mimetype string
+	// EncryptionFiles are the files describing the encryption, which are left
+	// out of the output file.
+	EncryptionFiles []string
+	// SkipLicenseFiles leaves all the .lcpl files out of the output file, and
+	// not only the ones holding the licenses of the publication.
+	SkipLicenseFiles bool
+}
+
+var (
+	containersMu sync.RWMutex
+	// containers are tried in order by DetectContainer, before the fallback
+	// for unknown containers.
+	containers = []Container{readiumContainer{}, epubContainer{}}
+)
+
+// RegisterContainer makes Decrypt support another kind of LCP container. It
+// is tried before the built in kinds and the ones registered before, so it
+// can also replace their implementation for the containers it detects.
+// RegisterContainer is meant to be called from init functions.
+func RegisterContainer(c Container) {
+	containersMu.Lock()
+	defer containersMu.Unlock()
+
+	containers = append([]Container{c}, containers...)
+}
+
+func registeredContainers() []Container {
+	containersMu.RLock()
+	defer containersMu.RUnlock()
+
+	return slices.Clone(containers)
+}
+
+// containerTypes returns the container types that can be decrypted.
+func containerTypes() []ContainerType {
+	var res []ContainerType
+
+	// Built in containers come first, in the order they were registered
+	registered := registeredContainers()
+
+	for i := len(registered) - 1; i >= 0; i-- {
+		for _, t := range registered[i].Types() {
+			if !slices.Contains(res, t) {
+				res = append(res, t)
+			}
+		}
+	}
+
+	return res
+}
+
+// licenseLocators returns the built in license locators, followed by the
+// ones of the registered containers.
+func licenseLocators() []LicenseLocator {
+	res := slices.Clone(defaultLicenseLocators)
+
+	for _, c := range registeredContainers() {
+		res = append(res, c.LicenseLocators()...)
+	}
+
+	return res
+}
+
+// DetectContainer returns what kind of publication the container at root
+// holds, usually a *zip.Reader. EPUB versions are read from the package
+// document, Readium package types from the mimetype file or else from the
+// resources of the manifest. The kinds added with RegisterContainer are
+// detected as well.
+//
+// When the container is broken, the returned info still holds the most likely
+// type along with the error.
+func DetectContainer(root fs.FS) (ContainerInfo, error) {
+	mimetype, err := readContainerMimetype(root)
+	if err != nil {
+		return ContainerInfo{Mimetype: mimetype}, err
+	}
+
+	for _, c := range registeredContainers() {
+		info, ok, err := c.Detect(root)
+		if !ok {
+			continue
+		}
+
+		info.Mimetype, info.container = mimetype, c
+
+		return info, err
+	}
+
+	return ContainerInfo{Type: ContainerUnknown, Mimetype: mimetype, container: unknownContainer{}}, nil
+}
+
+// readContainerMimetype returns the contents of the mimetype file of the
+// container at root, empty if it has none.
+func readContainerMimetype(root fs.FS) (string, error) {
+	data, err := fs.ReadFile(root, "mimetype")
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("error reading mimetype file: %w", err)
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(string(data), "\uFEFF")), nil
+}
+
+// impl returns the implementation of the container, the one for unknown
+// containers if it couldn't be detected.
+func (c ContainerInfo) impl() Container {
+	if c.container == nil {
+		return unknownContainer{}
+	}
+
+	return c.container
+}
+
+// epubContainer supports EPUB files, which describe their encryption in
+// META-INF/encryption.xml.
+type epubContainer struct{}
+
+func (epubContainer) Types() []ContainerType {
+	return []ContainerType{ContainerEPUB2, ContainerEPUB3}
+}
+
+func (epubContainer) Detect(root fs.FS) (ContainerInfo, bool, error) {
+	if _, err := fs.Stat(root, epub.ContainerPath); err != nil {
+		return ContainerInfo{}, false, nil
+	}
+
+	info := ContainerInfo{Type: ContainerEPUB3}
+
+	pkg, err := epub.ReadPackage(root)
+	if err != nil {
+		return info, true, err
+	}
+
+	info.Version = strings.TrimSpace(pkg.Version)
+	info.PackagePath = pkg.Path
+
+	if strings.HasPrefix(info.Version, "2") || strings.HasPrefix(info.Version, "1") {
+		info.Type = ContainerEPUB2
+	}
+
+	return info, true, nil
+}
+
+// LicenseLocators returns nil, the built in locators cover EPUB files.
+func (epubContainer) LicenseLocators() []LicenseLocator {
+	return nil
+}
+
+func (epubContainer) Encryption(root fs.FS, _ ContainerInfo) ([]FileEntry, map[string][]byte, error) {
+	files, err := listEncryptedFiles(root)
+	return files, nil, err
+}
+
+func (epubContainer) Packaging(ContainerInfo) Packaging {
+	return Packaging{
+		RequireMimetype:  true,
+		RepairMimetype:   true,
+		Mimetype:         defaultMimetype,
+		EncryptionFiles:  []string{"META-INF/encryption.xml"},
+		SkipLicenseFiles: true,
+	}
+}
+
+// unknownContainer handles the zip files no implementation detects, they get
+// their files decrypted according to META-INF/encryption.xml.
+type unknownContainer struct{}
+
+func (unknownContainer) Types() []ContainerType {
+	return []ContainerType{ContainerUnknown}
+}
+
+func (unknownContainer) Detect(fs.FS) (ContainerInfo, bool, error) {
+	return ContainerInfo{Type: ContainerUnknown}, true, nil
+}
+
+func (unknownContainer) LicenseLocators() []LicenseLocator {
+	return nil
+}
+
+func (unknownContainer) Encryption(root fs.FS, _ ContainerInfo) ([]FileEntry, map[string][]byte, error) {
+	files, err := listEncryptedFiles(root)
+	return files, nil, err
+}
+
+// Packaging keeps the structure of unknown containers as it is, only
+// removing the encryption that no longer applies.
+func (unknownContainer) Packaging(ContainerInfo) Packaging {
+	return Packaging{EncryptionFiles: []string{"META-INF/encryption.xml"}}
+}
+
+// checkContainer returns the warnings about the structure of the container,
+// which readers might choke on.
+func checkContainer(root fs.FS, c ContainerInfo) []string {
+	var warnings []string
+
+	if c.Type.IsReadium() && c.Mimetype == defaultMimetype {
+		warnings = append(warnings, fmt.Sprintf("Readium package declares the %q mimetype", defaultMimetype))
+	}
+
+	if !c.Type.IsEPUB() {
+		return warnings
+	}
+
+	pkg, err := epub.ReadPackage(root)
+	if err != nil {
+		return append(warnings, err.Error())
+	}
+
+	switch c.Type {
+	case ContainerEPUB3:
+		if _, ok := pkg.Nav(); !ok {
+			warnings = append(warnings, "EPUB 3 publication has no navigation document")
+		}
+	case ContainerEPUB2:
+		if _, ok := pkg.Item(pkg.Spine.Toc); !ok {
+			warnings = append(warnings, "EPUB 2 publication has no NCX table of contents")
+		}
+	}
+
+	return warnings
+}
+
+// isOPFLicenseMeta returns whether a meta element of the package document
+// holds a license, following the meta syntax of the given EPUB version.
+func isOPFLicenseMeta(t ContainerType, start xml.StartElement) bool {
+	if start.Name.Local != "meta" {
+		return false
+	}
+
+	for _, attr := range start.Attr {
+		if t == ContainerEPUB3 && attr.Name.Local == "property" && slices.Contains(opfLicenseProperties, attr.Value) {
+			return true
+		}
+
+		// EPUB 3 files can still use EPUB 2 style meta elements
+		if attr.Name.Local == "name" && slices.Contains(opfLicenseProperties, attr.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripOPFLicense removes the meta elements holding a license from a package
+// document, leaving the rest of the document untouched. It returns nil if the
+// document has no such element.
+func stripOPFLicense(t ContainerType, data []byte) ([]byte, error) {
+	return removeXMLElements(data, func(start xml.StartElement) bool { return isOPFLicenseMeta(t, start) })
+}
+
+// removeXMLElements removes the elements for which match returns true from
+// an XML document, leaving the rest of the document untouched. It returns nil
+// if no element matches.
+func removeXMLElements(data []byte, match func(start xml.StartElement) bool) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	type span struct{ start, end int64 }
+
+	var (
+		spans []span
+		start int64 = -1
+		depth int
+	)
+
+	for {
+		offset := decoder.InputOffset()
+
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error decoding package document: %w", err)
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if start >= 0 {
+				depth++
+			} else if match(token) {
+				start, depth = offset, 0
+			}
+		case xml.EndElement:
+			if start < 0 {
+				continue
+			}
+
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			spans = append(spans, span{start, decoder.InputOffset()})
+			start = -1
+		}
+	}
+
+	if len(spans) == 0 {
+		return nil, nil
+	}
+
+	var res bytes.Buffer
+	var last int64
+
+	for _, s := range spans {
+		res.Write(data[last:s.start])
+		last = s.end
+	}
+
+	res.Write(data[last:])
+
+	return res.Bytes(), nil
+}
@@ -0,0 +1,417 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/xmlenc"
+)
+
+// Severity ranks the findings of Diagnose.
+type Severity int
+
+const (
+	// SeverityInfo is a finding given for context, not a problem.
+	SeverityInfo Severity = iota
+	// SeverityWarning is a problem that decryption works around, or that
+	// some readers might choke on.
+	SeverityWarning
+	// SeverityError is a problem that prevents decrypting the publication,
+	// or parts of it.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Checks run by Diagnose.
+const (
+	CheckZip         = "zip"
+	CheckContainer   = "container"
+	CheckMimetype    = "mimetype"
+	CheckLicense     = "license"
+	CheckUserKey     = "user-key"
+	CheckEncryption  = "encryption"
+	CheckMissingFile = "missing-file"
+	CheckDecryption  = "decryption"
+)
+
+// Finding is the outcome of a check run by Diagnose.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	// Check is the check that produced the finding (Check constants).
+	Check string `json:"check"`
+	// Path is the entry of the input file the finding is about, if any.
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	if f.Path != "" {
+		return fmt.Sprintf("[%s] %s: %s", f.Check, f.Path, f.Message)
+	}
+
+	return fmt.Sprintf("[%s] %s", f.Check, f.Message)
+}
+
+// Diagnose checks the publication stored in in for the problems that prevent
+// decrypting it or make readers choke on it: zip integrity, mimetype,
+// presence and validity of the license, key check, encryption algorithm and
+// size of each encrypted entry, entries missing from the archive. If a user
+// key (or a passphrase, with WithPassphrase) is given and matches the
+// license, the publication is also decrypted, without writing the result
+// anywhere. userKeyHex can be empty to only run the checks that don't need
+// the key.
+//
+// The findings are sorted by decreasing severity.
+func Diagnose(in io.ReaderAt, inSize int64, userKeyHex string, opts ...DecryptOption) []Finding {
+	d := newDecrypter(opts)
+	dg := &diagnosis{d: d}
+
+	dg.run(in, inSize, userKeyHex, opts)
+
+	for i := range dg.findings {
+		dg.findings[i].Message = d.redact(dg.findings[i].Message)
+	}
+
+	slices.SortStableFunc(dg.findings, func(a, b Finding) int { return int(b.Severity - a.Severity) })
+
+	return dg.findings
+}
+
+type diagnosis struct {
+	d        *decrypter
+	findings []Finding
+}
+
+func (dg *diagnosis) add(severity Severity, check, path, msg string) {
+	dg.findings = append(dg.findings, Finding{Severity: severity, Check: check, Path: path, Message: msg})
+}
+
+func (dg *diagnosis) run(in io.ReaderAt, inSize int64, userKeyHex string, opts []DecryptOption) {
+	o := &dg.d.opts
+
+	zr, err := zip.NewReader(in, inSize)
+	if err != nil {
+		dg.add(SeverityError, CheckZip, "", "not a valid zip file: "+err.Error())
+		return
+	}
+
+	dg.checkEntries(zr)
+
+	container, err := DetectContainer(zr)
+	if err != nil {
+		dg.add(SeverityWarning, CheckContainer, "", "error detecting the kind of publication: "+err.Error())
+	} else {
+		dg.add(SeverityInfo, CheckContainer, "", capitalize(container.Type.String()))
+
+		for _, w := range checkContainer(zr, container) {
+			dg.add(SeverityWarning, CheckContainer, "", w)
+		}
+	}
+
+	dg.checkMimetype(zr, container)
+
+	// The external license is read here, decryption needs its own reader
+	var externalLicense []byte
+
+	if o.ExternalLicense != nil {
+		if externalLicense, err = io.ReadAll(o.ExternalLicense); err != nil {
+			dg.add(SeverityError, CheckLicense, "", "error reading license: "+err.Error())
+			return
+		}
+	}
+
+	keyOK := dg.checkLicenses(zr, externalLicense, userKeyHex)
+
+	dg.checkEncryption(zr, container)
+
+	if !keyOK {
+		return
+	}
+
+	opts = append(slices.Clone(opts), WithContinueOnError(), WithOnWarning(func(w Warning) {
+		switch w.Kind {
+		case WarningMissingFile, WarningRepair, WarningContainer, WarningLicense:
+			// Already covered by the other checks
+		case WarningSkippedEntry:
+			dg.add(SeverityError, CheckDecryption, w.Path, w.Message)
+		default:
+			dg.add(SeverityWarning, CheckDecryption, w.Path, w.Message)
+		}
+	}))
+
+	if externalLicense != nil {
+		opts = append(opts, WithExternalLicense(bytes.NewReader(externalLicense)))
+	}
+
+	if err := Decrypt(io.Discard, in, inSize, userKeyHex, opts...); err != nil {
+		dg.add(SeverityError, CheckDecryption, "", err.Error())
+		return
+	}
+
+	dg.add(SeverityInfo, CheckDecryption, "", "the publication can be decrypted")
+}
+
+// checkEntries reads all the entries of the archive, which checks their
+// checksums.
+func (dg *diagnosis) checkEntries(zr *zip.Reader) {
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		if err := readEntry(f); err != nil {
+			dg.add(SeverityError, CheckZip, f.Name, err.Error())
+		}
+	}
+}
+
+func readEntry(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("error opening entry: %w", err)
+	}
+
+	defer r.Close()
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("error reading entry, the archive is corrupted: %w", err)
+	}
+
+	return nil
+}
+
+func (dg *diagnosis) checkMimetype(zr *zip.Reader, container ContainerInfo) {
+	if !container.Type.IsEPUB() {
+		return
+	}
+
+	index := slices.IndexFunc(zr.File, func(f *zip.File) bool { return f.Name == "mimetype" })
+	if index < 0 {
+		dg.add(SeverityWarning, CheckMimetype, "mimetype", "the mimetype file is missing (added when decrypting)")
+		return
+	}
+
+	f := zr.File[index]
+
+	if index > 0 {
+		dg.add(SeverityWarning, CheckMimetype, f.Name, "the mimetype file is not the first entry of the archive (fixed when decrypting)")
+	}
+
+	if f.Method != zip.Store {
+		dg.add(SeverityWarning, CheckMimetype, f.Name, "the mimetype file is compressed (fixed when decrypting)")
+	}
+
+	if mimetype, err := readMimetype(f); err == nil && string(mimetype) != defaultMimetype {
+		dg.add(SeverityWarning, CheckMimetype, f.Name, fmt.Sprintf("the mimetype file contains %q instead of %q (fixed when decrypting)", mimetype, defaultMimetype))
+	}
+}
+
+// checkLicenses checks the licenses of the publication, and whether the user
+// key matches one of them. It returns whether decryption can be attempted.
+func (dg *diagnosis) checkLicenses(zr *zip.Reader, externalLicense []byte, userKeyHex string) bool {
+	o := &dg.d.opts
+
+	if o.ContentKey != nil {
+		dg.add(SeverityInfo, CheckLicense, "", "a content key is used, the license is not checked")
+		return true
+	}
+
+	parseOpts := func(path string) []LicenseParseOption {
+		return []LicenseParseOption{WithParseWarnings(func(msg string) {
+			dg.add(SeverityWarning, CheckLicense, path, msg)
+		})}
+	}
+
+	var (
+		licenses []*License
+		err      error
+	)
+
+	if externalLicense != nil {
+		var l *License
+
+		if l, err = ParseLicense(bytes.NewReader(externalLicense), parseOpts("")...); err == nil {
+			licenses = []*License{l}
+		}
+	} else {
+		licenses, _, err = readLicenses(zr, slices.Concat(licenseLocators(), o.LicenseLocators), parseOpts, func(path, msg string) {
+			dg.add(SeverityWarning, CheckLicense, path, msg)
+		})
+	}
+
+	if err != nil {
+		dg.add(SeverityError, CheckLicense, "", err.Error()+" (books distributed separately from their license need it passed along)")
+		return false
+	}
+
+	dg.d.addPII(licenses...)
+
+	for _, l := range licenses {
+		// The deviations from the specification are reported by parseOpts
+		dg.add(SeverityInfo, CheckLicense, "", fmt.Sprintf("license %s from %s, profile %s", l.ID, l.Provider, l.Encryption.Profile))
+	}
+
+	if userKeyHex == "" && o.Passphrase == "" {
+		dg.add(SeverityInfo, CheckUserKey, "", "no user key given, the key check and the decryption were not checked")
+		return false
+	}
+
+	userKeyFunc, err := o.userKeyFunc(userKeyHex)
+	if err != nil {
+		dg.add(SeverityError, CheckUserKey, "", err.Error())
+		return false
+	}
+
+	for _, l := range licenses {
+		userKey, err := userKeyFunc(l)
+		if err != nil {
+			// For example passphrases of unsupported profiles
+			dg.add(SeverityError, CheckUserKey, "", fmt.Sprintf("license %s: %s", l.ID, err))
+			continue
+		}
+
+		if l.CheckUserKey(userKey) == nil {
+			dg.add(SeverityInfo, CheckUserKey, "", "the user key matches license "+l.ID)
+			return true
+		}
+	}
+
+	dg.add(SeverityError, CheckUserKey, "", "the user key matches none of the licenses, it is wrong or belongs to another copy of the book")
+
+	return false
+}
+
+// checkEncryption checks the algorithm and the size of the encrypted
+// entries, and that none is missing from the archive.
+func (dg *diagnosis) checkEncryption(zr *zip.Reader, container ContainerInfo) {
+	var (
+		entries []FileEntry
+		err     error
+	)
+
+	if container.Type.IsReadium() {
+		entries, _, err = listManifestEncryptedFiles(zr)
+	} else {
+		entries, err = dg.listEncryptedFiles(zr)
+	}
+
+	if err != nil {
+		dg.add(SeverityError, CheckEncryption, "", "error listing encrypted files: "+err.Error())
+		return
+	}
+
+	dg.add(SeverityInfo, CheckEncryption, "", fmt.Sprintf("%d encrypted file(s)", len(entries)))
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	for _, entry := range entries {
+		f, ok := files[entry.Path]
+		if !ok {
+			dg.add(SeverityError, CheckMissingFile, entry.Path, "the file is listed as encrypted but missing from the archive, the book might be truncated")
+			continue
+		}
+
+		if msg := encryptedSizeProblem(entry.EncryptionAlgorithm, int64(f.UncompressedSize64)); msg != "" {
+			dg.add(SeverityError, CheckEncryption, entry.Path, msg)
+		}
+	}
+}
+
+// listEncryptedFiles is like the package function, but reports the entries
+// with an unsupported algorithm instead of failing.
+func (dg *diagnosis) listEncryptedFiles(zr *zip.Reader) ([]FileEntry, error) {
+	encFile, err := zr.Open("META-INF/encryption.xml")
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	defer encFile.Close()
+
+	encryption, err := xmlenc.Parse(encFile)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file: %w", err)
+	}
+
+	var res []FileEntry
+
+	for _, data := range encryption.EncryptedData {
+		path, ok, err := data.Path()
+		if err != nil {
+			dg.add(SeverityError, CheckEncryption, "", err.Error())
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		alg := EncryptionAlgorithm(data.EncryptionMethod.Algorithm)
+
+		if _, ok := lookupAlgorithm(alg); !ok {
+			dg.add(SeverityError, CheckEncryption, path, "unsupported encryption algorithm "+string(alg))
+			continue
+		}
+
+		if _, err := data.Compression(); err != nil {
+			dg.add(SeverityError, CheckEncryption, path, err.Error())
+			continue
+		}
+
+		res = append(res, FileEntry{Path: path, EncryptionAlgorithm: alg})
+	}
+
+	return res, nil
+}
+
+// encryptedSizeProblem returns why size can't be the size of data encrypted
+// with alg, or an empty string.
+func encryptedSizeProblem(alg EncryptionAlgorithm, size int64) string {
+	switch alg {
+	case EncryptionAlgorithmAES256CBC:
+		if size == 0 {
+			return ""
+		}
+
+		if size < 2*aes.BlockSize || size%aes.BlockSize != 0 {
+			return fmt.Sprintf("the encrypted data (%d bytes) is not made of an IV and whole AES blocks, the file is truncated or corrupted", size)
+		}
+	case EncryptionAlgorithmAES256GCM:
+		// 12 bytes nonce and 16 bytes tag
+		if size < 28 {
+			return fmt.Sprintf("the encrypted data (%d bytes) is too short for AES-GCM, the file is truncated or corrupted", size)
+		}
+	}
+
+	return ""
+}
+
+// capitalize upper cases the first letter of s.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,100 @@
+package lcp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// fontObfuscation is a font obfuscation algorithm, which XORs the start of the
+// fonts with a key derived from the unique identifier of the publication.
+// The output file has no encryption.xml anymore, so the fonts are
+// de-obfuscated along with the encrypted resources.
+type fontObfuscation struct {
+	// length is the number of bytes obfuscated at the start of the fonts.
+	length int
+	key    func(identifier string) ([]byte, error)
+}
+
+var fontObfuscations = map[EncryptionAlgorithm]fontObfuscation{
+	EncryptionAlgorithmFontObfuscation:      {length: 1040, key: idpfFontKey},
+	EncryptionAlgorithmAdobeFontObfuscation: {length: 1024, key: adobeFontKey},
+}
+
+// idpfFontKey returns the key of the IDPF font obfuscation: the SHA-1 hash of
+// the unique identifier, without its whitespace.
+func idpfFontKey(identifier string) ([]byte, error) {
+	identifier = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+
+		return r
+	}, identifier)
+
+	if identifier == "" {
+		return nil, errors.New("the publication has no unique identifier")
+	}
+
+	key := sha1.Sum([]byte(identifier))
+
+	return key[:], nil
+}
+
+// adobeFontKey returns the key of the Adobe font obfuscation: the 16 bytes of
+// the UUID of the unique identifier.
+func adobeFontKey(identifier string) ([]byte, error) {
+	uuid := strings.TrimPrefix(strings.TrimSpace(identifier), "urn:uuid:")
+
+	key, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(key) != 16 {
+		return nil, fmt.Errorf("the unique identifier of the publication is not a UUID: %q", identifier)
+	}
+
+	return key, nil
+}
+
+// deobfuscateFont XORs the first length bytes of data with key, in place.
+func deobfuscateFont(data, key []byte, length int) []byte {
+	for i := range min(length, len(data)) {
+		data[i] ^= key[i%len(key)]
+	}
+
+	return data
+}
+
+// fontKey returns the key de-obfuscating the fonts obfuscated with alg.
+func (d *decrypter) fontKey(alg EncryptionAlgorithm) ([]byte, error) {
+	return fontObfuscations[alg].key(d.identifier)
+}
+
+// deobfuscatingReader returns a reader de-obfuscating the font read from r,
+// which is obfuscated with alg.
+func deobfuscatingReader(r io.Reader, alg EncryptionAlgorithm, key []byte) (io.Reader, error) {
+	head := make([]byte, fontObfuscations[alg].length)
+
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(deobfuscateFont(head[:n], key, n)), r), nil
+}
+
+// publicationIdentifier returns the unique identifier of the EPUB
+// publication in root, empty if it has none.
+func publicationIdentifier(root fs.FS) string {
+	pkg, err := epub.ReadPackage(root)
+	if err != nil {
+		return ""
+	}
+
+	return pkg.Identifier()
+}
@@ -0,0 +1,340 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsCacheSize is the maximum total size of the decrypted files cached by the
+// file systems returned by OpenFS.
+const fsCacheSize = 16 << 20
+
+// OpenFS returns a read-only file system holding the publication stored in
+// in, as Decrypt would write it, but without writing anything: files are
+// decrypted when they are opened. The last decrypted files are cached, so
+// that serving the resources of a publication over and over does not decrypt
+// them each time.
+//
+// Files implement io.Seeker and io.ReaderAt, as net/http requires to serve
+// them. The options related to the output file have no effect.
+func OpenFS(in io.ReaderAt, inSize int64, userKeyHex string, opts ...DecryptOption) (fs.FS, error) {
+	d := newDecrypter(opts)
+
+	_, files, err := d.open(in, inSize, userKeyHex)
+	if err != nil {
+		return nil, d.redactError(err)
+	}
+
+	fsys := &decryptedFS{
+		d:     d,
+		in:    in,
+		files: map[string]fsFile{},
+		dirs:  map[string]*fsDir{".": {}},
+		cache: newResourceCache(fsCacheSize),
+	}
+
+	for _, f := range files {
+		fileEntry, action := d.fileAction(f)
+
+		switch action {
+		case FileActionSkip:
+			continue
+		case FileActionDirectory:
+			fsys.addDir(strings.TrimSuffix(f.Name, "/"), f.Modified)
+		default:
+			fsys.files[f.Name] = fsFile{f: f, entry: fileEntry, action: action}
+			fsys.addChild(f.Name)
+		}
+	}
+
+	for _, dir := range fsys.dirs {
+		slices.Sort(dir.children)
+	}
+
+	return fsys, nil
+}
+
+// decryptedFS is the file system returned by OpenFS.
+type decryptedFS struct {
+	d     *decrypter
+	in    io.ReaderAt
+	files map[string]fsFile
+	dirs  map[string]*fsDir
+	cache *resourceCache
+}
+
+type fsFile struct {
+	f      *zip.File
+	entry  FileEntry
+	action FileAction
+}
+
+type fsDir struct {
+	modified time.Time
+	children []string
+}
+
+// addDir registers the directory name, along with its parents.
+func (fsys *decryptedFS) addDir(name string, modified time.Time) {
+	if dir, ok := fsys.dirs[name]; ok {
+		if dir.modified.IsZero() {
+			dir.modified = modified
+		}
+
+		return
+	}
+
+	fsys.dirs[name] = &fsDir{modified: modified}
+	fsys.addChild(name)
+}
+
+// addChild registers name in its parent directory.
+func (fsys *decryptedFS) addChild(name string) {
+	parent := path.Dir(name)
+	fsys.addDir(parent, time.Time{})
+
+	dir := fsys.dirs[parent]
+	if !slices.Contains(dir.children, name) {
+		dir.children = append(dir.children, name)
+	}
+}
+
+func (fsys *decryptedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if dir, ok := fsys.dirs[name]; ok {
+		return &openDir{fsys: fsys, name: name, dir: dir}, nil
+	}
+
+	file, ok := fsys.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	r, err := fsys.reader(file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fsys.d.redactError(err)}
+	}
+
+	return &openFile{
+		SectionReader: r,
+		info:          fileInfo{name: path.Base(name), size: r.Size(), modified: file.f.Modified},
+	}, nil
+}
+
+// reader returns a reader of the decrypted contents of file. Files stored
+// without compression that are copied as they are get read directly from the
+// input file, the others are decrypted (or inflated) in memory.
+func (fsys *decryptedFS) reader(file fsFile) (*io.SectionReader, error) {
+	f := file.f
+
+	if file.action == FileActionCopy && f.Method == zip.Store && !fsys.d.rewritesFile(f.Name) {
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NewSectionReader(fsys.in, offset, int64(f.UncompressedSize64)), nil
+	}
+
+	data, ok := fsys.cache.get(f.Name)
+	if !ok {
+		var err error
+
+		data, err = fsys.d.readResource(f, file.entry, file.action)
+		if err != nil {
+			return nil, err
+		}
+
+		fsys.cache.add(f.Name, data)
+	}
+
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+}
+
+// openFile is an open regular file of a decryptedFS.
+type openFile struct {
+	*io.SectionReader
+	info fileInfo
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+// openDir is an open directory of a decryptedFS.
+type openDir struct {
+	fsys   *decryptedFS
+	name   string
+	dir    *fsDir
+	offset int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return fileInfo{name: path.Base(d.name), modified: d.dir.modified, dir: true}, nil
+}
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.dir.children[d.offset:]
+
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+
+		remaining = remaining[:min(n, len(remaining))]
+	}
+
+	entries := make([]fs.DirEntry, len(remaining))
+	for i, name := range remaining {
+		entries[i] = dirEntry{fsys: d.fsys, name: name}
+	}
+
+	d.offset += len(remaining)
+
+	return entries, nil
+}
+
+// dirEntry is an entry of a directory of a decryptedFS. Its info is only
+// computed when requested, since the size of an encrypted file is only known
+// once it is decrypted.
+type dirEntry struct {
+	fsys *decryptedFS
+	name string
+}
+
+func (e dirEntry) Name() string {
+	return path.Base(e.name)
+}
+
+func (e dirEntry) IsDir() bool {
+	_, ok := e.fsys.dirs[e.name]
+	return ok
+}
+
+func (e dirEntry) Type() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir
+	}
+
+	return 0
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	return fs.Stat(e.fsys, e.name)
+}
+
+// fileInfo describes a file or directory of a decryptedFS.
+type fileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+func (i fileInfo) Name() string {
+	return i.name
+}
+
+func (i fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+
+	return 0o444
+}
+
+func (i fileInfo) ModTime() time.Time {
+	return i.modified
+}
+
+func (i fileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i fileInfo) Sys() any {
+	return nil
+}
+
+// resourceCache keeps the most recently used decrypted files, up to a total
+// size of maxSize bytes.
+type resourceCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *cachedResource, most recently used first
+	entries map[string]*list.Element
+}
+
+type cachedResource struct {
+	name string
+	data []byte
+}
+
+func newResourceCache(maxSize int) *resourceCache {
+	return &resourceCache{maxSize: maxSize, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *resourceCache) get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return e.Value.(*cachedResource).data, true
+}
+
+func (c *resourceCache) add(name string, data []byte) {
+	if len(data) > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[name]; ok {
+		return
+	}
+
+	c.entries[name] = c.order.PushFront(&cachedResource{name: name, data: data})
+	c.size += len(data)
+
+	for c.size > c.maxSize {
+		oldest := c.order.Remove(c.order.Back()).(*cachedResource)
+		delete(c.entries, oldest.name)
+		c.size -= len(oldest.data)
+	}
+}
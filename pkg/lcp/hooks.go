@@ -0,0 +1,127 @@
+package lcp
+
+import "time"
+
+// FileAction describes what Decrypt does with an entry of the input file.
+type FileAction string
+
+const (
+	// FileActionCopy means that the entry is copied as is to the output file.
+	FileActionCopy FileAction = "copy"
+	// FileActionDecrypt means that the entry is decrypted (and decompressed
+	// if needed) before being written to the output file.
+	FileActionDecrypt FileAction = "decrypt"
+	// FileActionDirectory means that the entry is a directory.
+	FileActionDirectory FileAction = "directory"
+	// FileActionSkip means that the entry is not needed once the publication
+	// is decrypted, and is left out of the output file.
+	FileActionSkip FileAction = "skip"
+)
+
+// FileResult describes the outcome of processing an entry of the input file.
+type FileResult struct {
+	Entry  FileEntry
+	Action FileAction
+	// Err is the error that aborted the processing of the entry, if any.
+	Err      error
+	Duration time.Duration
+}
+
+// WithOnFileStart registers a function called before processing each entry
+// of the input file. For unencrypted entries, only the Path field of entry is
+// set. When several functions are registered, they are called in order.
+func WithOnFileStart(onFileStart func(entry FileEntry, action FileAction)) DecryptOption {
+	return func(o *decryptOptions) {
+		previous := o.OnFileStart
+		if previous == nil {
+			o.OnFileStart = onFileStart
+			return
+		}
+
+		o.OnFileStart = func(entry FileEntry, action FileAction) {
+			previous(entry, action)
+			onFileStart(entry, action)
+		}
+	}
+}
+
+// WithOnFileEnd registers a function called after processing each entry of
+// the input file, whether it succeeded or not. When several functions are
+// registered, they are called in order.
+func WithOnFileEnd(onFileEnd func(result FileResult)) DecryptOption {
+	return func(o *decryptOptions) {
+		previous := o.OnFileEnd
+		if previous == nil {
+			o.OnFileEnd = onFileEnd
+			return
+		}
+
+		o.OnFileEnd = func(result FileResult) {
+			previous(result)
+			onFileEnd(result)
+		}
+	}
+}
+
+// WarningKind classifies the non fatal issues reported through WithOnWarning.
+type WarningKind string
+
+const (
+	// WarningContainer is an issue with the structure of the publication.
+	WarningContainer WarningKind = "container"
+	// WarningMissingFile means that files listed in encryption.xml are
+	// missing from the input file.
+	WarningMissingFile WarningKind = "missing-file"
+	// WarningUnsafeName means that an entry with an unsafe name was renamed
+	// or left out.
+	WarningUnsafeName WarningKind = "unsafe-name"
+	// WarningDuplicateEntry means that several entries share the same name,
+	// and that only one of them was kept.
+	WarningDuplicateEntry WarningKind = "duplicate-entry"
+	// WarningSuspiciousFile means that an entry is not listed in
+	// encryption.xml but looks encrypted.
+	WarningSuspiciousFile WarningKind = "suspicious-file"
+	// WarningLicense means that an entry could not be checked for an
+	// embedded license, and was copied as is, or that a license (or a place
+	// where licenses are looked for) could not be read and was skipped.
+	WarningLicense WarningKind = "license"
+	// WarningPadding means that a decrypted entry ends with a malformed
+	// padding (or that the DecipherFunc of its algorithm reported another
+	// anomaly), which usually means that it is corrupted.
+	WarningPadding WarningKind = "padding"
+	// WarningSkippedEntry means that an entry could not be processed and was
+	// left out of the output file, when using WithContinueOnError.
+	WarningSkippedEntry WarningKind = "skipped-entry"
+	// WarningRepair means that the structure of the publication was fixed,
+	// for example its mimetype file.
+	WarningRepair WarningKind = "repair"
+)
+
+// Warning is a non fatal issue found while decrypting.
+type Warning struct {
+	Kind WarningKind
+	// Path is the entry of the input file the warning is about, empty for
+	// the warnings about the whole file.
+	Path    string
+	Message string
+}
+
+// WithOnWarning registers a function called for each non fatal issue found
+// while decrypting, as soon as it is found. Unlike Report.Warnings, it is
+// also called for the repairs and for the entries skipped when using
+// WithContinueOnError. When several functions are registered, they are called
+// in order.
+func WithOnWarning(onWarning func(w Warning)) DecryptOption {
+	return func(o *decryptOptions) {
+		previous := o.OnWarning
+		if previous == nil {
+			o.OnWarning = onWarning
+			return
+		}
+
+		o.OnWarning = func(w Warning) {
+			previous(w)
+			onWarning(w)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package lcp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// inflaters holds the decompressors used for compressed resources. They
+// allocate large buffers on creation, so we reuse them across entries.
+var inflaters sync.Pool
+
+// The size hint of inflate comes from the input file, which might be
+// malicious: the buffer allocated upfront is at most maxHintRatio times the
+// size of the compressed data, and at most maxHintSize. Larger data still
+// decompresses, growing the buffer as it goes.
+const (
+	maxHintRatio = 32
+	maxHintSize  = 64 << 20
+)
+
+// inflate decompresses raw deflate data. sizeHint, if positive, is the
+// expected size of the decompressed data, only used to preallocate the
+// result. If maxSize is positive, inflate fails with tooLarge once the
+// decompressed data exceeds it.
+func inflate(data []byte, sizeHint, maxSize int64, tooLarge error) ([]byte, error) {
+	src := bytes.NewReader(data)
+
+	inflater, _ := inflaters.Get().(io.ReadCloser)
+	if inflater == nil {
+		inflater = newInflater(src)
+	} else if err := resetInflater(inflater, src); err != nil {
+		return nil, fmt.Errorf("error resetting decompressor: %w", err)
+	}
+
+	defer inflaters.Put(inflater)
+
+	if sizeHint <= 0 {
+		// Text compresses well, so this is a better guess than len(data)
+		sizeHint = int64(len(data)) * 4
+	}
+
+	sizeHint = min(sizeHint, int64(len(data))*maxHintRatio, maxHintSize)
+
+	if maxSize > 0 {
+		sizeHint = min(sizeHint, maxSize)
+	}
+
+	// Ask for one more byte than the hint, so that reading up to EOF doesn't
+	// require growing the buffer.
+	res := bytes.NewBuffer(make([]byte, 0, sizeHint+1))
+
+	if _, err := res.ReadFrom(limitReader(inflater, maxSize, tooLarge)); err != nil {
+		return nil, err
+	}
+
+	return res.Bytes(), nil
+}
@@ -0,0 +1,20 @@
+//go:build klauspost
+
+package lcp
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// fastInflate tells whether the klauspost deflate implementation is used.
+const fastInflate = true
+
+func newInflater(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
+
+func resetInflater(inflater io.ReadCloser, r io.Reader) error {
+	return inflater.(flate.Resetter).Reset(r, nil)
+}
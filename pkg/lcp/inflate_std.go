@@ -0,0 +1,19 @@
+//go:build !klauspost
+
+package lcp
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// fastInflate tells whether the klauspost deflate implementation is used.
+const fastInflate = false
+
+func newInflater(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
+
+func resetInflater(inflater io.ReadCloser, r io.Reader) error {
+	return inflater.(flate.Resetter).Reset(r, nil)
+}
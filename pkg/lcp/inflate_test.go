@@ -0,0 +1,197 @@
+package lcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func deflate(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// allocatedBytes returns the number of bytes allocated by fn.
+func allocatedBytes(fn func()) uint64 {
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestInflateSizeHint(t *testing.T) {
+	data := bytes.Repeat([]byte("<p>Some chapter text.</p>\n"), 40000)
+	compressed := deflate(t, data)
+
+	// The allocations of inflate without a hint are the baseline: they
+	// depend on the build (the race detector adds its own), not the hint
+	var baseline uint64
+
+	for i := 0; i < 3; i++ {
+		allocated := allocatedBytes(func() {
+			if _, err := inflate(compressed, 0, 0, nil); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if i == 0 || allocated < baseline {
+			baseline = allocated
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sizeHint int64
+	}{
+		{"negative", -1},
+		{"exact", int64(len(data))},
+		{"too small", 10},
+		{"huge", 1 << 40},
+		{"overflowing", math.MaxInt64},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				res []byte
+				err error
+			)
+
+			allocated := allocatedBytes(func() {
+				res, err = inflate(compressed, tc.sizeHint, 0, nil)
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(res, data) {
+				t.Fatalf("unexpected decompressed data (%d bytes, want %d)", len(res), len(data))
+			}
+
+			// The hint is advisory, whatever it says the allocations stay
+			// in the order of magnitude of the ones without a hint
+			if allocated > 2*baseline {
+				t.Errorf("inflate allocated %d bytes, more than twice the %d bytes allocated without a hint", allocated, baseline)
+			}
+		})
+	}
+}
+
+func TestInflateMaxSize(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 1<<20)
+	compressed := deflate(t, data)
+	tooLarge := limitError("too large")
+
+	if _, err := inflate(compressed, int64(len(data)), int64(len(data))-1, tooLarge); err != tooLarge {
+		t.Errorf("got error %v, want %v", err, tooLarge)
+	}
+
+	if _, err := inflate(compressed, 1<<40, int64(len(data)), tooLarge); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestDecryptFileHostileOriginalLength decrypts a compressed resource whose
+// encryption.xml entry declares an absurd original length.
+func TestDecryptFileHostileOriginalLength(t *testing.T) {
+	ciphertext := mustDecodeHex("30313233343536373839616263646566 f87c120058a602614c73bace22625e12 eefa33ad435a858577351d6447e6b71e")
+
+	for _, originalLength := range []int64{1 << 40, math.MaxInt64} {
+		res, err := newDecrypter(nil).decryptFile(bytes.NewReader(ciphertext), int64(len(ciphertext)), selfTestContentKeyBytes(), FileEntry{
+			Path:                "chapter.xhtml",
+			IsCompressed:        true,
+			OriginalLength:      originalLength,
+			EncryptionAlgorithm: EncryptionAlgorithmAES256CBC,
+		})
+		if err != nil {
+			t.Fatalf("original length %d: %v", originalLength, err)
+		}
+
+		if want := "<p>Hello, self-test!</p>"; string(res) != want {
+			t.Errorf("original length %d: got %q, want %q", originalLength, res, want)
+		}
+	}
+}
+
+// fixedLayoutPage returns an XHTML page of about size bytes, like the pages of
+// fixed-layout books positioning each word of the text.
+func fixedLayoutPage(size int) []byte {
+	words := []string{"the", "reader", "publication", "license", "chapter", "content", "of", "and", "a", "page"}
+
+	var buf bytes.Buffer
+
+	buf.WriteString("<html xmlns=\"http://www.w3.org/1999/xhtml\"><body>\n")
+
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "<span class=\"w\" style=\"left:%dpx;top:%dpx\">%s</span>\n", (i*37)%1200, (i*53)%1800, words[(i*7+i/13)%len(words)])
+	}
+
+	buf.WriteString("</body></html>\n")
+
+	return buf.Bytes()
+}
+
+// benchmarkSizes are the sizes of the resources of the benchmarks: the pages
+// of fixed-layout books (most of them small, some large), and the largest of
+// their resources.
+var benchmarkSizes = []struct {
+	name string
+	size int
+}{
+	{"4KiB", 4 << 10},
+	{"64KiB", 64 << 10},
+	{"8MiB", 8 << 20},
+}
+
+// withoutInflaterPool runs fn with an empty pool of inflaters if pooled is
+// false, so that it creates a new one.
+func withoutInflaterPool(pooled bool, fn func()) {
+	if !pooled {
+		inflaters = sync.Pool{}
+	}
+
+	fn()
+}
+
+func BenchmarkInflate(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		data := fixedLayoutPage(size.size)
+		compressed := deflate(b, data)
+
+		for _, pooled := range []bool{true, false} {
+			b.Run(fmt.Sprintf("size=%s/pooled=%t", size.name, pooled), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+
+				for i := 0; i < b.N; i++ {
+					withoutInflaterPool(pooled, func() {
+						if _, err := inflate(compressed, int64(len(data)), 0, nil); err != nil {
+							b.Fatal(err)
+						}
+					})
+				}
+			})
+		}
+	}
+}
@@ -3,150 +3,840 @@ package lcp
 import (
 	"archive/zip"
 	"bytes"
-	"compress/flate"
+	"cmp"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/base64"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
-	"net/url"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abustany/lcp-decrypt/pkg/xmlenc"
 )
 
 type decryptOptions struct {
-	Log func(msg string)
+	Context            context.Context
+	Log                func(msg string)
+	DuplicatePolicy    DuplicatePolicy
+	Report             *Report
+	ScanUnlisted       bool
+	OnFileStart        func(entry FileEntry, action FileAction)
+	OnFileEnd          func(result FileResult)
+	OnWarning          func(w Warning)
+	ContinueOnError    bool
+	Passphrase         string
+	PassphraseVariants []PassphraseVariant
+	ExternalLicense    io.Reader
+	License            *License
+	ContentKey         []byte
+	LicenseID          string
+	StrictLicense      bool
+	LicenseLocators    []LicenseLocator
+	AllowedProviders   []string
+	SpoolThreshold     int64
+	MaxMemory          int64
+	Concurrency        int
+	ProfileTransforms  map[string]UserKeyTransform
+	RedactPII          bool
+	Preview            int
+	Transformers       []transformer
+	Limits             Limits
 }
 
 type DecryptOption func(*decryptOptions)
 
+// WithContext makes Decrypt stop as soon as possible once ctx is done. Decrypt
+// then returns an error wrapping ctx.Err().
+func WithContext(ctx context.Context) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Context = ctx
+	}
+}
+
 func WithLogger(log func(msg string)) DecryptOption {
 	return func(o *decryptOptions) {
 		o.Log = log
 	}
 }
 
+// DuplicatePolicy controls what happens when the input archive contains
+// several entries with the same name.
+type DuplicatePolicy int
+
+const (
+	// DuplicateLastWins keeps the last entry with a given name. This is the
+	// default, and matches what most zip tools do when extracting.
+	DuplicateLastWins DuplicatePolicy = iota
+	// DuplicateFirstWins keeps the first entry with a given name.
+	DuplicateFirstWins
+	// DuplicateError aborts the decryption.
+	DuplicateError
+)
+
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateLastWins:
+		return "last"
+	case DuplicateFirstWins:
+		return "first"
+	case DuplicateError:
+		return "error"
+	default:
+		return fmt.Sprintf("DuplicatePolicy(%d)", int(p))
+	}
+}
+
+// ParseDuplicatePolicy parses the names returned by DuplicatePolicy.String.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	for _, p := range []DuplicatePolicy{DuplicateLastWins, DuplicateFirstWins, DuplicateError} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid duplicate policy %q (valid values are last, first and error)", s)
+}
+
+func WithDuplicatePolicy(policy DuplicatePolicy) DecryptOption {
+	return func(o *decryptOptions) {
+		o.DuplicatePolicy = policy
+	}
+}
+
+// WithContinueOnError makes Decrypt skip the files that fail to decrypt
+// instead of aborting. The errors for all the skipped files are available in
+// Report.Err.
+//
+// Errors that leave the output file in an inconsistent state (for example
+// failures to write to out) still abort the decryption.
+func WithContinueOnError() DecryptOption {
+	return func(o *decryptOptions) {
+		o.ContinueOnError = true
+	}
+}
+
 type EncryptionAlgorithm string
 
 const (
-	EncryptionAlgorithmAES256CBC       EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
-	EncryptionAlgorithmFontObfuscation EncryptionAlgorithm = "http://www.idpf.org/2008/embedding"
+	EncryptionAlgorithmAES256CBC            EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	EncryptionAlgorithmAES256GCM            EncryptionAlgorithm = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+	EncryptionAlgorithmFontObfuscation      EncryptionAlgorithm = "http://www.idpf.org/2008/embedding"
+	EncryptionAlgorithmAdobeFontObfuscation EncryptionAlgorithm = "http://ns.adobe.com/pdf/enc#RC"
 )
 
+// WithExternalLicense makes Decrypt use the license read from r instead of the
+// one embedded in the input file. This is required for publications that are
+// distributed separately from their license.
+func WithExternalLicense(r io.Reader) DecryptOption {
+	return func(o *decryptOptions) {
+		o.ExternalLicense = r
+	}
+}
+
 // Decrypt reads an EPUB file encrypted with the Readium LCP DRM from in and
 // outputs a regular EPUB file to out.
 //
+// Readium packages (audiobooks, PDFs...), which describe their resources in a
+// manifest.json file rather than in an OPF file, are supported as well. The
+// output is then a Readium package without encryption. Containers of unknown
+// types get their files decrypted according to META-INF/encryption.xml, but
+// their structure is otherwise left as it is.
+//
+// The names of the entries of the input file are untrusted: absolute paths
+// are made relative, and entries pointing outside of the archive are left out
+// of the output file (with a warning in both cases).
+//
 // isSize should be the total size of the input data, and userKeyHex the hex
-// encoded LCP user key.
+// encoded LCP user key (or empty when using WithPassphrase).
 func Decrypt(out io.Writer, in io.ReaderAt, inSize int64, userKeyHex string, opts ...DecryptOption) error {
-	var decryptOptions decryptOptions
+	d := newDecrypter(opts)
+	start := time.Now()
+
+	err := d.decrypt(out, in, inSize, userKeyHex)
+
+	d.timings.fill(&d.report.Timings)
+	d.report.Timings.Total = time.Since(start)
+
+	if err != nil {
+		return d.redactError(err)
+	}
+
+	return nil
+}
+
+func newDecrypter(opts []DecryptOption) *decrypter {
+	decryptOptions := decryptOptions{
+		Context: context.Background(),
+	}
 
 	for _, o := range opts {
 		o(&decryptOptions)
 	}
 
-	log := func(msg string) {
-		if decryptOptions.Log == nil {
-			return
+	d := &decrypter{
+		opts:   decryptOptions,
+		report: decryptOptions.Report,
+	}
+
+	if d.report == nil {
+		d.report = &Report{}
+	}
+
+	return d
+}
+
+// open reads the content key of the publication stored in in, and returns
+// its entries, sanitized and deduplicated.
+func (d *decrypter) open(in io.ReaderAt, inSize int64, userKeyHex string) (*zip.Reader, []*zip.File, error) {
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return nil, nil, newError(MsgInvalidInput, fmt.Errorf("error opening input file: %w", err))
+	}
+
+	if err := d.readContentKey(inFile, userKeyHex); err != nil {
+		return nil, nil, err
+	}
+
+	d.detectContainer(inFile)
+	d.identifier = publicationIdentifier(inFile)
+
+	if d.opts.Preview > 0 {
+		if err := d.planPreview(inFile); err != nil {
+			return nil, nil, err
 		}
-		decryptOptions.Log(msg)
 	}
 
-	if userKeyHex == "" {
-		return fmt.Errorf("user key not specified")
+	files, err := dedupeFiles(sanitizeFiles(inFile.File, d.warn), d.opts.DuplicatePolicy, d.warn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := d.checkLimits(files); err != nil {
+		return nil, nil, err
 	}
 
-	userKey, err := hex.DecodeString(userKeyHex)
+	var encryptedFiles []FileEntry
+
+	encryptedFiles, d.rewrittenFiles, err = d.container.impl().Encryption(inFile, d.container)
 	if err != nil {
-		return fmt.Errorf("error decoding user key: %w", err)
+		return nil, nil, fmt.Errorf("error listing encrypted files: %w", err)
 	}
 
-	inFile, err := zip.NewReader(in, inSize)
+	for i := range encryptedFiles {
+		if name, ok := sanitizeEntryName(encryptedFiles[i].Path); ok {
+			encryptedFiles[i].Path = name
+		}
+	}
+
+	d.encryptedFiles = groupFileEntriesByPath(encryptedFiles)
+	d.report.MissingFiles = listMissingFiles(encryptedFiles, files)
+
+	return inFile, files, nil
+}
+
+func (d *decrypter) decrypt(out io.Writer, in io.ReaderAt, inSize int64, userKeyHex string) error {
+	if err := checkTransformers(d.opts.Transformers); err != nil {
+		return err
+	}
+
+	inFile, files, err := d.open(in, inSize, userKeyHex)
 	if err != nil {
-		return fmt.Errorf("error opening input file: %w", err)
+		return err
+	}
+
+	w := d.newEntryWriter(out)
+
+	if d.rules.RepairMimetype {
+		mimetype, err := d.prepareMimetype(files)
+		if err != nil {
+			return fmt.Errorf("error reading mimetype file: %w", err)
+		}
+
+		if mimetype != nil {
+			if err := d.finish(mimetype, w); err != nil {
+				return fmt.Errorf("error appending mimetype file to output zip file: %w", err)
+			}
+		}
+
+		files = slices.DeleteFunc(slices.Clone(files), func(f *zip.File) bool { return f.Name == "mimetype" })
+	}
+
+	if err := d.processFiles(files, w); err != nil {
+		if ctxErr := d.opts.Context.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			// Still close the writer so that all the data written so far gets
+			// flushed, the caller is free to discard it.
+			_ = w.close(inFile.Comment)
+			return interruptedError(err)
+		}
+
+		return err
+	}
+
+	if err := w.close(inFile.Comment); err != nil {
+		return fmt.Errorf("error finalizing output zip file: %w", err)
+	}
+
+	if len(d.report.MissingFiles) > 0 {
+		d.warn(WarningMissingFile, "", fmt.Sprintf("%d file(s) listed in encryption.xml are missing from the input file, it might be truncated or corrupted: %s", len(d.report.MissingFiles), strings.Join(d.report.MissingFiles, ", ")))
+	}
+
+	fileErrors := d.sortedFileErrors()
+	d.report.Err = d.redactError(errors.Join(fileErrors...))
+
+	kind := d.container.Type.String()
+
+	if len(fileErrors) > 0 {
+		d.log(fmt.Sprintf("Decrypted %s with %d error(s) and %d warning(s)", kind, len(fileErrors), len(d.report.Warnings)))
+	} else if len(d.report.Warnings) > 0 {
+		d.log(fmt.Sprintf("Decrypted %s with %d warning(s)", kind, len(d.report.Warnings)))
+	} else {
+		d.log("Decrypted " + kind)
 	}
 
-	contentKey, err := getContentKey(inFile, userKey)
+	return nil
+}
+
+// skippableError wraps errors that happen before anything gets written to the
+// output file for an entry. When continuing on errors, such entries are left
+// out of the output file.
+type skippableError struct {
+	Err error
+}
+
+func (e *skippableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *skippableError) Unwrap() error {
+	return e.Err
+}
+
+// decrypter holds the state of a Decrypt call.
+type decrypter struct {
+	opts           decryptOptions
+	report         *Report
+	contentKey     []byte
+	encryptedFiles map[string]FileEntry
+
+	// identifier is the unique identifier of the publication, from which the
+	// keys of the obfuscated fonts derive.
+	identifier string
+
+	// mu serializes the calls to the callbacks and the updates to the report
+	// when processing entries concurrently.
+	mu         sync.Mutex
+	fileErrors []indexedError
+
+	// licensePaths are the files holding the licenses of the publication.
+	licensePaths []string
+
+	// rewrittenFiles are the new contents of the unencrypted files that
+	// change in the output file, as the Readium manifest.
+	rewrittenFiles map[string][]byte
+
+	container ContainerInfo
+	rules     Packaging
+
+	timings timings
+
+	// outputSize is the total size of the entries prepared so far, checked
+	// against the Limits.
+	outputSize atomic.Int64
+
+	// redactor masks personal information when using WithRedactPII.
+	redactor *strings.Replacer
+
+	// preview lists the files left out when using WithPreview.
+	preview *previewPlan
+}
+
+// detectContainer finds out what kind of publication the input file holds,
+// and warns about the structural issues that might confuse readers.
+func (d *decrypter) detectContainer(root fs.FS) {
+	container, err := DetectContainer(root)
 	if err != nil {
-		return fmt.Errorf("error getting content key: %w", err)
+		d.warn(WarningContainer, "", fmt.Sprintf("error detecting the publication type: %s", err))
+
+		if container.Type == "" {
+			container.Type = ContainerUnknown
+		}
+	}
+
+	d.container = container
+	d.report.Container = container
+	d.rules = container.impl().Packaging(container)
+
+	if container.Version != "" {
+		d.log(fmt.Sprintf("Detected %s (version %s)", container.Type, container.Version))
+	} else {
+		d.log("Detected " + container.Type.String())
+	}
+
+	if container.Type == ContainerUnknown {
+		d.warn(WarningContainer, "", "unknown container type, its structure is kept as it is")
 	}
 
-	encryptedFiles, err := listEncryptedFiles(inFile)
 	if err != nil {
-		return fmt.Errorf("error listing encrypted files: %w", err)
+		return
+	}
+
+	for _, w := range checkContainer(root, container) {
+		d.warn(WarningContainer, "", w)
+	}
+}
+
+func (d *decrypter) log(msg string) {
+	if d.opts.Log == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.opts.Log(d.redact(msg))
+}
+
+func (d *decrypter) warn(kind WarningKind, path, msg string) {
+	msg = d.redact(msg)
+
+	d.mu.Lock()
+	d.report.Warnings = append(d.report.Warnings, msg)
+	d.mu.Unlock()
+
+	d.log("Warning: " + msg)
+	d.notifyWarning(Warning{Kind: kind, Path: path, Message: msg})
+}
+
+// notifyWarning passes w to the function registered with WithOnWarning.
+func (d *decrypter) notifyWarning(w Warning) {
+	if d.opts.OnWarning == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.opts.OnWarning(w)
+}
+
+// prepareMimetype returns the job writing the mimetype file, which comes
+// first in the output file. It returns nil if no mimetype file is needed.
+func (d *decrypter) prepareMimetype(files []*zip.File) (*fileJob, error) {
+	index := slices.IndexFunc(files, func(f *zip.File) bool { return f.Name == "mimetype" })
+
+	if index < 0 && !d.rules.RequireMimetype {
+		return nil, nil // Readium packages don't require a mimetype file
+	}
+
+	var mimetype []byte
+
+	if index >= 0 {
+		var err error
+
+		if mimetype, err = readMimetype(files[index]); err != nil {
+			return nil, err
+		}
 	}
 
-	outZip := zip.NewWriter(out)
+	mimetype = d.repairMimetype(mimetype, files, index)
 
-	if err := outZip.SetComment(inFile.Comment); err != nil {
-		return fmt.Errorf("error setting output file comment: %w", err)
+	if rewritten, ok := d.rewrittenFiles["mimetype"]; ok {
+		mimetype = rewritten
 	}
 
-	encryptedFilesSet := groupFileEntriesByPath(encryptedFiles)
+	entry := FileEntry{Path: "mimetype"}
+	d.fileStart(entry, FileActionCopy)
 
 	// According to the ePUB spec, the "mimetype" file must come first in the
 	// archive and not be compressed.
-	mimetypeFile, err := outZip.CreateHeader(&zip.FileHeader{
-		Name:   "mimetype",
-		Method: zip.Store,
-	})
+	return &fileJob{
+		entry:  entry,
+		action: FileActionCopy,
+		start:  time.Now(),
+		prepared: &preparedFile{
+			header: zip.FileHeader{
+				Name:               "mimetype",
+				CreatorVersion:     zipVersion20,
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE(mimetype),
+				CompressedSize64:   uint64(len(mimetype)),
+				UncompressedSize64: uint64(len(mimetype)),
+			},
+			data: mimetype,
+		},
+	}, nil
+}
+
+// repairMimetype fixes the mistakes of sloppy packagers that make strict
+// readers reject the mimetype file, files[index] being the input mimetype
+// file (index is negative if there is none) and mimetype its contents.
+func (d *decrypter) repairMimetype(mimetype []byte, files []*zip.File, index int) []byte {
+	if index < 0 {
+		d.repair("added missing mimetype file")
+		return []byte(cmp.Or(d.rules.Mimetype, defaultMimetype))
+	}
+
+	if index > 0 {
+		d.repair("moved mimetype file to the start of the archive")
+	}
+
+	if files[index].Method != zip.Store {
+		d.repair("stored mimetype file without compression")
+	}
 
-	if _, err := io.WriteString(mimetypeFile, "application/epub+zip"); err != nil {
-		return fmt.Errorf("error appending mimetype file to output zip file: %w", err)
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(mimetype, []byte("\uFEFF")))
+	if len(trimmed) != len(mimetype) {
+		d.repair("removed byte order mark and whitespace around mimetype")
 	}
 
-	for _, f := range inFile.File {
-		switch f.Name {
-		case "META-INF/encryption.xml", "META-INF/license.lcpl", "mimetype":
-			continue // already written / not needed once content is decrypted
+	if d.rules.Mimetype != "" && string(trimmed) != d.rules.Mimetype {
+		d.repair(fmt.Sprintf("replaced invalid mimetype %q with %s", trimmed, d.rules.Mimetype))
+		return []byte(d.rules.Mimetype)
+	}
+
+	return trimmed
+}
+
+// repair records a fix made to the structure of the publication.
+func (d *decrypter) repair(msg string) {
+	d.mu.Lock()
+	d.report.Repairs = append(d.report.Repairs, msg)
+	d.mu.Unlock()
+
+	d.log("Repaired: " + msg)
+	d.notifyWarning(Warning{Kind: WarningRepair, Path: "mimetype", Message: msg})
+}
+
+// fileAction decides what to do with an entry of the input file.
+func (d *decrypter) fileAction(f *zip.File) (FileEntry, FileAction) {
+	switch {
+	case slices.Contains(d.rules.EncryptionFiles, f.Name), d.rules.SkipLicenseFiles && isLicenseFile(f.Name), slices.Contains(d.licensePaths, f.Name):
+		return FileEntry{Path: f.Name}, FileActionSkip // not needed once content is decrypted
+	case strings.HasSuffix(f.Name, "/"):
+		return FileEntry{Path: f.Name}, FileActionDirectory
+	case d.preview != nil && d.preview.dropsFile(f.Name):
+		return FileEntry{Path: f.Name}, FileActionSkip
+	}
+
+	if fileEntry, ok := d.encryptedFiles[f.Name]; ok {
+		return fileEntry, FileActionDecrypt
+	}
+
+	return FileEntry{Path: f.Name}, FileActionCopy
+}
+
+// prepareFile computes the output for an entry of the input file. Since
+// nothing gets written to the output file, all the errors only affect this
+// entry.
+func (d *decrypter) prepareFile(f *zip.File, fileEntry FileEntry, action FileAction) (*preparedFile, error) {
+	switch action {
+	case FileActionSkip:
+		return nil, nil
+	case FileActionDirectory:
+		return directoryFile(f), nil
+	}
+
+	d.log("Processing file " + f.Name + "...")
+
+	if action == FileActionCopy {
+		if d.opts.ScanUnlisted {
+			suspicious, err := scanUnlistedFile(f)
+			if err != nil {
+				return nil, &skippableError{fmt.Errorf("error scanning file %s from input zip file: %w", f.Name, err)}
+			}
+
+			if suspicious {
+				d.mu.Lock()
+				d.report.SuspiciousFiles = append(d.report.SuspiciousFiles, f.Name)
+				d.mu.Unlock()
+
+				d.warn(WarningSuspiciousFile, f.Name, "file "+f.Name+" is not listed in encryption.xml but looks encrypted, it will probably be unreadable")
+			}
+		}
+
+		if rewritten, ok := d.rewrittenFiles[f.Name]; ok {
+			// For example, the encryption properties of a Readium manifest
+			// must go away along with the encryption
+			data, err := d.transform(f.Name, rewritten)
+			if err != nil {
+				return nil, err
+			}
+
+			return newPreparedFile(f, data)
 		}
 
-		log("Processing file " + f.Name + "...")
+		if d.container.Type.IsEPUB() && f.Name == d.container.PackagePath {
+			return d.preparePackageDocument(f)
+		}
 
-		dstFile, err := outZip.Create(f.Name)
-		if err != nil {
-			return fmt.Errorf("error appending file %s to output zip file: %w", f.Name, err)
+		if d.transforms(f.Name) {
+			return d.prepareTransformedFile(f)
 		}
 
-		if strings.HasSuffix(f.Name, "/") {
-			continue // no need to copy any data for directories
+		return copiedFile(f), nil
+	}
+
+	if d.spoolsFile(f, fileEntry) {
+		return d.prepareSpooledFile(f, fileEntry)
+	}
+
+	srcFile, err := f.Open()
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)}
+	}
+
+	defer srcFile.Close()
+
+	data, err := d.decryptFile(srcFile, int64(f.UncompressedSize64), d.contentKey, fileEntry)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error decrypting file %s: %w", f.Name, err)}
+	}
+
+	if err := srcFile.Close(); err != nil {
+		return nil, &skippableError{fmt.Errorf("error closing file %s from input zip file: %w", f.Name, err)}
+	}
+
+	if data, err = d.transform(f.Name, data); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	p, err := newPreparedFile(f, data)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error preparing file %s: %w", f.Name, err)}
+	}
+
+	d.timings.since(phaseCompress, start)
+
+	digest := sha256.Sum256(data)
+	d.recordDigest(f.Name, digest[:])
+
+	return p, nil
+}
+
+// recordDigest stores the SHA-256 digest of the decrypted contents of an
+// entry in the report.
+func (d *decrypter) recordDigest(name string, digest []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.report.Digests == nil {
+		d.report.Digests = map[string]string{}
+	}
+
+	d.report.Digests[name] = hex.EncodeToString(digest)
+}
+
+// preparePackageDocument copies the EPUB package document, without the
+// license some vendors store in its metadata, and without the documents left
+// out of previews.
+func (d *decrypter) preparePackageDocument(f *zip.File) (*preparedFile, error) {
+	data, err := d.packageDocument(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		if d.transforms(f.Name) {
+			return d.prepareTransformedFile(f)
 		}
 
-		srcFile, err := f.Open()
+		return copiedFile(f), nil
+	}
+
+	if data, err = d.transform(f.Name, data); err != nil {
+		return nil, err
+	}
+
+	p, err := newPreparedFile(f, data)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error preparing file %s: %w", f.Name, err)}
+	}
+
+	return p, nil
+}
+
+// packageDocument returns the contents of the EPUB package document once the
+// license and the documents left out of previews are removed, or nil if it
+// can be copied as is.
+func (d *decrypter) packageDocument(f *zip.File) ([]byte, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)}
+	}
+
+	defer fd.Close()
+
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error reading file %s from input zip file: %w", f.Name, err)}
+	}
+
+	modified := false
+
+	stripped, err := stripOPFLicense(d.container.Type, data)
+
+	switch {
+	case err != nil && d.preview == nil:
+		d.warn(WarningLicense, f.Name, fmt.Sprintf("error looking for a license in %s, copying it as is: %s", f.Name, err))
+		return nil, nil
+	case err != nil:
+		return nil, &skippableError{fmt.Errorf("error reading file %s: %w", f.Name, err)}
+	case stripped != nil:
+		d.log("Removing the license from the metadata of " + f.Name)
+		data, modified = stripped, true
+	}
+
+	if d.preview != nil {
+		trimmed, err := removeXMLElements(data, d.preview.dropsElement)
 		if err != nil {
-			return fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)
+			return nil, &skippableError{fmt.Errorf("error reading file %s: %w", f.Name, err)}
 		}
 
-		if fileEntry, ok := encryptedFilesSet[f.Name]; ok {
-			err = decryptFile(dstFile, srcFile, contentKey, fileEntry.EncryptionAlgorithm, fileEntry.IsCompressed)
-		} else {
-			_, err = io.Copy(dstFile, srcFile)
+		if trimmed != nil {
+			data, modified = trimmed, true
 		}
+	}
 
-		if err != nil {
-			return fmt.Errorf("error copying data for file %s to output zip file: %w", f.Name, err)
+	if !modified {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+const defaultMimetype = "application/epub+zip"
+
+// readMimetype returns the contents of the mimetype file.
+func readMimetype(f *zip.File) ([]byte, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	defer fd.Close()
+
+	return io.ReadAll(fd)
+}
+
+// sanitizeEntryName returns a safe version of an entry name coming from the
+// input file, relative to the root of the archive and using forward slashes.
+// It returns false if the name points outside of the archive.
+func sanitizeEntryName(name string) (string, bool) {
+	isDir := strings.HasSuffix(name, "/") || strings.HasSuffix(name, "\\")
+
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	// Windows drive letters, as in C:/Windows
+	if len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z') {
+		name = name[2:]
+	}
+
+	name = path.Clean(strings.TrimLeft(name, "/"))
+
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\x00") {
+		return "", false
+	}
+
+	if isDir {
+		name += "/"
+	}
+
+	return name, true
+}
+
+// sanitizeFiles protects from the archives with entries named to be
+// extracted outside of the destination directory ("zip slip"). Absolute paths
+// are made relative, and entries that can't be made safe are left out.
+func sanitizeFiles(files []*zip.File, warn func(kind WarningKind, path, msg string)) []*zip.File {
+	res := make([]*zip.File, 0, len(files))
+
+	for _, f := range files {
+		name, ok := sanitizeEntryName(f.Name)
+
+		switch {
+		case !ok:
+			warn(WarningUnsafeName, f.Name, fmt.Sprintf("leaving out entry with unsafe name %q", f.Name))
+			continue
+		case name != f.Name:
+			warn(WarningUnsafeName, f.Name, fmt.Sprintf("renaming entry with unsafe name %q to %s", f.Name, name))
+
+			renamed := *f
+			renamed.Name = name
+			f = &renamed
 		}
 
-		if err := srcFile.Close(); err != nil {
-			return fmt.Errorf("error closing file %s from input zip file: %w", f.Name, err)
+		res = append(res, f)
+	}
+
+	return res
+}
+
+// dedupeFiles filters out the entries sharing their name with another entry,
+// according to policy.
+func dedupeFiles(files []*zip.File, policy DuplicatePolicy, warn func(kind WarningKind, path, msg string)) ([]*zip.File, error) {
+	counts := make(map[string]int, len(files))
+
+	for _, f := range files {
+		counts[f.Name]++
+	}
+
+	if len(counts) == len(files) {
+		return files, nil
+	}
+
+	var duplicates []string
+
+	for _, f := range files {
+		if counts[f.Name] > 1 && !slices.Contains(duplicates, f.Name) {
+			duplicates = append(duplicates, f.Name)
 		}
 	}
 
-	if err := outZip.Close(); err != nil {
-		return fmt.Errorf("error finalizing output zip file: %w", err)
+	if policy == DuplicateError {
+		return nil, fmt.Errorf("input file contains duplicate entries: %s", strings.Join(duplicates, ", "))
 	}
 
-	log("Decrypted ePUB")
+	for _, name := range duplicates {
+		warn(WarningDuplicateEntry, name, fmt.Sprintf("input file contains %d entries named %s, keeping the %s one", counts[name], name, policy))
+	}
 
-	return nil
+	res := make([]*zip.File, 0, len(counts))
+	seen := make(map[string]int, len(counts))
+
+	for _, f := range files {
+		seen[f.Name]++
+
+		keep := seen[f.Name] == 1 // DuplicateFirstWins
+		if policy == DuplicateLastWins {
+			keep = seen[f.Name] == counts[f.Name]
+		}
+
+		if keep {
+			res = append(res, f)
+		}
+	}
+
+	return res, nil
 }
 
 type FileEntry struct {
-	Path                string
-	IsCompressed        bool
+	Path         string
+	IsCompressed bool
+	// OriginalLength is the size of the file once decrypted and decompressed,
+	// or 0 if unknown.
+	OriginalLength      int64
 	EncryptionAlgorithm EncryptionAlgorithm
 }
 
@@ -158,61 +848,46 @@ func listEncryptedFiles(epubRoot fs.FS) ([]FileEntry, error) {
 
 	defer encFile.Close()
 
-	var encryption struct {
-		EncryptedData []struct {
-			EncryptionMethod struct {
-				Algorithm string `xml:"Algorithm,attr"`
-			}
-			CipherData struct {
-				CipherReference struct {
-					URI string `xml:"URI,attr"`
-				}
-			}
-			EncryptionProperties struct {
-				EncryptionProperty []struct {
-					Compression []struct {
-						Method int `xml:"Method,attr"`
-					}
-				}
-			}
-		}
-	}
-
-	if err := xml.NewDecoder(encFile).Decode(&encryption); err != nil {
+	encryption, err := xmlenc.Parse(encFile)
+	if err != nil {
 		return nil, fmt.Errorf("error decoding file: %w", err)
 	}
 
 	var res []FileEntry
 
 	for _, d := range encryption.EncryptedData {
-		path, err := url.PathUnescape(d.CipherData.CipherReference.URI)
+		path, ok, err := d.Path()
 		if err != nil {
-			return nil, fmt.Errorf("error decoding entry path %q: %w", d.CipherData.CipherReference.URI, err)
+			return nil, err
+		}
+
+		if !ok {
+			// Inline data, there is no resource to decrypt
+			continue
 		}
 
 		isCompressed := false
-		var encryptionAlgorithm EncryptionAlgorithm
+		var originalLength int64
+		encryptionAlgorithm := EncryptionAlgorithm(d.EncryptionMethod.Algorithm)
 
-		switch d.EncryptionMethod.Algorithm {
-		case string(EncryptionAlgorithmAES256CBC), string(EncryptionAlgorithmFontObfuscation):
-			encryptionAlgorithm = EncryptionAlgorithm(d.EncryptionMethod.Algorithm)
-		default:
-			return nil, fmt.Errorf("unsupported encryption algorithm for file %s: %s", path, d.EncryptionMethod.Algorithm)
+		if err := checkAlgorithm(path, encryptionAlgorithm); err != nil {
+			return nil, err
 		}
 
-	PropertyLoop:
-		for _, p := range d.EncryptionProperties.EncryptionProperty {
-			for _, c := range p.Compression {
-				if c.Method == 8 {
-					isCompressed = true
-					break PropertyLoop
-				}
-			}
+		c, err := d.Compression()
+		if err != nil {
+			return nil, fmt.Errorf("error reading compression of file %s: %w", path, err)
+		}
+
+		if c != nil {
+			isCompressed = true
+			originalLength = c.OriginalLength
 		}
 
 		res = append(res, FileEntry{
 			Path:                path,
 			IsCompressed:        isCompressed,
+			OriginalLength:      originalLength,
 			EncryptionAlgorithm: encryptionAlgorithm,
 		})
 	}
@@ -220,128 +895,138 @@ func listEncryptedFiles(epubRoot fs.FS) ([]FileEntry, error) {
 	return res, nil
 }
 
-func groupFileEntriesByPath(strs []FileEntry) map[string]FileEntry {
-	res := make(map[string]FileEntry, len(strs))
+// listMissingFiles returns the paths of the encrypted entries that don't
+// exist in files.
+func listMissingFiles(encryptedFiles []FileEntry, files []*zip.File) []string {
+	present := make(map[string]struct{}, len(files))
 
-	for _, s := range strs {
-		res[s.Path] = s
+	for _, f := range files {
+		present[f.Name] = struct{}{}
 	}
 
-	return res
-}
+	var res []string
 
-func getContentKey(epubRoot fs.FS, userKey []byte) ([]byte, error) {
-	var license struct {
-		ID         string `json:"id"`
-		Encryption struct {
-			ContentKey struct {
-				EncryptedValue string `json:"encrypted_value"`
-			} `json:"content_key"`
-			UserKey struct {
-				KeyCheck string `json:"key_check"`
-			} `json:"user_key"`
+	for _, e := range encryptedFiles {
+		if _, ok := present[e.Path]; !ok {
+			res = append(res, e.Path)
 		}
 	}
 
-	licenseFile, err := epubRoot.Open("META-INF/license.lcpl")
-	if err != nil {
-		return nil, fmt.Errorf("error opening license file: %w", err)
-	}
+	return res
+}
 
-	if err := json.NewDecoder(licenseFile).Decode(&license); err != nil {
-		return nil, fmt.Errorf("error decoding json: %w", err)
-	}
+func groupFileEntriesByPath(strs []FileEntry) map[string]FileEntry {
+	res := make(map[string]FileEntry, len(strs))
 
-	encryptedKeyCheck, err := base64.StdEncoding.DecodeString(license.Encryption.UserKey.KeyCheck)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding key check: %w", err)
+	for _, s := range strs {
+		res[s.Path] = s
 	}
 
-	keyCheck, err := decipherAES256CBC(encryptedKeyCheck, userKey)
-	if err != nil {
-		return nil, fmt.Errorf("error decrypting key check: %w", err)
-	}
+	return res
+}
 
-	if string(keyCheck) != license.ID {
-		return nil, fmt.Errorf("decrypted key check (%s) does not match license ID (%s)", keyCheck, license.ID)
-	}
+func decipherAES256CBC(data, key []byte) ([]byte, error) {
+	res, _, err := decipherAES256CBCPadding(data, key)
+	return res, err
+}
 
-	encryptedContentKey, err := base64.StdEncoding.DecodeString(license.Encryption.ContentKey.EncryptedValue)
+// decipherAES256CBCPadding is like decipherAES256CBC, but also tells whether
+// the padding is well formed (all its bytes hold its length). A malformed
+// padding whose length is still in range is removed anyway.
+func decipherAES256CBCPadding(data, key []byte) ([]byte, bool, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding content key: %w", err)
+		return nil, false, fmt.Errorf("error creating cipher: %w", err)
 	}
 
-	contentKey, err := decipherAES256CBC(encryptedContentKey, userKey)
-	if err != nil {
-		return nil, fmt.Errorf("error decrypting content key: %w", err)
+	if len(data) == 0 {
+		return nil, true, nil
 	}
 
-	return contentKey, nil
-}
-
-func decipherAES256CBC(data, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("error creating cipher: %w", err)
+	if len(data) < 2*aes.BlockSize {
+		return nil, false, fmt.Errorf("data is too short (%d bytes)", len(data))
 	}
 
 	iv, cipherData := data[:aes.BlockSize], data[aes.BlockSize:]
 
-	if len(data) == 0 {
-		return nil, nil
+	if len(cipherData)%aes.BlockSize != 0 {
+		return nil, false, fmt.Errorf("data length %d is not a multiple of the block size", len(cipherData))
 	}
 
-	res := make([]byte, len(cipherData))
+	// Decrypt in place, data can be large
+	res := cipherData
 	cipher.NewCBCDecrypter(block, iv).CryptBlocks(res, cipherData)
 
+	return stripPadding(res)
+}
+
+// stripPadding removes the PKCS#7 padding of decrypted data, and returns
+// whether it was well formed.
+func stripPadding(res []byte) ([]byte, bool, error) {
 	paddingLen := int(res[len(res)-1])
 	if paddingLen > len(res) {
-		return nil, fmt.Errorf("invalid padding length %d (data length is %d)", paddingLen, len(res))
+		return nil, false, fmt.Errorf("invalid padding length %d (data length is %d)", paddingLen, len(res))
 	}
 
+	valid := paddingLen > 0 && bytes.Count(res[len(res)-paddingLen:], []byte{byte(paddingLen)}) == paddingLen
 	res = res[:len(res)-paddingLen]
 
-	return res, nil
+	return res, valid, nil
 }
 
-func decipherFontObfuscation(data, key []byte) ([]byte, error) {
-	// Let's assume readers know how to deal with this algorithm... Worst case,
-	// let's hope they fallback to any font.
-	return data, nil
-}
+// decryptFile returns the decrypted contents of an encrypted entry. srcSize
+// is the size of the encrypted data declared by the input file, which is only
+// used to preallocate memory: it comes from the headers of the zip entry, and
+// can't be trusted.
+func (d *decrypter) decryptFile(src io.Reader, srcSize int64, contentKey []byte, fileEntry FileEntry) ([]byte, error) {
+	start := time.Now()
 
-func decryptFile(dst io.Writer, src io.Reader, contentKey []byte, encryptionAlgorithm EncryptionAlgorithm, isCompressed bool) error {
-	encryptedData, err := io.ReadAll(src)
-	if err != nil {
-		return fmt.Errorf("error reading data: %w", err)
+	// Avoid the repeated reallocations of io.ReadAll for large files, without
+	// allocating gigabytes for a forged size
+	encryptedData := bytes.NewBuffer(make([]byte, 0, min(max(srcSize, 0), maxHintSize)+1))
+
+	if _, err := encryptedData.ReadFrom(src); err != nil {
+		return nil, fmt.Errorf("error reading data: %w", err)
 	}
 
-	var decipherFunc func(data []byte, key []byte) (res []byte, err error)
+	start = d.timings.since(phaseRead, start)
+	d.timings.encryptedBytes.Add(int64(encryptedData.Len()))
 
-	switch encryptionAlgorithm {
-	case EncryptionAlgorithmAES256CBC:
-		decipherFunc = decipherAES256CBC
-	case EncryptionAlgorithmFontObfuscation:
-		decipherFunc = decipherFontObfuscation
-	default:
-		return fmt.Errorf("invalid encryption algorithm: %s", encryptionAlgorithm)
+	alg, ok := lookupAlgorithm(fileEntry.EncryptionAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("invalid encryption algorithm: %s", fileEntry.EncryptionAlgorithm)
 	}
 
-	data, err := decipherFunc(encryptedData, contentKey)
+	key := contentKey
+
+	if _, ok := fontObfuscations[fileEntry.EncryptionAlgorithm]; ok {
+		var err error
+		if key, err = d.fontKey(fileEntry.EncryptionAlgorithm); err != nil {
+			d.warn(WarningContainer, fileEntry.Path, "font "+fileEntry.Path+" is left obfuscated: "+err.Error())
+			return encryptedData.Bytes(), nil
+		}
+	}
+
+	data, err := alg.decipher(encryptedData.Bytes(), key, func(msg string) {
+		d.warn(WarningPadding, fileEntry.Path, "file "+fileEntry.Path+" "+msg)
+	})
 	if err != nil {
-		return fmt.Errorf("error decrypting data: %w", err)
+		return nil, fmt.Errorf("error decrypting data: %w", err)
 	}
 
-	cleartextReader := io.NopCloser(bytes.NewReader(data))
-	defer cleartextReader.Close()
+	start = d.timings.since(phaseDecrypt, start)
 
-	if isCompressed {
-		cleartextReader = flate.NewReader(cleartextReader)
-	}
+	if fileEntry.IsCompressed {
+		maxSize, tooLarge := d.decompressedLimit(fileEntry.Path, int64(len(data)))
 
-	if _, err := io.Copy(dst, cleartextReader); err != nil {
-		return fmt.Errorf("error writing data: %w", err)
+		if data, err = inflate(data, fileEntry.OriginalLength, maxSize, tooLarge); err != nil {
+			return nil, fmt.Errorf("error decompressing data: %w", err)
+		}
+
+		d.timings.since(phaseInflate, start)
 	}
 
-	return nil
+	d.timings.decryptedBytes.Add(int64(len(data)))
+
+	return data, nil
 }
@@ -0,0 +1,627 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// encryptResource encrypts data as the resources of LCP publications:
+// AES-256-CBC with the IV prepended and PKCS#7 padding.
+func encryptResource(t testing.TB, data, key []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	res := make([]byte, aes.BlockSize+len(data)+padding)
+
+	copy(res, "0123456789abcdef")
+	copy(res[aes.BlockSize:], data)
+
+	for i := len(res) - padding; i < len(res); i++ {
+		res[i] = byte(padding)
+	}
+
+	cipher.NewCBCEncrypter(block, res[:aes.BlockSize]).CryptBlocks(res[aes.BlockSize:], res[aes.BlockSize:])
+
+	return res
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	key := selfTestContentKeyBytes()
+
+	for _, size := range benchmarkSizes {
+		data := fixedLayoutPage(size.size)
+		encrypted := encryptResource(b, deflate(b, data), key)
+
+		entry := FileEntry{
+			Path:                "page.xhtml",
+			IsCompressed:        true,
+			OriginalLength:      int64(len(data)),
+			EncryptionAlgorithm: EncryptionAlgorithmAES256CBC,
+		}
+
+		for _, pooled := range []bool{true, false} {
+			b.Run(fmt.Sprintf("size=%s/pooled=%t", size.name, pooled), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+
+				for i := 0; i < b.N; i++ {
+					withoutInflaterPool(pooled, func() {
+						res, err := newDecrypter(nil).decryptFile(bytes.NewReader(encrypted), int64(len(encrypted)), key, entry)
+						if err != nil {
+							b.Fatal(err)
+						}
+
+						if len(res) != len(data) {
+							b.Fatalf("got %d bytes, want %d", len(res), len(data))
+						}
+					})
+				}
+			})
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, res := range SelfTest() {
+		if res.Err != nil {
+			t.Errorf("%s: %v", res.Name, res.Err)
+		}
+	}
+}
+
+// TestDeobfuscatingReader checks that the fonts streamed to the output are
+// de-obfuscated like the ones decrypted in memory.
+func TestDeobfuscatingReader(t *testing.T) {
+	key := mustDecodeHex("0f1e2d3c4b5a69788796a5b4c3d2e1f0")
+
+	for alg := range fontObfuscations {
+		for _, size := range []int{0, 10, 1024, 1040, 1100} {
+			font := selfTestFont()[:size]
+
+			r, err := deobfuscatingReader(bytes.NewReader(font), alg, key)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", alg, size, err)
+			}
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", alg, size, err)
+			}
+
+			if want := deobfuscateFont(bytes.Clone(font), key, fontObfuscations[alg].length); !bytes.Equal(got, want) {
+				t.Errorf("%s, %d bytes: got %x, want %x", alg, size, got, want)
+			}
+		}
+	}
+}
+
+func TestSanitizeEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"OEBPS/chapter.xhtml", "OEBPS/chapter.xhtml", true},
+		{"OEBPS/", "OEBPS/", true},
+		{"../chapter.xhtml", "", false},
+		{"../../etc/passwd", "", false},
+		{"OEBPS/../../chapter.xhtml", "", false},
+		{"..", "", false},
+		{".", "", false},
+		{"OEBPS/../chapter.xhtml", "chapter.xhtml", true},
+		{"./OEBPS//chapter.xhtml", "OEBPS/chapter.xhtml", true},
+		{"/etc/passwd", "etc/passwd", true},
+		{"//server/share/chapter.xhtml", "server/share/chapter.xhtml", true},
+		{"/../chapter.xhtml", "", false},
+		{"C:/Windows/chapter.xhtml", "Windows/chapter.xhtml", true},
+		{"c:chapter.xhtml", "chapter.xhtml", true},
+		{"OEBPS\\chapter.xhtml", "OEBPS/chapter.xhtml", true},
+		{"OEBPS\\", "OEBPS/", true},
+		{"..\\chapter.xhtml", "", false},
+		{"C:\\Windows\\chapter.xhtml", "Windows/chapter.xhtml", true},
+		{"\\\\server\\share\\chapter.xhtml", "server/share/chapter.xhtml", true},
+		{"OEBPS/chapter\x00.xhtml", "", false},
+	} {
+		got, ok := sanitizeEntryName(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("sanitizeEntryName(%q) = %q, %t, want %q, %t", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// zipFiles returns entries named after names, their comment telling them
+// apart.
+func zipFiles(names ...string) []*zip.File {
+	res := make([]*zip.File, len(names))
+
+	for i, name := range names {
+		res[i] = &zip.File{FileHeader: zip.FileHeader{Name: name, Comment: fmt.Sprint(i)}}
+	}
+
+	return res
+}
+
+// fileIDs returns the names of files, with the comment set by zipFiles.
+func fileIDs(files []*zip.File) []string {
+	res := make([]string, len(files))
+
+	for i, f := range files {
+		res[i] = f.Name + "#" + f.Comment
+	}
+
+	return res
+}
+
+func TestSanitizeFiles(t *testing.T) {
+	var warnings []string
+
+	got := sanitizeFiles(zipFiles("mimetype", "../evil.xhtml", "/OEBPS/a.xhtml", "OEBPS\\b.xhtml", "OEBPS/c.xhtml"), func(kind WarningKind, path, msg string) {
+		if kind != WarningUnsafeName {
+			t.Errorf("unexpected warning kind %s", kind)
+		}
+
+		warnings = append(warnings, path)
+	})
+
+	if want := []string{"mimetype#0", "OEBPS/a.xhtml#2", "OEBPS/b.xhtml#3", "OEBPS/c.xhtml#4"}; !slices.Equal(fileIDs(got), want) {
+		t.Errorf("got files %q, want %q", fileIDs(got), want)
+	}
+
+	if want := []string{"../evil.xhtml", "/OEBPS/a.xhtml", "OEBPS\\b.xhtml"}; !slices.Equal(warnings, want) {
+		t.Errorf("got warnings for %q, want %q", warnings, want)
+	}
+}
+
+func TestDedupeFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		files    []string
+		policy   DuplicatePolicy
+		want     []string
+		warnings []string
+		err      bool
+	}{
+		{
+			name:   "no duplicates",
+			files:  []string{"mimetype", "OEBPS/a.xhtml", "OEBPS/b.xhtml"},
+			policy: DuplicateError,
+			want:   []string{"mimetype#0", "OEBPS/a.xhtml#1", "OEBPS/b.xhtml#2"},
+		},
+		{
+			name:     "last wins",
+			files:    []string{"OEBPS/a.xhtml", "OEBPS/b.xhtml", "OEBPS/a.xhtml", "OEBPS/a.xhtml"},
+			policy:   DuplicateLastWins,
+			want:     []string{"OEBPS/b.xhtml#1", "OEBPS/a.xhtml#3"},
+			warnings: []string{"OEBPS/a.xhtml"},
+		},
+		{
+			name:     "first wins",
+			files:    []string{"OEBPS/a.xhtml", "OEBPS/b.xhtml", "OEBPS/a.xhtml", "OEBPS/b.xhtml"},
+			policy:   DuplicateFirstWins,
+			want:     []string{"OEBPS/a.xhtml#0", "OEBPS/b.xhtml#1"},
+			warnings: []string{"OEBPS/a.xhtml", "OEBPS/b.xhtml"},
+		},
+		{
+			name:   "error",
+			files:  []string{"OEBPS/a.xhtml", "OEBPS/a.xhtml"},
+			policy: DuplicateError,
+			err:    true,
+		},
+		{
+			// Entry names are case-sensitive in the output archive, as in
+			// EPUB, so these are different resources
+			name:   "case collision",
+			files:  []string{"OEBPS/Chapter.xhtml", "OEBPS/chapter.xhtml", "OEBPS/CHAPTER.XHTML"},
+			policy: DuplicateError,
+			want:   []string{"OEBPS/Chapter.xhtml#0", "OEBPS/chapter.xhtml#1", "OEBPS/CHAPTER.XHTML#2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var warnings []string
+
+			got, err := dedupeFiles(zipFiles(tc.files...), tc.policy, func(kind WarningKind, path, msg string) {
+				if kind != WarningDuplicateEntry {
+					t.Errorf("unexpected warning kind %s", kind)
+				}
+
+				warnings = append(warnings, path)
+			})
+
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got files %q", fileIDs(got))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(fileIDs(got), tc.want) {
+				t.Errorf("got files %q, want %q", fileIDs(got), tc.want)
+			}
+
+			if !slices.Equal(warnings, tc.warnings) {
+				t.Errorf("got warnings for %q, want %q", warnings, tc.warnings)
+			}
+		})
+	}
+}
+
+// TestSanitizeThenDedupe checks that the entries whose names only become
+// equal once sanitized are deduplicated too.
+func TestSanitizeThenDedupe(t *testing.T) {
+	files := sanitizeFiles(zipFiles("OEBPS/a.xhtml", "/OEBPS/a.xhtml", "OEBPS\\a.xhtml", "OEBPS/x/../a.xhtml"), func(WarningKind, string, string) {})
+
+	got, err := dedupeFiles(files, DuplicateLastWins, func(WarningKind, string, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"OEBPS/a.xhtml#3"}; !slices.Equal(fileIDs(got), want) {
+		t.Errorf("got files %q, want %q", fileIDs(got), want)
+	}
+}
+
+// TestListEncryptedFilesInline checks that the encrypted data stored inline in
+// encryption.xml is not taken for a missing resource.
+func TestListEncryptedFilesInline(t *testing.T) {
+	root := fstest.MapFS{
+		"META-INF/encryption.xml": {Data: []byte(`<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+    <enc:CipherData><enc:CipherValue>MDEyMzQ1Njc4OWFiY2RlZg==</enc:CipherValue></enc:CipherData>
+  </enc:EncryptedData>
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/chapter.xhtml#start"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`)},
+	}
+
+	entries, err := listEncryptedFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Path != "OEBPS/chapter.xhtml" {
+		t.Fatalf("got entries %+v, want OEBPS/chapter.xhtml only", entries)
+	}
+
+	if missing := listMissingFiles(entries, zipFiles("mimetype", "OEBPS/chapter.xhtml")); len(missing) != 0 {
+		t.Errorf("got missing files %q", missing)
+	}
+}
+
+func TestListEncryptedFilesUnknownCompression(t *testing.T) {
+	root := fstest.MapFS{
+		"META-INF/encryption.xml": {Data: []byte(`<encryption xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/chapter.xhtml"/></enc:CipherData>
+    <enc:EncryptionProperties>
+      <enc:EncryptionProperty><Compression xmlns="http://www.idpf.org/2016/encryption#compression" Method="12" OriginalLength="100"/></enc:EncryptionProperty>
+    </enc:EncryptionProperties>
+  </enc:EncryptedData>
+</encryption>`)},
+	}
+
+	if entries, err := listEncryptedFiles(root); err == nil {
+		t.Errorf("expected an error, got entries %+v", entries)
+	}
+}
+
+func TestCBCReader(t *testing.T) {
+	key := selfTestContentKeyBytes()
+
+	for _, size := range []int{0, 1, 15, 16, 1000, cbcChunkSize - 1, cbcChunkSize, 3*cbcChunkSize + 7} {
+		data := fixedLayoutPage(size)[:size]
+		encrypted := encryptResource(t, data, key)
+
+		r, err := newCBCReader(bytes.NewReader(encrypted), key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		if !bytes.Equal(got, data) || !r.validPadding {
+			t.Errorf("%d bytes: got %d bytes (valid padding %t), want the original data", size, len(got), r.validPadding)
+		}
+
+		// A source failing like a zip entry shorter than its declared size
+		// must not pass for the end of the data, whole blocks or not
+		for _, cut := range []int{2 * aes.BlockSize, len(encrypted) - aes.BlockSize} {
+			if cut <= aes.BlockSize {
+				continue
+			}
+
+			r, err := newCBCReader(io.MultiReader(bytes.NewReader(encrypted[:cut]), errReader{io.ErrUnexpectedEOF}), key)
+			if err != nil {
+				t.Fatalf("%d bytes cut at %d: %v", size, cut, err)
+			}
+
+			if _, err := io.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%d bytes cut at %d: got error %v, want %v", size, cut, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+// testChapter is the contents of the chapter of the books made by testBook.
+var testChapter = []byte("<html><body><p>Hello, test!</p></body></html>")
+
+// testBook returns an EPUB book protected by selfTestLicense, whose chapter
+// is encrypted. forge can change the headers of the entries before they are
+// written.
+func testBook(t testing.TB, forge func(*zip.FileHeader)) []byte {
+	t.Helper()
+
+	encrypted := encryptResource(t, testChapter, selfTestContentKeyBytes())
+
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{"mimetype", []byte("application/epub+zip")},
+		{"META-INF/container.xml", []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`)},
+		{"META-INF/license.lcpl", []byte(selfTestLicense)},
+		{"META-INF/encryption.xml", []byte(`<?xml version="1.0"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#" xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+    <ds:KeyInfo><ds:RetrievalMethod URI="license.lcpl#/encryption/content_key" Type="http://readium.org/2014/01/lcp#EncryptedContentKey"/></ds:KeyInfo>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/chapter.xhtml"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`)},
+		{"OEBPS/content.opf", []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:uuid:12345678-9abc-def0-1234-56789abcdef0</dc:identifier>
+    <dc:title>Test</dc:title>
+  </metadata>
+  <manifest><item id="chapter" href="chapter.xhtml" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="chapter"/></spine>
+</package>`)},
+		{"OEBPS/chapter.xhtml", encrypted},
+	}
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		header := &zip.FileHeader{
+			Name:               e.name,
+			Method:             zip.Store,
+			CRC32:              crc32.ChecksumIEEE(e.data),
+			CompressedSize64:   uint64(len(e.data)),
+			UncompressedSize64: uint64(len(e.data)),
+		}
+
+		if forge != nil {
+			forge(header)
+		}
+
+		w, err := zw.CreateRaw(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// testUserKey is the user key of selfTestLicense, hex encoded.
+func testUserKey() string {
+	return hex.EncodeToString(selfTestUserKey())
+}
+
+func TestDecryptTestBook(t *testing.T) {
+	book := testBook(t, nil)
+
+	var out bytes.Buffer
+
+	if err := Decrypt(&out, bytes.NewReader(book), int64(len(book)), testUserKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range zr.File {
+		if f.Name == "META-INF/license.lcpl" || f.Name == "META-INF/encryption.xml" {
+			t.Errorf("%s is still in the decrypted book", f.Name)
+		}
+
+		if f.Name != "OEBPS/chapter.xhtml" {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, testChapter) {
+			t.Errorf("got chapter %q, want %q", data, testChapter)
+		}
+
+		return
+	}
+
+	t.Error("no chapter in the decrypted book")
+}
+
+// forgedSizes are sizes declared by the zip64 headers of forged entries,
+// which must not be trusted to allocate memory.
+var forgedSizes = []uint64{1 << 40, 1 << 62, 1<<63 + 1<<10, math.MaxUint64}
+
+// forgeChapterSize returns a function forging the declared size of the
+// chapter of testBook.
+func forgeChapterSize(size uint64) func(*zip.FileHeader) {
+	return func(h *zip.FileHeader) {
+		if h.Name == "OEBPS/chapter.xhtml" {
+			h.UncompressedSize64 = size
+		}
+	}
+}
+
+// TestDecryptForgedEntrySize checks that entries declaring absurd sizes make
+// Decrypt and OpenFS fail instead of panicking.
+func TestDecryptForgedEntrySize(t *testing.T) {
+	for _, size := range forgedSizes {
+		book := testBook(t, forgeChapterSize(size))
+
+		for _, tc := range []struct {
+			name string
+			opts []DecryptOption
+		}{
+			{"no limits", nil},
+			{"service limits", []DecryptOption{WithLimits(ServiceLimits)}},
+			{"max memory", []DecryptOption{WithMaxMemory(1 << 20)}},
+			{"concurrent", []DecryptOption{WithConcurrency(4)}},
+		} {
+			if err := Decrypt(io.Discard, bytes.NewReader(book), int64(len(book)), testUserKey(), tc.opts...); err == nil {
+				t.Errorf("size %d, %s: expected an error", size, tc.name)
+			}
+		}
+
+		fsys, err := OpenFS(bytes.NewReader(book), int64(len(book)), testUserKey())
+		if err != nil {
+			continue
+		}
+
+		if data, err := fs.ReadFile(fsys, "OEBPS/chapter.xhtml"); err == nil {
+			t.Errorf("size %d: read %d bytes from OpenFS, expected an error", size, len(data))
+		}
+	}
+}
+
+func TestReadLicensesSkipsFailures(t *testing.T) {
+	root := fstest.MapFS{
+		"META-INF/container.xml": {Data: []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`)},
+		"META-INF/license.lcpl": {Data: []byte(selfTestLicense)},
+		// The package document can't be read, since no charset reader
+		// is available for its encoding
+		"content.opf":   {Data: []byte(`<?xml version="1.0" encoding="windows-1252"?><package/>`)},
+		"extra.lcpl":    {Data: []byte("{not a license")},
+		"chapter.xhtml": {Data: testChapter},
+	}
+
+	var warned []string
+
+	licenses, paths, err := readLicenses(root, licenseLocators(), func(string) []LicenseParseOption { return nil }, func(path, msg string) {
+		warned = append(warned, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(licenses) != 1 || !slices.Equal(paths, []string{licensePath}) {
+		t.Errorf("expected the license at %s, got %d licenses from %v", licensePath, len(licenses), paths)
+	}
+
+	if !slices.Equal(warned, []string{"extra.lcpl", ""}) {
+		t.Errorf("expected warnings about extra.lcpl and the package document, got %q", warned)
+	}
+
+	// Without a valid license, the first failure is reported
+	delete(root, "META-INF/license.lcpl")
+
+	if _, _, err := readLicenses(root, licenseLocators(), func(string) []LicenseParseOption { return nil }, nil); err == nil || !strings.Contains(err.Error(), "extra.lcpl") {
+		t.Errorf("expected an error about extra.lcpl, got %v", err)
+	}
+}
+
+func TestListManifestEncryptedFiles(t *testing.T) {
+	manifest := `{
+  "metadata": {"title": "Test", "duration": 12345678901234567890, "version": 1.10},
+  "@context": "https://readium.org/webpub-manifest/context.jsonld",
+  "readingOrder": [
+    {"type": "audio/mpeg", "href": "track1.mp3", "properties": {"encrypted": {"algorithm": "http://www.w3.org/2001/04/xmlenc#aes256-cbc", "profile": "http://readium.org/lcp/basic-profile", "scheme": "http://readium.org/2014/01/lcp"}}},
+    {"type": "audio/mpeg", "href": "track2.mp3", "properties": {"page": "left", "encrypted": {"algorithm": "http://www.w3.org/2001/04/xmlenc#aes256-cbc", "compression": "deflate", "originalLength": 42}}},
+    {"type": "audio/mpeg", "href": "track3.mp3"}
+  ]
+}`
+
+	entries, stripped, err := listManifestEncryptedFiles(fstest.MapFS{readiumManifestPath: {Data: []byte(manifest)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []FileEntry{
+		{Path: "track1.mp3", EncryptionAlgorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+		{Path: "track2.mp3", IsCompressed: true, OriginalLength: 42, EncryptionAlgorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+	}
+
+	if fmt.Sprint(entries) != fmt.Sprint(want) {
+		t.Errorf("got entries %+v, want %+v", entries, want)
+	}
+
+	if bytes.Contains(stripped, []byte("encrypted")) {
+		t.Errorf("the encryption properties are still in the manifest:\n%s", stripped)
+	}
+
+	// The rest of the manifest is untouched: key order, numbers that don't
+	// fit a float64 and the other properties
+	var compact bytes.Buffer
+
+	if err := json.Compact(&compact, stripped); err != nil {
+		t.Fatal(err)
+	}
+
+	wantCompact := `{"metadata":{"title":"Test","duration":12345678901234567890,"version":1.10},` +
+		`"@context":"https://readium.org/webpub-manifest/context.jsonld",` +
+		`"readingOrder":[{"type":"audio/mpeg","href":"track1.mp3"},` +
+		`{"type":"audio/mpeg","href":"track2.mp3","properties":{"page":"left"}},` +
+		`{"type":"audio/mpeg","href":"track3.mp3"}]}`
+
+	if compact.String() != wantCompact {
+		t.Errorf("got manifest\n%s\nwant\n%s", compact.String(), wantCompact)
+	}
+}
@@ -0,0 +1,513 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// License is a Readium LCP license document, as described in
+// https://readium.org/lcp-specs/releases/lcp/latest.html
+type License struct {
+	ID         string            `json:"id"`
+	Issued     time.Time         `json:"issued"`
+	Updated    *time.Time        `json:"updated,omitempty"`
+	Provider   string            `json:"provider"`
+	Encryption LicenseEncryption `json:"encryption"`
+	Links      Links             `json:"links,omitempty"`
+	User       LicenseUser       `json:"user"`
+	Rights     LicenseRights     `json:"rights"`
+	Signature  LicenseSignature  `json:"signature"`
+
+	// raw is the document the license was parsed from, needed to check its
+	// signature.
+	raw []byte
+}
+
+type LicenseEncryption struct {
+	Profile    string `json:"profile"`
+	ContentKey struct {
+		Algorithm      string `json:"algorithm"`
+		EncryptedValue string `json:"encrypted_value"`
+	} `json:"content_key"`
+	UserKey struct {
+		Algorithm string `json:"algorithm"`
+		TextHint  string `json:"text_hint"`
+		KeyCheck  string `json:"key_check"`
+	} `json:"user_key"`
+}
+
+// Link is a link to an external resource related to a license (hint page,
+// publication, status document...).
+type Link struct {
+	Rel       string `json:"rel"`
+	Href      string `json:"href"`
+	Type      string `json:"type,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Profile   string `json:"profile,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+	Length    int64  `json:"length,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+// LicenseUser identifies the user a license was issued to. The fields listed
+// in Encrypted are encrypted with the user key.
+type LicenseUser struct {
+	ID        string   `json:"id,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Encrypted []string `json:"encrypted,omitempty"`
+}
+
+// Decrypt returns a copy of u with the fields listed in Encrypted decrypted
+// with userKey. Encrypted is empty in the result.
+func (u LicenseUser) Decrypt(userKey []byte) (LicenseUser, error) {
+	res := u
+	res.Encrypted = nil
+
+	for _, name := range u.Encrypted {
+		var field *string
+
+		switch name {
+		case "id":
+			field = &res.ID
+		case "email":
+			field = &res.Email
+		case "name":
+			field = &res.Name
+		default:
+			continue // unknown (extension) field
+		}
+
+		if *field == "" {
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(*field)
+		if err != nil {
+			return LicenseUser{}, fmt.Errorf("error decoding user %s: %w", name, err)
+		}
+
+		decrypted, err := decipherAES256CBC(data, userKey)
+		if err != nil {
+			return LicenseUser{}, fmt.Errorf("error decrypting user %s: %w", name, err)
+		}
+
+		*field = string(decrypted)
+	}
+
+	return res, nil
+}
+
+// IsEncrypted returns whether the field with the given JSON name (for
+// example "email") is encrypted.
+func (u LicenseUser) IsEncrypted(field string) bool {
+	return slices.Contains(u.Encrypted, field)
+}
+
+// LicenseRights lists what the user is allowed to do with the publication.
+// Nil fields mean that there is no restriction.
+type LicenseRights struct {
+	// Print is the number of pages the user is allowed to print.
+	Print *int64 `json:"print,omitempty"`
+	// Copy is the number of characters the user is allowed to copy.
+	Copy  *int64     `json:"copy,omitempty"`
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+	// Extensions holds the provider specific rights, keyed by their URI.
+	Extensions map[string]json.RawMessage `json:"-"`
+}
+
+func (r *LicenseRights) UnmarshalJSON(data []byte) error {
+	type standardRights LicenseRights // avoid infinite recursion
+
+	if err := json.Unmarshal(data, (*standardRights)(r)); err != nil {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+
+	for _, k := range []string{"print", "copy", "start", "end"} {
+		delete(all, k)
+	}
+
+	if len(all) > 0 {
+		r.Extensions = all
+	}
+
+	return nil
+}
+
+func (r LicenseRights) MarshalJSON() ([]byte, error) {
+	type standardRights LicenseRights // avoid infinite recursion
+
+	data, err := json.Marshal(standardRights(r))
+	if err != nil || len(r.Extensions) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.Extensions {
+		all[k] = v
+	}
+
+	return json.Marshal(all)
+}
+
+type LicenseSignature struct {
+	Algorithm   string `json:"algorithm"`
+	Certificate string `json:"certificate"`
+	Value       string `json:"value"`
+}
+
+// licensePath is the location of the license in EPUB files.
+const licensePath = "META-INF/license.lcpl"
+
+// LicenseParseOption customizes how ParseLicense handles the licenses
+// deviating from the specification.
+type LicenseParseOption func(o *licenseParseOptions)
+
+type licenseParseOptions struct {
+	Strict bool
+	Warn   func(msg string)
+}
+
+// WithStrictParsing makes ParseLicense reject the licenses with missing
+// mandatory fields, values of the wrong type or a key check of unexpected
+// size, for validation tools. By default, these deviations are tolerated as
+// long as the license can still be used.
+func WithStrictParsing() LicenseParseOption {
+	return func(o *licenseParseOptions) {
+		o.Strict = true
+	}
+}
+
+// WithParseWarnings registers a function called for each deviation from the
+// specification tolerated by ParseLicense.
+func WithParseWarnings(warn func(msg string)) LicenseParseOption {
+	return func(o *licenseParseOptions) {
+		o.Warn = warn
+	}
+}
+
+// ParseLicense parses a license document. Unless WithStrictParsing is used,
+// the fields holding values of the wrong type are left empty, and missing
+// mandatory fields are accepted (decrypting with such a license might still
+// fail later on).
+func ParseLicense(r io.Reader, opts ...LicenseParseOption) (*License, error) {
+	var o licenseParseOptions
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	warn := func(msg string) {
+		if o.Warn != nil {
+			o.Warn(msg)
+		}
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading license: %w", err)
+	}
+
+	var (
+		license = License{raw: raw}
+		typeErr *json.UnmarshalTypeError
+	)
+
+	// The decoder carries on after values of the wrong type, and returns the
+	// first such error once done.
+	err = json.NewDecoder(bytes.NewReader(raw)).Decode(&license)
+
+	switch {
+	case errors.As(err, &typeErr) && !o.Strict:
+		warn(fmt.Sprintf("ignoring invalid value: %s", err))
+	case err != nil:
+		return nil, fmt.Errorf("error decoding json: %w", err)
+	}
+
+	if problems := license.problems(); len(problems) > 0 {
+		if o.Strict {
+			return nil, fmt.Errorf("invalid license: %s", strings.Join(problems, ", "))
+		}
+
+		for _, p := range problems {
+			warn(p)
+		}
+	}
+
+	return &license, nil
+}
+
+// Validate returns an error listing the deviations of the license from the
+// specification: missing mandatory fields, or encrypted values of unexpected
+// size.
+func (l *License) Validate() error {
+	if problems := l.problems(); len(problems) > 0 {
+		return fmt.Errorf("invalid license: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+func (l *License) problems() []string {
+	var res []string
+
+	for _, field := range []struct{ name, value string }{
+		{"id", l.ID},
+		{"provider", l.Provider},
+		{"encryption.profile", l.Encryption.Profile},
+		{"encryption.content_key.algorithm", l.Encryption.ContentKey.Algorithm},
+		{"encryption.content_key.encrypted_value", l.Encryption.ContentKey.EncryptedValue},
+		{"encryption.user_key.algorithm", l.Encryption.UserKey.Algorithm},
+		{"encryption.user_key.text_hint", l.Encryption.UserKey.TextHint},
+		{"encryption.user_key.key_check", l.Encryption.UserKey.KeyCheck},
+		{"signature.algorithm", l.Signature.Algorithm},
+		{"signature.certificate", l.Signature.Certificate},
+		{"signature.value", l.Signature.Value},
+	} {
+		if field.value == "" {
+			res = append(res, "missing "+field.name)
+		}
+	}
+
+	if l.Issued.IsZero() {
+		res = append(res, "missing issued")
+	}
+
+	for _, rel := range []string{LinkRelHint, LinkRelPublication} {
+		if _, ok := l.Links.Link(rel); !ok {
+			res = append(res, fmt.Sprintf("missing %s link", rel))
+		}
+	}
+
+	// The key check is the license ID encrypted with AES-256-CBC, and the
+	// content key a 32 bytes key: both are prefixed with a 16 bytes IV, and
+	// padded to a multiple of 16 bytes.
+	if l.ID != "" {
+		res = append(res, encryptedValueProblems("encryption.user_key.key_check", l.Encryption.UserKey.KeyCheck, 16+(len(l.ID)/16+1)*16)...)
+	}
+
+	res = append(res, encryptedValueProblems("encryption.content_key.encrypted_value", l.Encryption.ContentKey.EncryptedValue, 16+48)...)
+
+	return res
+}
+
+// encryptedValueProblems checks that value is a base64 encoded value of size
+// bytes.
+func encryptedValueProblems(name, value string, size int) []string {
+	if value == "" {
+		return nil // reported as missing
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return []string{fmt.Sprintf("%s is not valid base64", name)}
+	}
+
+	if len(data) != size {
+		return []string{fmt.Sprintf("%s is %d bytes long, expected %d", name, len(data), size)}
+	}
+
+	return nil
+}
+
+// ReadLicense returns the license embedded in a protected publication. inSize
+// should be the total size of the input data. When the publication embeds
+// several licenses, the first one is returned.
+func ReadLicense(in io.ReaderAt, inSize int64) (*License, error) {
+	licenses, err := ReadLicenses(in, inSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return licenses[0], nil
+}
+
+// ReadLicenses returns all the licenses embedded in a protected publication,
+// starting with the one at the standard location. Some aggregated files embed
+// one license per distribution channel. inSize should be the total size of
+// the input data. opts are passed to ParseLicense.
+func ReadLicenses(in io.ReaderAt, inSize int64, opts ...LicenseParseOption) ([]*License, error) {
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+
+	licenses, _, err := readLicenses(inFile, licenseLocators(), func(string) []LicenseParseOption { return opts }, nil)
+
+	return licenses, err
+}
+
+// isLicenseFile returns whether the file at name is a license document.
+func isLicenseFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".lcpl")
+}
+
+// WithLicenseID makes Decrypt use the embedded license with the given ID,
+// for publications that embed several licenses. By default, Decrypt uses the
+// first license whose key check matches the user key.
+func WithLicenseID(id string) DecryptOption {
+	return func(o *decryptOptions) {
+		o.LicenseID = id
+	}
+}
+
+// WithStrictLicense makes Decrypt reject the licenses deviating from the
+// specification (see WithStrictParsing). By default, the deviations are
+// reported as warnings.
+func WithStrictLicense() DecryptOption {
+	return func(o *decryptOptions) {
+		o.StrictLicense = true
+	}
+}
+
+// licenseParseOptions returns the options to parse the license stored in the
+// file at path (empty for licenses not stored in a file of their own).
+func (d *decrypter) licenseParseOptions(path string) []LicenseParseOption {
+	if d.opts.StrictLicense {
+		return []LicenseParseOption{WithStrictParsing()}
+	}
+
+	return []LicenseParseOption{WithParseWarnings(func(msg string) {
+		if path == "" {
+			d.warn(WarningLicense, "", "license: "+msg)
+		} else {
+			d.warn(WarningLicense, path, "license "+path+": "+msg)
+		}
+	})}
+}
+
+// selectLicense picks the license to use among the ones embedded in a
+// publication: the one with the given ID if id is not empty, or the first one
+// the user key computed by userKey unlocks.
+func selectLicense(licenses []*License, id string, userKey func(l *License) ([]byte, error)) (*License, error) {
+	ids := make([]string, len(licenses))
+
+	for i, l := range licenses {
+		ids[i] = l.ID
+	}
+
+	if id != "" {
+		if i := slices.Index(ids, id); i != -1 {
+			return licenses[i], nil
+		}
+
+		return nil, newError(MsgLicenseNotFound, fmt.Errorf("no license with ID %s (available licenses: %s)", id, strings.Join(ids, ", ")))
+	}
+
+	if len(licenses) == 1 {
+		return licenses[0], nil // contentKey reports the key check error
+	}
+
+	for _, l := range licenses {
+		if key, err := userKey(l); err == nil && l.CheckUserKey(key) == nil {
+			return l, nil
+		}
+	}
+
+	hint := ""
+	for _, l := range licenses {
+		hint = cmp.Or(hint, l.Encryption.UserKey.TextHint)
+	}
+
+	return nil, userKeyMismatch(hint, fmt.Errorf("the user key does not match any of the %d embedded licenses (%s)", len(licenses), strings.Join(ids, ", ")))
+}
+
+// UserKeyMismatchError is wrapped by the errors returned when the user key or
+// passphrase does not match the license.
+type UserKeyMismatchError struct {
+	// Hint is the passphrase hint of the license (encryption.user_key.text_hint),
+	// telling which passphrase the provider expects. It can be empty.
+	Hint string
+	Err  error
+}
+
+func (e *UserKeyMismatchError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%s (passphrase hint: %s)", e.Err, e.Hint)
+}
+
+func (e *UserKeyMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// userKeyMismatch returns the error reporting that the user key does not
+// match a license whose passphrase hint is hint.
+func userKeyMismatch(hint string, err error) error {
+	err = &UserKeyMismatchError{Hint: hint, Err: err}
+
+	if hint != "" {
+		return newError(MsgUserKeyMismatchHint, err, hint)
+	}
+
+	return newError(MsgUserKeyMismatch, err)
+}
+
+// CheckUserKey returns an error if userKey is not the user key for this
+// license. The error wraps a *UserKeyMismatchError holding the passphrase hint
+// of the license.
+func (l *License) CheckUserKey(userKey []byte) error {
+	encryptedKeyCheck, err := base64.StdEncoding.DecodeString(l.Encryption.UserKey.KeyCheck)
+	if err != nil {
+		return fmt.Errorf("error decoding key check: %w", err)
+	}
+
+	keyCheck, err := decipherAES256CBC(encryptedKeyCheck, userKey)
+	if err != nil {
+		// Usually a bad padding, as the key is wrong
+		return userKeyMismatch(l.Encryption.UserKey.TextHint, fmt.Errorf("error decrypting key check: %w", err))
+	}
+
+	if string(keyCheck) != l.ID {
+		return userKeyMismatch(l.Encryption.UserKey.TextHint, fmt.Errorf("decrypted key check (%s) does not match license ID (%s)", keyCheck, l.ID))
+	}
+
+	return nil
+}
+
+// contentKey checks userKey against the license's key check, and uses it to
+// decrypt the content key.
+func (l *License) contentKey(userKey []byte) ([]byte, error) {
+	if err := l.CheckUserKey(userKey); err != nil {
+		return nil, err
+	}
+
+	if alg := l.Encryption.ContentKey.Algorithm; alg != "" && alg != string(EncryptionAlgorithmAES256CBC) {
+		return nil, fmt.Errorf("unsupported content key algorithm %s", alg)
+	}
+
+	encryptedContentKey, err := base64.StdEncoding.DecodeString(l.Encryption.ContentKey.EncryptedValue)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding content key: %w", err)
+	}
+
+	contentKey, err := decipherAES256CBC(encryptedContentKey, userKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting content key: %w", err)
+	}
+
+	return contentKey, nil
+}
@@ -0,0 +1,35 @@
+package lcp
+
+import (
+	"errors"
+	"io"
+	"slices"
+)
+
+// Credential unlocks the content key of a license: either the hex encoded
+// user key, or the passphrase of the user.
+type Credential struct {
+	UserKeyHex string
+	Passphrase string
+}
+
+// DecryptLicensed is like Decrypt, for callers that already obtained and
+// parsed the license of the publication (for example from a store API or a
+// database): license is used instead of the one embedded in the input file,
+// as with WithExternalLicense.
+func DecryptLicensed(out io.Writer, in io.ReaderAt, inSize int64, license *License, credential Credential, opts ...DecryptOption) error {
+	if license == nil {
+		return errors.New("no license specified")
+	}
+
+	opts = append(slices.Clone(opts), func(o *decryptOptions) {
+		o.License = license
+		o.ExternalLicense = nil
+	})
+
+	if credential.Passphrase != "" {
+		opts = append(opts, WithPassphrase(credential.Passphrase))
+	}
+
+	return Decrypt(out, in, inSize, credential.UserKeyHex, opts...)
+}
@@ -0,0 +1,182 @@
+package lcp
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Limits bound the resources a publication can make Decrypt use, to protect
+// the hosts decrypting untrusted files from zip bombs and the like. Sizes are
+// the ones of the entries once decrypted and decompressed. Zero values
+// disable the corresponding limit.
+type Limits struct {
+	// MaxEntries is the maximum number of entries of the input file.
+	MaxEntries int
+	// MaxEntrySize is the maximum size of an entry.
+	MaxEntrySize int64
+	// MaxTotalSize is the maximum size of all the entries together.
+	MaxTotalSize int64
+	// MaxCompressionRatio is the maximum ratio between the size of an entry
+	// and the size of its compressed data. It only applies to the entries
+	// larger than 1 MiB, as small files can compress very well.
+	MaxCompressionRatio int64
+}
+
+// ServiceLimits are the limits for services decrypting the files of
+// untrusted users, far above the needs of real publications.
+var ServiceLimits = Limits{
+	MaxEntries:          20000,
+	MaxEntrySize:        1 << 30,
+	MaxTotalSize:        4 << 30,
+	MaxCompressionRatio: 200,
+}
+
+// compressionRatioMinSize is the size from which MaxCompressionRatio applies.
+const compressionRatioMinSize = 1 << 20
+
+// ErrLimitExceeded is wrapped by the errors returned when the input file
+// exceeds one of the Limits. Such errors abort the decryption, even with
+// WithContinueOnError.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// WithLimits makes Decrypt fail as soon as the input file exceeds one of the
+// limits.
+func WithLimits(limits Limits) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Limits = limits
+	}
+}
+
+func limitError(format string, args ...any) error {
+	err := fmt.Errorf("%w: %s", ErrLimitExceeded, fmt.Sprintf(format, args...))
+	return newError(MsgLimitExceeded, err)
+}
+
+// checkLimits checks the sizes the entries of the input file declare, before
+// anything gets decrypted.
+func (d *decrypter) checkLimits(files []*zip.File) error {
+	l := d.opts.Limits
+
+	if l.MaxEntries > 0 && len(files) > l.MaxEntries {
+		return limitError("the input file has %d entries, more than the maximum of %d", len(files), l.MaxEntries)
+	}
+
+	var total int64
+
+	for _, f := range files {
+		size := declaredSize(f.UncompressedSize64)
+		total = addSizes(total, size)
+
+		if maxSize := l.entrySize(declaredSize(f.CompressedSize64)); maxSize > 0 && size > maxSize {
+			return limitError("file %s decompresses to %d bytes, more than the maximum of %d", f.Name, size, maxSize)
+		}
+	}
+
+	if l.MaxTotalSize > 0 && total > l.MaxTotalSize {
+		return limitError("the input file decompresses to %d bytes, more than the maximum of %d", total, l.MaxTotalSize)
+	}
+
+	return nil
+}
+
+// entrySize returns the maximum size of an entry whose compressed data is
+// compressed bytes long, 0 if there is none. No entry can be larger than the
+// maximum total size either.
+func (l Limits) entrySize(compressed int64) int64 {
+	res := l.MaxEntrySize
+
+	if l.MaxTotalSize > 0 && (res <= 0 || l.MaxTotalSize < res) {
+		res = l.MaxTotalSize
+	}
+
+	if l.MaxCompressionRatio > 0 {
+		byRatio := int64(math.MaxInt64)
+		if compressed <= math.MaxInt64/l.MaxCompressionRatio {
+			byRatio = max(compressed*l.MaxCompressionRatio, compressionRatioMinSize)
+		}
+
+		if res <= 0 || byRatio < res {
+			res = byRatio
+		}
+	}
+
+	return res
+}
+
+// declaredSize returns a size declared by a zip header as an int64. The
+// headers can't be trusted: the sizes that don't fit are saturated, instead
+// of turning negative and passing the checks against the limits.
+func declaredSize(size uint64) int64 {
+	return int64(min(size, math.MaxInt64))
+}
+
+// addSizes returns a+b for non negative sizes, saturated instead of
+// overflowing.
+func addSizes(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+
+	return a + b
+}
+
+// decompressedLimit returns the maximum size of the decompressed data of the
+// entry path, whose compressed data is compressed bytes long (0 if there is
+// none), and the error to fail with past it.
+func (d *decrypter) decompressedLimit(path string, compressed int64) (int64, error) {
+	maxSize := d.opts.Limits.entrySize(compressed)
+	return maxSize, limitError("file %s decompresses to more than the maximum of %d bytes", path, maxSize)
+}
+
+// countOutput adds size to the total size of the entries written so far, and
+// fails if it exceeds the maximum.
+func (d *decrypter) countOutput(size int64) error {
+	total := d.outputSize.Add(size)
+
+	if maxSize := d.opts.Limits.MaxTotalSize; maxSize > 0 && total > maxSize {
+		return limitError("the decrypted publication is larger than the maximum of %d bytes", maxSize)
+	}
+
+	return nil
+}
+
+// limitReader returns a reader reading from r, and failing with err once
+// more than maxSize bytes are read. It returns r if maxSize is not positive.
+func limitReader(r io.Reader, maxSize int64, err error) io.Reader {
+	if maxSize <= 0 {
+		return r
+	}
+
+	return &limitedReader{r: r, remaining: maxSize, err: err}
+}
+
+// limitedReader reads from r, and fails with err once more than remaining
+// bytes are read.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, r.err
+	}
+
+	// Read one byte more than allowed to find out if there is more data
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+
+	if r.remaining < 0 {
+		return n, r.err
+	}
+
+	return n, err
+}
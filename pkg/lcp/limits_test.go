@@ -0,0 +1,189 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+// sizedFile is an entry declaring the given sizes in its zip header.
+type sizedFile struct {
+	compressed, uncompressed uint64
+}
+
+func TestCheckLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits Limits
+		files  []sizedFile
+		err    bool
+	}{
+		{
+			name:   "no limits",
+			limits: Limits{},
+			files:  []sizedFile{{1, math.MaxUint64}, {math.MaxUint64, math.MaxUint64}},
+		},
+		{
+			name:   "within the service limits",
+			limits: ServiceLimits,
+			files:  []sizedFile{{10 << 20, 100 << 20}, {1 << 10, 900 << 10}, {0, 0}},
+		},
+		{
+			name:   "too many entries",
+			limits: Limits{MaxEntries: 2},
+			files:  []sizedFile{{1, 1}, {1, 1}, {1, 1}},
+			err:    true,
+		},
+		{
+			name:   "entry too large",
+			limits: Limits{MaxEntrySize: 1000},
+			files:  []sizedFile{{1000, 1000}, {1001, 1001}},
+			err:    true,
+		},
+		{
+			name:   "total too large",
+			limits: Limits{MaxTotalSize: 1000},
+			files:  []sizedFile{{600, 600}, {600, 600}},
+			err:    true,
+		},
+		{
+			name:   "compression ratio",
+			limits: Limits{MaxCompressionRatio: 200},
+			files:  []sizedFile{{1 << 20, 201 << 20}},
+			err:    true,
+		},
+		{
+			name:   "compression ratio of small files",
+			limits: Limits{MaxCompressionRatio: 200},
+			files:  []sizedFile{{10, 1 << 20}},
+		},
+		{
+			name:   "declared size of 2^63",
+			limits: ServiceLimits,
+			files:  []sizedFile{{100, 1 << 63}},
+			err:    true,
+		},
+		{
+			name:   "declared size of 2^64-1",
+			limits: ServiceLimits,
+			files:  []sizedFile{{100, 100}, {100, math.MaxUint64}},
+			err:    true,
+		},
+		{
+			name:   "negative sizes don't offset the total",
+			limits: Limits{MaxTotalSize: 1000},
+			files:  []sizedFile{{800, 800}, {100, 1<<64 - 600}},
+			err:    true,
+		},
+		{
+			name:   "overflowing total",
+			limits: Limits{MaxTotalSize: math.MaxInt64 - 1},
+			files:  []sizedFile{{1, math.MaxInt64 / 2}, {1, math.MaxInt64 / 2}, {1, math.MaxInt64 / 2}},
+			err:    true,
+		},
+		{
+			name:   "overflowing compression ratio",
+			limits: Limits{MaxEntrySize: 1 << 30, MaxCompressionRatio: 200},
+			files:  []sizedFile{{1 << 60, 1 << 31}},
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files := make([]*zip.File, len(tc.files))
+			for i, f := range tc.files {
+				files[i] = &zip.File{FileHeader: zip.FileHeader{Name: "file", CompressedSize64: f.compressed, UncompressedSize64: f.uncompressed}}
+			}
+
+			err := newDecrypter([]DecryptOption{WithLimits(tc.limits)}).checkLimits(files)
+
+			if tc.err && !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("got error %v, want %v", err, ErrLimitExceeded)
+			} else if !tc.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	for _, tc := range []struct {
+		limits     Limits
+		compressed int64
+		want       int64
+	}{
+		{Limits{}, 100, 0},
+		{Limits{MaxEntrySize: 1000}, 100, 1000},
+		{Limits{MaxEntrySize: 1000, MaxTotalSize: 500}, 100, 500},
+		{Limits{MaxCompressionRatio: 10}, 100, compressionRatioMinSize},
+		{Limits{MaxCompressionRatio: 10}, 1 << 30, 10 << 30},
+		{Limits{MaxCompressionRatio: 10, MaxEntrySize: 1 << 31}, 1 << 30, 1 << 31},
+		{Limits{MaxCompressionRatio: 200}, 1 << 60, math.MaxInt64},
+		{Limits{MaxCompressionRatio: 200}, math.MaxInt64, math.MaxInt64},
+	} {
+		if got := tc.limits.entrySize(tc.compressed); got != tc.want {
+			t.Errorf("%+v.entrySize(%d) = %d, want %d", tc.limits, tc.compressed, got, tc.want)
+		}
+	}
+}
+
+// TestDecryptLimitsForgedSize checks that the entries declaring sizes of 2^63
+// and more are caught by the limits before anything is decrypted.
+func TestDecryptLimitsForgedSize(t *testing.T) {
+	for _, size := range []uint64{1 << 63, 1<<63 + 1<<10, math.MaxUint64} {
+		book := testBook(t, forgeChapterSize(size))
+
+		if err := Decrypt(io.Discard, bytes.NewReader(book), int64(len(book)), testUserKey(), WithLimits(ServiceLimits)); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("size %d: got error %v, want %v", size, err, ErrLimitExceeded)
+		}
+	}
+
+	book := testBook(t, nil)
+
+	if err := Decrypt(io.Discard, bytes.NewReader(book), int64(len(book)), testUserKey(), WithLimits(ServiceLimits)); err != nil {
+		t.Errorf("unexpected error for the book within the limits: %v", err)
+	}
+}
+
+// TestDecryptFileCompressionRatio checks that a resource decompressing far
+// beyond the size it declares (a zip bomb) is stopped while inflating.
+func TestDecryptFileCompressionRatio(t *testing.T) {
+	data := make([]byte, 8<<20)
+	encrypted := encryptResource(t, deflate(t, data), selfTestContentKeyBytes())
+	entry := FileEntry{
+		Path:                "bomb.xhtml",
+		IsCompressed:        true,
+		OriginalLength:      100,
+		EncryptionAlgorithm: EncryptionAlgorithmAES256CBC,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		limits Limits
+		err    bool
+	}{
+		{"no limits", Limits{}, false},
+		{"compression ratio", Limits{MaxCompressionRatio: 200}, true},
+		{"entry size", Limits{MaxEntrySize: 1 << 20}, true},
+		{"total size", Limits{MaxTotalSize: 1 << 20}, true},
+	} {
+		d := newDecrypter([]DecryptOption{WithLimits(tc.limits)})
+
+		res, err := d.decryptFile(bytes.NewReader(encrypted), int64(len(encrypted)), selfTestContentKeyBytes(), entry)
+		if tc.err {
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("%s: got error %v, want %v", tc.name, err, ErrLimitExceeded)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if len(res) != len(data) {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(res), len(data))
+		}
+	}
+}
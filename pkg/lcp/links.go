@@ -0,0 +1,155 @@
+package lcp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Relations of the links found in licenses and status documents.
+const (
+	LinkRelHint        = "hint"
+	LinkRelPublication = "publication"
+	LinkRelSelf        = "self"
+	LinkRelStatus      = "status"
+	LinkRelSupport     = "support"
+	LinkRelLicense     = "license"
+	LinkRelRegister    = "register"
+	LinkRelReturn      = "return"
+	LinkRelRenew       = "renew"
+)
+
+// Links is a list of links, as found in licenses and status documents.
+type Links []Link
+
+// Link returns the first link with the given relation.
+func (links Links) Link(rel string) (Link, bool) {
+	i := slices.IndexFunc(links, func(l Link) bool { return l.HasRel(rel) })
+	if i < 0 {
+		return Link{}, false
+	}
+
+	return links[i], true
+}
+
+// All returns the links with the given relation.
+func (links Links) All(rel string) []Link {
+	var res []Link
+
+	for _, l := range links {
+		if l.HasRel(rel) {
+			res = append(res, l)
+		}
+	}
+
+	return res
+}
+
+// HasRel returns whether rel is one of the relations of the link. Some
+// providers list several relations, separated by spaces.
+func (l Link) HasRel(rel string) bool {
+	return slices.Contains(strings.Fields(l.Rel), rel)
+}
+
+// Expand returns the URL of the link. For templated links (like the register
+// or renew links of status documents), the URI template (RFC 6570, without
+// the value modifiers) is expanded with params, and the variables missing
+// from params are left out.
+func (l Link) Expand(params map[string]string) (string, error) {
+	if !l.Templated {
+		return l.Href, nil
+	}
+
+	var b strings.Builder
+
+	rest := l.Href
+
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated expression in link template %s", l.Href)
+		}
+
+		b.WriteString(rest[:start])
+		expandTemplateExpression(&b, rest[start+1:start+end], params)
+		rest = rest[start+end+1:]
+	}
+
+	return b.String(), nil
+}
+
+// expandTemplateExpression writes the expansion of the URI template
+// expression expr (the part between braces) to b.
+func expandTemplateExpression(b *strings.Builder, expr string, params map[string]string) {
+	var (
+		prefix, separator = "", ","
+		named, reserved   = false, false
+	)
+
+	if expr != "" {
+		switch expr[0] {
+		case '+':
+			reserved = true
+		case '#':
+			prefix, reserved = "#", true
+		case '?':
+			prefix, separator, named = "?", "&", true
+		case '&':
+			prefix, separator, named = "&", "&", true
+		}
+
+		if prefix != "" || reserved {
+			expr = expr[1:]
+		}
+	}
+
+	first := true
+
+	for _, name := range strings.Split(expr, ",") {
+		value, ok := params[name]
+		if !ok {
+			continue
+		}
+
+		if first {
+			b.WriteString(prefix)
+			first = false
+		} else {
+			b.WriteString(separator)
+		}
+
+		if named {
+			b.WriteString(name)
+			b.WriteByte('=')
+		}
+
+		b.WriteString(templateEscape(value, reserved))
+	}
+}
+
+// templateEscape percent-encodes the characters of s that are not unreserved
+// (or reserved, if allowReserved is true) in URIs.
+func templateEscape(s string, allowReserved bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("-._~", c) >= 0:
+			b.WriteByte(c)
+		case allowReserved && strings.IndexByte(":/?#[]@!$&'()*+,;=", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
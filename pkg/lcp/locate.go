@@ -0,0 +1,258 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// EmbeddedLicense is a license document found in a publication.
+type EmbeddedLicense struct {
+	// Path is the file holding the license, which gets left out of the
+	// decrypted publication. It is empty when the license is not stored in a
+	// file of its own (for example in the OPF metadata).
+	Path string
+	Data []byte
+}
+
+// LicenseLocator finds the license documents embedded in a publication. It
+// returns no licenses (and no error) if the publication doesn't use the
+// embedding it knows about.
+type LicenseLocator func(root fs.FS) ([]EmbeddedLicense, error)
+
+// defaultLicenseLocators are tried in order, the licenses found by the first
+// ones come first.
+var defaultLicenseLocators = []LicenseLocator{
+	LocateLicenseFiles,
+	LocateMetaInfJSONLicenses,
+	LocateOPFLicense,
+}
+
+// WithLicenseLocators makes Decrypt look for licenses with locators, after
+// the built in ones (LocateLicenseFiles, LocateMetaInfJSONLicenses and
+// LocateOPFLicense) and the ones of the containers added with
+// RegisterContainer have been tried.
+func WithLicenseLocators(locators ...LicenseLocator) DecryptOption {
+	return func(o *decryptOptions) {
+		o.LicenseLocators = append(o.LicenseLocators, locators...)
+	}
+}
+
+// LocateLicenseFiles finds the .lcpl files of a publication, starting with
+// the ones at the standard locations (META-INF/license.lcpl for EPUB files,
+// license.lcpl for Readium packages).
+func LocateLicenseFiles(root fs.FS) ([]EmbeddedLicense, error) {
+	paths := []string{licensePath, readiumLicensePath}
+
+	names, err := listFiles(root)
+	if err != nil {
+		return nil, fmt.Errorf("error listing license files: %w", err)
+	}
+
+	for _, name := range names {
+		if isLicenseFile(name) && !slices.Contains(paths, name) {
+			paths = append(paths, name)
+		}
+	}
+
+	var res []EmbeddedLicense
+
+	for _, p := range paths {
+		data, err := fs.ReadFile(root, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading license file %s: %w", p, err)
+		}
+
+		res = append(res, EmbeddedLicense{Path: p, Data: data})
+	}
+
+	return res, nil
+}
+
+// LocateMetaInfJSONLicenses finds the licenses stored under a non standard
+// name in the META-INF directory, such as META-INF/license.json.
+func LocateMetaInfJSONLicenses(root fs.FS) ([]EmbeddedLicense, error) {
+	names, err := listFiles(root)
+	if err != nil {
+		return nil, fmt.Errorf("error listing META-INF directory: %w", err)
+	}
+
+	var res []EmbeddedLicense
+
+	for _, p := range names {
+		if path.Dir(p) != "META-INF" || !strings.EqualFold(path.Ext(p), ".json") {
+			continue
+		}
+
+		data, err := fs.ReadFile(root, p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", p, err)
+		}
+
+		if looksLikeLicense(data) {
+			res = append(res, EmbeddedLicense{Path: p, Data: data})
+		}
+	}
+
+	return res, nil
+}
+
+// opfLicenseProperties are the meta properties (or names, for EPUB 2 style
+// meta elements) under which some vendors store the license in the OPF
+// metadata.
+var opfLicenseProperties = []string{"lcp:license", "lcpl"}
+
+// LocateOPFLicense finds a license stored in the OPF metadata of an EPUB file,
+// either as JSON or as base64 encoded JSON.
+func LocateOPFLicense(root fs.FS) ([]EmbeddedLicense, error) {
+	if _, err := fs.Stat(root, epub.ContainerPath); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil // not an EPUB file
+	}
+
+	pkg, err := epub.ReadPackage(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading package document: %w", err)
+	}
+
+	var res []EmbeddedLicense
+
+	for _, m := range pkg.Metadata.Meta {
+		value := strings.TrimSpace(m.Value)
+
+		switch {
+		case slices.Contains(opfLicenseProperties, m.Property):
+		case slices.Contains(opfLicenseProperties, m.Name):
+			value = strings.TrimSpace(m.Content)
+		default:
+			continue
+		}
+
+		data := []byte(value)
+
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			data = decoded
+		}
+
+		if looksLikeLicense(data) {
+			res = append(res, EmbeddedLicense{Data: data})
+		}
+	}
+
+	return res, nil
+}
+
+// looksLikeLicense returns whether data is a JSON document with the fields
+// required to decrypt a publication.
+func looksLikeLicense(data []byte) bool {
+	var license License
+
+	if err := json.Unmarshal(data, &license); err != nil {
+		return false
+	}
+
+	return license.ID != "" && license.Encryption.ContentKey.EncryptedValue != ""
+}
+
+// readLicenses returns the licenses found by locators, along with the paths
+// of the files holding them. parseOpts returns the options to parse the
+// license found in the file at path. Locators and licenses that fail are
+// reported to warn and skipped, readLicenses only fails if no license was
+// found, with the first of these errors if any.
+func readLicenses(root fs.FS, locators []LicenseLocator, parseOpts func(path string) []LicenseParseOption, warn func(path, msg string)) ([]*License, []string, error) {
+	var (
+		licenses []*License
+		paths    []string
+		firstErr error
+	)
+
+	skip := func(path string, err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if warn != nil {
+			warn(path, err.Error()+", skipping it")
+		}
+	}
+
+	for _, locate := range locators {
+		found, err := locate(root)
+		if err != nil {
+			skip("", fmt.Errorf("error looking for licenses: %w", err))
+			continue
+		}
+
+		for _, l := range found {
+			license, err := ParseLicense(bytes.NewReader(l.Data), parseOpts(l.Path)...)
+			if err != nil {
+				skip(l.Path, fmt.Errorf("error reading license %s: %w", l.Path, err))
+				continue
+			}
+
+			if l.Path != "" {
+				paths = append(paths, l.Path)
+			}
+
+			// Different locators might find the same license
+			if !slices.ContainsFunc(licenses, func(other *License) bool { return other.ID == license.ID }) {
+				licenses = append(licenses, license)
+			}
+		}
+	}
+
+	if len(licenses) == 0 {
+		if firstErr != nil {
+			return nil, nil, firstErr
+		}
+
+		return nil, nil, newError(MsgNoLicense, fmt.Errorf("error opening license file: %w", fs.ErrNotExist))
+	}
+
+	return licenses, paths, nil
+}
+
+// listFiles returns the paths of the regular files in root. Zip files are
+// listed from their central directory, since walking them as a file system
+// fails when they have duplicate entries.
+func listFiles(root fs.FS) ([]string, error) {
+	if r, ok := root.(*zip.Reader); ok {
+		var res []string
+
+		for _, f := range r.File {
+			if !strings.HasSuffix(f.Name, "/") && !slices.Contains(res, f.Name) {
+				res = append(res, f.Name)
+			}
+		}
+
+		return res, nil
+	}
+
+	var res []string
+
+	err := fs.WalkDir(root, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			res = append(res, p)
+		}
+
+		return nil
+	})
+
+	return res, err
+}
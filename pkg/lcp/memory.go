@@ -0,0 +1,393 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithMaxMemory caps the memory Decrypt uses to hold entries to about max
+// bytes. Entries are normally decrypted in memory: with this option, fewer
+// entries are processed at the same time when they would not fit (see
+// WithConcurrency), and the entries too large to fit at all are decrypted to
+// temporary files instead. DecryptStream also spools its input to a temporary
+// file rather than keep more than a quarter of max in memory.
+//
+// Temporary files are created in the default directory for temporary files
+// (see os.TempDir), which should not be a memory backed file system.
+func WithMaxMemory(max int64) DecryptOption {
+	return func(o *decryptOptions) {
+		o.MaxMemory = max
+	}
+}
+
+// spoolBufferSize is the memory an entry decrypted to a temporary file uses.
+const spoolBufferSize = 256 << 10
+
+// entryMemory estimates the memory needed to decrypt the entry f in memory:
+// the encrypted data (decrypted in place), the decompressed data, and the
+// data compressed again for the output file.
+func entryMemory(f *zip.File, entry FileEntry, action FileAction) int64 {
+	if action != FileActionDecrypt {
+		return 0
+	}
+
+	// The sizes are declared by the input file, the sums saturate rather than
+	// turning negative and fitting in any budget
+	size := declaredSize(f.UncompressedSize64)
+
+	if entry.IsCompressed {
+		plain := entry.OriginalLength
+		if plain <= 0 {
+			plain = addSizes(addSizes(size, size), addSizes(size, size))
+		}
+
+		return addSizes(size, addSizes(plain, plain))
+	}
+
+	return addSizes(size, size)
+}
+
+// spoolsFile returns whether the entry f is too large to be decrypted in
+// memory, and should go through a temporary file.
+func (d *decrypter) spoolsFile(f *zip.File, entry FileEntry) bool {
+	if d.opts.MaxMemory <= 0 || entryMemory(f, entry, FileActionDecrypt) <= d.opts.MaxMemory || d.transforms(f.Name) {
+		return false
+	}
+
+	// Other algorithms need the whole data (for example to authenticate it)
+	alg, _ := lookupAlgorithm(entry.EncryptionAlgorithm)
+
+	return alg.streamable
+}
+
+// jobMemory returns the part of the memory budget the processing of the entry
+// f takes.
+func (d *decrypter) jobMemory(f *zip.File) int64 {
+	entry, action := d.fileAction(f)
+
+	if action == FileActionDecrypt && d.spoolsFile(f, entry) {
+		return min(spoolBufferSize, d.opts.MaxMemory)
+	}
+
+	return min(entryMemory(f, entry, action), d.opts.MaxMemory)
+}
+
+// prepareSpooledFile decrypts the entry f to a temporary file, one chunk at a
+// time, compressing it again on the fly if needed.
+func (d *decrypter) prepareSpooledFile(f *zip.File, entry FileEntry) (*preparedFile, error) {
+	d.log("File " + f.Name + " is too large to be decrypted in memory, using a temporary file")
+
+	p, err := d.spoolFile(f, entry)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error decrypting file %s: %w", f.Name, err)}
+	}
+
+	return p, nil
+}
+
+func (d *decrypter) spoolFile(f *zip.File, entry FileEntry) (*preparedFile, error) {
+	start := time.Now()
+
+	src, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening file from input zip file: %w", err)
+	}
+
+	defer src.Close()
+
+	var (
+		plain io.Reader
+		cbc   *cbcReader
+	)
+
+	switch entry.EncryptionAlgorithm {
+	case EncryptionAlgorithmAES256CBC:
+		if cbc, err = newCBCReader(src, d.contentKey); err != nil {
+			return nil, err
+		}
+
+		plain = cbc
+	case EncryptionAlgorithmFontObfuscation, EncryptionAlgorithmAdobeFontObfuscation:
+		key, err := d.fontKey(entry.EncryptionAlgorithm)
+		if err != nil {
+			d.warn(WarningContainer, entry.Path, "font "+entry.Path+" is left obfuscated: "+err.Error())
+			plain = src
+
+			break
+		}
+
+		if plain, err = deobfuscatingReader(src, entry.EncryptionAlgorithm, key); err != nil {
+			return nil, fmt.Errorf("error decrypting data: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid encryption algorithm: %s", entry.EncryptionAlgorithm)
+	}
+
+	if entry.IsCompressed {
+		inflater := newInflater(plain)
+		defer inflater.Close()
+
+		maxSize, tooLarge := d.decompressedLimit(entry.Path, declaredSize(f.UncompressedSize64))
+		plain = limitReader(inflater, maxSize, tooLarge)
+	}
+
+	br := bufio.NewReaderSize(plain, 4096)
+
+	// compressionMethod only looks at the magic bytes of the data
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+
+	method := compressionMethod(f.Name, head)
+
+	spool, err := os.CreateTemp("", "lcp-decrypt-entry-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	p := &preparedFile{spool: spool}
+
+	// Spooling fails more often than in memory decryption (full disk...),
+	// don't leave the temporary file behind.
+	ok := false
+	defer func() {
+		if !ok {
+			p.release()
+		}
+	}()
+
+	var (
+		dst      io.Writer = spool
+		deflater *flate.Writer
+		crc      = crc32.NewIEEE()
+		digest   = sha256.New()
+	)
+
+	if method == zip.Deflate {
+		if deflater, err = flate.NewWriter(spool, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+
+		dst = deflater
+	}
+
+	size, err := io.Copy(io.MultiWriter(dst, crc, digest), &contextReader{d.opts.Context, br})
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+
+	if deflater != nil {
+		if err := deflater.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing data: %w", err)
+		}
+	}
+
+	d.timings.since(phaseDecrypt, start)
+	d.timings.encryptedBytes.Add(int64(f.UncompressedSize64))
+	d.timings.decryptedBytes.Add(size)
+
+	if cbc != nil && !cbc.validPadding {
+		d.warn(WarningPadding, entry.Path, "file "+entry.Path+" has a malformed padding, it might be corrupted")
+	}
+
+	compressedSize, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("error writing temporary file: %w", err)
+	}
+
+	p.header = outputHeader(f, method, crc.Sum32(), size)
+	p.header.CompressedSize64 = uint64(compressedSize)
+
+	d.recordDigest(f.Name, digest.Sum(nil))
+
+	ok = true
+
+	return p, nil
+}
+
+// contextReader stops reading once its context is done, so that spooling a
+// large entry can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// cbcChunkSize is the amount of data cbcReader decrypts at once.
+const cbcChunkSize = 64 << 10
+
+// cbcReader decrypts AES-256-CBC data prefixed with its IV as it is read. The
+// last block is held back until the end of the data is reached, as it holds
+// the padding.
+type cbcReader struct {
+	src  io.Reader
+	mode cipher.BlockMode
+	buf  []byte
+	held []byte
+	out  []byte
+	done bool
+	// validPadding tells whether the padding was well formed, once the
+	// whole data is read.
+	validPadding bool
+}
+
+func newCBCReader(src io.Reader, key []byte) (*cbcReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	switch _, err := io.ReadFull(src, iv); {
+	case errors.Is(err, io.EOF):
+		// Empty data, like decipherAES256CBCPadding
+		return &cbcReader{done: true, validPadding: true}, nil
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, fmt.Errorf("data is too short")
+	case err != nil:
+		return nil, fmt.Errorf("error reading data: %w", err)
+	}
+
+	return &cbcReader{
+		src:  src,
+		mode: cipher.NewCBCDecrypter(block, iv),
+		buf:  make([]byte, cbcChunkSize+aes.BlockSize),
+		held: make([]byte, 0, aes.BlockSize),
+	}, nil
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+// fill decrypts the next chunk of data.
+func (r *cbcReader) fill() error {
+	heldLen := copy(r.buf, r.held)
+	n, err := readChunk(r.src, r.buf[heldLen:])
+	data := r.buf[:heldLen+n]
+
+	switch {
+	case err == nil:
+		// More data might follow, keep the last block for later
+		keep := len(data) - aes.BlockSize
+		r.mode.CryptBlocks(data[:keep], data[:keep])
+		r.out = data[:keep]
+		r.held = append(r.held[:0], data[keep:]...)
+
+		return nil
+	case errors.Is(err, io.EOF):
+		r.done = true
+
+		if len(data) == 0 {
+			return fmt.Errorf("data is too short")
+		}
+
+		if len(data)%aes.BlockSize != 0 {
+			return fmt.Errorf("data length is not a multiple of the block size")
+		}
+
+		r.mode.CryptBlocks(data, data)
+
+		r.out, r.validPadding, err = stripPadding(data)
+
+		return err
+	default:
+		return fmt.Errorf("error reading data: %w", err)
+	}
+}
+
+// readChunk reads from r until buf is full, or r ends with io.EOF. Unlike
+// io.ReadFull, it tells the end of the data from r failing with
+// io.ErrUnexpectedEOF, as zip entries shorter than their declared size do.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n := 0
+
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// memoryBudget limits the memory held by the entries being processed.
+type memoryBudget struct {
+	mu        sync.Mutex
+	available int64
+	// released is closed (and replaced) when memory is released.
+	released chan struct{}
+}
+
+func newMemoryBudget(size int64) *memoryBudget {
+	return &memoryBudget{available: size, released: make(chan struct{})}
+}
+
+// acquire waits until n bytes are available, or ctx is done.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+
+		if b.available >= n {
+			b.available -= n
+			b.mu.Unlock()
+
+			return nil
+		}
+
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.available += n
+	close(b.released)
+	b.released = make(chan struct{})
+}
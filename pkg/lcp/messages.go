@@ -0,0 +1,268 @@
+package lcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/language"
+)
+
+// MessageID identifies a user facing message independently of its language,
+// so that applications embedding this package can present it in the language
+// of their users (see Localize).
+type MessageID string
+
+const (
+	MsgInvalidInput                MessageID = "invalid-input"
+	MsgNoLicense                   MessageID = "no-license"
+	MsgLicenseNotFound             MessageID = "license-not-found"
+	MsgUserKeyMissing              MessageID = "user-key-missing"
+	MsgInvalidUserKey              MessageID = "invalid-user-key"
+	MsgUserKeyMismatch             MessageID = "user-key-mismatch"
+	MsgUserKeyMismatchHint         MessageID = "user-key-mismatch-hint"
+	MsgUnsupportedProfile          MessageID = "unsupported-profile"
+	MsgUnsupportedUserKeyAlgorithm MessageID = "unsupported-user-key-algorithm"
+	MsgProviderNotAllowed          MessageID = "provider-not-allowed"
+	MsgUnsupportedAlgorithm        MessageID = "unsupported-algorithm"
+	MsgInterrupted                 MessageID = "interrupted"
+	MsgLimitExceeded               MessageID = "limit-exceeded"
+)
+
+// warningMessageID returns the ID of the message describing warnings of kind.
+func warningMessageID(kind WarningKind) MessageID {
+	return MessageID("warning-" + string(kind))
+}
+
+// Error is an error that has a localizable message. Its Error method returns
+// the English message of the wrapped error, which holds more details.
+type Error struct {
+	ID MessageID
+	// Args are the arguments of the message templates.
+	Args []any
+	Err  error
+}
+
+func newError(id MessageID, err error, args ...any) *Error {
+	return &Error{ID: id, Args: args, Err: err}
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// Catalog maps message IDs to templates in a language. Templates are
+// formatted with the Args of the message, using the verbs of the fmt package
+// (%[1]s for the first argument...).
+type Catalog map[MessageID]string
+
+var (
+	catalogsMu sync.RWMutex
+	catalogs   = map[language.Tag]Catalog{
+		language.English: englishCatalog,
+		language.French:  frenchCatalog,
+	}
+)
+
+// RegisterCatalog adds the messages of catalog to the ones of the language
+// identified by the BCP 47 tag lang (for example "de" or "pt-BR"), so that
+// applications can provide the languages this package lacks.
+func RegisterCatalog(lang string, catalog Catalog) error {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return fmt.Errorf("invalid language %q: %w", lang, err)
+	}
+
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+
+	merged := Catalog{}
+
+	for id, msg := range catalogs[tag] {
+		merged[id] = msg
+	}
+
+	for id, msg := range catalog {
+		merged[id] = msg
+	}
+
+	catalogs[tag] = merged
+
+	return nil
+}
+
+// Languages returns the languages there is a catalog for, as BCP 47 tags.
+func Languages() []string {
+	catalogsMu.RLock()
+	defer catalogsMu.RUnlock()
+
+	res := make([]string, 0, len(catalogs))
+
+	for tag := range catalogs {
+		res = append(res, tag.String())
+	}
+
+	slices.Sort(res)
+
+	return res
+}
+
+// matchLanguage returns the language with a catalog best matching locale,
+// which can be a BCP 47 tag, a list of them as in the Accept-Language header,
+// or a POSIX locale like fr_FR.UTF-8. It falls back to English.
+func matchLanguage(locale string) language.Tag {
+	if !strings.ContainsAny(locale, ",;") {
+		// POSIX locales: fr_FR.UTF-8, de_DE@euro
+		locale, _, _ = strings.Cut(locale, ".")
+		locale, _, _ = strings.Cut(locale, "@")
+		locale = strings.ReplaceAll(locale, "_", "-")
+	}
+
+	desired, _, err := language.ParseAcceptLanguage(locale)
+	if err != nil || len(desired) == 0 {
+		return language.English
+	}
+
+	catalogsMu.RLock()
+	defer catalogsMu.RUnlock()
+
+	tags := []language.Tag{language.English} // the fallback
+	for tag := range catalogs {
+		if tag != language.English {
+			tags = append(tags, tag)
+		}
+	}
+
+	matcher := language.NewMatcher(tags)
+
+	// Matching all the desired languages at once picks English for "de, fr"
+	// (with a low confidence), rather than the second choice.
+	for _, tag := range desired {
+		if _, i, confidence := matcher.Match(tag); confidence >= language.High {
+			return tags[i]
+		}
+	}
+
+	return language.English
+}
+
+// MatchLanguage returns the language of the messages returned by Localize
+// for locale, as a BCP 47 tag.
+func MatchLanguage(locale string) string {
+	return matchLanguage(locale).String()
+}
+
+// message formats the message id in the language best matching locale,
+// falling back to English.
+func message(locale string, id MessageID, args ...any) (string, bool) {
+	tag := matchLanguage(locale)
+
+	catalogsMu.RLock()
+	template, ok := catalogs[tag][id]
+	if !ok {
+		template, ok = catalogs[language.English][id]
+	}
+	catalogsMu.RUnlock()
+
+	if !ok {
+		return "", false
+	}
+
+	if !strings.Contains(template, "%") {
+		return template, true // the message doesn't use the arguments
+	}
+
+	return fmt.Sprintf(template, args...), true
+}
+
+// Localize returns a short message describing err, for end users, in the
+// language best matching locale (see MatchLanguage). Errors that have no
+// localizable message are returned as err.Error().
+func Localize(err error, locale string) string {
+	var e *Error
+
+	if errors.As(err, &e) {
+		if msg, ok := message(locale, e.ID, e.Args...); ok {
+			return msg
+		}
+	}
+
+	return err.Error()
+}
+
+// UserLocale returns the locale of the user from the usual environment
+// variables (LC_ALL, LC_MESSAGES and LANG), for the command line tools to
+// pass to Localize. It is empty if none is set.
+func UserLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// Localize returns a short description of w, for end users, in the language
+// best matching locale.
+func (w Warning) Localize(locale string) string {
+	if msg, ok := message(locale, warningMessageID(w.Kind), w.Path); ok {
+		return msg
+	}
+
+	return w.Message
+}
+
+var englishCatalog = Catalog{
+	MsgInvalidInput:                "The file is not a valid publication, it might be truncated or corrupted.",
+	MsgNoLicense:                   "No LCP license was found in the publication, it is either not protected with LCP or distributed separately from its license.",
+	MsgLicenseNotFound:             "The publication has no license with the requested ID.",
+	MsgUserKeyMissing:              "No user key or passphrase was provided.",
+	MsgInvalidUserKey:              "The user key is invalid, it should be 64 hexadecimal characters.",
+	MsgUserKeyMismatch:             "The user key or passphrase does not match the license of the publication.",
+	MsgUserKeyMismatchHint:         "The user key or passphrase does not match the license of the publication. Passphrase hint: %[1]s",
+	MsgUnsupportedProfile:          "The license uses the %[1]s encryption profile, which requires the user key computed by a reading application supporting it.",
+	MsgUnsupportedUserKeyAlgorithm: "The license derives the user key from the passphrase with an unsupported algorithm (%[1]s), the user key is needed instead.",
+	MsgProviderNotAllowed:          "The license was issued by %[1]s, which is not an allowed provider.",
+	MsgUnsupportedAlgorithm:        "The file %[1]s is encrypted with an unsupported algorithm (%[2]s).",
+	MsgInterrupted:                 "Decryption was interrupted.",
+	MsgLimitExceeded:               "The publication is too large or too compressed to be decrypted here, it might be malicious.",
+
+	warningMessageID(WarningContainer):      "The structure of the publication is unusual.",
+	warningMessageID(WarningMissingFile):    "Some encrypted files are missing from the publication, it might be truncated or corrupted.",
+	warningMessageID(WarningUnsafeName):     "The file %[1]s has an unsafe name, it was renamed or left out.",
+	warningMessageID(WarningDuplicateEntry): "The publication contains several files named %[1]s, only one was kept.",
+	warningMessageID(WarningSuspiciousFile): "The file %[1]s looks encrypted but is not listed as such.",
+	warningMessageID(WarningLicense):        "A license of the publication deviates from the specification.",
+	warningMessageID(WarningPadding):        "The file %[1]s might be corrupted.",
+	warningMessageID(WarningSkippedEntry):   "The file %[1]s could not be decrypted and was left out.",
+	warningMessageID(WarningRepair):         "The structure of the publication was repaired.",
+}
+
+var frenchCatalog = Catalog{
+	MsgInvalidInput:                "Le fichier n'est pas une publication valide, il est peut-être tronqué ou corrompu.",
+	MsgNoLicense:                   "Aucune licence LCP n'a été trouvée dans la publication : soit elle n'est pas protégée par LCP, soit sa licence est distribuée séparément.",
+	MsgLicenseNotFound:             "La publication n'a pas de licence avec l'identifiant demandé.",
+	MsgUserKeyMissing:              "Aucune clé utilisateur ni phrase secrète n'a été fournie.",
+	MsgInvalidUserKey:              "La clé utilisateur est invalide, elle doit comporter 64 caractères hexadécimaux.",
+	MsgUserKeyMismatch:             "La clé utilisateur ou la phrase secrète ne correspond pas à la licence de la publication.",
+	MsgUserKeyMismatchHint:         "La clé utilisateur ou la phrase secrète ne correspond pas à la licence de la publication. Indice : %[1]s",
+	MsgUnsupportedProfile:          "La licence utilise le profil de chiffrement %[1]s, qui nécessite la clé utilisateur calculée par une application de lecture le prenant en charge.",
+	MsgUnsupportedUserKeyAlgorithm: "La licence dérive la clé utilisateur de la phrase secrète avec un algorithme non pris en charge (%[1]s), la clé utilisateur est nécessaire.",
+	MsgProviderNotAllowed:          "La licence a été émise par %[1]s, qui ne fait pas partie des fournisseurs autorisés.",
+	MsgUnsupportedAlgorithm:        "Le fichier %[1]s est chiffré avec un algorithme non pris en charge (%[2]s).",
+	MsgInterrupted:                 "Le déchiffrement a été interrompu.",
+	MsgLimitExceeded:               "La publication est trop volumineuse ou trop compressée pour être déchiffrée ici, elle est peut-être malveillante.",
+
+	warningMessageID(WarningContainer):      "La structure de la publication est inhabituelle.",
+	warningMessageID(WarningMissingFile):    "Des fichiers chiffrés manquent dans la publication, elle est peut-être tronquée ou corrompue.",
+	warningMessageID(WarningUnsafeName):     "Le fichier %[1]s a un nom dangereux, il a été renommé ou écarté.",
+	warningMessageID(WarningDuplicateEntry): "La publication contient plusieurs fichiers nommés %[1]s, un seul a été conservé.",
+	warningMessageID(WarningSuspiciousFile): "Le fichier %[1]s semble chiffré mais n'est pas déclaré comme tel.",
+	warningMessageID(WarningLicense):        "Une licence de la publication s'écarte de la spécification.",
+	warningMessageID(WarningPadding):        "Le fichier %[1]s est peut-être corrompu.",
+	warningMessageID(WarningSkippedEntry):   "Le fichier %[1]s n'a pas pu être déchiffré et a été écarté.",
+	warningMessageID(WarningRepair):         "La structure de la publication a été réparée.",
+}
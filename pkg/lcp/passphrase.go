@@ -0,0 +1,124 @@
+package lcp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// PassphraseVariant is a normalization of the passphrase typed by the user.
+// Some vendor applications hash a normalized form of the passphrase rather
+// than the passphrase itself, its hash then does not match the user key.
+type PassphraseVariant struct {
+	Name      string
+	Normalize func(passphrase string) string
+}
+
+var (
+	// PassphraseAsTyped is the passphrase as it was typed.
+	PassphraseAsTyped = PassphraseVariant{"as-typed", func(s string) string { return s }}
+	// PassphraseTrimmed is the passphrase without its leading and trailing
+	// white space.
+	PassphraseTrimmed = PassphraseVariant{"trimmed", strings.TrimSpace}
+	// PassphraseNFC is the passphrase in Unicode normalization form C.
+	PassphraseNFC = PassphraseVariant{"nfc", norm.NFC.String}
+	// PassphraseNFKC is the passphrase in Unicode normalization form KC.
+	PassphraseNFKC = PassphraseVariant{"nfkc", norm.NFKC.String}
+	// PassphraseCaseFolded is the case folded passphrase (mostly lower
+	// cased).
+	PassphraseCaseFolded = PassphraseVariant{"case-folded", func(s string) string { return cases.Fold().String(s) }}
+	// PassphraseNFKCCaseFolded is the trimmed passphrase, in normalization
+	// form KC and case folded.
+	PassphraseNFKCCaseFolded = PassphraseVariant{"nfkc-case-folded", func(s string) string {
+		return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(strings.TrimSpace(s))))
+	}}
+)
+
+// PassphraseVariants lists the built in passphrase variants, starting with
+// the passphrase as typed.
+var PassphraseVariants = []PassphraseVariant{
+	PassphraseAsTyped,
+	PassphraseTrimmed,
+	PassphraseNFC,
+	PassphraseNFKC,
+	PassphraseCaseFolded,
+	PassphraseNFKCCaseFolded,
+}
+
+// ParsePassphraseVariants returns the built in variants with the given comma
+// separated names, or all of them for "all".
+func ParsePassphraseVariants(names string) ([]PassphraseVariant, error) {
+	if names == "all" {
+		return PassphraseVariants, nil
+	}
+
+	var res []PassphraseVariant
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		i := slices.IndexFunc(PassphraseVariants, func(v PassphraseVariant) bool { return v.Name == name })
+		if i < 0 {
+			var valid []string
+			for _, v := range PassphraseVariants {
+				valid = append(valid, v.Name)
+			}
+
+			return nil, fmt.Errorf("unknown passphrase variant %q (valid values: all, %s)", name, strings.Join(valid, ", "))
+		}
+
+		res = append(res, PassphraseVariants[i])
+	}
+
+	return res, nil
+}
+
+// WithPassphraseVariants makes WithPassphrase also try the given variants of
+// the passphrase, in order, after the passphrase as typed. The variant that
+// matched is stored in Report.PassphraseVariant.
+func WithPassphraseVariants(variants ...PassphraseVariant) DecryptOption {
+	return func(o *decryptOptions) {
+		o.PassphraseVariants = append(o.PassphraseVariants, variants...)
+	}
+}
+
+// passphraseVariants returns the variants to try, starting with the
+// passphrase as typed, without the duplicates.
+func passphraseVariants(variants []PassphraseVariant) []PassphraseVariant {
+	res := []PassphraseVariant{PassphraseAsTyped}
+
+	for _, v := range variants {
+		if !slices.ContainsFunc(res, func(other PassphraseVariant) bool { return other.Name == v.Name }) {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+// PassphraseUserKey returns the user key derived from the first variant of
+// passphrase that unlocks the license, along with that variant. The
+// passphrase as typed is always tried first. Only the WithPassphraseVariants
+// and WithProfileTransform options are used, the latter being required for
+// the licenses using other profiles than the basic one.
+func (l *License) PassphraseUserKey(passphrase string, opts ...DecryptOption) ([]byte, PassphraseVariant, error) {
+	o := decryptOptions{Passphrase: passphrase}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	userKey, variant, err := o.passphraseVariantUserKey(l)
+	if err != nil {
+		return nil, PassphraseVariant{}, err
+	}
+
+	if err := l.CheckUserKey(userKey); err != nil {
+		return nil, PassphraseVariant{}, err
+	}
+
+	return userKey, variant, nil
+}
@@ -0,0 +1,100 @@
+package lcp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// WithRedactPII makes Decrypt mask the personal information found in the
+// licenses (license IDs, user ID, email and name) in its log messages, its
+// report and the errors it returns, for running in shared or logged
+// environments.
+func WithRedactPII() DecryptOption {
+	return func(o *decryptOptions) {
+		o.RedactPII = true
+	}
+}
+
+// Redact returns the masked version of a personal value. The same value is
+// always masked the same way, so that logs can still be correlated.
+func Redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	h := sha256.Sum256([]byte(value))
+
+	return "[redacted " + hex.EncodeToString(h[:4]) + "]"
+}
+
+// PII returns the personal values of the license, which WithRedactPII masks.
+func (l *License) PII() []string {
+	var res []string
+
+	for _, v := range []string{l.ID, l.User.ID, l.User.Email, l.User.Name} {
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+// addPII makes the decrypter mask the personal values of licenses when
+// redacting.
+func (d *decrypter) addPII(licenses ...*License) {
+	if !d.opts.RedactPII {
+		return
+	}
+
+	var values []string
+
+	for _, l := range licenses {
+		values = append(values, l.PII()...)
+	}
+
+	// Mask the longest values first, in case one contains another
+	slices.SortFunc(values, func(a, b string) int { return len(b) - len(a) })
+
+	pairs := make([]string, 0, 2*len(values))
+
+	for _, v := range values {
+		pairs = append(pairs, v, Redact(v))
+	}
+
+	d.redactor = strings.NewReplacer(pairs...)
+}
+
+// redact masks the personal values in s.
+func (d *decrypter) redact(s string) string {
+	if d.redactor == nil {
+		return s
+	}
+
+	return d.redactor.Replace(s)
+}
+
+// redactError masks the personal values in the message of err, while keeping
+// it unwrappable.
+func (d *decrypter) redactError(err error) error {
+	if err == nil || d.redactor == nil {
+		return err
+	}
+
+	return &redactedError{err: err, msg: d.redact(err.Error())}
+}
+
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
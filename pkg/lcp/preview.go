@@ -0,0 +1,99 @@
+package lcp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+// WithPreview makes Decrypt only output the beginning of EPUB publications:
+// the first n documents of the reading order, along with the package
+// document, the navigation document and the other resources. This quickly
+// checks the key and the rendering of a large publication before decrypting
+// it entirely.
+func WithPreview(n int) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Preview = n
+	}
+}
+
+// previewPlan lists the documents of the reading order left out of a
+// preview.
+type previewPlan struct {
+	// ids are the manifest IDs of the documents, paths their paths in the
+	// container.
+	ids, paths map[string]struct{}
+}
+
+func (d *decrypter) planPreview(root fs.FS) error {
+	if !d.container.Type.IsEPUB() {
+		return fmt.Errorf("previews are only supported for EPUB publications, the input file holds: %s", d.container.Type)
+	}
+
+	pkg, err := epub.ReadPackage(root)
+	if err != nil {
+		return fmt.Errorf("error reading package document: %w", err)
+	}
+
+	kept := map[string]struct{}{pkg.Spine.Toc: {}}
+
+	if nav, ok := pkg.Nav(); ok {
+		kept[nav.ID] = struct{}{}
+	}
+
+	refs := pkg.Spine.ItemRefs
+
+	for _, ref := range refs[:min(d.opts.Preview, len(refs))] {
+		kept[ref.IDRef] = struct{}{}
+	}
+
+	plan := &previewPlan{ids: map[string]struct{}{}, paths: map[string]struct{}{}}
+
+	for _, ref := range refs {
+		if _, ok := kept[ref.IDRef]; ok {
+			continue
+		}
+
+		if item, ok := pkg.Item(ref.IDRef); ok {
+			plan.ids[item.ID] = struct{}{}
+			plan.paths[pkg.ItemPath(item)] = struct{}{}
+		}
+	}
+
+	d.preview = plan
+	d.log(fmt.Sprintf("Preview: keeping %d of the %d documents of the reading order", len(refs)-len(plan.ids), len(refs)))
+
+	return nil
+}
+
+// dropsFile returns whether the file at name is left out of the preview.
+func (p *previewPlan) dropsFile(name string) bool {
+	_, ok := p.paths[name]
+	return ok
+}
+
+// dropsElement returns whether an element of the package document refers to
+// a document left out of the preview.
+func (p *previewPlan) dropsElement(start xml.StartElement) bool {
+	var attr string
+
+	switch start.Name.Local {
+	case "item":
+		attr = "id"
+	case "itemref":
+		attr = "idref"
+	default:
+		return false
+	}
+
+	for _, a := range start.Attr {
+		if a.Name.Local == attr {
+			_, ok := p.ids[a.Value]
+			return ok
+		}
+	}
+
+	return false
+}
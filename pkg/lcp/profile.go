@@ -0,0 +1,130 @@
+package lcp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Encryption profiles of LCP licenses.
+const (
+	// ProfileBasic is the profile of the licenses whose user key is the
+	// SHA-256 hash of the passphrase.
+	ProfileBasic = "http://readium.org/lcp/basic-profile"
+	// Profile10 is the production profile of LCP 1.0, which transforms that
+	// hash with a secret only known to certified reading applications.
+	Profile10 = "http://readium.org/lcp/profile-1.0"
+)
+
+// ErrUnsupportedProfile is returned (wrapped) by Decrypt when the user key
+// can't be derived from the passphrase because of the encryption profile of
+// the license.
+var ErrUnsupportedProfile = errors.New("unsupported encryption profile")
+
+// UserKeyTransform computes the user key of a license from the hash of the
+// passphrase (with the user key algorithm of the license, SHA-256 in
+// practice), as specified by the encryption profile of the license.
+type UserKeyTransform func(passphraseHash []byte) ([]byte, error)
+
+// WithProfileTransform makes WithPassphrase work with the licenses using
+// profile, by deriving their user key with transform. The basic profile is
+// built in, the production profiles rely on secrets that callers must supply
+// this way.
+func WithProfileTransform(profile string, transform UserKeyTransform) DecryptOption {
+	return func(o *decryptOptions) {
+		if o.ProfileTransforms == nil {
+			o.ProfileTransforms = map[string]UserKeyTransform{}
+		}
+
+		o.ProfileTransforms[profile] = transform
+	}
+}
+
+// CheckPassphraseProfile returns an error wrapping ErrUnsupportedProfile if
+// UserKeyFromPassphrase can't derive the user key of the license, which
+// happens for all the profiles but the basic one. The user key itself works
+// whatever the profile.
+func (l *License) CheckPassphraseProfile() error {
+	profile := l.Encryption.Profile
+
+	if profile == "" || profile == ProfileBasic {
+		return nil
+	}
+
+	return newError(MsgUnsupportedProfile, fmt.Errorf("%w %s: user keys can only be derived from passphrases for the basic profile, decrypting this license requires the user key computed by a reading application supporting that profile", ErrUnsupportedProfile, profile), profile)
+}
+
+// profileTransform returns the user key transform for the profile of l, or
+// nil if the profile is not supported.
+func (o *decryptOptions) profileTransform(l *License) UserKeyTransform {
+	switch profile := l.Encryption.Profile; profile {
+	case "", ProfileBasic:
+		return func(passphraseHash []byte) ([]byte, error) { return passphraseHash, nil }
+	default:
+		return o.ProfileTransforms[profile]
+	}
+}
+
+// passphraseUserKey derives the user key of l from the passphrase.
+func (o *decryptOptions) passphraseUserKey(l *License) ([]byte, error) {
+	userKey, _, err := o.passphraseVariantUserKey(l)
+	return userKey, err
+}
+
+// passphraseVariantUserKey derives the user key of l from the first variant
+// of the passphrase passing its key check, or from the passphrase as typed if
+// none does. It also returns the variant used.
+func (o *decryptOptions) passphraseVariantUserKey(l *License) ([]byte, PassphraseVariant, error) {
+	transform := o.profileTransform(l)
+	if transform == nil {
+		return nil, PassphraseVariant{}, l.CheckPassphraseProfile()
+	}
+
+	var (
+		first        []byte
+		firstVariant PassphraseVariant
+	)
+
+	for _, v := range passphraseVariants(o.PassphraseVariants) {
+		hash, err := l.passphraseHash(v.Normalize(o.Passphrase))
+		if err != nil {
+			return nil, PassphraseVariant{}, err
+		}
+
+		userKey, err := transform(hash)
+		if err != nil {
+			return nil, PassphraseVariant{}, fmt.Errorf("error deriving user key for profile %s: %w", l.Encryption.Profile, err)
+		}
+
+		if len(o.PassphraseVariants) == 0 || l.CheckUserKey(userKey) == nil {
+			return userKey, v, nil
+		}
+
+		if first == nil {
+			first, firstVariant = userKey, v
+		}
+	}
+
+	return first, firstVariant, nil
+}
+
+// passphraseLicenses returns the licenses whose user key can be derived from
+// the passphrase.
+func (o *decryptOptions) passphraseLicenses(licenses []*License) ([]*License, error) {
+	var res []*License
+
+	for _, l := range licenses {
+		if o.profileTransform(l) != nil && l.CheckUserKeyAlgorithm() == nil {
+			res = append(res, l)
+		}
+	}
+
+	if len(res) == 0 {
+		if o.profileTransform(licenses[0]) == nil {
+			return nil, licenses[0].CheckPassphraseProfile()
+		}
+
+		return nil, licenses[0].CheckUserKeyAlgorithm()
+	}
+
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package lcp
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrProviderNotAllowed is returned (wrapped) by Decrypt when the license of
+// the publication was issued by a provider not listed in
+// WithAllowedProviders.
+var ErrProviderNotAllowed = errors.New("provider not allowed")
+
+// WithAllowedProviders makes Decrypt refuse the licenses whose provider is not
+// one of providers. When a publication embeds several licenses, only the ones
+// from allowed providers are considered.
+//
+// The provider can't be checked without a license, so this option can't be
+// combined with WithContentKey.
+func WithAllowedProviders(providers []string) DecryptOption {
+	return func(o *decryptOptions) {
+		o.AllowedProviders = providers
+	}
+}
+
+// normalizeProvider makes "https://example.com" and "https://example.com/"
+// compare equal.
+func normalizeProvider(provider string) string {
+	return strings.TrimSuffix(strings.TrimSpace(provider), "/")
+}
+
+// providerAllowed returns whether licenses from provider can be used.
+func (o *decryptOptions) providerAllowed(provider string) bool {
+	if len(o.AllowedProviders) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(o.AllowedProviders, func(p string) bool {
+		return normalizeProvider(p) == normalizeProvider(provider)
+	})
+}
+
+// filterAllowedLicenses returns the licenses issued by allowed providers.
+func (o *decryptOptions) filterAllowedLicenses(licenses []*License) ([]*License, error) {
+	var res []*License
+
+	for _, l := range licenses {
+		if o.providerAllowed(l.Provider) {
+			res = append(res, l)
+		}
+	}
+
+	if len(res) == 0 {
+		providers := make([]string, len(licenses))
+
+		for i, l := range licenses {
+			providers[i] = l.Provider
+		}
+
+		issuers := strings.Join(providers, ", ")
+
+		return nil, newError(MsgProviderNotAllowed, fmt.Errorf("%w: the license was issued by %s", ErrProviderNotAllowed, issuers), issuers)
+	}
+
+	return res, nil
+}
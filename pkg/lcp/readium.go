@@ -0,0 +1,393 @@
+package lcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Readium packages (audiobooks, PDFs...) list their resources in a Readium Web
+// Publication manifest instead of an OPF file, and describe the encryption of
+// each resource in its "encrypted" property rather than in
+// META-INF/encryption.xml. Their license sits at the root of the container.
+const (
+	readiumManifestPath = "manifest.json"
+	readiumLicensePath  = "license.lcpl"
+)
+
+// isReadiumPackage returns whether the container at root is a Readium package
+// rather than an EPUB file.
+func isReadiumPackage(root fs.FS) bool {
+	if _, err := fs.Stat(root, "META-INF/encryption.xml"); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	_, err := fs.Stat(root, readiumManifestPath)
+
+	return err == nil
+}
+
+// readiumContainer supports Readium packages, whose type is read from the
+// mimetype file or else guessed from the resources of the manifest.
+type readiumContainer struct{}
+
+func (readiumContainer) Types() []ContainerType {
+	return []ContainerType{ContainerPDF, ContainerAudiobook, ContainerDivina, ContainerReadium}
+}
+
+func (readiumContainer) Detect(root fs.FS) (ContainerInfo, bool, error) {
+	if !isReadiumPackage(root) {
+		return ContainerInfo{}, false, nil
+	}
+
+	info := ContainerInfo{Type: ContainerReadium}
+
+	mimetype, err := readContainerMimetype(root)
+	if err != nil {
+		return info, true, err
+	}
+
+	for _, m := range readiumMimetypes {
+		if mimetype == m.protected || mimetype == m.decrypted {
+			info.Type = m.typ
+			return info, true, nil
+		}
+	}
+
+	manifestType, err := readiumManifestType(root)
+	if err != nil {
+		return info, true, err
+	}
+
+	if manifestType != "" {
+		info.Type = manifestType
+	}
+
+	return info, true, nil
+}
+
+// LicenseLocators returns nil, the built in locators cover Readium packages.
+func (readiumContainer) LicenseLocators() []LicenseLocator {
+	return nil
+}
+
+// Encryption reads the encrypted resources from the manifest, which gets
+// rewritten without the encryption properties. Protected packages declare a
+// "+lcp" mimetype, which gets replaced as it doesn't apply to the decrypted
+// package.
+func (readiumContainer) Encryption(root fs.FS, info ContainerInfo) ([]FileEntry, map[string][]byte, error) {
+	files, manifest, err := listManifestEncryptedFiles(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rewritten := map[string][]byte{readiumManifestPath: manifest}
+
+	for _, m := range readiumMimetypes {
+		if info.Mimetype == m.protected {
+			rewritten["mimetype"] = []byte(m.decrypted)
+		}
+	}
+
+	return files, rewritten, nil
+}
+
+// Packaging rewrites the manifest, which describes the encryption.
+func (readiumContainer) Packaging(ContainerInfo) Packaging {
+	return Packaging{RepairMimetype: true}
+}
+
+// Media types of the protected Readium packages, and of their unprotected
+// counterparts.
+var readiumMimetypes = []struct {
+	typ                  ContainerType
+	protected, decrypted string
+}{
+	{ContainerPDF, "application/pdf+lcp", "application/webpub+zip"},
+	{ContainerAudiobook, "application/audiobook+lcp", "application/audiobook+zip"},
+	{ContainerDivina, "application/divina+lcp", "application/divina+zip"},
+	{ContainerReadium, "application/webpub+lcp", "application/webpub+zip"},
+}
+
+// readiumManifestType guesses the type of a Readium package from the media
+// types of its reading order, it returns an empty type if they are mixed.
+func readiumManifestType(root fs.FS) (ContainerType, error) {
+	data, err := fs.ReadFile(root, readiumManifestPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var manifest struct {
+		ReadingOrder []struct {
+			Type string `json:"type"`
+		} `json:"readingOrder"`
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("error decoding manifest: %w", err)
+	}
+
+	var res ContainerType
+
+	for _, link := range manifest.ReadingOrder {
+		var t ContainerType
+
+		switch {
+		case link.Type == "application/pdf":
+			t = ContainerPDF
+		case strings.HasPrefix(link.Type, "audio/"):
+			t = ContainerAudiobook
+		case strings.HasPrefix(link.Type, "image/"):
+			t = ContainerDivina
+		default:
+			return "", nil
+		}
+
+		if res != "" && res != t {
+			return "", nil
+		}
+
+		res = t
+	}
+
+	return res, nil
+}
+
+// readiumEncryption is the "encrypted" property of a link in a Readium
+// manifest.
+type readiumEncryption struct {
+	Algorithm      string `json:"algorithm"`
+	Compression    string `json:"compression"`
+	OriginalLength int64  `json:"originalLength"`
+}
+
+// listManifestEncryptedFiles reads the encrypted resources from the manifest
+// of a Readium package. It also returns the manifest with the encryption
+// properties removed, to be written in the output file. The rest of the
+// manifest is kept as is, in its original order.
+func listManifestEncryptedFiles(root fs.FS) ([]FileEntry, []byte, error) {
+	data, err := fs.ReadFile(root, readiumManifestPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	// Only the encryption properties are decoded below, check the rest too
+	if err := json.Unmarshal(data, new(json.RawMessage)); err != nil {
+		return nil, nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+
+	var res []FileEntry
+
+	var walk func(v json.RawMessage) (json.RawMessage, error)
+	walk = func(v json.RawMessage) (json.RawMessage, error) {
+		switch v = bytes.TrimSpace(v); {
+		case bytes.HasPrefix(v, []byte("[")):
+			var elems []json.RawMessage
+
+			if err := json.Unmarshal(v, &elems); err != nil {
+				return nil, err
+			}
+
+			for i, e := range elems {
+				walked, err := walk(e)
+				if err != nil {
+					return nil, err
+				}
+
+				elems[i] = walked
+			}
+
+			return json.Marshal(elems)
+		case bytes.HasPrefix(v, []byte("{")):
+			link, err := decodeJSONObject(v)
+			if err != nil {
+				return nil, err
+			}
+
+			entry, link, err := manifestLinkEntry(link)
+			if err != nil {
+				return nil, err
+			}
+
+			if entry != nil {
+				res = append(res, *entry)
+			}
+
+			for i, m := range link {
+				walked, err := walk(m.Value)
+				if err != nil {
+					return nil, err
+				}
+
+				link[i].Value = walked
+			}
+
+			return encodeJSONObject(link)
+		default:
+			return v, nil
+		}
+	}
+
+	stripped, err := walk(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var indented bytes.Buffer
+
+	if err := json.Indent(&indented, stripped, "", "  "); err != nil {
+		return nil, nil, fmt.Errorf("error encoding manifest: %w", err)
+	}
+
+	return res, indented.Bytes(), nil
+}
+
+// jsonMember is a member of a JSON object, whose value is left undecoded.
+type jsonMember struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// decodeJSONObject returns the members of the JSON object in data, in their
+// order in the document.
+func decodeJSONObject(data []byte) ([]jsonMember, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if _, err := dec.Token(); err != nil { // {
+		return nil, err
+	}
+
+	var res []jsonMember
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		m := jsonMember{Key: key.(string)}
+
+		if err := dec.Decode(&m.Value); err != nil {
+			return nil, err
+		}
+
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+// encodeJSONObject is the reverse of decodeJSONObject.
+func encodeJSONObject(members []jsonMember) (json.RawMessage, error) {
+	buf := bytes.NewBufferString("{")
+
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(m.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.Value)
+	}
+
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// jsonMemberValue returns the value of the member key, the last one if there
+// are several like encoding/json does, or nil.
+func jsonMemberValue(members []jsonMember, key string) json.RawMessage {
+	var res json.RawMessage
+
+	for _, m := range members {
+		if m.Key == key {
+			res = m.Value
+		}
+	}
+
+	return res
+}
+
+// withoutJSONMember returns members without the ones named key.
+func withoutJSONMember(members []jsonMember, key string) []jsonMember {
+	return slices.DeleteFunc(members, func(m jsonMember) bool { return m.Key == key })
+}
+
+// manifestLinkEntry returns the FileEntry for a link of a Readium manifest,
+// or nil if the link is not encrypted, along with the link without its
+// encryption property.
+func manifestLinkEntry(link []jsonMember) (*FileEntry, []jsonMember, error) {
+	var href string
+
+	_ = json.Unmarshal(jsonMemberValue(link, "href"), &href)
+
+	rawProperties := jsonMemberValue(link, "properties")
+	if href == "" || !bytes.HasPrefix(bytes.TrimSpace(rawProperties), []byte("{")) {
+		return nil, link, nil
+	}
+
+	properties, err := decodeJSONObject(rawProperties)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawEncryption := jsonMemberValue(properties, "encrypted")
+	if rawEncryption == nil || string(rawEncryption) == "null" {
+		return nil, link, nil
+	}
+
+	var encryption readiumEncryption
+
+	if err := json.Unmarshal(rawEncryption, &encryption); err != nil {
+		return nil, nil, fmt.Errorf("error decoding encryption properties of %s: %w", href, err)
+	}
+
+	if properties = withoutJSONMember(properties, "encrypted"); len(properties) == 0 {
+		link = withoutJSONMember(link, "properties")
+	} else {
+		encoded, err := encodeJSONObject(properties)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := range link {
+			if link[i].Key == "properties" {
+				link[i].Value = encoded
+			}
+		}
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding resource path %q: %w", href, err)
+	}
+
+	if u.IsAbs() {
+		return nil, link, nil // remote resource, not in the package
+	}
+
+	entry := &FileEntry{
+		Path:                strings.TrimPrefix(u.Path, "/"),
+		IsCompressed:        encryption.Compression == "deflate",
+		OriginalLength:      encryption.OriginalLength,
+		EncryptionAlgorithm: EncryptionAlgorithm(encryption.Algorithm),
+	}
+
+	if err := checkAlgorithm(entry.Path, entry.EncryptionAlgorithm); err != nil {
+		return nil, nil, err
+	}
+
+	return entry, link, nil
+}
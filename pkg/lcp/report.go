@@ -0,0 +1,41 @@
+package lcp
+
+// Report summarizes what happened during a decryption run.
+type Report struct {
+	// Container describes the input file.
+	Container ContainerInfo
+	// Warnings lists the non fatal issues encountered while decrypting, in
+	// the order they were found.
+	Warnings []string
+	// MissingFiles lists the paths referenced by encryption.xml that don't
+	// exist in the input archive. This usually means that the download was
+	// truncated, or that the file was repackaged.
+	MissingFiles []string
+	// SuspiciousFiles lists the paths of the files that are not listed in
+	// encryption.xml but look encrypted. It is only filled when using
+	// WithUnlistedEncryptionScan.
+	SuspiciousFiles []string
+	// Repairs lists the fixes made to the structure of the publication (for
+	// example a missing or malformed mimetype file).
+	Repairs []string
+	// PassphraseVariant is the name of the variant of the passphrase that
+	// unlocked the license when using WithPassphraseVariants, empty if the
+	// passphrase matched as typed.
+	PassphraseVariant string
+	// Digests maps the paths of the decrypted resources to the hex encoded
+	// SHA-256 digest of their decrypted contents.
+	Digests map[string]string
+	// Timings breaks down the time spent decrypting.
+	Timings Timings
+	// Err joins the errors for the files that were left out of the output
+	// file when using WithContinueOnError.
+	Err error
+}
+
+// WithReport makes Decrypt fill report as it processes the input file. The
+// report is filled even if Decrypt returns an error.
+func WithReport(report *Report) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Report = report
+	}
+}
@@ -0,0 +1,88 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// rewritesFile returns whether the unencrypted entry name is modified on its
+// way to the output file.
+func (d *decrypter) rewritesFile(name string) bool {
+	_, rewritten := d.rewrittenFiles[name]
+
+	return rewritten ||
+		(d.container.Type.IsEPUB() && name == d.container.PackagePath)
+}
+
+// openResource returns the contents of an entry of the input file, as
+// Decrypt would write them to the output file. Entries copied as they are
+// are read from the input file as they are consumed, the others are
+// prepared in memory.
+func (d *decrypter) openResource(f *zip.File, fileEntry FileEntry, action FileAction) (io.ReadCloser, error) {
+	if action == FileActionCopy && !d.rewritesFile(f.Name) {
+		fd, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)
+		}
+
+		return fd, nil
+	}
+
+	data, err := d.readResource(f, fileEntry, action)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readResource reads the contents of an entry of the input file in memory,
+// as Decrypt would write them to the output file.
+func (d *decrypter) readResource(f *zip.File, fileEntry FileEntry, action FileAction) ([]byte, error) {
+	if action == FileActionCopy {
+		if rewritten, ok := d.rewrittenFiles[f.Name]; ok {
+			return rewritten, nil
+		}
+
+		if d.container.Type.IsEPUB() && f.Name == d.container.PackagePath {
+			data, err := d.packageDocument(f)
+			if err != nil || data != nil {
+				return data, err
+			}
+		}
+	}
+
+	srcFile, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)
+	}
+
+	defer srcFile.Close()
+
+	if action == FileActionCopy {
+		data, err := io.ReadAll(srcFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file %s from input zip file: %w", f.Name, err)
+		}
+
+		return data, nil
+	}
+
+	data, err := d.decryptFile(srcFile, int64(f.UncompressedSize64), d.contentKey, fileEntry)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting file %s: %w", f.Name, err)
+	}
+
+	return data, nil
+}
+
+// errReader is an io.Reader failing with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
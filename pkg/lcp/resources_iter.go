@@ -0,0 +1,64 @@
+//go:build go1.23
+
+package lcp
+
+import (
+	"io"
+	"iter"
+)
+
+// hasResourcesIterator tells whether Resources is available.
+const hasResourcesIterator = true
+
+// Resources returns an iterator over the resources of the publication stored
+// in in, each yielded with a reader of its decrypted contents. Resources are
+// only read and decrypted as the iteration reaches them, which lets callers
+// process a publication (indexing its text, converting its images...)
+// without writing a whole output file.
+//
+// The contents are the ones Decrypt would write: the license, encryption
+// files and directories are left out, and the package document and Readium
+// manifest lose their encryption information. A reader is only valid until
+// the iteration moves on to the next resource. If a resource can't be
+// decrypted, its reader returns the error, and the iteration goes on.
+//
+// The returned error is about opening the publication (invalid file, wrong
+// key...). The iteration stops early once the context passed with
+// WithContext is done.
+func Resources(in io.ReaderAt, inSize int64, userKeyHex string, opts ...DecryptOption) (iter.Seq2[FileEntry, io.Reader], error) {
+	d := newDecrypter(opts)
+
+	_, files, err := d.open(in, inSize, userKeyHex)
+	if err != nil {
+		return nil, d.redactError(err)
+	}
+
+	return func(yield func(FileEntry, io.Reader) bool) {
+		for _, f := range files {
+			if d.opts.Context.Err() != nil {
+				return
+			}
+
+			fileEntry, action := d.fileAction(f)
+			if action == FileActionSkip || action == FileActionDirectory {
+				continue
+			}
+
+			rc, err := d.openResource(f, fileEntry, action)
+			if err != nil {
+				if !yield(fileEntry, errReader{d.redactError(err)}) {
+					return
+				}
+
+				continue
+			}
+
+			more := yield(fileEntry, rc)
+			rc.Close()
+
+			if !more {
+				return
+			}
+		}
+	}, nil
+}
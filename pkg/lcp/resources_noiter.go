@@ -0,0 +1,6 @@
+//go:build !go1.23
+
+package lcp
+
+// hasResourcesIterator tells whether Resources is available.
+const hasResourcesIterator = false
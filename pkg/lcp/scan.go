@@ -0,0 +1,163 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// WithUnlistedEncryptionScan makes Decrypt check the entries that are not
+// listed in encryption.xml, and warn about the ones that look encrypted
+// anyway. Such entries are copied as is to the output file, and are likely to
+// be unreadable.
+func WithUnlistedEncryptionScan() DecryptOption {
+	return func(o *decryptOptions) {
+		o.ScanUnlisted = true
+	}
+}
+
+// scanUnlistedFile returns true if the contents of f look encrypted.
+func scanUnlistedFile(f *zip.File) (bool, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return false, fmt.Errorf("error opening file: %w", err)
+	}
+
+	defer fd.Close()
+
+	data, err := io.ReadAll(io.LimitReader(fd, scanSampleSize))
+	if err != nil {
+		return false, fmt.Errorf("error reading file: %w", err)
+	}
+
+	return looksEncrypted(f.Name, data), nil
+}
+
+// scanSampleSize is the maximum number of bytes looked at when deciding if
+// some data looks encrypted.
+const scanSampleSize = 64 * 1024
+
+// minScanSize is the size under which we don't try to guess if data is
+// encrypted: there is not enough of it to get meaningful statistics.
+const minScanSize = 64
+
+type magic struct {
+	Offset int
+	Bytes  string
+}
+
+// magicsByExtension lists the signatures expected at the beginning of binary
+// files commonly found in publications.
+var magicsByExtension = map[string][]magic{
+	".jpg":   {{0, "\xff\xd8\xff"}},
+	".jpeg":  {{0, "\xff\xd8\xff"}},
+	".png":   {{0, "\x89PNG\r\n\x1a\n"}},
+	".gif":   {{0, "GIF87a"}, {0, "GIF89a"}},
+	".webp":  {{8, "WEBP"}},
+	".ttf":   {{0, "\x00\x01\x00\x00"}, {0, "true"}},
+	".otf":   {{0, "OTTO"}, {0, "\x00\x01\x00\x00"}},
+	".woff":  {{0, "wOFF"}},
+	".woff2": {{0, "wOF2"}},
+	".mp3":   {{0, "ID3"}, {0, "\xff\xfb"}, {0, "\xff\xf3"}, {0, "\xff\xf2"}},
+	".mp4":   {{4, "ftyp"}},
+	".m4a":   {{4, "ftyp"}},
+	".m4b":   {{4, "ftyp"}},
+	".ogg":   {{0, "OggS"}},
+	".opus":  {{0, "OggS"}},
+	".pdf":   {{0, "%PDF"}},
+}
+
+// textExtensions lists the extensions of files expected to contain text.
+var textExtensions = map[string]struct{}{
+	".xhtml": {}, ".html": {}, ".htm": {}, ".xml": {}, ".opf": {}, ".ncx": {},
+	".css": {}, ".js": {}, ".svg": {}, ".smil": {}, ".txt": {}, ".json": {},
+}
+
+// hasKnownMagic returns true if data starts with a signature expected for a
+// file named name. If the extension of name is unknown, any known signature
+// is accepted.
+func hasKnownMagic(name string, data []byte) bool {
+	magics, ok := magicsByExtension[strings.ToLower(path.Ext(name))]
+	if !ok {
+		for _, m := range magicsByExtension {
+			magics = append(magics, m...)
+		}
+	}
+
+	for _, m := range magics {
+		if len(data) >= m.Offset+len(m.Bytes) && string(data[m.Offset:m.Offset+len(m.Bytes)]) == m.Bytes {
+			return true
+		}
+	}
+
+	return false
+}
+
+// looksLikeText returns true if data is valid UTF-8 (or UTF-16 with a BOM).
+func looksLikeText(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("\xfe\xff")) || bytes.HasPrefix(data, []byte("\xff\xfe")) {
+		return true
+	}
+
+	// Don't let a multi byte character truncated by the sampling fail the
+	// check.
+	for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+
+	return utf8.Valid(data)
+}
+
+// entropy returns the Shannon entropy of data, in bits per byte.
+func entropy(data []byte) float64 {
+	var counts [256]int
+
+	for _, b := range data {
+		counts[b]++
+	}
+
+	res := 0.0
+
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		p := float64(c) / float64(len(data))
+		res -= p * math.Log2(p)
+	}
+
+	return res
+}
+
+// looksEncrypted guesses whether the contents of a file named name look
+// encrypted: encrypted data has a very high entropy, and doesn't start with
+// the signature expected from the file's type.
+func looksEncrypted(name string, data []byte) bool {
+	if len(data) < minScanSize {
+		return false
+	}
+
+	if len(data) > scanSampleSize {
+		data = data[:scanSampleSize]
+	}
+
+	if _, ok := textExtensions[strings.ToLower(path.Ext(name))]; ok && looksLikeText(data) {
+		return false
+	}
+
+	if hasKnownMagic(name, data) {
+		return false
+	}
+
+	// Even truly random data can't reach 8 bits per byte with small samples,
+	// since not all byte values get a chance to appear.
+	threshold := 0.9 * math.Min(8, math.Log2(float64(len(data))))
+
+	return entropy(data) >= threshold
+}
@@ -0,0 +1,279 @@
+package lcp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// SelfTestResult is the outcome of one of the checks run by SelfTest.
+type SelfTestResult struct {
+	Name string
+	// Err tells why the check failed, nil if it passed.
+	Err error
+}
+
+// selfTestLicense is a license whose user key is the one derived from the
+// "lcp-decrypt self-test" passphrase, and whose content key is the bytes 0 to
+// 31.
+const selfTestLicense = `{
+  "id": "self-test-license",
+  "encryption": {
+    "profile": "http://readium.org/lcp/basic-profile",
+    "content_key": {
+      "algorithm": "http://www.w3.org/2001/04/xmlenc#aes256-cbc",
+      "encrypted_value": "MDEyMzQ1Njc4OWFiY2RlZnZaySIyOU9bpYJSXft/4M3pR646NMuAdX9iUnwqixalfJo2Y+9/7pMyTmCeou22NQ=="
+    },
+    "user_key": {
+      "algorithm": "http://www.w3.org/2001/04/xmlenc#sha256",
+      "key_check": "MDEyMzQ1Njc4OWFiY2RlZg8cbZA+Rd0PTh5457b5uRGrlGp7j1WYZ8A6wUmQ9DfM"
+    }
+  }
+}`
+
+// selfTests are the checks run by SelfTest. The first ones check the AES
+// implementation of the platform against published vectors, the others the
+// code paths of Decrypt against vectors computed once.
+var selfTests = []struct {
+	name string
+	run  func() error
+}{
+	{"AES-256-CBC (NIST SP 800-38A F.2.6)", selfTestCBC},
+	{"AES-256-GCM (GCM spec test cases 13 and 14)", selfTestGCM},
+	{"user key from passphrase", selfTestPassphrase},
+	{"content key unwrapping", selfTestContentKey},
+	{"key check rejects the wrong key", selfTestWrongKey},
+	{"padding removal", selfTestPadding},
+	{"invalid padding detection", selfTestInvalidPadding},
+	{"resource decryption and decompression", selfTestResource},
+	{"IDPF font obfuscation", selfTestFontObfuscation},
+	{"Adobe font obfuscation", selfTestAdobeFontObfuscation},
+}
+
+// SelfTest runs known-answer tests on the cryptographic code paths used to
+// decrypt publications, and returns the result of each check. It lets users
+// on unusual platforms (WebAssembly, ARM boxes...) confirm that decryption
+// behaves before suspecting their keys.
+func SelfTest() []SelfTestResult {
+	results := make([]SelfTestResult, len(selfTests))
+
+	for i, t := range selfTests {
+		results[i] = SelfTestResult{Name: t.name, Err: t.run()}
+	}
+
+	return results
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func expectBytes(what string, got, want []byte) error {
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("unexpected %s: got %x, want %x", what, got, want)
+	}
+
+	return nil
+}
+
+func selfTestCBC() error {
+	key := mustDecodeHex("603deb1015ca71be2b73aef0857d7781 1f352c073b6108d72d9810a30914dff4")
+	iv := mustDecodeHex("000102030405060708090a0b0c0d0e0f")
+	ciphertext := mustDecodeHex("f58c4c04d6e5f1ba779eabfb5f7bfbd6 9cfc4e967edb808d679f777bc6702c7d 39f23369a9d9bacfa530e26304231461 b2eb05e2c39be9fcda6c19078c6a9d1b")
+	plaintext := mustDecodeHex("6bc1bee22e409f96e93d7e117393172a ae2d8a571e03ac9c9eb76fac45af8e51 30c81c46a35ce411e5fbc1191a0a52ef f69f2445df4f9b17ad2b417be66c3710")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	res := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(res, ciphertext)
+
+	return expectBytes("plaintext", res, plaintext)
+}
+
+func selfTestGCM() error {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		return err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	for _, tc := range []struct {
+		plaintext, sealed []byte
+	}{
+		{nil, mustDecodeHex("530f8afbc74536b9a963b4f1c4cb738b")},
+		{make([]byte, 16), mustDecodeHex("cea7403d4d606b6e074ec5d3baf39d18 d0d1c8a799996bf0265b98b5d48ab919")},
+	} {
+		if err := expectBytes("ciphertext", gcm.Seal(nil, nonce, tc.plaintext, nil), tc.sealed); err != nil {
+			return err
+		}
+
+		opened, err := gcm.Open(nil, nonce, tc.sealed, nil)
+		if err != nil {
+			return fmt.Errorf("error opening ciphertext: %w", err)
+		}
+
+		if err := expectBytes("plaintext", opened, tc.plaintext); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func selfTestUserKey() []byte {
+	return UserKeyFromPassphrase("lcp-decrypt self-test")
+}
+
+func selfTestContentKeyBytes() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	return key
+}
+
+func selfTestPassphrase() error {
+	return expectBytes("user key", selfTestUserKey(), mustDecodeHex("da71b15de8d3d5c3cb204ad37a93bfcad3bfbe366374f0d135c77a89bd0bf126"))
+}
+
+func selfTestContentKey() error {
+	license, err := ParseLicense(strings.NewReader(selfTestLicense))
+	if err != nil {
+		return err
+	}
+
+	contentKey, err := license.contentKey(selfTestUserKey())
+	if err != nil {
+		return err
+	}
+
+	return expectBytes("content key", contentKey, selfTestContentKeyBytes())
+}
+
+func selfTestWrongKey() error {
+	license, err := ParseLicense(strings.NewReader(selfTestLicense))
+	if err != nil {
+		return err
+	}
+
+	if err := license.CheckUserKey(UserKeyFromPassphrase("wrong passphrase")); err == nil {
+		return fmt.Errorf("a wrong user key was accepted")
+	}
+
+	return nil
+}
+
+// selfTestPadding decrypts a message whose length is a multiple of the block
+// size, and which therefore ends with a whole block of padding.
+func selfTestPadding() error {
+	res, err := decipherAES256CBC(mustDecodeHex("30313233343536373839616263646566 433835d416a6a908ffdf00a8e624f05d 83cbc733f06483bf8c63bdb4228db1a3"), selfTestContentKeyBytes())
+	if err != nil {
+		return err
+	}
+
+	return expectBytes("plaintext", res, []byte("0123456789ABCDEF"))
+}
+
+// selfTestInvalidPadding decrypts a message with the wrong key, which yields
+// garbage whose last byte is not a valid padding length.
+func selfTestInvalidPadding() error {
+	key := selfTestContentKeyBytes()
+	key[0] ^= 0xff
+
+	// The last byte of the garbage is 0xcc, more than the 16 bytes of data
+	if _, err := decipherAES256CBC(mustDecodeHex("30313233343536373839616263646566 433835d416a6a908ffdf00a8e624f05d"), key); err == nil {
+		return fmt.Errorf("an invalid padding was accepted")
+	}
+
+	return nil
+}
+
+func selfTestResource() error {
+	res, err := newDecrypter(nil).decryptFile(bytes.NewReader(mustDecodeHex("30313233343536373839616263646566 f87c120058a602614c73bace22625e12 eefa33ad435a858577351d6447e6b71e")), 48, selfTestContentKeyBytes(), FileEntry{
+		Path:                "self-test.xhtml",
+		IsCompressed:        true,
+		EncryptionAlgorithm: EncryptionAlgorithmAES256CBC,
+	})
+	if err != nil {
+		return err
+	}
+
+	return expectBytes("resource", res, []byte("<p>Hello, self-test!</p>"))
+}
+
+// selfTestFont is the font de-obfuscated by the font obfuscation self-tests:
+// the bytes 0 to 250 repeated over 1100 bytes, so that the bytes after the
+// obfuscated ones are checked too.
+func selfTestFont() []byte {
+	font := make([]byte, 1100)
+	for i := range font {
+		font[i] = byte(i % 251)
+	}
+
+	return font
+}
+
+// selfTestFontObfuscation checks the IDPF font obfuscation: the key is the
+// SHA-1 of the identifier without its whitespace, XORed with the first 1040
+// bytes of the font.
+func selfTestFontObfuscation() error {
+	d := newDecrypter(nil)
+	d.identifier = " urn:uuid:12345678-9abc-def0-1234-56789abcdef0\n"
+
+	key, err := d.fontKey(EncryptionAlgorithmFontObfuscation)
+	if err != nil {
+		return err
+	}
+
+	if err := expectBytes("key", key, mustDecodeHex("d5136d90a6cbd07e7ec7326acb8753f97a31c839")); err != nil {
+		return err
+	}
+
+	return selfTestDeobfuscate(d, EncryptionAlgorithmFontObfuscation, "9eb13b85acc774962900393f06d5b5d17537b9f20d639bb91c9e74299dd38441")
+}
+
+// selfTestAdobeFontObfuscation checks the Adobe font obfuscation: the key is
+// the UUID of the identifier, XORed with the first 1024 bytes of the font.
+func selfTestAdobeFontObfuscation() error {
+	d := newDecrypter(nil)
+	d.identifier = "urn:uuid:0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"
+
+	return selfTestDeobfuscate(d, EncryptionAlgorithmAdobeFontObfuscation, "99d667669e474eef33dfa4add81338d2356aa458dd7b5d82f733d1fdf8d0039b")
+}
+
+// selfTestDeobfuscate de-obfuscates selfTestFont with alg, and compares the
+// SHA-256 of the result with wantHash.
+func selfTestDeobfuscate(d *decrypter, alg EncryptionAlgorithm, wantHash string) error {
+	font := selfTestFont()
+
+	res, err := d.decryptFile(bytes.NewReader(font), int64(len(font)), selfTestContentKeyBytes(), FileEntry{
+		Path:                "font.otf",
+		EncryptionAlgorithm: alg,
+	})
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(res)
+
+	return expectBytes("font hash", hash[:], mustDecodeHex(wantHash))
+}
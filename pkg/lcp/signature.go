@@ -0,0 +1,160 @@
+package lcp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// Signature algorithms of licenses.
+const (
+	SignatureAlgorithmRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	SignatureAlgorithmECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+// Certificate returns the certificate of the provider that signed the
+// license.
+func (l *License) Certificate() (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(l.Signature.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 digest of the
+// certificate of the provider that signed the license.
+func (l *License) CertificateFingerprint() (string, error) {
+	cert, err := l.Certificate()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(cert.Raw)
+
+	return hex.EncodeToString(h[:]), nil
+}
+
+// VerifySignature checks that the license was signed with the certificate it
+// holds, and was not modified since. If roots is not nil, the certificate
+// must also have been issued by one of roots (for example the EDRLab root
+// certificate for licenses issued by certified providers), and been valid
+// when the license was issued. Only licenses read with ParseLicense can be
+// verified.
+func (l *License) VerifySignature(roots *x509.CertPool) error {
+	if l.raw == nil {
+		return fmt.Errorf("the license was not read with ParseLicense")
+	}
+
+	cert, err := l.Certificate()
+	if err != nil {
+		return err
+	}
+
+	if roots != nil {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: l.Issued,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("error verifying certificate: %w", err)
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(l.Signature.Value)
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %w", err)
+	}
+
+	data, err := canonicalLicense(l.raw)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+
+	switch l.Signature.Algorithm {
+	case SignatureAlgorithmRSASHA256:
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the certificate does not hold an RSA key")
+		}
+
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+	case SignatureAlgorithmECDSASHA256:
+		key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the certificate does not hold an ECDSA key")
+		}
+
+		if !verifyECDSA(key, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm %s", l.Signature.Algorithm)
+	}
+
+	return nil
+}
+
+// verifyECDSA checks an ECDSA signature, either ASN.1 encoded or made of the
+// concatenated r and s values (as in XML signatures).
+func verifyECDSA(key *ecdsa.PublicKey, digest, signature []byte) bool {
+	if ecdsa.VerifyASN1(key, digest, signature) {
+		return true
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+
+	return ecdsa.Verify(key, digest, r, s)
+}
+
+// canonicalLicense returns the signed form of a license document: without
+// its signature, with the keys of all objects sorted and without any
+// whitespace.
+func canonicalLicense(raw []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var doc map[string]any
+
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding license: %w", err)
+	}
+
+	delete(doc, "signature")
+
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("error encoding license: %w", err)
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
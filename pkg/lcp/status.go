@@ -0,0 +1,50 @@
+package lcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// LicenseStatus is the status of a license, as described in
+// https://readium.org/lcp-specs/releases/lsd/latest.html
+type LicenseStatus string
+
+const (
+	LicenseStatusReady     LicenseStatus = "ready"
+	LicenseStatusActive    LicenseStatus = "active"
+	LicenseStatusRevoked   LicenseStatus = "revoked"
+	LicenseStatusReturned  LicenseStatus = "returned"
+	LicenseStatusCancelled LicenseStatus = "cancelled"
+	LicenseStatusExpired   LicenseStatus = "expired"
+)
+
+// IsUsable returns whether a license with this status can still be used.
+func (s LicenseStatus) IsUsable() bool {
+	return s == LicenseStatusReady || s == LicenseStatusActive
+}
+
+// StatusDocument is a License Status Document, fetched from the status link
+// of a license.
+type StatusDocument struct {
+	ID      string        `json:"id"`
+	Status  LicenseStatus `json:"status"`
+	Message string        `json:"message"`
+	Updated struct {
+		License time.Time `json:"license"`
+		Status  time.Time `json:"status"`
+	} `json:"updated"`
+	Links Links `json:"links"`
+}
+
+// ParseStatusDocument parses a License Status Document.
+func ParseStatusDocument(r io.Reader) (*StatusDocument, error) {
+	var doc StatusDocument
+
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding json: %w", err)
+	}
+
+	return &doc, nil
+}
@@ -0,0 +1,63 @@
+package lcp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultSpoolThreshold is the size up to which DecryptStream keeps the input
+// in memory.
+const DefaultSpoolThreshold = 32 << 20
+
+// WithSpoolThreshold sets the size up to which DecryptStream keeps the input in
+// memory. Larger inputs are spooled to a temporary file.
+func WithSpoolThreshold(size int64) DecryptOption {
+	return func(o *decryptOptions) {
+		o.SpoolThreshold = size
+	}
+}
+
+// DecryptStream is like Decrypt, for inputs that don't support random access
+// (HTTP response bodies, pipes...). Since zip files can only be read with
+// random access, the input is first read in memory, or in a temporary file if
+// it is larger than the spool threshold (see WithSpoolThreshold).
+func DecryptStream(out io.Writer, in io.Reader, userKeyHex string, opts ...DecryptOption) error {
+	o := decryptOptions{SpoolThreshold: DefaultSpoolThreshold}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.MaxMemory > 0 {
+		o.SpoolThreshold = min(o.SpoolThreshold, o.MaxMemory/4)
+	}
+
+	var buffer bytes.Buffer
+
+	// Read one byte more than the threshold to know if the input fits
+	n, err := buffer.ReadFrom(io.LimitReader(in, o.SpoolThreshold+1))
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+
+	if n <= o.SpoolThreshold {
+		return Decrypt(out, bytes.NewReader(buffer.Bytes()), n, userKeyHex, opts...)
+	}
+
+	spool, err := os.CreateTemp("", "lcp-decrypt-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, io.MultiReader(&buffer, in))
+	if err != nil {
+		return fmt.Errorf("error spooling input to temporary file: %w", err)
+	}
+
+	return Decrypt(out, spool, size, userKeyHex, opts...)
+}
@@ -0,0 +1,81 @@
+package lcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Timings breaks down the time spent by a decryption run, to tell whether
+// slowness comes from the cryptography, the compression or the output file.
+//
+// The per entry phases (Read to Write) are summed over all the entries, so
+// they can exceed Total when entries are processed concurrently (see
+// WithConcurrency). Entries decrypted through temporary files (see
+// WithMaxMemory) are processed as a stream: all their processing is counted
+// in Decrypt.
+type Timings struct {
+	Total time.Duration
+	// License is the time spent reading and parsing the licenses.
+	License time.Duration
+	// KeyUnwrap is the time spent checking the user key against the licenses
+	// and decrypting the content key.
+	KeyUnwrap time.Duration
+	// Read is the time spent reading the encrypted entries from the input
+	// file (including their decompression, for the ones stored compressed).
+	Read time.Duration
+	// Decrypt is the time spent deciphering the encrypted entries.
+	Decrypt time.Duration
+	// Inflate is the time spent decompressing the entries that were
+	// compressed before being encrypted.
+	Inflate time.Duration
+	// Compress is the time spent compressing the decrypted entries for the
+	// output file.
+	Compress time.Duration
+	// Write is the time spent writing the entries to the output file,
+	// including the ones copied as is.
+	Write time.Duration
+	// EncryptedBytes is the size of the encrypted entries, and
+	// DecryptedBytes the size of their decrypted (and decompressed)
+	// contents.
+	EncryptedBytes int64
+	DecryptedBytes int64
+}
+
+// phase identifies a step of the processing of the entries.
+type phase int
+
+const (
+	phaseRead phase = iota
+	phaseDecrypt
+	phaseInflate
+	phaseCompress
+	phaseWrite
+	phaseCount
+)
+
+// timings accumulates the time spent in each phase, from concurrent workers.
+type timings struct {
+	phases         [phaseCount]atomic.Int64
+	encryptedBytes atomic.Int64
+	decryptedBytes atomic.Int64
+}
+
+// since adds the time elapsed since start to the phase p, and returns the
+// current time, to chain phases.
+func (t *timings) since(p phase, start time.Time) time.Time {
+	now := time.Now()
+	t.phases[p].Add(int64(now.Sub(start)))
+
+	return now
+}
+
+// fill copies the timings of the entries to report.
+func (t *timings) fill(report *Timings) {
+	report.Read = time.Duration(t.phases[phaseRead].Load())
+	report.Decrypt = time.Duration(t.phases[phaseDecrypt].Load())
+	report.Inflate = time.Duration(t.phases[phaseInflate].Load())
+	report.Compress = time.Duration(t.phases[phaseCompress].Load())
+	report.Write = time.Duration(t.phases[phaseWrite].Load())
+	report.EncryptedBytes = t.encryptedBytes.Load()
+	report.DecryptedBytes = t.decryptedBytes.Load()
+}
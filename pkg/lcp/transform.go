@@ -0,0 +1,117 @@
+package lcp
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// TransformerFunc rewrites the contents of an entry of the output file, path
+// being its path in the archive, and returns the new contents.
+type TransformerFunc func(path string, data []byte) ([]byte, error)
+
+type transformer struct {
+	pattern string
+	fn      TransformerFunc
+}
+
+// matches returns true if the transformer applies to the entry name. Patterns
+// without a slash only look at the last element of the name, so that *.css
+// matches all the style sheets.
+func (t transformer) matches(name string) bool {
+	if !strings.Contains(t.pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, _ := path.Match(t.pattern, name)
+
+	return ok
+}
+
+// WithTransformer registers fn to rewrite the entries matching pattern before
+// they are written to the output file, for common fix-ups (custom CSS,
+// broken references...) that would otherwise require a second pass over the
+// output file. pattern uses the syntax of path.Match, and is matched against
+// the last element of the entry paths if it contains no slash.
+//
+// fn gets the decrypted contents of the entries, after the changes made by
+// Decrypt (license removal...). When several transformers match an entry,
+// they run in the order they were registered. The entries matching a
+// transformer are always processed in memory, regardless of WithMaxMemory,
+// and fn can be called concurrently when using WithConcurrency.
+// Transformers only apply to Decrypt, not to Resources or OpenFS.
+func WithTransformer(pattern string, fn TransformerFunc) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Transformers = append(o.Transformers, transformer{pattern: pattern, fn: fn})
+	}
+}
+
+// checkTransformers returns an error if the pattern of a transformer is
+// invalid.
+func checkTransformers(transformers []transformer) error {
+	for _, t := range transformers {
+		if _, err := path.Match(t.pattern, ""); err != nil {
+			return fmt.Errorf("invalid transformer pattern %q: %w", t.pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// transforms returns true if a transformer applies to the entry name.
+func (d *decrypter) transforms(name string) bool {
+	for _, t := range d.opts.Transformers {
+		if t.matches(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transform runs the transformers applying to the entry name on its
+// contents.
+func (d *decrypter) transform(name string, data []byte) ([]byte, error) {
+	for _, t := range d.opts.Transformers {
+		if !t.matches(name) {
+			continue
+		}
+
+		var err error
+
+		if data, err = t.fn(name, data); err != nil {
+			return nil, &skippableError{fmt.Errorf("error transforming file %s: %w", name, err)}
+		}
+	}
+
+	return data, nil
+}
+
+// prepareTransformedFile reads an entry copied from the input file, and
+// runs the transformers on it.
+func (d *decrypter) prepareTransformedFile(f *zip.File) (*preparedFile, error) {
+	fd, err := f.Open()
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error opening file %s from input zip file: %w", f.Name, err)}
+	}
+
+	defer fd.Close()
+
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error reading file %s from input zip file: %w", f.Name, err)}
+	}
+
+	if data, err = d.transform(f.Name, data); err != nil {
+		return nil, err
+	}
+
+	p, err := newPreparedFile(f, data)
+	if err != nil {
+		return nil, &skippableError{fmt.Errorf("error preparing file %s: %w", f.Name, err)}
+	}
+
+	return p, nil
+}
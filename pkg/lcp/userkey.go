@@ -0,0 +1,221 @@
+package lcp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+)
+
+// WithPassphrase makes Decrypt derive the user key from the user's
+// passphrase, as done by the LCP basic profile. The userKeyHex argument of
+// Decrypt must then be empty.
+func WithPassphrase(passphrase string) DecryptOption {
+	return func(o *decryptOptions) {
+		o.Passphrase = passphrase
+	}
+}
+
+// WithContentKey makes Decrypt decrypt the resources with contentKey, a
+// content key obtained by other means than a license (for example from a
+// store API). No license is read then, and the userKeyHex argument of Decrypt
+// must be empty.
+func WithContentKey(contentKey []byte) DecryptOption {
+	return func(o *decryptOptions) {
+		o.ContentKey = contentKey
+	}
+}
+
+// UserKeyFromPassphrase derives the user key from the user's passphrase, as
+// done by the LCP basic profile with the SHA-256 user key algorithm.
+func UserKeyFromPassphrase(passphrase string) []byte {
+	h := sha256.Sum256([]byte(passphrase))
+	return h[:]
+}
+
+// UserKeyAlgorithmSHA256 is the user key algorithm (encryption.user_key.algorithm
+// of licenses) hashing the passphrase with SHA-256, the only one defined by
+// the LCP specification.
+const UserKeyAlgorithmSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+
+// ErrUnsupportedUserKeyAlgorithm is returned (wrapped) by Decrypt when the
+// user key can't be derived from the passphrase because the license uses an
+// unknown user key algorithm.
+var ErrUnsupportedUserKeyAlgorithm = errors.New("unsupported user key algorithm")
+
+// userKeyAlgorithms are the functions hashing the passphrase for each user
+// key algorithm, by lower cased name. Licenses that don't declare one use
+// SHA-256, and some name it without the URI.
+var userKeyAlgorithms = map[string]func(passphrase string) []byte{
+	"":                     UserKeyFromPassphrase,
+	UserKeyAlgorithmSHA256: UserKeyFromPassphrase,
+	"sha256":               UserKeyFromPassphrase,
+	"sha-256":              UserKeyFromPassphrase,
+}
+
+// CheckUserKeyAlgorithm returns an error wrapping
+// ErrUnsupportedUserKeyAlgorithm if the user key of the license can't be
+// derived from a passphrase because of its user key algorithm. The user key
+// itself works whatever the algorithm.
+func (l *License) CheckUserKeyAlgorithm() error {
+	if _, ok := userKeyAlgorithms[strings.ToLower(l.Encryption.UserKey.Algorithm)]; ok {
+		return nil
+	}
+
+	alg := l.Encryption.UserKey.Algorithm
+
+	return newError(MsgUnsupportedUserKeyAlgorithm, fmt.Errorf("%w %s: the user key can't be derived from the passphrase, pass the user key instead", ErrUnsupportedUserKeyAlgorithm, alg), alg)
+}
+
+// passphraseHash hashes passphrase with the user key algorithm of the license,
+// giving the user key of the basic profile.
+func (l *License) passphraseHash(passphrase string) ([]byte, error) {
+	hash, ok := userKeyAlgorithms[strings.ToLower(l.Encryption.UserKey.Algorithm)]
+	if !ok {
+		return nil, l.CheckUserKeyAlgorithm()
+	}
+
+	return hash(passphrase), nil
+}
+
+// userKeyFunc returns the function computing the user key to use for
+// decrypting the content key of a license.
+func (o *decryptOptions) userKeyFunc(userKeyHex string) (func(l *License) ([]byte, error), error) {
+	switch {
+	case userKeyHex != "" && o.Passphrase != "":
+		return nil, fmt.Errorf("both a user key and a passphrase were specified")
+	case o.Passphrase != "":
+		// The derivation depends on the profile of each license
+		return o.passphraseUserKey, nil
+	case userKeyHex == "":
+		return nil, newError(MsgUserKeyMissing, errors.New("user key not specified"))
+	}
+
+	userKey, err := hex.DecodeString(userKeyHex)
+	if err != nil {
+		return nil, newError(MsgInvalidUserKey, fmt.Errorf("error decoding user key: %w", err))
+	}
+
+	if len(userKey) != 32 {
+		return nil, newError(MsgInvalidUserKey, fmt.Errorf("invalid user key length %d (expected 32 bytes)", len(userKey)))
+	}
+
+	return func(*License) ([]byte, error) { return userKey, nil }, nil
+}
+
+// readContentKey sets the key to use for decrypting the resources of the
+// publication in root.
+func (d *decrypter) readContentKey(root fs.FS, userKeyHex string) error {
+	o := &d.opts
+
+	if o.ContentKey != nil {
+		if len(o.AllowedProviders) > 0 {
+			return fmt.Errorf("a content key cannot be used along with allowed providers, the provider can only be checked in a license")
+		}
+
+		if userKeyHex != "" || o.Passphrase != "" {
+			return fmt.Errorf("a content key cannot be used along with a user key or a passphrase")
+		}
+
+		if len(o.ContentKey) != 32 {
+			return fmt.Errorf("invalid content key length %d (expected 32 bytes)", len(o.ContentKey))
+		}
+
+		d.contentKey = o.ContentKey
+
+		return nil
+	}
+
+	userKey, err := o.userKeyFunc(userKeyHex)
+	if err != nil {
+		return err
+	}
+
+	var (
+		license *License
+		start   = time.Now()
+		parsed  time.Time
+	)
+
+	if o.License != nil || o.ExternalLicense != nil {
+		switch {
+		case o.License != nil:
+			license = o.License
+
+			if o.StrictLicense {
+				if err := license.Validate(); err != nil {
+					return fmt.Errorf("error reading license: %w", err)
+				}
+			}
+		default:
+			if license, err = ParseLicense(o.ExternalLicense, d.licenseParseOptions("")...); err != nil {
+				return fmt.Errorf("error reading license: %w", err)
+			}
+		}
+
+		parsed = time.Now()
+		d.addPII(license)
+
+		if _, err := o.filterAllowedLicenses([]*License{license}); err != nil {
+			return err
+		}
+
+		if o.Passphrase != "" {
+			if _, err := o.passphraseLicenses([]*License{license}); err != nil {
+				return err
+			}
+		}
+	} else {
+		locators := slices.Concat(licenseLocators(), o.LicenseLocators)
+
+		licenses, paths, err := readLicenses(root, locators, d.licenseParseOptions, func(path, msg string) {
+			d.warn(WarningLicense, path, msg)
+		})
+		if err != nil {
+			return fmt.Errorf("error reading license: %w", err)
+		}
+
+		parsed = time.Now()
+		d.licensePaths = paths
+		d.addPII(licenses...)
+
+		if licenses, err = o.filterAllowedLicenses(licenses); err != nil {
+			return err
+		}
+
+		if o.Passphrase != "" {
+			if licenses, err = o.passphraseLicenses(licenses); err != nil {
+				return err
+			}
+		}
+
+		if license, err = selectLicense(licenses, o.LicenseID, userKey); err != nil {
+			return err
+		}
+	}
+
+	key, err := userKey(license)
+	if err != nil {
+		return err
+	}
+
+	if o.Passphrase != "" && len(o.PassphraseVariants) > 0 {
+		if _, variant, _ := o.passphraseVariantUserKey(license); variant.Name != PassphraseAsTyped.Name {
+			d.report.PassphraseVariant = variant.Name
+			d.log("The passphrase matched once normalized (" + variant.Name + ")")
+		}
+	}
+
+	if d.contentKey, err = license.contentKey(key); err != nil {
+		return fmt.Errorf("error getting content key: %w", err)
+	}
+
+	d.report.Timings.License = parsed.Sub(start)
+	d.report.Timings.KeyUnwrap = time.Since(parsed)
+
+	return nil
+}
@@ -0,0 +1,384 @@
+package lcp
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// preparedFile is an entry of the output file, ready to be written: either
+// its raw (possibly compressed) data, or the input entry it is copied from
+// without being decompressed.
+type preparedFile struct {
+	// index is the position of the entry in the output file's central
+	// directory.
+	index    int
+	header   zip.FileHeader
+	data     []byte
+	copyFrom *zip.File
+	// spool, if not nil, is the temporary file holding the raw data of the
+	// entry, for entries too large to be held in memory.
+	spool *os.File
+}
+
+const (
+	flagDataDescriptor = 0x8
+	flagUTF8           = 0x800
+)
+
+// newPreparedFile returns the prepared entry holding data for the input entry
+// f, compressed if it is worth it.
+func newPreparedFile(f *zip.File, data []byte) (*preparedFile, error) {
+	p := &preparedFile{
+		header: outputHeader(f, compressionMethod(f.Name, data), crc32.ChecksumIEEE(data), int64(len(data))),
+		data:   data,
+	}
+
+	if p.header.Method == zip.Deflate {
+		var buf bytes.Buffer
+
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := fw.Write(data); err != nil {
+			return nil, fmt.Errorf("error compressing data: %w", err)
+		}
+
+		if err := fw.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing data: %w", err)
+		}
+
+		p.data = buf.Bytes()
+	}
+
+	p.header.CompressedSize64 = uint64(len(p.data))
+
+	return p, nil
+}
+
+// outputHeader returns the header of the output entry holding the decrypted
+// contents of the input entry f.
+func outputHeader(f *zip.File, method uint16, crc uint32, size int64) zip.FileHeader {
+	return zip.FileHeader{
+		Name:               f.Name,
+		CreatorVersion:     zipVersion20,
+		Flags:              f.Flags & flagUTF8,
+		Method:             method,
+		Modified:           f.Modified,
+		ModifiedTime:       f.ModifiedTime,
+		ModifiedDate:       f.ModifiedDate,
+		CRC32:              crc,
+		UncompressedSize64: uint64(size),
+	}
+}
+
+// copiedFile returns the prepared entry copying f as is.
+func copiedFile(f *zip.File) *preparedFile {
+	return &preparedFile{header: f.FileHeader, copyFrom: f}
+}
+
+// directoryFile returns the prepared entry for the directory entry f, keeping
+// its modification time and attributes.
+func directoryFile(f *zip.File) *preparedFile {
+	return &preparedFile{header: zip.FileHeader{
+		Name:           f.Name,
+		Comment:        f.Comment,
+		Flags:          f.Flags & flagUTF8,
+		Method:         zip.Store,
+		Modified:       f.Modified,
+		ModifiedTime:   f.ModifiedTime,
+		ModifiedDate:   f.ModifiedDate,
+		CreatorVersion: f.CreatorVersion,
+		ExternalAttrs:  f.ExternalAttrs,
+	}}
+}
+
+// writeData writes the raw data of the entry to w, and returns the number of
+// bytes written.
+func (p *preparedFile) writeData(w io.Writer) (int64, error) {
+	if p.spool != nil {
+		return io.Copy(w, io.NewSectionReader(p.spool, 0, int64(p.header.CompressedSize64)))
+	}
+
+	if p.copyFrom == nil {
+		n, err := w.Write(p.data)
+		return int64(n), err
+	}
+
+	src, err := p.copyFrom.OpenRaw()
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+
+	return io.Copy(w, src)
+}
+
+// release removes the temporary file of a spooled entry, once it is written.
+func (p *preparedFile) release() {
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+	}
+}
+
+// entryWriter writes prepared entries to the output file.
+type entryWriter interface {
+	writeEntry(p *preparedFile) error
+	close(comment string) error
+}
+
+// serialWriter writes the entries one after the other, in the order they are
+// passed to writeEntry.
+type serialWriter struct {
+	zw *zip.Writer
+}
+
+func (w *serialWriter) writeEntry(p *preparedFile) error {
+	header := p.header
+
+	dst, err := w.zw.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("error appending file %s to output zip file: %w", header.Name, err)
+	}
+
+	if _, err := p.writeData(dst); err != nil {
+		return fmt.Errorf("error copying data for file %s to output zip file: %w", header.Name, err)
+	}
+
+	return nil
+}
+
+func (w *serialWriter) close(comment string) error {
+	if err := w.zw.SetComment(comment); err != nil {
+		return err
+	}
+
+	return w.zw.Close()
+}
+
+// parallelWriter lets several goroutines write entries at the same time: each
+// entry reserves the region it needs at the end of the file, and the central
+// directory gets written once all the entries are done. Entries are listed in
+// the central directory by index, whatever order they were written in.
+type parallelWriter struct {
+	out io.WriterAt
+
+	mu      sync.Mutex
+	offset  int64
+	entries []writtenEntry
+}
+
+type writtenEntry struct {
+	index  int
+	header zip.FileHeader
+	offset int64
+}
+
+const (
+	uint16max = 0xffff
+	uint32max = 0xffffffff
+
+	zipVersion20 = 20
+	zipVersion45 = 45 // zip64
+
+	zip64ExtraID = 0x0001
+)
+
+func (w *parallelWriter) writeEntry(p *preparedFile) error {
+	header := p.header
+	header.Flags &^= flagDataDescriptor // sizes are known upfront
+
+	header.Extra = withoutZip64Extra(header.Extra)
+	local := localFileHeader(&header)
+
+	w.mu.Lock()
+	offset := w.offset
+	w.offset += int64(len(local)) + int64(header.CompressedSize64)
+	w.entries = append(w.entries, writtenEntry{index: p.index, header: header, offset: offset})
+	w.mu.Unlock()
+
+	if _, err := w.out.WriteAt(local, offset); err != nil {
+		return fmt.Errorf("error appending file %s to output zip file: %w", header.Name, err)
+	}
+
+	n, err := p.writeData(io.NewOffsetWriter(w.out, offset+int64(len(local))))
+	if err == nil && n != int64(header.CompressedSize64) {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, header.CompressedSize64)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error copying data for file %s to output zip file: %w", header.Name, err)
+	}
+
+	return nil
+}
+
+func (w *parallelWriter) close(comment string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	slices.SortFunc(w.entries, func(a, b writtenEntry) int { return a.index - b.index })
+
+	var dir bytes.Buffer
+
+	for _, e := range w.entries {
+		dir.Write(centralDirectoryHeader(&e.header, e.offset))
+	}
+
+	dir.Write(endOfCentralDirectory(len(w.entries), int64(dir.Len()), w.offset, comment))
+
+	_, err := w.out.WriteAt(dir.Bytes(), w.offset)
+
+	return err
+}
+
+func needsZip64(h *zip.FileHeader) bool {
+	return h.CompressedSize64 >= uint32max || h.UncompressedSize64 >= uint32max
+}
+
+func localFileHeader(h *zip.FileHeader) []byte {
+	version := uint16(zipVersion20)
+	compressedSize, uncompressedSize := uint32(h.CompressedSize64), uint32(h.UncompressedSize64)
+	extra := h.Extra
+
+	if needsZip64(h) {
+		version = zipVersion45
+		compressedSize, uncompressedSize = uint32max, uint32max
+		extra = slices.Concat(zip64Extra(h.UncompressedSize64, h.CompressedSize64), extra)
+	}
+
+	b := binary.LittleEndian.AppendUint32(nil, 0x04034b50)
+	b = binary.LittleEndian.AppendUint16(b, version)
+	b = binary.LittleEndian.AppendUint16(b, h.Flags)
+	b = binary.LittleEndian.AppendUint16(b, h.Method)
+	b = binary.LittleEndian.AppendUint16(b, h.ModifiedTime)
+	b = binary.LittleEndian.AppendUint16(b, h.ModifiedDate)
+	b = binary.LittleEndian.AppendUint32(b, h.CRC32)
+	b = binary.LittleEndian.AppendUint32(b, compressedSize)
+	b = binary.LittleEndian.AppendUint32(b, uncompressedSize)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(h.Name)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+	b = append(b, h.Name...)
+
+	return append(b, extra...)
+}
+
+func centralDirectoryHeader(h *zip.FileHeader, offset int64) []byte {
+	version := uint16(zipVersion20)
+	compressedSize, uncompressedSize := uint32(h.CompressedSize64), uint32(h.UncompressedSize64)
+	localOffset := uint32(offset)
+	extra := h.Extra
+
+	if needsZip64(h) || offset >= uint32max {
+		version = zipVersion45
+		compressedSize, uncompressedSize, localOffset = uint32max, uint32max, uint32max
+		extra = slices.Concat(zip64Extra(h.UncompressedSize64, h.CompressedSize64, uint64(offset)), extra)
+	}
+
+	creatorVersion := h.CreatorVersion&0xff00 | version
+
+	b := binary.LittleEndian.AppendUint32(nil, 0x02014b50)
+	b = binary.LittleEndian.AppendUint16(b, creatorVersion)
+	b = binary.LittleEndian.AppendUint16(b, version)
+	b = binary.LittleEndian.AppendUint16(b, h.Flags)
+	b = binary.LittleEndian.AppendUint16(b, h.Method)
+	b = binary.LittleEndian.AppendUint16(b, h.ModifiedTime)
+	b = binary.LittleEndian.AppendUint16(b, h.ModifiedDate)
+	b = binary.LittleEndian.AppendUint32(b, h.CRC32)
+	b = binary.LittleEndian.AppendUint32(b, compressedSize)
+	b = binary.LittleEndian.AppendUint32(b, uncompressedSize)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(h.Name)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(extra)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(h.Comment)))
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk number
+	b = binary.LittleEndian.AppendUint16(b, 0) // internal attributes
+	b = binary.LittleEndian.AppendUint32(b, h.ExternalAttrs)
+	b = binary.LittleEndian.AppendUint32(b, localOffset)
+	b = append(b, h.Name...)
+	b = append(b, extra...)
+
+	return append(b, h.Comment...)
+}
+
+// endOfCentralDirectory returns the end of central directory record, preceded
+// by the zip64 ones if needed.
+func endOfCentralDirectory(count int, size, offset int64, comment string) []byte {
+	var b []byte
+
+	records, dirSize, dirOffset := uint16(count), uint32(size), uint32(offset)
+
+	if count >= uint16max || size >= uint32max || offset >= uint32max {
+		records, dirSize, dirOffset = uint16max, uint32max, uint32max
+
+		b = binary.LittleEndian.AppendUint32(b, 0x06064b50)
+		b = binary.LittleEndian.AppendUint64(b, 44) // size of the rest of the record
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)
+		b = binary.LittleEndian.AppendUint16(b, zipVersion45)
+		b = binary.LittleEndian.AppendUint32(b, 0) // disk number
+		b = binary.LittleEndian.AppendUint32(b, 0) // disk with the central directory
+		b = binary.LittleEndian.AppendUint64(b, uint64(count))
+		b = binary.LittleEndian.AppendUint64(b, uint64(count))
+		b = binary.LittleEndian.AppendUint64(b, uint64(size))
+		b = binary.LittleEndian.AppendUint64(b, uint64(offset))
+
+		// zip64 end of central directory locator
+		b = binary.LittleEndian.AppendUint32(b, 0x07064b50)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, uint64(offset+size))
+		b = binary.LittleEndian.AppendUint32(b, 1) // number of disks
+	}
+
+	b = binary.LittleEndian.AppendUint32(b, 0x06054b50)
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk number
+	b = binary.LittleEndian.AppendUint16(b, 0) // disk with the central directory
+	b = binary.LittleEndian.AppendUint16(b, records)
+	b = binary.LittleEndian.AppendUint16(b, records)
+	b = binary.LittleEndian.AppendUint32(b, dirSize)
+	b = binary.LittleEndian.AppendUint32(b, dirOffset)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(comment)))
+
+	return append(b, comment...)
+}
+
+func zip64Extra(values ...uint64) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, zip64ExtraID)
+	b = binary.LittleEndian.AppendUint16(b, uint16(8*len(values)))
+
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+
+	return b
+}
+
+// withoutZip64Extra removes the zip64 extra field copied from the input file,
+// the writer adds its own when needed.
+func withoutZip64Extra(extra []byte) []byte {
+	var res []byte
+
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:])) + 4
+
+		if size > len(extra) {
+			break
+		}
+
+		if id != zip64ExtraID {
+			res = append(res, extra[:size]...)
+		}
+
+		extra = extra[size:]
+	}
+
+	return res
+}
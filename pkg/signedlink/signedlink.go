@@ -0,0 +1,111 @@
+// Package signedlink handles the store responses made of a signed link to a
+// protected publication and the hex encoded content key of that publication.
+// Some providers (Bookbites...) use them instead of shipping LCP licenses.
+package signedlink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+)
+
+// Response is a store response pointing to a protected publication.
+type Response struct {
+	SignedLink string `json:"signed_link"`
+	Key        string `json:"key"`
+}
+
+// ParseResponse decodes a store response.
+func ParseResponse(r io.Reader) (*Response, error) {
+	var res Response
+
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error decoding json: %w", err)
+	}
+
+	switch {
+	case res.SignedLink == "":
+		return nil, errors.New("response has no signed_link")
+	case res.Key == "":
+		return nil, errors.New("response has no key")
+	}
+
+	return &res, nil
+}
+
+// ContentKey returns the decoded content key of the publication.
+func (r *Response) ContentKey() ([]byte, error) {
+	key, err := hex.DecodeString(r.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding content key: %w", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid content key length %d (expected 32 bytes)", len(key))
+	}
+
+	return key, nil
+}
+
+// Download writes the protected publication to w.
+func (r *Response) Download(ctx context.Context, client *http.Client, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.SignedLink, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d while downloading publication", res.StatusCode)
+	}
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("error downloading publication: %w", err)
+	}
+
+	return nil
+}
+
+// FetchAndDecrypt downloads the publication r points to, and writes its
+// decrypted version to out. The publication is stored in a temporary file
+// while it gets decrypted.
+func FetchAndDecrypt(ctx context.Context, client *http.Client, r *Response, out io.Writer, opts ...lcp.DecryptOption) error {
+	contentKey, err := r.ContentKey()
+	if err != nil {
+		return err
+	}
+
+	tmpFd, err := os.CreateTemp("", "lcp-decrypt-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+
+	defer os.Remove(tmpFd.Name())
+	defer tmpFd.Close()
+
+	if err := r.Download(ctx, client, tmpFd); err != nil {
+		return err
+	}
+
+	size, err := tmpFd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("error getting publication size: %w", err)
+	}
+
+	opts = append(opts, lcp.WithContentKey(contentKey), lcp.WithContext(ctx))
+
+	return lcp.Decrypt(out, tmpFd, size, "", opts...)
+}
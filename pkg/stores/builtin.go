@@ -0,0 +1,72 @@
+package stores
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/abustany/lcp-decrypt/pkg/lcp"
+	"github.com/abustany/lcp-decrypt/pkg/signedlink"
+)
+
+func init() {
+	Register(&Adapter{
+		Name:             "lcp",
+		Description:      "stores serving standard LCP licenses, with a link to the publication",
+		ParseFulfillment: parseLicenseFulfillment,
+	})
+
+	Register(&Adapter{
+		Name:             "bookbites",
+		Description:      "Bookbites, and other stores returning a signed_link to the publication along with its content key",
+		ParseFulfillment: parseSignedLinkFulfillment,
+	})
+}
+
+// parseLicenseFulfillment handles the standard LCP acquisition flow, where
+// the license links to the publication.
+func parseLicenseFulfillment(data []byte) (*Fulfillment, error) {
+	var probe struct {
+		ID         string `json:"id"`
+		Encryption *struct {
+			Profile string `json:"profile"`
+		} `json:"encryption"`
+	}
+
+	if json.Unmarshal(data, &probe) != nil || probe.ID == "" || probe.Encryption == nil {
+		return nil, ErrNotRecognized
+	}
+
+	license, err := lcp.ParseLicense(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := license.Links.Link(lcp.LinkRelPublication); ok {
+		return &Fulfillment{URL: l.Href, License: data}, nil
+	}
+
+	return nil, fmt.Errorf("license %s has no publication link", license.ID)
+}
+
+func parseSignedLinkFulfillment(data []byte) (*Fulfillment, error) {
+	var probe struct {
+		SignedLink *string `json:"signed_link"`
+	}
+
+	if json.Unmarshal(data, &probe) != nil || probe.SignedLink == nil {
+		return nil, ErrNotRecognized
+	}
+
+	res, err := signedlink.ParseResponse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	contentKey, err := res.ContentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fulfillment{URL: res.SignedLink, ContentKey: contentKey}, nil
+}
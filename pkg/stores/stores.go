@@ -0,0 +1,236 @@
+// Package stores holds the adapters describing the quirks of the stores and
+// libraries distributing LCP protected publications: the format of the
+// responses of their APIs, of their key endpoints... Supporting a store that
+// does things slightly differently only requires registering a new adapter.
+package stores
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecognized is returned by the ParseFulfillment function of an adapter
+// when a response does not come from its store.
+var ErrNotRecognized = errors.New("response not recognized")
+
+// Fulfillment is what a store response gives access to: the protected
+// publication, and the means to decrypt it.
+type Fulfillment struct {
+	// URL is the location of the protected publication.
+	URL string
+	// License is the license of the publication, nil if the store does not
+	// ship licenses.
+	License []byte
+	// ContentKey is the content key of the publication, for stores that
+	// don't ship licenses.
+	ContentKey []byte
+}
+
+// Adapter describes the quirks of a store.
+type Adapter struct {
+	// Name identifies the adapter, for example on the command line.
+	Name        string
+	Description string
+	// Providers lists the provider URIs of the licenses issued by the store.
+	Providers []string
+	// ParseFulfillment extracts the fulfillment information from a response
+	// of the store (license document, wrapper JSON document...). It returns
+	// ErrNotRecognized if the response does not come from the store. Nil if
+	// the store has no such responses.
+	ParseFulfillment func(data []byte) (*Fulfillment, error)
+	// ParseUserKeys extracts the hex encoded user keys from a response of the
+	// key endpoint of the store. Nil if the store uses the format handled by
+	// ParseUserKeys.
+	ParseUserKeys func(data []byte) ([]string, error)
+}
+
+// UserKeys extracts the hex encoded user keys from a response of the key
+// endpoint of the store.
+func (a *Adapter) UserKeys(data []byte) ([]string, error) {
+	if a.ParseUserKeys != nil {
+		return a.ParseUserKeys(data)
+	}
+
+	return ParseUserKeys(data)
+}
+
+var (
+	mu       sync.RWMutex
+	adapters []*Adapter
+)
+
+// Register makes an adapter available. It panics if an adapter with the same
+// name is already registered.
+func Register(a *Adapter) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if a.Name == "" {
+		panic("stores: adapter has no name")
+	}
+
+	if slices.ContainsFunc(adapters, func(other *Adapter) bool { return other.Name == a.Name }) {
+		panic("stores: adapter " + a.Name + " registered twice")
+	}
+
+	adapters = append(adapters, a)
+}
+
+// All returns the registered adapters, in registration order.
+func All() []*Adapter {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return slices.Clone(adapters)
+}
+
+// Lookup returns the adapter with the given name.
+func Lookup(name string) (*Adapter, bool) {
+	for _, a := range All() {
+		if a.Name == name {
+			return a, true
+		}
+	}
+
+	return nil, false
+}
+
+// ForProvider returns the adapter of the store issuing the licenses of
+// provider.
+func ForProvider(provider string) (*Adapter, bool) {
+	provider = strings.TrimSuffix(provider, "/")
+
+	for _, a := range All() {
+		if slices.ContainsFunc(a.Providers, func(p string) bool { return strings.TrimSuffix(p, "/") == provider }) {
+			return a, true
+		}
+	}
+
+	return nil, false
+}
+
+// DetectFulfillment tries the adapters in registration order to parse a
+// store response, and returns the first one recognizing it along with the
+// fulfillment information.
+func DetectFulfillment(data []byte) (*Adapter, *Fulfillment, error) {
+	for _, a := range All() {
+		if a.ParseFulfillment == nil {
+			continue
+		}
+
+		fulfillment, err := a.ParseFulfillment(data)
+		if errors.Is(err, ErrNotRecognized) {
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s response: %w", a.Name, err)
+		}
+
+		return a, fulfillment, nil
+	}
+
+	return nil, nil, errors.New("the response does not come from any known store")
+}
+
+// ParseUserKeys returns the user keys found in a key endpoint response, which
+// is either a single object or an array of objects with a user_key field:
+//
+//	[{"user_key": "0123..."}]
+func ParseUserKeys(data []byte) ([]string, error) {
+	type keyObject struct {
+		UserKey string `json:"user_key"`
+	}
+
+	var objects []keyObject
+
+	if err := json.Unmarshal(data, &objects); err != nil {
+		var object keyObject
+
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %w", err)
+		}
+
+		objects = []keyObject{object}
+	}
+
+	var keys []string
+
+	for _, o := range objects {
+		if o.UserKey != "" {
+			keys = append(keys, o.UserKey)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no user_key field found")
+	}
+
+	return keys, nil
+}
+
+// FindUserKeys returns the user keys found anywhere in a JSON document: the
+// hex encoded keys held by the fields named user_key, userKey or key, at any
+// depth. It handles the responses of the store APIs that don't use the format
+// of ParseUserKeys, such as
+//
+//	{"result": {"key": "0123..."}}
+func FindUserKeys(data []byte) ([]string, error) {
+	var doc any
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error decoding JSON: %w", err)
+	}
+
+	var keys []string
+
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			names := make([]string, 0, len(v))
+			for name := range v {
+				names = append(names, name)
+			}
+
+			slices.Sort(names)
+
+			for _, name := range names {
+				if s, ok := v[name].(string); ok && isKeyField(name) && isHexKey(s) && !slices.Contains(keys, s) {
+					keys = append(keys, s)
+				}
+
+				walk(v[name])
+			}
+		}
+	}
+
+	walk(doc)
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no user key found")
+	}
+
+	return keys, nil
+}
+
+// isKeyField returns true if name is the name of a field holding a user key.
+func isKeyField(name string) bool {
+	name = strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+	return name == "userkey" || name == "key"
+}
+
+// isHexKey returns true if s is a hex encoded 256 bit key.
+func isHexKey(s string) bool {
+	key, err := hex.DecodeString(s)
+	return err == nil && len(key) == 32
+}
@@ -0,0 +1,19 @@
+//go:build !wasm
+
+package main
+
+import "unsafe"
+
+// hostWriteChunk only exists when running in a WebAssembly host, this
+// definition lets the package build (and be vetted) on other platforms.
+func hostWriteChunk(ptr unsafe.Pointer, size int32) {
+	panic("no WebAssembly host")
+}
+
+func hostReportError(ptr unsafe.Pointer, size int32) {
+	panic("no WebAssembly host")
+}
+
+func hostFetch(ptr unsafe.Pointer, size int32) *byte {
+	panic("no WebAssembly host")
+}
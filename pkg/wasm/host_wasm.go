@@ -0,0 +1,27 @@
+package main
+
+import "unsafe"
+
+// hostWriteChunk is provided by the host as lcp.writeChunk, and receives the
+// decrypted archive chunk by chunk. The chunk is only valid during the call,
+// the host must copy it (or write it somewhere) before returning.
+//
+//go:wasmimport lcp writeChunk
+func hostWriteChunk(ptr unsafe.Pointer, size int32)
+
+// hostReportError is provided by the host as lcp.reportError, and receives
+// the message of the error a call is about to fail with, in the language set
+// with setLocale, for displaying it to the user.
+//
+//go:wasmimport lcp reportError
+func hostReportError(ptr unsafe.Pointer, size int32)
+
+// hostFetch is provided by the host as lcp.fetch, and downloads the URL of
+// size bytes at ptr. The host stores the response body in a slice allocated
+// with newBytes, and returns its handle, or 0 if the download failed. As
+// downloading is asynchronous, the host must provide the function through
+// WebAssembly.Suspending, and call the exports using it through
+// WebAssembly.promising (JavaScript Promise Integration).
+//
+//go:wasmimport lcp fetch
+func hostFetch(ptr unsafe.Pointer, size int32) *byte
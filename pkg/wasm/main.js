@@ -1,8 +1,75 @@
+/**
+ * Receives the chunks of the decrypted archive passed to lcp.writeChunk by
+ * decryptStream.
+ *
+ * @type {((chunk: Uint8Array) => void) | null}
+ */
+let chunkSink = null;
+
+/**
+ * The message of the last error reported by the module through
+ * lcp.reportError, in the language of the user.
+ *
+ * @type {string | null}
+ */
+let lastError = null;
+
+/**
+ * Whether the browser supports JavaScript Promise Integration, which
+ * decryptLicensed needs to download files from the module.
+ */
+const canFetch = "Suspending" in WebAssembly && "promising" in WebAssembly;
+
 async function getLCP(go) {
   const WASM_URL = "lcp.wasm";
 
   let instance;
 
+  /**
+   * Downloads a URL for the module, and returns the handle of the response
+   * body, or 0 on error. The server must allow cross-origin requests.
+   *
+   * @param {number} ptr
+   * @param {number} size
+   * @returns {Promise<number>}
+   */
+  const fetchForModule = async (ptr, size) => {
+    // Read the URL before awaiting, the memory may grow meanwhile
+    const url = new TextDecoder().decode(
+      new Uint8Array(instance.exports.memory.buffer, ptr, size),
+    );
+
+    try {
+      const res = await fetch(url);
+      if (!res.ok) throw new Error(`unexpected status code: ${res.status}`);
+      return newGoBytes(instance, new Uint8Array(await res.arrayBuffer()));
+    } catch (error) {
+      console.error(`error fetching ${url}`, error);
+      return 0;
+    }
+  };
+
+  go.importObject.lcp = {
+    writeChunk: (ptr, size) => {
+      if (!chunkSink) throw new Error("unexpected chunk");
+      // The chunk is only valid during the call, and the memory buffer may
+      // change if the memory grows: read it now.
+      chunkSink(new Uint8Array(instance.exports.memory.buffer, ptr, size));
+    },
+    reportError: (ptr, size) => {
+      lastError = new TextDecoder().decode(
+        new Uint8Array(instance.exports.memory.buffer, ptr, size),
+      );
+    },
+    fetch: canFetch
+      ? new WebAssembly.Suspending(fetchForModule)
+      : () => {
+          throw new Error(
+            "this browser can't download files from WebAssembly",
+          );
+        },
+  };
+
   if ("instantiateStreaming" in WebAssembly) {
     instance = (
       await WebAssembly.instantiateStreaming(fetch(WASM_URL), go.importObject)
@@ -30,71 +97,267 @@ function newGoString(lcp, s) {
   return newGoBytes(lcp, data);
 }
 
+/**
+ * Returns a view of the bytes of a Go handle, directly into the module
+ * memory. The view is only valid until the next call into the module, which
+ * may grow (and so detach) its memory.
+ *
+ * @param {WebAssembly.Instance} lcp
+ * @param {number} ptr
+ * @returns {Uint8Array}
+ */
+function goBytesView(lcp, ptr) {
+  const { memory, bytesSize } = lcp.exports;
+  return new Uint8Array(memory.buffer, ptr, bytesSize(ptr));
+}
+
 /**
  * @param {WebAssembly.Instance} lcp
  * @param {Uint8Array} data
  * @returns {number} The memory address
  */
 function newGoBytes(lcp, data) {
-  const { newBytes } = lcp.exports;
-  const addr = newBytes(data.length);
-  // Read *after* calling newBytes
-  const u8mem = new Uint8Array(lcp.exports.memory.buffer);
-
-  for (let i = 0; i < data.length; ++i) u8mem[addr + i] = data[i];
+  const addr = lcp.exports.newBytes(data.length);
+  if (addr) goBytesView(lcp, addr).set(data);
 
   return addr;
 }
 
 /**
+ * Copies a file into the module memory, reading it chunk by chunk directly
+ * into place so that it is never held as a whole outside of the module.
+ *
  * @param {WebAssembly.Instance} lcp
- * @param {number} ptr
- * @returns {Uint8Array | null}
+ * @param {File} file
+ * @param {AbortSignal} signal
+ * @returns {Promise<number>} The memory address
  */
-function bytesFromGo(lcp, ptr) {
-  const { memory, bytesSize } = lcp.exports;
-  const size = bytesSize(ptr);
-  if (!size) return null;
+async function newGoBytesFromFile(lcp, file, signal) {
+  const addr = lcp.exports.newBytes(file.size);
+  const reader = file.stream().getReader();
+  let offset = 0;
+
+  for (;;) {
+    if (signal.aborted) {
+      await reader.cancel();
+      lcp.exports.freeBytes(addr);
+      throw cancelledError();
+    }
+
+    const { done, value } = await reader.read();
+    if (done) break;
+    // No call into the module happens while reading, so the view stays valid
+    // between chunks, it is recreated anyway to keep the rule simple.
+    goBytesView(lcp, addr).set(value, offset);
+    offset += value.length;
+  }
+
+  return addr;
+}
+
+/**
+ * Opens the file where the decrypted book is saved, if the browser supports
+ * the File System Access API.
+ *
+ * @param {string} name
+ * @returns {Promise<FileSystemWritableFileStream | null>}
+ */
+async function openOutputStream(name) {
+  if (!("showSaveFilePicker" in window)) return null;
 
-  return new Uint8Array(memory.buffer).subarray(ptr, ptr + size);
+  const handle = await window.showSaveFilePicker({ suggestedName: name });
+  return handle.createWritable();
+}
+
+function cancelledError() {
+  return new DOMException("Decryption cancelled", "AbortError");
 }
 
 /**
+ * Decrypts a book, streaming the decrypted archive to the disk as it is
+ * produced when possible, so that it never has to be held in the module
+ * memory. The decryption stops early when signal is aborted, or when writing
+ * to the disk fails.
+ *
  * @param {WebAssembly.Instance} lcp
  * @param {File} file
  * @param {string} key
+ * @param {AbortSignal} signal
  */
-async function decrypt(lcp, file, key) {
-  const { decrypt, freeBytes } = lcp.exports;
-  const fileData = new Uint8Array(await file.arrayBuffer());
-  const goFile = newGoBytes(lcp, fileData);
+async function decryptStreaming(lcp, file, key, signal) {
+  const { decryptStream, freeBytes } = lcp.exports;
+  const name = `decrypted.${file.name}`;
+  const output = await openOutputStream(name);
+
+  let goFile;
+
+  try {
+    goFile = await newGoBytesFromFile(lcp, file, signal);
+  } catch (error) {
+    if (output) await output.abort();
+    throw error;
+  }
+
   const goKey = newGoString(lcp, key);
-  let goOut;
 
   try {
-    goOut = decrypt(goFile, goKey);
-    const decryptedData = bytesFromGo(lcp, goOut);
-    if (!decryptedData) throw new Error("no decrypted data");
-    const blob = new Blob([decryptedData], { type: "application/epub+zip" });
-    const link = document.createElement("a");
-    link.href = URL.createObjectURL(blob);
-    link.download = `decrypted.${file.name}`;
-    document.body.appendChild(link);
-    link.click();
-    document.body.removeChild(link);
-    URL.revokeObjectURL(link.href);
+    await streamOutput(lcp, name, output, signal, (job) =>
+      decryptStream(goFile, goKey, 0, job),
+    );
   } finally {
     freeBytes(goFile);
     freeBytes(goKey);
-    if (goOut) freeBytes(goOut);
   }
 }
 
+/**
+ * Downloads the publication of a license and decrypts it, streaming the
+ * decrypted archive like decryptStreaming. The license is either the
+ * contents of a .lcpl file, or its URL. Requires canFetch.
+ *
+ * @param {WebAssembly.Instance} lcp
+ * @param {string} license
+ * @param {string} key
+ * @param {AbortSignal} signal
+ */
+async function decryptLicensed(lcp, license, key, signal) {
+  const { freeBytes } = lcp.exports;
+  const decrypt = WebAssembly.promising(lcp.exports.decryptLicensed);
+  const output = await openOutputStream("decrypted.epub");
+  const goLicense = newGoString(lcp, license);
+  const goKey = newGoString(lcp, key);
+
+  try {
+    await streamOutput(lcp, "decrypted.epub", output, signal, (job) =>
+      decrypt(goLicense, goKey, 0, 0, job),
+    );
+  } finally {
+    freeBytes(goLicense);
+    freeBytes(goKey);
+  }
+}
+
+/**
+ * Runs a decryption, writing the chunks passed to lcp.writeChunk to output,
+ * or downloading them as name once done if output is null.
+ *
+ * @param {WebAssembly.Instance} lcp
+ * @param {string} name
+ * @param {FileSystemWritableFileStream | null} output
+ * @param {AbortSignal} signal
+ * @param {(job: number) => boolean | Promise<boolean>} run Starts the
+ *   decryption, returns whether it completed
+ */
+async function streamOutput(lcp, name, output, signal, run) {
+  const { newJob, cancel } = lcp.exports;
+  const job = newJob();
+
+  /** @type {Uint8Array[]} */
+  const chunks = [];
+  let pending = Promise.resolve();
+  let writeError = null;
+
+  chunkSink = (chunk) => {
+    // The module gives control back to us on each chunk, this is where the
+    // job can be cancelled.
+    if (signal.aborted || writeError) {
+      cancel(job);
+      return;
+    }
+
+    const copy = chunk.slice();
+    if (output) {
+      pending = pending
+        .then(() => output.write(copy))
+        .catch((error) => {
+          writeError = error;
+        });
+    } else chunks.push(copy);
+  };
+
+  let completed;
+
+  try {
+    completed = await run(job);
+  } catch (error) {
+    if (output) await output.abort();
+    throw error;
+  } finally {
+    chunkSink = null;
+  }
+
+  if (output) await pending;
+
+  if (!completed || writeError) {
+    if (output) await output.abort();
+    throw writeError || cancelledError();
+  }
+
+  if (output) {
+    await output.close();
+    return;
+  }
+
+  download(new Blob(chunks, { type: "application/epub+zip" }), name);
+}
+
+/**
+ * @param {Blob} blob
+ * @param {string} name
+ */
+function download(blob, name) {
+  const link = document.createElement("a");
+  link.href = URL.createObjectURL(blob);
+  link.download = name;
+  document.body.appendChild(link);
+  link.click();
+  document.body.removeChild(link);
+  URL.revokeObjectURL(link.href);
+}
+
 async function main() {
   const go = new Go();
   const lcp = await getLCP(go);
 
+  // Make sure the crypto code behaves on this browser's WebAssembly engine,
+  // rather than producing corrupted books.
+  if (lcp.exports.selfTest() > 0) {
+    alert("This browser failed the self-test, decrypted books could be corrupted. See the console for details.");
+  }
+
+  // Report errors in the language of the user
+  const goLocale = newGoString(lcp, navigator.languages.join(","));
+  lcp.exports.setLocale(goLocale);
+  lcp.exports.freeBytes(goLocale);
+
+  // Only offer the kinds of publications this build can decrypt
+  const capsPtr = lcp.exports.capabilities();
+  const caps = JSON.parse(new TextDecoder().decode(goBytesView(lcp, capsPtr)));
+  lcp.exports.freeBytes(capsPtr);
+
+  const extensions = {
+    epub2: ".epub",
+    epub3: ".epub",
+    pdf: ".lcpdf",
+    audiobook: ".lcpau",
+    divina: ".lcpdi",
+  };
+  const accept = new Set(caps.containerTypes.map((t) => extensions[t]).filter((e) => e));
+
+  // Licenses can only be used if the module can download their publication
+  if (canFetch) {
+    accept.add(".lcpl");
+    document.getElementById("license-field").hidden = false;
+  }
+
+  document.getElementById("input-file").setAttribute("accept", [...accept].join(","));
+
   const submitButton = document.getElementById("button-submit");
+  const cancelButton = document.getElementById("button-cancel");
+  /** @type {AbortController | null} */
+  let controller = null;
+
+  cancelButton.addEventListener("click", () => controller?.abort());
 
   const resetSubmitButton = () => {
     submitButton.removeAttribute("disabled");
@@ -108,28 +371,42 @@ async function main() {
     ev.preventDefault();
     const formData = new FormData(ev.target);
     const file = formData.get("file");
+    const licenseURL = formData.get("license");
     const key = formData.get("key");
 
-    if (
-      busy ||
-      !file ||
-      !(file instanceof File) ||
-      !key ||
-      typeof key !== "string"
-    )
+    if (busy || !key || typeof key !== "string") return;
+
+    const signal = (controller = new AbortController()).signal;
+    /** @type {() => Promise<void>} */
+    let run;
+
+    if (typeof licenseURL === "string" && licenseURL) {
+      run = () => decryptLicensed(lcp, licenseURL, key, signal);
+    } else if (file instanceof File && file.name.endsWith(".lcpl")) {
+      run = async () => decryptLicensed(lcp, await file.text(), key, signal);
+    } else if (file instanceof File && file.size > 0) {
+      run = () => decryptStreaming(lcp, file, key, signal);
+    } else {
+      controller = null;
       return;
+    }
 
     busy = true;
+    lastError = null;
     submitButton.setAttribute("disabled", "1");
     submitButton.innerText = "Decrypting...";
+    cancelButton.hidden = false;
 
-    decrypt(lcp, file, key)
+    run()
       .catch((error) => {
+        if (error.name === "AbortError") return;
         console.error(error);
-        alert("There was an error decrypting the file");
+        alert(lastError || "There was an error decrypting the file");
       })
       .finally(() => {
         busy = false;
+        controller = null;
+        cancelButton.hidden = true;
         resetSubmitButton();
       });
   });
@@ -1,16 +1,37 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unsafe"
 
 	"github.com/abustany/lcp-decrypt/pkg/lcp"
 )
 
+// defaultChunkSize is the size of the chunks passed to the host by
+// decryptStream when it does not pick one.
+const defaultChunkSize = 1 << 20
+
+// handles keeps alive the byte slices shared with the host. A handle is the
+// address of the first byte of its slice in the module memory, so the host
+// can read and write the bytes in place, through a view of bytesSize(handle)
+// bytes at that address, without copying them. Views must be recreated after
+// any call into the module: its memory may grow, which detaches the
+// ArrayBuffer the previous views were created on.
 var handles = map[*byte][]byte{}
 
 func main() {
 }
 
+// newBytes allocates a slice of size bytes, that the host fills through a
+// view before passing its handle to decrypt or decryptStream.
+//
 //export newBytes
 func newBytes(size int) *byte {
 	if size == 0 {
@@ -37,14 +58,257 @@ func bytesSize(ptr *byte) int {
 	return len(handles[ptr])
 }
 
+// decrypt decrypts the publication in inPtr, and returns the handle of the
+// decrypted archive, which the host reads through a view.
+//
 //export decrypt
 func decrypt(inPtr *byte, userKeyHexPtr *byte) *byte {
 	var out bytes.Buffer
 	inputData := handles[inPtr]
 
-	if err := lcp.Decrypt(&out, bytes.NewReader(handles[inPtr]), int64(len(inputData)), string(handles[userKeyHexPtr])); err != nil {
-		panic(err.Error())
+	// The decrypted archive is about the size of the input, growing the
+	// buffer as it is written would copy it several times.
+	out.Grow(len(inputData))
+
+	if err := lcp.Decrypt(&out, bytes.NewReader(handles[inPtr]), int64(len(inputData)), string(handles[userKeyHexPtr]), lcp.WithLimits(lcp.ServiceLimits)); err != nil {
+		fail(err)
 	}
 
 	return newHandle(out.Bytes())
 }
+
+// locale is the locale of the user, set by the host, in which the errors
+// are reported.
+var locale string
+
+// setLocale sets the locale of the user from the string in ptr, for example
+// the comma separated navigator.languages.
+//
+//export setLocale
+func setLocale(ptr *byte) {
+	locale = string(handles[ptr])
+}
+
+// fail reports the message of err to the host, in the language of the user,
+// and aborts the call.
+func fail(err error) {
+	msg := []byte(lcp.Localize(err, locale))
+	if len(msg) > 0 {
+		hostReportError(unsafe.Pointer(&msg[0]), int32(len(msg)))
+	}
+
+	panic(err.Error())
+}
+
+// selfTest runs lcp.SelfTest, printing the failed checks to the console, and
+// returns how many failed.
+//
+//export selfTest
+func selfTest() int {
+	failed := 0
+
+	for _, r := range lcp.SelfTest() {
+		if r.Err != nil {
+			failed++
+			println("self-test failed: " + r.Name + ": " + r.Err.Error())
+		}
+	}
+
+	return failed
+}
+
+// capabilities returns the handle of the JSON encoded lcp.Capabilities.
+//
+//export capabilities
+func capabilities() *byte {
+	data, err := json.Marshal(lcp.Capabilities())
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return newHandle(data)
+}
+
+// job is a decryption started with a job ID, which the host can cancel.
+type job struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobs holds the jobs created by newJob, until their decryption returns.
+var (
+	jobs      = map[int]job{}
+	nextJobID = 0
+)
+
+// newJob returns the ID of a new job, which the host passes to
+// decryptStream to be able to cancel it.
+//
+//export newJob
+func newJob() int {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	nextJobID++
+	jobs[nextJobID] = job{ctx: ctx, cancel: cancel}
+
+	return nextJobID
+}
+
+// cancel aborts the decryption of a job, which then returns as soon as
+// possible. The host regains control during a decryption when the module
+// calls lcp.writeChunk, which is where it usually calls cancel (or from
+// another thread).
+//
+//export cancel
+func cancel(jobID int) {
+	if j, ok := jobs[jobID]; ok {
+		j.cancel()
+	}
+}
+
+// endJob forgets a job once its decryption returned.
+func endJob(jobID int) {
+	if j, ok := jobs[jobID]; ok {
+		j.cancel()
+		delete(jobs, jobID)
+	}
+}
+
+// hostWriter passes what is written to it to the host, until ctx is done.
+type hostWriter struct {
+	ctx context.Context
+}
+
+func (w hostWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(p) > 0 {
+		hostWriteChunk(unsafe.Pointer(&p[0]), int32(len(p)))
+	}
+
+	return len(p), nil
+}
+
+// decryptStream works like decrypt, but passes the decrypted archive to the
+// host's lcp.writeChunk function as it is produced, in chunks of chunkSize
+// bytes (or more for large writes), instead of keeping it in memory. jobID
+// is either 0, or an ID returned by newJob to be able to cancel the
+// decryption. decryptStream returns false if the job was cancelled.
+//
+//export decryptStream
+func decryptStream(inPtr *byte, userKeyHexPtr *byte, chunkSize int, jobID int) bool {
+	return stream(chunkSize, jobID, func(ctx context.Context, out io.Writer) error {
+		inputData := handles[inPtr]
+
+		return lcp.Decrypt(out, bytes.NewReader(inputData), int64(len(inputData)), string(handles[userKeyHexPtr]), lcp.WithContext(ctx), lcp.WithLimits(lcp.ServiceLimits))
+	})
+}
+
+// decryptLicensed downloads the publication of a license and decrypts it,
+// passing the decrypted archive to the host like decryptStream. licensePtr
+// holds either the license document (.lcpl) or its URL, and credentialPtr
+// the user key, or the passphrase if isPassphrase is true. The downloads go
+// through the host's lcp.fetch function, so the host must call this function
+// through WebAssembly.promising (see hostFetch).
+//
+//export decryptLicensed
+func decryptLicensed(licensePtr *byte, credentialPtr *byte, isPassphrase bool, chunkSize int, jobID int) bool {
+	return stream(chunkSize, jobID, func(ctx context.Context, out io.Writer) error {
+		licenseData := handles[licensePtr]
+
+		if url := string(bytes.TrimSpace(licenseData)); strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://") {
+			ptr, err := fetch(ctx, url)
+			if err != nil {
+				return fmt.Errorf("error downloading license: %w", err)
+			}
+
+			defer freeBytes(ptr)
+			licenseData = handles[ptr]
+		}
+
+		license, err := lcp.ParseLicense(bytes.NewReader(licenseData))
+		if err != nil {
+			return fmt.Errorf("error parsing license: %w", err)
+		}
+
+		link, ok := license.Links.Link(lcp.LinkRelPublication)
+		if !ok {
+			return errors.New("the license has no publication link")
+		}
+
+		ptr, err := fetch(ctx, link.Href)
+		if err != nil {
+			return fmt.Errorf("error downloading publication: %w", err)
+		}
+
+		defer freeBytes(ptr)
+		publication := handles[ptr]
+
+		credential := lcp.Credential{UserKeyHex: string(handles[credentialPtr])}
+		if isPassphrase {
+			credential = lcp.Credential{Passphrase: string(handles[credentialPtr])}
+		}
+
+		return lcp.DecryptLicensed(out, bytes.NewReader(publication), int64(len(publication)), license, credential, lcp.WithContext(ctx), lcp.WithLimits(lcp.ServiceLimits))
+	})
+}
+
+// fetch downloads url through the host, and returns the handle of the
+// response body.
+func fetch(ctx context.Context, url string) (*byte, error) {
+	b := []byte(url)
+	ptr := hostFetch(unsafe.Pointer(&b[0]), int32(len(b)))
+
+	// The job may have been cancelled while the host was downloading
+	if err := ctx.Err(); err != nil {
+		freeBytes(ptr)
+		return nil, err
+	}
+
+	if _, ok := handles[ptr]; !ok {
+		return nil, fmt.Errorf("error fetching %s", url)
+	}
+
+	return ptr, nil
+}
+
+// stream runs decrypt, passing the archive it writes to the host's
+// lcp.writeChunk function in chunks of chunkSize bytes (or more for large
+// writes). jobID is either 0, or an ID returned by newJob to be able to
+// cancel the decryption. stream returns false if the job was cancelled.
+func stream(chunkSize int, jobID int, decrypt func(ctx context.Context, out io.Writer) error) bool {
+	ctx := context.Background()
+
+	if jobID != 0 {
+		j, ok := jobs[jobID]
+		if !ok {
+			panic(fmt.Sprintf("unknown job %d", jobID))
+		}
+
+		ctx = j.ctx
+		defer endJob(jobID)
+	}
+
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	out := bufio.NewWriterSize(hostWriter{ctx: ctx}, chunkSize)
+
+	err := decrypt(ctx, out)
+	if err == nil {
+		err = out.Flush()
+	}
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		fail(err)
+	}
+
+	return true
+}
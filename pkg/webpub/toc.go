@@ -0,0 +1,190 @@
+package webpub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// readNav reads the table of contents from the EPUB 3 navigation document at
+// navPath.
+func readNav(fsys fs.FS, navPath string) ([]Link, error) {
+	data, err := fs.ReadFile(fsys, navPath)
+	if err != nil {
+		return nil, err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	inTOC := false
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			// No toc nav element
+			return nil, nil
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case start.Name.Local == "nav":
+			inTOC = slices.Contains(strings.Fields(attr(start, "type")), "toc")
+		case start.Name.Local == "ol" && inTOC:
+			return readNavList(d, navPath)
+		}
+	}
+}
+
+// readNavList reads the entries of an ol element, after its start tag.
+func readNavList(d *xml.Decoder, navPath string) ([]Link, error) {
+	var links []Link
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "li" {
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			link, err := readNavItem(d, navPath)
+			if err != nil {
+				return nil, err
+			}
+
+			links = append(links, link)
+		case xml.EndElement:
+			return links, nil
+		}
+	}
+}
+
+// readNavItem reads an li element of the navigation document, after its start
+// tag.
+func readNavItem(d *xml.Decoder, navPath string) (Link, error) {
+	var link Link
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return link, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "a", "span":
+				if href := attr(t, "href"); href != "" {
+					link.Href = resolveHref(navPath, href)
+				}
+
+				if link.Title, err = readText(d); err != nil {
+					return link, err
+				}
+			case "ol":
+				if link.Children, err = readNavList(d, navPath); err != nil {
+					return link, err
+				}
+			default:
+				if err := d.Skip(); err != nil {
+					return link, err
+				}
+			}
+		case xml.EndElement:
+			return link, nil
+		}
+	}
+}
+
+// readText returns the text content of the current element, after its start
+// tag.
+func readText(d *xml.Decoder) (string, error) {
+	var text strings.Builder
+
+	for depth := 1; depth > 0; {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text.Write(t)
+		}
+	}
+
+	return strings.Join(strings.Fields(text.String()), " "), nil
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+type ncx struct {
+	NavPoints []navPoint `xml:"navMap>navPoint"`
+}
+
+type navPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []navPoint `xml:"navPoint"`
+}
+
+// readNCX reads the table of contents from the EPUB 2 NCX file at ncxPath.
+func readNCX(fsys fs.FS, ncxPath string) ([]Link, error) {
+	data, err := fs.ReadFile(fsys, ncxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc ncx
+
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return ncxLinks(doc.NavPoints, ncxPath), nil
+}
+
+func ncxLinks(points []navPoint, ncxPath string) []Link {
+	var links []Link
+
+	for _, p := range points {
+		links = append(links, Link{
+			Href:     resolveHref(ncxPath, p.Content.Src),
+			Title:    strings.TrimSpace(p.Label),
+			Children: ncxLinks(p.Children, ncxPath),
+		})
+	}
+
+	return links
+}
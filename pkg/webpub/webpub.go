@@ -0,0 +1,319 @@
+// Package webpub converts EPUB publications to Readium Web Publications: a
+// manifest.json file describing the publication, next to its resources. See
+// https://readium.org/webpub-manifest/.
+package webpub
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abustany/lcp-decrypt/pkg/epub"
+)
+
+const (
+	// ManifestPath is the path of the manifest in a Web Publication.
+	ManifestPath = "manifest.json"
+
+	// ManifestMediaType is the media type of Web Publication manifests.
+	ManifestMediaType = "application/webpub+json"
+
+	// PackageMediaType is the media type of packaged Web Publications
+	// (.webpub files).
+	PackageMediaType = "application/webpub+zip"
+
+	manifestContext = "https://readium.org/webpub-manifest/context.jsonld"
+)
+
+// Manifest is a Readium Web Publication manifest.
+type Manifest struct {
+	Context      string   `json:"@context"`
+	Metadata     Metadata `json:"metadata"`
+	Links        []Link   `json:"links"`
+	ReadingOrder []Link   `json:"readingOrder"`
+	Resources    []Link   `json:"resources,omitempty"`
+	TOC          []Link   `json:"toc,omitempty"`
+}
+
+// Metadata describes a publication.
+type Metadata struct {
+	Type        string        `json:"@type,omitempty"`
+	Identifier  string        `json:"identifier,omitempty"`
+	Title       string        `json:"title"`
+	Author      []Contributor `json:"author,omitempty"`
+	Contributor []Contributor `json:"contributor,omitempty"`
+	Language    []string      `json:"language,omitempty"`
+	Publisher   string        `json:"publisher,omitempty"`
+	Published   string        `json:"published,omitempty"`
+	Modified    string        `json:"modified,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Subject     []string      `json:"subject,omitempty"`
+}
+
+// Contributor is a person or organization that contributed to a publication.
+type Contributor struct {
+	Name   string `json:"name"`
+	SortAs string `json:"sortAs,omitempty"`
+}
+
+// Link points to a resource of the publication, relative to the manifest.
+type Link struct {
+	Href     string `json:"href"`
+	Type     string `json:"type,omitempty"`
+	Rel      string `json:"rel,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Children []Link `json:"children,omitempty"`
+}
+
+// FromEPUB builds the manifest of the EPUB publication stored in fsys. The
+// resources keep their path in the EPUB file.
+func FromEPUB(fsys fs.FS) (*Manifest, error) {
+	pkg, err := epub.ReadPackage(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Context: manifestContext,
+		Metadata: Metadata{
+			Type:        "http://schema.org/Book",
+			Identifier:  pkg.Identifier(),
+			Title:       pkg.Title(),
+			Language:    pkg.Metadata.Languages,
+			Publisher:   strings.TrimSpace(pkg.Metadata.Publisher),
+			Published:   strings.TrimSpace(pkg.Metadata.Date),
+			Modified:    pkg.Property("dcterms:modified"),
+			Description: strings.TrimSpace(pkg.Metadata.Description),
+			Subject:     pkg.Metadata.Subjects,
+		},
+		Links: []Link{{Href: ManifestPath, Type: ManifestMediaType, Rel: "self"}},
+	}
+
+	for _, c := range pkg.Metadata.Creators {
+		m.Metadata.Author = append(m.Metadata.Author, contributor(c))
+	}
+
+	for _, c := range pkg.Metadata.Contributors {
+		m.Metadata.Contributor = append(m.Metadata.Contributor, contributor(c))
+	}
+
+	inReadingOrder := map[string]bool{}
+
+	for _, item := range pkg.ReadingOrder() {
+		inReadingOrder[item.ID] = true
+		m.ReadingOrder = append(m.ReadingOrder, itemLink(pkg, item))
+	}
+
+	cover, hasCover := pkg.Cover()
+	nav, hasNav := pkg.Nav()
+
+	for _, item := range pkg.Manifest {
+		if inReadingOrder[item.ID] {
+			continue
+		}
+
+		link := itemLink(pkg, item)
+
+		switch {
+		case hasCover && item.ID == cover.ID:
+			link.Rel = "cover"
+		case hasNav && item.ID == nav.ID:
+			link.Rel = "contents"
+		}
+
+		m.Resources = append(m.Resources, link)
+	}
+
+	if hasNav {
+		m.TOC, err = readNav(fsys, pkg.ItemPath(nav))
+	} else if ncx, ok := pkg.Item(pkg.Spine.Toc); ok {
+		m.TOC, err = readNCX(fsys, pkg.ItemPath(ncx))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading table of contents: %w", err)
+	}
+
+	return m, nil
+}
+
+func contributor(c epub.Creator) Contributor {
+	return Contributor{Name: strings.TrimSpace(c.Name), SortAs: c.FileAs}
+}
+
+func itemLink(pkg *epub.Package, item epub.Item) Link {
+	return Link{Href: escapePath(pkg.ItemPath(item)), Type: item.MediaType}
+}
+
+// resolveHref resolves href relative to the document at base, keeping any
+// fragment.
+func resolveHref(base, href string) string {
+	_, fragment, hasFragment := strings.Cut(href, "#")
+
+	res := escapePath(epub.ResolveHref(base, href))
+	if hasFragment {
+		res += "#" + fragment
+	}
+
+	return res
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// Package writes a packaged Web Publication (.webpub file) built from the EPUB
+// file in in to out. inSize should be the total size of the input data.
+func Package(out io.Writer, in io.ReaderAt, inSize int64) error {
+	inFile, m, err := open(in, inSize)
+	if err != nil {
+		return err
+	}
+
+	outZip := zip.NewWriter(out)
+
+	w, err := outZip.Create(ManifestPath)
+	if err != nil {
+		return fmt.Errorf("error appending manifest: %w", err)
+	}
+
+	if err := writeManifest(w, m); err != nil {
+		return err
+	}
+
+	for _, f := range inFile.File {
+		if !isResource(f.Name) {
+			continue
+		}
+
+		header := f.FileHeader
+
+		dst, err := outZip.CreateRaw(&header)
+		if err != nil {
+			return fmt.Errorf("error appending file %s: %w", f.Name, err)
+		}
+
+		src, err := f.OpenRaw()
+		if err != nil {
+			return fmt.Errorf("error opening file %s: %w", f.Name, err)
+		}
+
+		if _, err := io.Copy(dst, src); err != nil {
+			return fmt.Errorf("error copying file %s: %w", f.Name, err)
+		}
+	}
+
+	if err := outZip.Close(); err != nil {
+		return fmt.Errorf("error finalizing output zip file: %w", err)
+	}
+
+	return nil
+}
+
+// Extract writes an exploded Web Publication built from the EPUB file in in to
+// the directory dir, which must exist. inSize should be the total size of the
+// input data.
+func Extract(dir string, in io.ReaderAt, inSize int64) error {
+	inFile, m, err := open(in, inSize)
+	if err != nil {
+		return err
+	}
+
+	manifestFd, err := os.Create(filepath.Join(dir, ManifestPath))
+	if err != nil {
+		return fmt.Errorf("error creating manifest: %w", err)
+	}
+
+	defer manifestFd.Close()
+
+	if err := writeManifest(manifestFd, m); err != nil {
+		return err
+	}
+
+	if err := manifestFd.Close(); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	for _, f := range inFile.File {
+		if !isResource(f.Name) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		if err := extractFile(dir, f); err != nil {
+			return fmt.Errorf("error extracting file %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func open(in io.ReaderAt, inSize int64) (*zip.Reader, *Manifest, error) {
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening input file: %w", err)
+	}
+
+	m, err := FromEPUB(inFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building manifest: %w", err)
+	}
+
+	return inFile, m, nil
+}
+
+func writeManifest(w io.Writer, m *Manifest) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(m); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+
+	return nil
+}
+
+// isResource returns whether a file of the EPUB container should be part of
+// the Web Publication. The EPUB specific files are left out.
+func isResource(name string) bool {
+	return name != "mimetype" && !strings.HasPrefix(name, "META-INF/")
+}
+
+func extractFile(dir string, f *zip.File) error {
+	name := filepath.FromSlash(f.Name)
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("invalid file path")
+	}
+
+	dst := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dstFd, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	defer dstFd.Close()
+
+	if _, err := io.Copy(dstFd, src); err != nil {
+		return err
+	}
+
+	return dstFd.Close()
+}
@@ -0,0 +1,190 @@
+// Package xmlenc parses the XML Encryption documents
+// (https://www.w3.org/TR/xmlenc-core1/) used by EPUB and other Readium
+// containers to list their encrypted resources (META-INF/encryption.xml).
+//
+// Elements are matched by their local name, regardless of their namespace, as
+// some packagers get the namespaces wrong.
+package xmlenc
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Namespaces of the elements of an encryption document.
+const (
+	Namespace            = "http://www.w3.org/2001/04/xmlenc#"
+	SignatureNamespace   = "http://www.w3.org/2000/09/xmldsig#"
+	CompressionNamespace = "http://www.idpf.org/2016/encryption#compression"
+)
+
+// Compression methods of the IDPF compression extension.
+const (
+	CompressionStored  = 0
+	CompressionDeflate = 8
+)
+
+// Encryption is the root element of an encryption document.
+type Encryption struct {
+	EncryptedKeys []EncryptedKey  `xml:"EncryptedKey"`
+	EncryptedData []EncryptedData `xml:"EncryptedData"`
+}
+
+// EncryptedData describes an encrypted resource.
+type EncryptedData struct {
+	ID                   string                `xml:"Id,attr,omitempty"`
+	Type                 string                `xml:"Type,attr,omitempty"`
+	MimeType             string                `xml:"MimeType,attr,omitempty"`
+	EncryptionMethod     EncryptionMethod      `xml:"EncryptionMethod"`
+	KeyInfo              *KeyInfo              `xml:"KeyInfo"`
+	CipherData           CipherData            `xml:"CipherData"`
+	EncryptionProperties *EncryptionProperties `xml:"EncryptionProperties"`
+}
+
+// EncryptedKey is a key encrypted with another key, which EncryptedData
+// elements can reference in their KeyInfo.
+type EncryptedKey struct {
+	ID               string           `xml:"Id,attr,omitempty"`
+	Recipient        string           `xml:"Recipient,attr,omitempty"`
+	EncryptionMethod EncryptionMethod `xml:"EncryptionMethod"`
+	KeyInfo          *KeyInfo         `xml:"KeyInfo"`
+	CipherData       CipherData       `xml:"CipherData"`
+	// References lists the EncryptedData elements using this key.
+	References []DataReference `xml:"ReferenceList>DataReference"`
+}
+
+// DataReference points to an EncryptedData element.
+type DataReference struct {
+	URI string `xml:"URI,attr"`
+}
+
+// EncryptionMethod is the algorithm used to encrypt some data, identified by
+// its URI.
+type EncryptionMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+// KeyInfo tells where to find the key to decrypt some data.
+type KeyInfo struct {
+	KeyName         string           `xml:"KeyName,omitempty"`
+	RetrievalMethod *RetrievalMethod `xml:"RetrievalMethod"`
+}
+
+// RetrievalMethod points to a key stored outside of the encryption document,
+// for example in an LCP license.
+type RetrievalMethod struct {
+	URI  string `xml:"URI,attr"`
+	Type string `xml:"Type,attr,omitempty"`
+}
+
+// CipherData holds the encrypted data, either inline or as a reference to
+// another resource.
+type CipherData struct {
+	// CipherValue is the base64 encoded encrypted data.
+	CipherValue     string           `xml:"CipherValue,omitempty"`
+	CipherReference *CipherReference `xml:"CipherReference"`
+}
+
+// CipherReference points to the resource holding the encrypted data.
+type CipherReference struct {
+	URI string `xml:"URI,attr"`
+}
+
+// EncryptionProperties holds additional information about encrypted data.
+type EncryptionProperties struct {
+	Properties []EncryptionProperty `xml:"EncryptionProperty"`
+}
+
+// EncryptionProperty is a single piece of additional information about
+// encrypted data.
+type EncryptionProperty struct {
+	ID          string       `xml:"Id,attr,omitempty"`
+	Target      string       `xml:"Target,attr,omitempty"`
+	Compression *Compression `xml:"Compression"`
+}
+
+// Compression is the IDPF extension telling how a resource was compressed
+// before being encrypted.
+type Compression struct {
+	Method int `xml:"Method,attr"`
+	// OriginalLength is the size of the resource once decrypted and
+	// decompressed.
+	OriginalLength int64 `xml:"OriginalLength,attr"`
+}
+
+// Parse decodes an encryption document.
+func Parse(r io.Reader) (*Encryption, error) {
+	var encryption Encryption
+
+	if err := xml.NewDecoder(r).Decode(&encryption); err != nil {
+		return nil, fmt.Errorf("error decoding XML: %w", err)
+	}
+
+	return &encryption, nil
+}
+
+// Path returns the path of the encrypted resource, relative to the root of
+// the container. ok is false for inline data, which is not stored in a
+// resource of the container.
+//
+// Some packagers reference resources with a fragment or a query
+// ("OEBPS/chapter.xhtml#start"), which don't belong to the path of the
+// resource and are dropped. The path is also cleaned ("./OEBPS/../a.xhtml"
+// gives "a.xhtml") so that it matches the names of the entries of the
+// container.
+func (d *EncryptedData) Path() (p string, ok bool, err error) {
+	if d.CipherData.CipherReference == nil {
+		return "", false, nil
+	}
+
+	uri := d.CipherData.CipherReference.URI
+
+	ref, _, _ := strings.Cut(uri, "#")
+	ref, _, _ = strings.Cut(ref, "?")
+
+	if p, err = url.PathUnescape(ref); err != nil {
+		return "", false, fmt.Errorf("error decoding resource path %q: %w", uri, err)
+	}
+
+	return strings.TrimPrefix(path.Clean("/"+p), "/"), true, nil
+}
+
+// Compression returns how the resource was deflated before being encrypted,
+// or nil if it was stored as it is (or the encryption document does not say).
+// It returns an error if the resource was compressed with another method.
+func (d *EncryptedData) Compression() (*Compression, error) {
+	if d.EncryptionProperties == nil {
+		return nil, nil
+	}
+
+	for _, p := range d.EncryptionProperties.Properties {
+		if p.Compression == nil {
+			continue
+		}
+
+		switch p.Compression.Method {
+		case CompressionStored:
+			return nil, nil
+		case CompressionDeflate:
+			return p.Compression, nil
+		default:
+			return nil, fmt.Errorf("unsupported compression method %d", p.Compression.Method)
+		}
+	}
+
+	return nil, nil
+}
+
+// RetrievalURI returns the URI of the key used to encrypt the resource, or an
+// empty string if the resource does not reference any key.
+func (d *EncryptedData) RetrievalURI() string {
+	if d.KeyInfo == nil || d.KeyInfo.RetrievalMethod == nil {
+		return ""
+	}
+
+	return d.KeyInfo.RetrievalMethod.URI
+}
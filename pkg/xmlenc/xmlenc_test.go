@@ -0,0 +1,116 @@
+package xmlenc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ref  *CipherReference
+		want string
+		ok   bool
+		err  bool
+	}{
+		{name: "plain", ref: &CipherReference{URI: "OEBPS/chapter.xhtml"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "fragment", ref: &CipherReference{URI: "OEBPS/chapter.xhtml#start"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "query", ref: &CipherReference{URI: "OEBPS/chapter.xhtml?v=2"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "query and fragment", ref: &CipherReference{URI: "OEBPS/chapter.xhtml?v=2#start"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "escaped", ref: &CipherReference{URI: "OEBPS/chapter%201.xhtml"}, want: "OEBPS/chapter 1.xhtml", ok: true},
+		{name: "dot segments", ref: &CipherReference{URI: "./OEBPS/text/../chapter.xhtml"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "going up", ref: &CipherReference{URI: "../../OEBPS/chapter.xhtml"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "absolute", ref: &CipherReference{URI: "/OEBPS/chapter.xhtml"}, want: "OEBPS/chapter.xhtml", ok: true},
+		{name: "invalid escape", ref: &CipherReference{URI: "OEBPS/chapter%zz.xhtml"}, err: true},
+		{name: "inline"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := EncryptedData{CipherData: CipherData{CipherReference: tc.ref}}
+			if tc.ref == nil {
+				d.CipherData.CipherValue = "MDEyMzQ1Njc4OWFiY2RlZg=="
+			}
+
+			got, ok, err := d.Path()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("got %q, %t, want %q, %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		properties string
+		want       *Compression
+		err        bool
+	}{
+		{name: "no properties"},
+		{
+			name:       "no compression property",
+			properties: `<EncryptionProperty><Other/></EncryptionProperty>`,
+		},
+		{
+			name:       "stored",
+			properties: `<EncryptionProperty><Compression Method="0" OriginalLength="1234"/></EncryptionProperty>`,
+		},
+		{
+			name:       "deflate",
+			properties: `<EncryptionProperty><Compression Method="8" OriginalLength="1234"/></EncryptionProperty>`,
+			want:       &Compression{Method: CompressionDeflate, OriginalLength: 1234},
+		},
+		{
+			name:       "deflate after another property",
+			properties: `<EncryptionProperty Id="other"/><EncryptionProperty><Compression Method="8" OriginalLength="1234"/></EncryptionProperty>`,
+			want:       &Compression{Method: CompressionDeflate, OriginalLength: 1234},
+		},
+		{
+			name:       "unknown method",
+			properties: `<EncryptionProperty><Compression Method="12" OriginalLength="1234"/></EncryptionProperty>`,
+			err:        true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := `<encryption><EncryptedData><CipherData><CipherReference URI="a.xhtml"/></CipherData>`
+			if tc.properties != "" {
+				doc += `<EncryptionProperties>` + tc.properties + `</EncryptionProperties>`
+			}
+
+			doc += `</EncryptedData></encryption>`
+
+			encryption, err := Parse(strings.NewReader(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := encryption.EncryptedData[0].Compression()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == nil) != (tc.want == nil) || got != nil && *got != *tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
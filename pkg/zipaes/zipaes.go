@@ -0,0 +1,226 @@
+// Package zipaes encrypts zip archives with the WinZip AES encryption
+// (AE-2, 256 bit keys), which most archive managers (7-Zip, WinZip, macOS
+// Archive Utility with third party tools, unzip builds with AES support...)
+// can open given the password.
+//
+// See https://www.winzip.com/en/support/aes-encryption/ for the format.
+package zipaes
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// methodAES is the compression method of AES encrypted entries, their
+	// actual method is stored in the AES extra field.
+	methodAES = 99
+	// extraAES is the ID of the AES extra field.
+	extraAES = 0x9901
+
+	keySize       = 32 // AES-256
+	saltSize      = keySize / 2
+	verifierSize  = 2
+	authCodeSize  = 10
+	kdfIterations = 1000
+
+	// flagEncrypted and flagDataDescriptor are general purpose bit flags of
+	// the zip entries.
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+)
+
+// Encrypt reads a zip archive from in and writes a copy of it to out, with
+// all the files encrypted with password. The entries are not decompressed,
+// each is encrypted as it is stored in the input archive. inSize should be
+// the total size of the input data.
+func Encrypt(out io.Writer, in io.ReaderAt, inSize int64, password string) error {
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	inFile, err := zip.NewReader(in, inSize)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
+	}
+
+	outZip := zip.NewWriter(out)
+
+	if err := outZip.SetComment(inFile.Comment); err != nil {
+		return fmt.Errorf("error setting output zip file comment: %w", err)
+	}
+
+	for _, f := range inFile.File {
+		if err := encryptFile(outZip, f, password); err != nil {
+			return fmt.Errorf("error encrypting file %s: %w", f.Name, err)
+		}
+	}
+
+	if err := outZip.Close(); err != nil {
+		return fmt.Errorf("error finalizing output zip file: %w", err)
+	}
+
+	return nil
+}
+
+func encryptFile(outZip *zip.Writer, f *zip.File, password string) error {
+	if strings.HasSuffix(f.Name, "/") {
+		// Directories have no data to protect
+		return outZip.Copy(f)
+	}
+
+	src, err := f.OpenRaw()
+	if err != nil {
+		return fmt.Errorf("error opening file from input zip file: %w", err)
+	}
+
+	header := f.FileHeader
+	header.Extra = appendAESExtra(header.Extra, header.Method)
+	header.Method = methodAES
+	header.Flags = header.Flags&^flagDataDescriptor | flagEncrypted
+	// AE-2 entries have no CRC, which would leak information about small
+	// files: the authentication code replaces it.
+	header.CRC32 = 0
+	header.CompressedSize64 += saltSize + verifierSize + authCodeSize
+
+	dst, err := outZip.CreateRaw(&header)
+	if err != nil {
+		return fmt.Errorf("error creating file in output zip file: %w", err)
+	}
+
+	w, err := newEncryptWriter(dst, password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("error copying file: %w", err)
+	}
+
+	return w.Close()
+}
+
+// appendAESExtra appends the AES extra field of an entry compressed with
+// method to extra.
+func appendAESExtra(extra []byte, method uint16) []byte {
+	extra = slices.Clip(extra) // don't write to the input archive's memory
+	extra = binary.LittleEndian.AppendUint16(extra, extraAES)
+	extra = binary.LittleEndian.AppendUint16(extra, 7) // size of the field
+	extra = binary.LittleEndian.AppendUint16(extra, 2) // AE-2
+	extra = append(extra, 'A', 'E')
+	extra = append(extra, 3) // 256 bit keys
+
+	return binary.LittleEndian.AppendUint16(extra, method)
+}
+
+// encryptWriter encrypts the data written to it, writing the salt and the
+// password verifier first, and the authentication code on Close.
+type encryptWriter struct {
+	dst     io.Writer
+	block   cipher.Block
+	mac     hash.Hash
+	counter uint64
+	stream  [aes.BlockSize]byte
+	// used is the number of bytes of stream already used
+	used int
+	buf  []byte
+}
+
+func newEncryptWriter(dst io.Writer, password string) (*encryptWriter, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+
+	keys := pbkdf2SHA1([]byte(password), salt, kdfIterations, 2*keySize+verifierSize)
+
+	block, err := aes.NewCipher(keys[:keySize])
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	if _, err := dst.Write(append(salt, keys[2*keySize:]...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		dst:   dst,
+		block: block,
+		mac:   hmac.New(sha1.New, keys[keySize:2*keySize]),
+		used:  aes.BlockSize,
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf[:0], p...)
+
+	// WinZip uses CTR mode with a little endian counter starting at 1,
+	// which cipher.NewCTR can't do.
+	for i := range w.buf {
+		if w.used == aes.BlockSize {
+			w.counter++
+
+			var counter [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(counter[:], w.counter)
+			w.block.Encrypt(w.stream[:], counter[:])
+			w.used = 0
+		}
+
+		w.buf[i] ^= w.stream[w.used]
+		w.used++
+	}
+
+	w.mac.Write(w.buf)
+
+	if _, err := w.dst.Write(w.buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close writes the authentication code of the data.
+func (w *encryptWriter) Close() error {
+	_, err := w.dst.Write(w.mac.Sum(nil)[:authCodeSize])
+	return err
+}
+
+// pbkdf2SHA1 derives a key of keyLen bytes from password (PBKDF2 with
+// HMAC-SHA1, RFC 8018).
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var res []byte
+
+	for block := uint32(1); len(res) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		res = append(res, t...)
+	}
+
+	return res[:keyLen]
+}
@@ -0,0 +1,353 @@
+package zipaes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/bsdtar.zip was made with libarchive 3.7.7:
+//
+//	bsdtar -cf bsdtar.zip --format zip --options zip:encryption=aes256 \
+//		--passphrase 'lcp-decrypt zipaes' mimetype OEBPS
+const bsdtarPassword = "lcp-decrypt zipaes"
+
+// bsdtarFiles are the contents of the files of testdata/bsdtar.zip.
+func bsdtarFiles() map[string][]byte {
+	var chapter strings.Builder
+
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&chapter, "<p>Paragraph %d of the chapter.</p>\n", i)
+	}
+
+	return map[string][]byte{
+		"mimetype":            []byte("application/epub+zip"),
+		"OEBPS/chapter.xhtml": []byte(chapter.String()),
+		"OEBPS/short.txt":     []byte("0123456789abcdefXYZ"),
+	}
+}
+
+// aesExtra returns the AE version and the actual compression method stored in
+// the AES extra field of f.
+func aesExtra(f *zip.File) (version, method uint16, err error) {
+	for extra := f.Extra; len(extra) >= 4; {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		if field := extra[4 : 4+size]; id == extraAES && size == 7 {
+			if field[2] != 'A' || field[3] != 'E' || field[4] != 3 {
+				return 0, 0, fmt.Errorf("unexpected AES extra field %x", field)
+			}
+
+			return binary.LittleEndian.Uint16(field), binary.LittleEndian.Uint16(field[5:]), nil
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return 0, 0, errors.New("no AES extra field")
+}
+
+// decryptFile decrypts and decompresses f, written independently of
+// encryptWriter from the WinZip specification.
+func decryptFile(f *zip.File, password string) ([]byte, error) {
+	if f.Method != methodAES || f.Flags&flagEncrypted == 0 {
+		return nil, fmt.Errorf("entry is not AES encrypted (method %d, flags %#x)", f.Method, f.Flags)
+	}
+
+	version, method, err := aesExtra(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < saltSize+verifierSize+authCodeSize {
+		return nil, errors.New("entry too short")
+	}
+
+	salt, verifier := data[:saltSize], data[saltSize:saltSize+verifierSize]
+	ciphertext := data[saltSize+verifierSize : len(data)-authCodeSize]
+	authCode := data[len(data)-authCodeSize:]
+
+	keys := pbkdf2SHA1([]byte(password), salt, kdfIterations, 2*keySize+verifierSize)
+
+	if !bytes.Equal(verifier, keys[2*keySize:]) {
+		return nil, errors.New("wrong password")
+	}
+
+	mac := hmac.New(sha1.New, keys[keySize:2*keySize])
+	mac.Write(ciphertext)
+
+	if !hmac.Equal(authCode, mac.Sum(nil)[:authCodeSize]) {
+		return nil, errors.New("invalid authentication code")
+	}
+
+	block, err := aes.NewCipher(keys[:keySize])
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(ciphertext))
+
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		var counter, stream [aes.BlockSize]byte
+
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+		block.Encrypt(stream[:], counter[:])
+
+		for j := i; j < min(i+aes.BlockSize, len(ciphertext)); j++ {
+			plain[j] = ciphertext[j] ^ stream[j-i]
+		}
+	}
+
+	switch method {
+	case zip.Store:
+	case zip.Deflate:
+		if plain, err = io.ReadAll(flate.NewReader(bytes.NewReader(plain))); err != nil {
+			return nil, fmt.Errorf("error inflating: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+
+	if version == 1 && f.CRC32 == 0 {
+		return nil, errors.New("AE-1 entry without CRC")
+	}
+
+	return plain, nil
+}
+
+// TestPBKDF2SHA1 checks pbkdf2SHA1 against the vectors of RFC 6070.
+func TestPBKDF2SHA1(t *testing.T) {
+	for _, tc := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	} {
+		want, _ := hex.DecodeString(tc.want)
+
+		if got := pbkdf2SHA1([]byte(tc.password), []byte(tc.salt), tc.iterations, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2SHA1(%q, %q, %d) = %x, want %x", tc.password, tc.salt, tc.iterations, got, want)
+		}
+	}
+}
+
+// TestDecryptBsdtarArchive checks the decryption code of the tests, and so the
+// key derivation, counter layout and authentication code it shares with
+// Encrypt, against an archive encrypted by libarchive.
+func TestDecryptBsdtarArchive(t *testing.T) {
+	zr, err := zip.OpenReader("testdata/bsdtar.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer zr.Close()
+
+	want := bsdtarFiles()
+	found := 0
+
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		found++
+
+		got, err := decryptFile(f, bsdtarPassword)
+		if err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+			continue
+		}
+
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: got %q, want %q", f.Name, got, want[f.Name])
+		}
+
+		if _, err := decryptFile(f, "wrong password"); err == nil {
+			t.Errorf("%s: decrypted with a wrong password", f.Name)
+		}
+	}
+
+	if found != len(want) {
+		t.Errorf("found %d files, want %d", found, len(want))
+	}
+}
+
+// testArchive returns a zip archive holding files, stored or deflated
+// according to their name, and a directory.
+func testArchive(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	if _, err := zw.Create("OEBPS/"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		method := zip.Deflate
+		if name == "mimetype" || strings.HasSuffix(name, ".txt") {
+			method = zip.Store
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.SetComment("test archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	const password = "round trip"
+
+	files := bsdtarFiles()
+	files["empty.txt"] = nil
+	in := testArchive(t, files)
+
+	var out bytes.Buffer
+
+	if err := Encrypt(&out, bytes.NewReader(in), int64(len(in)), password); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zr.Comment != "test archive" {
+		t.Errorf("got comment %q", zr.Comment)
+	}
+
+	found := 0
+
+	for _, f := range zr.File {
+		if f.Name == "OEBPS/" {
+			if f.Method == methodAES {
+				t.Error("directory is encrypted")
+			}
+
+			continue
+		}
+
+		found++
+
+		if version, _, err := aesExtra(f); err != nil || version != 2 || f.CRC32 != 0 {
+			t.Errorf("%s: not an AE-2 entry without CRC (version %d, CRC %#x, %v)", f.Name, version, f.CRC32, err)
+		}
+
+		got, err := decryptFile(f, password)
+		if err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+			continue
+		}
+
+		if !bytes.Equal(got, files[f.Name]) {
+			t.Errorf("%s: got %q, want %q", f.Name, got, files[f.Name])
+		}
+	}
+
+	if found != len(files) {
+		t.Errorf("found %d files, want %d", found, len(files))
+	}
+}
+
+func TestEncryptEmptyPassword(t *testing.T) {
+	in := testArchive(t, bsdtarFiles())
+
+	if err := Encrypt(io.Discard, bytes.NewReader(in), int64(len(in)), ""); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// TestBsdtarExtractsEncrypt checks that libarchive opens the archives made by
+// Encrypt, when bsdtar is installed.
+func TestBsdtarExtractsEncrypt(t *testing.T) {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Skip("bsdtar is not installed")
+	}
+
+	const password = "interoperability"
+
+	files := bsdtarFiles()
+	in := testArchive(t, files)
+	dir := t.TempDir()
+
+	var out bytes.Buffer
+
+	if err := Encrypt(&out, bytes.NewReader(in), int64(len(in)), password); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "encrypted.zip")
+
+	if err := os.WriteFile(archive, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bsdtar, "-xf", archive, "--passphrase", password, "-C", dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("bsdtar failed: %v\n%s", err, output)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}